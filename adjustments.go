@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+)
+
+// All of the reasons support staff may give for an adjustment
+type AdjustmentReason string
+
+const (
+	GOODWILL         AdjustmentReason = "goodwill"
+	ERROR_CORRECTION AdjustmentReason = "error_correction"
+	RECONCILIATION   AdjustmentReason = "reconciliation"
+	FEE_WAIVER       AdjustmentReason = "fee_waiver"
+)
+
+var adjustmentReasons = map[AdjustmentReason]bool{
+	GOODWILL:         true,
+	ERROR_CORRECTION: true,
+	RECONCILIATION:   true,
+	FEE_WAIVER:       true,
+}
+
+// Credits an account from its tenant's fee account, or debits it back when amount is negative
+// The posting goes through the ledger like any other transfer and is audited with its reason
+func (s *Service) Adjust(ctx context.Context, role Role, a *Account, amount int64, reason AdjustmentReason, note string) (*Transaction, error) {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return nil, err
+	}
+
+	if !adjustmentReasons[reason] {
+		return nil, newError(INVALID_ARGUMENT, "Unknown adjustment reason")
+	}
+
+	if amount == 0 {
+		return nil, newError(INVALID_AMOUNT, "Adjustments need an amount")
+	}
+
+	s.mu.RLock()
+	house, ok := s.feeAccounts[a.tenant]
+	s.mu.RUnlock()
+
+	if !ok {
+		return nil, ErrNoFeeAccount
+	}
+
+	from, to, value := house, a, amount
+	if amount < 0 {
+		from, to, value = a, house, -amount
+	}
+
+	metadata := map[string]string{"adjustment": string(reason), "note": note}
+	t, err := s.postTransfer(ctx, from, to, uint32(value), metadata)
+
+	s.audit(AuditRecord{transactionID: transactionIDOf(t), account: a, operation: ADJUST, reason: string(reason) + ": " + note, err: err})
+
+	return t, err
+}
+
+// Forces a transaction that never moved money into another state that doesn't move money either
+// Payments that were closed are corrected with refunds or adjustments instead
+// The payment's accounts are locked first, so no payment of it is halfway through
+func (s *Service) CorrectState(ctx context.Context, role Role, t *Transaction, state TransactionState, reason string) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	if reason == "" {
+		return newError(INVALID_ARGUMENT, "Corrections need a reason")
+	}
+
+	if state == CLOSED {
+		return newError(INVALID_STATE, "Closed transactions can only be corrected through the ledger")
+	}
+
+	_, release, err := s.lockAccounts(ctx, s.paymentAccounts(t)...)
+
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
+	s.mu.Lock()
+	previous := t.state
+	if previous == CLOSED {
+		s.mu.Unlock()
+		return newError(INVALID_STATE, "Closed transactions can only be corrected through the ledger")
+	}
+	// The handler holds the payer's funds until it answers
+	if previous == AWAITING_HANDLER {
+		s.mu.Unlock()
+		return newError(INVALID_STATE, "Transaction is waiting for its handler to decide")
+	}
+	t.state = state
+	s.mu.Unlock()
+
+	s.save(t)
+	s.audit(AuditRecord{transactionID: t.id, operation: CORRECT_STATE, reason: string(previous) + " -> " + string(state) + ": " + reason})
+
+	return nil
+}
+
+// Gives the payer back the fee charged on a closed transaction
+// Credit surcharges are taken off what the sender owes, only the part already paid back is returned from the fee account
+// Returns the transfer made from the fee account, nil when nothing had to be paid back
+func (s *Service) WaiveFee(ctx context.Context, role Role, t *Transaction, note string) (*Transaction, error) {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	house := s.feeAccounts[t.tenant]
+	s.mu.RUnlock()
+
+	// The house is the sender of the second leg of an exchange, whose spread the recipient paid
+	payer := t.sender
+	if payer == house {
+		payer = t.recipient
+	}
+
+	ctx, release, err := s.lockAccounts(ctx, payer, house)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer release()
+
+	s.mu.Lock()
+	if t.state != CLOSED || t.fee <= 0 {
+		s.mu.Unlock()
+		return nil, newError(INVALID_STATE, "Transaction has no fee to waive")
+	}
+	if t.feeWaived {
+		s.mu.Unlock()
+		return nil, newError(INVALID_STATE, "Fee was already waived")
+	}
+	if house == nil {
+		s.mu.Unlock()
+		return nil, ErrNoFeeAccount
+	}
+	t.feeWaived = true
+	refund := uint32(t.fee)
+	var forgiven uint32
+	if t.paymentMethod == CREDIT {
+		forgiven = min(refund, s.owedOnCredit(payer))
+		refund -= forgiven
+	}
+	s.mu.Unlock()
+
+	id := strconv.FormatUint(uint64(t.id), 10)
+
+	var waiver *Transaction
+
+	if refund > 0 {
+		metadata := map[string]string{"adjustment": string(FEE_WAIVER), "fee_waived_from": id, "note": note}
+		waiver, err = s.postTransfer(ctx, house, payer, refund, metadata)
+	}
+
+	if err == nil && forgiven > 0 {
+		metadata := map[string]string{"adjustment": string(FEE_WAIVER), "credit_waived_from": id, "note": note}
+		_, err = s.postCreditWaiver(ctx, payer, house, forgiven, metadata)
+
+		// What was paid back is taken back, the waiver is made whole or not at all
+		if err != nil && waiver != nil {
+			undo := map[string]string{"fee_waiver_undone": strconv.FormatUint(uint64(waiver.id), 10)}
+			if _, undoErr := s.postTransfer(context.WithoutCancel(ctx), payer, house, refund, undo); undoErr != nil {
+				err = errors.Join(err, undoErr)
+			}
+			waiver = nil
+		}
+	}
+
+	if err != nil {
+		s.mu.Lock()
+		t.feeWaived = false
+		s.mu.Unlock()
+	}
+
+	s.audit(AuditRecord{transactionID: t.id, account: payer, operation: WAIVE_FEE, reason: note, err: err})
+
+	return waiver, err
+}
+
+// Returns what an account owes on credit, billed or not
+// Caller must hold s.mu
+func (s *Service) owedOnCredit(a *Account) uint32 {
+	owed := a.unbilledCredit
+
+	for _, st := range s.statements[a] {
+		owed += st.outstanding()
+	}
+
+	return owed
+}
+
+// Posts a transaction taking up to amount off what an account owes on credit, from the unbilled charges first and then from the newest statements
+// No balance moves, the house gives up what it was owed, and the change is journaled like a credit payment
+func (s *Service) postCreditWaiver(ctx context.Context, a *Account, house *Account, amount uint32, metadata map[string]string) (*Transaction, error) {
+	ctx, release, err := s.lockAccounts(ctx, a, house)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer release()
+
+	t := &Transaction{
+		id:            s.newTransactionID(),
+		tenant:        a.tenant,
+		sender:        a,
+		recipient:     house,
+		state:         OPEN,
+		paymentMethod: CREDIT,
+		metadata:      metadata,
+		createdAt:     s.now(),
+	}
+
+	journalCtx, sequence, err := s.journalBegin(ctx, t)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	unbilled := min(amount, a.unbilledCredit)
+	a.unbilledCredit -= unbilled
+	forgiven := unbilled
+
+	statements := s.statements[a]
+
+	for i := len(statements) - 1; i >= 0 && forgiven < amount; i-- {
+		part := min(amount-forgiven, statements[i].outstanding())
+		statements[i].amount -= part
+		forgiven += part
+	}
+
+	a.creditUsed -= forgiven
+	t.amount = forgiven
+	t.state = CLOSED
+	t.closedAt = s.now()
+	s.mu.Unlock()
+
+	journalApplied(journalCtx, a, AccountDelta{CreditUsed: -int64(forgiven), UnbilledCredit: -int64(unbilled)})
+
+	s.save(t)
+	s.journalEnd(sequence, nil)
+	s.postToLedger(t)
+
+	return t, nil
+}
+
+// Appends a record of a privileged operation to the audit trail
+func (s *Service) audit(r AuditRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r.at = s.now()
+	s.auditTrail = append(s.auditTrail, r)
+}
+
+// Returns the id of a transaction, zero when there's none
+func transactionIDOf(t *Transaction) uint32 {
+	if t == nil {
+		return 0
+	}
+
+	return t.id
+}
@@ -0,0 +1,31 @@
+package main
+
+import "fmt"
+
+// Publishes an alert for every threshold a payment took the account below
+func (s *Service) checkBalanceAlerts(a *Account, before uint32) {
+	for _, threshold := range a.alertThresholds {
+		if before >= threshold && a.balance < threshold {
+			s.publish(Event{
+				kind:    BALANCE_ALERT,
+				account: a,
+				detail:  fmt.Sprintf("balance %d fell below %d", a.balance, threshold),
+			})
+		}
+	}
+}
+
+// Changes the balances that raise an alert for an account
+// Alerts go through the service event publisher, so webhooks or notifications can be plugged there
+func (s *Service) SetBalanceAlerts(role Role, a *Account, thresholds []uint32) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a.alertThresholds = thresholds
+
+	return nil
+}
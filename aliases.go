@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"strings"
+	"sync"
+)
+
+// Returned when an alias is already registered to another account
+var ErrAliasTaken = newError(ALREADY_EXISTS, "Alias is already taken")
+
+// Maps human friendly handles, like emails, phones and usernames, to accounts
+type AliasDirectory struct {
+	mu      sync.RWMutex
+	aliases map[TenantID]map[string]uint32
+}
+
+// Creates an empty directory
+func NewAliasDirectory() *AliasDirectory {
+	return &AliasDirectory{aliases: map[TenantID]map[string]uint32{}}
+}
+
+// Brings an alias to the form it's stored in
+// Emails and usernames are case-insensitive, phone numbers keep only digits and a leading +
+func normalizeAlias(alias string) string {
+	alias = strings.ToLower(strings.TrimSpace(alias))
+
+	if !strings.HasPrefix(alias, "+") {
+		return alias
+	}
+
+	var b strings.Builder
+	b.WriteByte('+')
+
+	for _, r := range alias[1:] {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
+
+// Registers an alias for an account
+// Returns ErrAliasTaken if another account of the tenant already uses it
+func (d *AliasDirectory) register(a *Account, alias string) error {
+	alias = normalizeAlias(alias)
+
+	if alias == "" || alias == "+" {
+		return newError(INVALID_ARGUMENT, "Alias can't be empty")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.aliases[a.tenant] == nil {
+		d.aliases[a.tenant] = map[string]uint32{}
+	}
+
+	if id, ok := d.aliases[a.tenant][alias]; ok && id != a.id {
+		return ErrAliasTaken
+	}
+
+	d.aliases[a.tenant][alias] = a.id
+
+	return nil
+}
+
+// Registers every alias of an account, or none of them if one is taken
+func (d *AliasDirectory) registerAll(a *Account, aliases []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.aliases[a.tenant] == nil {
+		d.aliases[a.tenant] = map[string]uint32{}
+	}
+
+	for _, alias := range aliases {
+		if id, ok := d.aliases[a.tenant][normalizeAlias(alias)]; ok && id != a.id {
+			return ErrAliasTaken
+		}
+	}
+
+	for _, alias := range aliases {
+		d.aliases[a.tenant][normalizeAlias(alias)] = a.id
+	}
+
+	return nil
+}
+
+// Removes an alias from the directory
+func (d *AliasDirectory) unregister(tenant TenantID, alias string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.aliases[tenant], normalizeAlias(alias))
+}
+
+// Returns the id of the account an alias belongs to
+func (d *AliasDirectory) resolve(tenant TenantID, alias string) (uint32, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	id, ok := d.aliases[tenant][normalizeAlias(alias)]
+
+	if !ok {
+		return 0, ErrNotFound
+	}
+
+	return id, nil
+}
+
+// Returns every alias of a tenant with the id of the account it belongs to
+func (d *AliasDirectory) list(tenant TenantID) map[string]uint32 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return maps.Clone(d.aliases[tenant])
+}
+
+// Registers an alias for an account
+func (s *Service) RegisterAlias(role Role, a *Account, alias string) error {
+	if err := authorize(role, PAY); err != nil {
+		return err
+	}
+
+	return s.aliases.register(a, alias)
+}
+
+// Removes an alias from the directory
+func (s *Service) UnregisterAlias(role Role, tenant TenantID, alias string) error {
+	if err := authorize(role, PAY); err != nil {
+		return err
+	}
+
+	s.aliases.unregister(tenant, alias)
+
+	return nil
+}
+
+// Finds the account an alias belongs to
+func (s *Service) ResolveAlias(role Role, tenant TenantID, alias string) (*Account, error) {
+	if err := authorize(role, READ); err != nil {
+		return nil, err
+	}
+
+	id, err := s.aliases.resolve(tenant, alias)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.repository.findAccount(tenant, id)
+}
+
+// Pays a transaction to whichever account the alias belongs to
+func (s *Service) PayToAlias(ctx context.Context, role Role, t *Transaction, alias string) error {
+	recipient, err := s.ResolveAlias(role, t.tenant, alias)
+
+	if err != nil {
+		return err
+	}
+
+	t.recipient = recipient
+
+	return s.Pay(ctx, role, t)
+}
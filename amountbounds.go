@@ -0,0 +1,65 @@
+package main
+
+// Returned when a payment is smaller than its payment method allows, wrapped with the bounds
+var ErrAmountBelowMinimum = newError(AMOUNT_BELOW_MINIMUM, "Amount is below the minimum of the payment method")
+
+// Returned when a payment is larger than its payment method allows, wrapped with the bounds
+var ErrAmountAboveMaximum = newError(AMOUNT_ABOVE_MAXIMUM, "Amount is above the maximum of the payment method")
+
+// Models the smallest and largest amounts a payment method takes, zero leaves that side open
+type AmountBounds struct {
+	min uint32
+	max uint32
+}
+
+// Wraps a payment's amount error with the bounds it broke, so callers can tell the payer what is allowed
+type AmountOutOfBoundsError struct {
+	err    *CodedError
+	method PaymentMethod
+	bounds AmountBounds
+}
+
+func (e *AmountOutOfBoundsError) Error() string {
+	return e.err.Error()
+}
+
+func (e *AmountOutOfBoundsError) Unwrap() error {
+	return e.err
+}
+
+// Checks a transaction's amount against the bounds
+func (b AmountBounds) check(t *Transaction) error {
+	if b.min != 0 && t.amount < b.min {
+		return &AmountOutOfBoundsError{err: ErrAmountBelowMinimum, method: t.paymentMethod, bounds: b}
+	}
+
+	if b.max != 0 && t.amount > b.max {
+		return &AmountOutOfBoundsError{err: ErrAmountAboveMaximum, method: t.paymentMethod, bounds: b}
+	}
+
+	return nil
+}
+
+// Limits the amounts payments of a method can have, in minor units
+// Zero leaves a side open, and zero for both removes the bounds
+func (s *Service) SetAmountBounds(role Role, method PaymentMethod, min uint32, max uint32) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	if max != 0 && min > max {
+		return newError(INVALID_ARGUMENT, "Minimum amount can't be above the maximum")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if min == 0 && max == 0 {
+		delete(s.amountBounds, method)
+		return nil
+	}
+
+	s.amountBounds[method] = AmountBounds{min: min, max: max}
+
+	return nil
+}
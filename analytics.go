@@ -0,0 +1,282 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// All of the possible sizes of an aggregation period
+type Granularity string
+
+const (
+	DAILY   Granularity = "daily"
+	WEEKLY  Granularity = "weekly"
+	MONTHLY Granularity = "monthly"
+)
+
+// Totals of the transactions closed in one period
+type Aggregate struct {
+	start time.Time
+	count int
+	total uint64
+}
+
+// Totals of the transactions an account made with one counterparty
+type Counterparty struct {
+	account *Account
+	count   int
+	total   uint64
+}
+
+// Returns the start of the period a moment belongs to
+// Weeks start on Monday
+func (g Granularity) periodStart(at time.Time) time.Time {
+	year, month, day := at.Date()
+	start := time.Date(year, month, day, 0, 0, 0, 0, at.Location())
+
+	switch g {
+	case WEEKLY:
+		return start.AddDate(0, 0, -(int(start.Weekday())+6)%7)
+	case MONTHLY:
+		return start.AddDate(0, 0, 1-day)
+	default:
+		return start
+	}
+}
+
+// Keeps daily totals up to date as payments close, so aggregations don't scan the repository
+type DailyRollup struct {
+	mu   sync.Mutex
+	days map[TenantID]map[time.Time]*Aggregate
+	// Totals of the days already closed, which no payment can change anymore
+	history map[TenantID]map[time.Time]Aggregate
+}
+
+// Creates an empty rollup
+func NewDailyRollup() *DailyRollup {
+	return &DailyRollup{
+		days:    map[TenantID]map[time.Time]*Aggregate{},
+		history: map[TenantID]map[time.Time]Aggregate{},
+	}
+}
+
+// Moves the totals of the days that ended by cutoff into the history
+func (r *DailyRollup) seal(tenant TenantID, cutoff time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.history[tenant] == nil {
+		r.history[tenant] = map[time.Time]Aggregate{}
+	}
+
+	for day, agg := range r.days[tenant] {
+		if !day.AddDate(0, 0, 1).After(cutoff) {
+			r.history[tenant][day] = *agg
+			delete(r.days[tenant], day)
+		}
+	}
+}
+
+// Adds a closed transaction to the totals of its day
+func (r *DailyRollup) add(t *Transaction) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.days[t.tenant] == nil {
+		r.days[t.tenant] = map[time.Time]*Aggregate{}
+	}
+
+	day := DAILY.periodStart(t.closedAt)
+	agg, ok := r.days[t.tenant][day]
+
+	if !ok {
+		agg = &Aggregate{start: day}
+		r.days[t.tenant][day] = agg
+	}
+
+	agg.count++
+	agg.total += uint64(t.amount)
+}
+
+// Returns the daily totals of a tenant between from and to
+func (r *DailyRollup) between(tenant TenantID, from time.Time, to time.Time) []Aggregate {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var days []Aggregate
+
+	for day, agg := range r.days[tenant] {
+		if !day.Before(from) && day.Before(to) {
+			days = append(days, *agg)
+		}
+	}
+
+	for day, agg := range r.history[tenant] {
+		if !day.Before(from) && day.Before(to) {
+			days = append(days, agg)
+		}
+	}
+
+	return days
+}
+
+// Returns the closed transactions of a tenant between from and to
+func (s *Service) closedBetween(tenant TenantID, from time.Time, to time.Time) ([]*Transaction, error) {
+	return query(s.transactions(tenant), closedIn(from, to))
+}
+
+// Returns the amount paid with each payment method between from and to
+func (s *Service) TotalsByMethod(role Role, tenant TenantID, from time.Time, to time.Time) (map[PaymentMethod]uint64, error) {
+	if err := authorize(role, READ); err != nil {
+		return nil, err
+	}
+
+	transactions, err := s.closedBetween(tenant, from, to)
+
+	if err != nil {
+		return nil, err
+	}
+
+	totals := map[PaymentMethod]uint64{}
+
+	for _, t := range transactions {
+		totals[t.paymentMethod] += uint64(t.amount)
+	}
+
+	return totals, nil
+}
+
+// Returns the totals of each period between from and to, oldest first
+// Uses the daily rollup when the service keeps one
+func (s *Service) Aggregates(role Role, tenant TenantID, g Granularity, from time.Time, to time.Time) ([]Aggregate, error) {
+	if err := authorize(role, READ); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	rollup := s.rollup
+	s.mu.RUnlock()
+
+	var days []Aggregate
+
+	if rollup != nil {
+		days = rollup.between(tenant, from, to)
+	} else {
+		transactions, err := s.closedBetween(tenant, from, to)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, t := range transactions {
+			days = append(days, Aggregate{start: t.closedAt, count: 1, total: uint64(t.amount)})
+		}
+	}
+
+	periods := map[time.Time]*Aggregate{}
+
+	for _, d := range days {
+		start := g.periodStart(d.start)
+		agg, ok := periods[start]
+
+		if !ok {
+			agg = &Aggregate{start: start}
+			periods[start] = agg
+		}
+
+		agg.count += d.count
+		agg.total += d.total
+	}
+
+	aggregates := make([]Aggregate, 0, len(periods))
+
+	for _, agg := range periods {
+		aggregates = append(aggregates, *agg)
+	}
+
+	sort.Slice(aggregates, func(i, j int) bool {
+		return aggregates[i].start.Before(aggregates[j].start)
+	})
+
+	return aggregates, nil
+}
+
+// Returns the n accounts an account paid the most to
+func (s *Service) TopCounterparties(role Role, a *Account, n int) ([]Counterparty, error) {
+	if err := authorize(role, READ); err != nil {
+		return nil, err
+	}
+
+	transactions, err := query(s.transactions(a.tenant), closedSentBy(a))
+
+	if err != nil {
+		return nil, err
+	}
+
+	byAccount := map[uint32]*Counterparty{}
+
+	for _, t := range transactions {
+		c, ok := byAccount[t.recipient.id]
+
+		if !ok {
+			c = &Counterparty{account: t.recipient}
+			byAccount[t.recipient.id] = c
+		}
+
+		c.count++
+		c.total += uint64(t.amount)
+	}
+
+	counterparties := make([]Counterparty, 0, len(byAccount))
+
+	for _, c := range byAccount {
+		counterparties = append(counterparties, *c)
+	}
+
+	sort.Slice(counterparties, func(i, j int) bool {
+		return counterparties[i].total > counterparties[j].total
+	})
+
+	if len(counterparties) > n {
+		counterparties = counterparties[:n]
+	}
+
+	return counterparties, nil
+}
+
+// Returns the average amount of the transactions closed between from and to
+func (s *Service) AverageSize(role Role, tenant TenantID, from time.Time, to time.Time) (uint32, error) {
+	if err := authorize(role, READ); err != nil {
+		return 0, err
+	}
+
+	transactions, err := s.closedBetween(tenant, from, to)
+
+	if err != nil || len(transactions) == 0 {
+		return 0, err
+	}
+
+	var total uint64
+
+	for _, t := range transactions {
+		total += uint64(t.amount)
+	}
+
+	return uint32(total / uint64(len(transactions))), nil
+}
+
+// Makes the service keep daily totals as payments close
+// Only payments closed from then on are counted by the rollup
+func (s *Service) EnableRollup(role Role) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rollup = NewDailyRollup()
+
+	return nil
+}
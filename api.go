@@ -0,0 +1,510 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Major version of the HTTP API, the first segment of every versioned path
+type APIVersion string
+
+const (
+	API_V1 APIVersion = "v1"
+)
+
+// Media type clients name a version with when calling a path without one, e.g. application/vnd.dip.v1+json
+var apiMediaType = regexp.MustCompile(`application/vnd\.dip\.(v[0-9]+)\+json`)
+
+// Body of every API response, the shape of data depends on the version that answered
+// Version 1 payloads are described by schemas/api.v1.schema.json, fields can be added but never renamed or removed
+type APIEnvelope struct {
+	Version APIVersion `json:"version"`
+	Data    any        `json:"data,omitempty"`
+	Error   *APIError  `json:"error,omitempty"`
+}
+
+// Error part of the envelope, code and name are stable across versions
+type APIError struct {
+	Code    ErrorCode `json:"code"`
+	Name    string    `json:"name"`
+	Message string    `json:"message"`
+}
+
+// Account as version 1 of the API shows it
+type AccountResourceV1 struct {
+	ID       uint32   `json:"id"`
+	Tenant   TenantID `json:"tenant"`
+	Name     string   `json:"name"`
+	Balance  uint32   `json:"balance"`
+	Currency string   `json:"currency,omitempty"`
+}
+
+// Transaction as version 1 of the API shows it
+type TransactionResourceV1 struct {
+	ID            uint32           `json:"id"`
+	Tenant        TenantID         `json:"tenant"`
+	Sender        uint32           `json:"sender"`
+	Recipient     uint32           `json:"recipient"`
+	Amount        uint32           `json:"amount"`
+	Fee           int64            `json:"fee"`
+	State         TransactionState `json:"state"`
+	PaymentMethod PaymentMethod    `json:"payment_method"`
+	Reference     string           `json:"reference,omitempty"`
+	CreatedAt     time.Time        `json:"created_at"`
+	ClosedAt      time.Time        `json:"closed_at,omitzero"`
+}
+
+// Payment submitted to version 1 of the API, paid as soon as it's created
+type TransactionRequestV1 struct {
+	Sender    uint32 `json:"sender"`
+	Recipient uint32 `json:"recipient"`
+	Amount    uint32 `json:"amount"`
+	// Debit when empty
+	PaymentMethod PaymentMethod     `json:"payment_method,omitempty"`
+	CardToken     string            `json:"card_token,omitempty"`
+	Memo          string            `json:"memo,omitempty"`
+	Reference     string            `json:"reference,omitempty"`
+	Category      Category          `json:"category,omitempty"`
+	PromoCode     string            `json:"promo_code,omitempty"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+}
+
+// Answers a request with the data of the envelope, once the key is known to allow the operation
+type apiHandler func(r *http.Request, key *APIKey) (any, error)
+
+// Data of a streamed response, run once the request is authorized with send writing one item
+// Items go out as JSON lines, flushed as they are sent. Handlers check what can fail up front, since the status is sent
+// before the first item
+type apiStream func(send func(any) error) error
+
+// Models one operation of the API, served by a handler per version
+type apiEndpoint struct {
+	method    string
+	path      string
+	operation Operation
+	versions  map[APIVersion]apiHandler
+}
+
+// Identifies an endpoint at a version
+type apiRoute struct {
+	version APIVersion
+	method  string
+	path    string
+}
+
+// Models the retirement of an endpoint at a version
+// It keeps working, with Deprecation and Sunset headers, until the sunset and answers 410 after it
+type Deprecation struct {
+	at     time.Time
+	sunset time.Time
+	// Where integrators should move to, sent as the successor-version link
+	successor string
+}
+
+// Serves the service over HTTP, authenticated with API keys sent as bearer tokens
+// Every path is served under its version, e.g. /v1/tenants/acme/accounts/1, and without it for clients that
+// name the version in the Accept header. Those that don't get the oldest version, so they never break
+type APIServer struct {
+	service *Service
+	mux     *http.ServeMux
+
+	mu           sync.RWMutex
+	endpoints    map[apiRoute]*apiEndpoint
+	deprecations map[apiRoute]Deprecation
+}
+
+// Creates the API of a service
+func NewAPIServer(s *Service) *APIServer {
+	a := &APIServer{
+		service:      s,
+		mux:          http.NewServeMux(),
+		endpoints:    map[apiRoute]*apiEndpoint{},
+		deprecations: map[apiRoute]Deprecation{},
+	}
+
+	a.handle(&apiEndpoint{method: http.MethodGet, path: "/tenants/{tenant}/accounts/{id}", operation: READ, versions: map[APIVersion]apiHandler{
+		API_V1: a.accountV1,
+	}})
+	a.handle(&apiEndpoint{method: http.MethodGet, path: "/tenants/{tenant}/transactions/{id}", operation: READ, versions: map[APIVersion]apiHandler{
+		API_V1: a.transactionV1,
+	}})
+	a.handle(&apiEndpoint{method: http.MethodPost, path: "/tenants/{tenant}/transactions", operation: PAY, versions: map[APIVersion]apiHandler{
+		API_V1: a.createTransactionV1,
+	}})
+	a.handle(&apiEndpoint{method: http.MethodPost, path: "/tenants/{tenant}/transactions/{id}/pay", operation: PAY, versions: map[APIVersion]apiHandler{
+		API_V1: a.payV1,
+	}})
+	a.handle(&apiEndpoint{method: http.MethodGet, path: "/tenants/{tenant}/ledger", operation: READ, versions: map[APIVersion]apiHandler{
+		API_V1: a.ledgerV1,
+	}})
+
+	return a
+}
+
+// Routes an endpoint under each of its versions and without a version
+func (a *APIServer) handle(e *apiEndpoint) {
+	for version := range e.versions {
+		a.endpoints[apiRoute{version, e.method, e.path}] = e
+		a.mux.HandleFunc(e.method+" /"+string(version)+e.path, func(w http.ResponseWriter, r *http.Request) {
+			a.serve(w, r, e, version)
+		})
+	}
+
+	a.mux.HandleFunc(e.method+" "+e.path, func(w http.ResponseWriter, r *http.Request) {
+		a.serve(w, r, e, a.negotiate(r, e))
+	})
+}
+
+// Picks the version of an endpoint a request without one in the path is answered with
+func (a *APIServer) negotiate(r *http.Request, e *apiEndpoint) APIVersion {
+	for _, match := range apiMediaType.FindAllStringSubmatch(r.Header.Get("Accept"), -1) {
+		if _, ok := e.versions[APIVersion(match[1])]; ok {
+			return APIVersion(match[1])
+		}
+	}
+
+	versions := make([]APIVersion, 0, len(e.versions))
+
+	for version := range e.versions {
+		versions = append(versions, version)
+	}
+
+	return slices.MinFunc(versions, compareAPIVersions)
+}
+
+// Orders versions by their number, so v10 comes after v9
+func compareAPIVersions(a APIVersion, b APIVersion) int {
+	x, _ := strconv.Atoi(strings.TrimPrefix(string(a), "v"))
+	y, _ := strconv.Atoi(strings.TrimPrefix(string(b), "v"))
+
+	return x - y
+}
+
+func (a *APIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mux.ServeHTTP(w, r)
+}
+
+// Answers a request with the handler of a version, wrapped in the envelope
+func (a *APIServer) serve(w http.ResponseWriter, r *http.Request, e *apiEndpoint, version APIVersion) {
+	w.Header().Set("Dip-Version", string(version))
+	w.Header().Add("Vary", "Accept")
+
+	a.mu.RLock()
+	deprecation, deprecated := a.deprecations[apiRoute{version, e.method, e.path}]
+	a.mu.RUnlock()
+
+	if deprecated {
+		w.Header().Set("Deprecation", "@"+strconv.FormatInt(deprecation.at.Unix(), 10))
+		w.Header().Set("Sunset", deprecation.sunset.UTC().Format(http.TimeFormat))
+
+		if deprecation.successor != "" {
+			w.Header().Set("Link", "<"+deprecation.successor+`>; rel="successor-version"`)
+		}
+
+		if !a.service.now().Before(deprecation.sunset) {
+			a.respond(w, r, version, http.StatusGone, nil, newError(NOT_FOUND, "Endpoint version was retired"))
+			return
+		}
+	}
+
+	secret, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	key, err := a.service.apiKeys.authenticate(secret)
+
+	if err == nil && !key.allows(e.operation) {
+		err = ErrForbidden
+	}
+
+	// Keys only reach their own tenant, the others look like they don't exist
+	if err == nil && TenantID(r.PathValue("tenant")) != key.tenant {
+		err = ErrNotFound
+	}
+
+	var data any
+
+	if err == nil {
+		data, err = e.versions[version](r, key)
+	}
+
+	if stream, ok := data.(apiStream); ok && err == nil {
+		a.stream(w, stream)
+		return
+	}
+
+	a.respond(w, r, version, apiStatus(err), data, err)
+}
+
+// Writes a streamed response as JSON lines
+func (a *APIServer) stream(w http.ResponseWriter, stream apiStream) {
+	flusher := http.NewResponseController(w)
+	encoder := json.NewEncoder(w)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// The stream ends when the client goes away or can't be written to, there's no one left to tell
+	stream(func(item any) error {
+		if err := encoder.Encode(item); err != nil {
+			return err
+		}
+
+		return flusher.Flush()
+	})
+}
+
+// Writes the envelope, with the error in the language the request accepts
+func (a *APIServer) respond(w http.ResponseWriter, r *http.Request, version APIVersion, status int, data any, err error) {
+	envelope := APIEnvelope{Version: version, Data: data}
+
+	if err != nil {
+		code := errorCode(err)
+		envelope.Error = &APIError{Code: code, Name: code.name(), Message: localizeError(err, acceptedLocale(r))}
+
+		var retry *RetryAfterError
+
+		if errors.As(err, &retry) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retry.retryAfter.Seconds()+1)))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.dip."+string(version)+"+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(envelope)
+}
+
+// Returns the first language of the Accept-Language header
+func acceptedLocale(r *http.Request) Locale {
+	tag, _, _ := strings.Cut(r.Header.Get("Accept-Language"), ",")
+	tag, _, _ = strings.Cut(tag, ";")
+
+	return Locale(strings.TrimSpace(tag))
+}
+
+// Maps the code of an error to the HTTP status it is answered with
+func apiStatus(err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+
+	switch errorCode(err) {
+	case NOT_FOUND:
+		return http.StatusNotFound
+	case INVALID_API_KEY:
+		return http.StatusUnauthorized
+	case FORBIDDEN:
+		return http.StatusForbidden
+	case RATE_LIMITED:
+		return http.StatusTooManyRequests
+	case BUSY:
+		return http.StatusServiceUnavailable
+	case INVALID_ARGUMENT, INVALID_AMOUNT:
+		return http.StatusBadRequest
+	case CONFIRMATION_REQUIRED, APPROVAL_REQUIRED, CHAIN_CONFIRMATIONS_PENDING, GATEWAY_SETTLEMENT_PENDING, HANDLER_DECISION_PENDING:
+		return http.StatusAccepted
+	case PAYMENT_TIMEOUT:
+		return http.StatusGatewayTimeout
+	case INTERNAL:
+		return http.StatusInternalServerError
+	default:
+		return http.StatusUnprocessableEntity
+	}
+}
+
+// Marks an endpoint version as deprecated from now on, retiring it at sunset
+func (a *APIServer) Deprecate(role Role, version APIVersion, method string, path string, sunset time.Time, successor string) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	route := apiRoute{version, method, path}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.endpoints[route]; !ok {
+		return ErrNotFound
+	}
+
+	a.deprecations[route] = Deprecation{at: a.service.now(), sunset: sunset, successor: successor}
+
+	return nil
+}
+
+// Reads the account the path names
+func (a *APIServer) pathAccount(r *http.Request) (*Account, error) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 32)
+
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	return a.service.repository.findAccount(TenantID(r.PathValue("tenant")), uint32(id))
+}
+
+// Reads the transaction the path names
+func (a *APIServer) pathTransaction(r *http.Request) (*Transaction, error) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 32)
+
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	return a.service.repository.findTransaction(TenantID(r.PathValue("tenant")), uint32(id))
+}
+
+func (a *APIServer) accountV1(r *http.Request, key *APIKey) (any, error) {
+	account, err := a.pathAccount(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	balance, err := a.service.Balance(r.Context(), OPERATOR, account)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return AccountResourceV1{ID: account.id, Tenant: account.tenant, Name: account.name, Balance: balance, Currency: account.currency}, nil
+}
+
+func (a *APIServer) transactionV1(r *http.Request, key *APIKey) (any, error) {
+	t, err := a.pathTransaction(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return transactionResourceV1(t), nil
+}
+
+func (a *APIServer) payV1(r *http.Request, key *APIKey) (any, error) {
+	t, err := a.pathTransaction(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Payments left waiting, e.g. for a confirmation, are answered with the transaction as well as the error
+	err = a.service.payWithKey(r.Context(), key, t)
+
+	return transactionResourceV1(t), err
+}
+
+func (a *APIServer) createTransactionV1(r *http.Request, key *APIKey) (any, error) {
+	var body TransactionRequestV1
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, newError(INVALID_ARGUMENT, "Request body is not a valid transaction")
+	}
+
+	tenant := TenantID(r.PathValue("tenant"))
+	sender, err := a.service.repository.findAccount(tenant, body.Sender)
+
+	if err != nil {
+		return nil, err
+	}
+
+	recipient, err := a.service.repository.findAccount(tenant, body.Recipient)
+
+	if err != nil {
+		return nil, err
+	}
+
+	b := a.service.NewTransfer().From(sender).To(recipient).Amount(body.Amount).
+		WithCard(body.CardToken).
+		WithMemo(body.Memo).
+		WithReference(body.Reference).
+		WithCategory(body.Category).
+		WithPromoCode(body.PromoCode)
+
+	if body.PaymentMethod != "" {
+		b.Via(body.PaymentMethod)
+	}
+
+	if header := r.Header.Get(signatureHeader); header != "" {
+		signature, nonce, expiresAt, err := parseSignatureHeader(header)
+
+		if err != nil {
+			return nil, err
+		}
+
+		b.Signed(signature, nonce, expiresAt)
+	}
+
+	for k, v := range body.Metadata {
+		b.WithMetadata(k, v)
+	}
+
+	t, err := b.Build()
+
+	if err != nil {
+		return nil, err
+	}
+
+	t.locale = acceptedLocale(r)
+	err = a.service.payWithKey(r.Context(), key, t)
+
+	return transactionResourceV1(t), err
+}
+
+// Streams the ledger entries of the tenant after the from sequence, filtered to the account parameters if any
+// The stream stays open and carries on with entries as they are posted, until the client goes away
+func (a *APIServer) ledgerV1(r *http.Request, key *APIKey) (any, error) {
+	filter := LedgerFilter{tenant: key.tenant}
+	var from uint64
+
+	if value := r.URL.Query().Get("from"); value != "" {
+		sequence, err := strconv.ParseUint(value, 10, 64)
+
+		if err != nil {
+			return nil, newError(INVALID_ARGUMENT, "Ledger sequence is not a number")
+		}
+
+		from = sequence
+	}
+
+	for _, value := range r.URL.Query()["account"] {
+		id, err := strconv.ParseUint(value, 10, 32)
+
+		if err != nil {
+			return nil, ErrNotFound
+		}
+
+		filter.accounts = append(filter.accounts, uint32(id))
+	}
+
+	if _, _, err := a.service.ledgerLog().after(from); err != nil {
+		return nil, err
+	}
+
+	return apiStream(func(send func(any) error) error {
+		return a.service.TailLedger(r.Context(), OPERATOR, filter, from, func(e LedgerEntryV1) error {
+			return send(e)
+		})
+	}), nil
+}
+
+// Converts a transaction to its version 1 resource
+func transactionResourceV1(t *Transaction) TransactionResourceV1 {
+	return TransactionResourceV1{
+		ID:            t.id,
+		Tenant:        t.tenant,
+		Sender:        t.sender.id,
+		Recipient:     t.recipient.id,
+		Amount:        t.amount,
+		Fee:           t.fee,
+		State:         t.state,
+		PaymentMethod: t.paymentMethod,
+		Reference:     t.reference,
+		CreatedAt:     t.createdAt,
+		ClosedAt:      t.closedAt,
+	}
+}
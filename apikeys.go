@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sync"
+	"time"
+)
+
+// Returned when an API key or account made too many requests, wrapped with when to retry
+var ErrRateLimited = newError(RATE_LIMITED, "Rate limit exceeded")
+
+// Models the credentials handed to a machine integration
+type APIKey struct {
+	id string
+	// Tenant whose accounts and transactions the key can reach, the only one
+	tenant     TenantID
+	secretHash [sha256.Size]byte
+	scopes     []Operation
+	limiter    *tokenBucket
+	revoked    bool
+	createdAt  time.Time
+}
+
+// Checks if the key was granted an operation
+func (k *APIKey) allows(op Operation) bool {
+	for _, scope := range k.scopes {
+		if scope == op {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Issues, rotates, revokes and authenticates API keys
+// Only hashes of the secrets are kept
+type APIKeyStore struct {
+	mu       sync.Mutex
+	keys     map[string]*APIKey
+	bySecret map[[sha256.Size]byte]*APIKey
+	// Source of key ids and secrets
+	random io.Reader
+	now    func() time.Time
+}
+
+// Creates an empty in-memory key store
+func NewAPIKeyStore() *APIKeyStore {
+	return &APIKeyStore{
+		keys:     map[string]*APIKey{},
+		bySecret: map[[sha256.Size]byte]*APIKey{},
+		random:   rand.Reader,
+		now:      time.Now,
+	}
+}
+
+// Creates a key limited to the given scopes and request rate
+// Returns the key id and its secret, which is never shown again
+func (st *APIKeyStore) issue(tenant TenantID, scopes []Operation, perSecond float64, burst int) (string, string, error) {
+	id, err := randomHex(st.random, 8)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	secret, err := randomHex(st.random, 32)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	key := &APIKey{
+		id:         "key_" + id,
+		tenant:     tenant,
+		secretHash: sha256.Sum256([]byte(secret)),
+		scopes:     scopes,
+		limiter:    newTokenBucket(perSecond, burst, st.now()),
+		createdAt:  st.now(),
+	}
+
+	st.keys[key.id] = key
+	st.bySecret[key.secretHash] = key
+
+	return key.id, secret, nil
+}
+
+// Replaces the secret of a key, the old secret stops working right away
+func (st *APIKeyStore) rotate(id string) (string, error) {
+	secret, err := randomHex(st.random, 32)
+
+	if err != nil {
+		return "", err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	key, ok := st.keys[id]
+
+	if !ok || key.revoked {
+		return "", newError(INVALID_API_KEY, "Unknown API key")
+	}
+
+	delete(st.bySecret, key.secretHash)
+	key.secretHash = sha256.Sum256([]byte(secret))
+	st.bySecret[key.secretHash] = key
+
+	return secret, nil
+}
+
+// Permanently disables a key
+func (st *APIKeyStore) revoke(id string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	key, ok := st.keys[id]
+
+	if !ok {
+		return newError(INVALID_API_KEY, "Unknown API key")
+	}
+
+	key.revoked = true
+	delete(st.bySecret, key.secretHash)
+
+	return nil
+}
+
+// Finds the key a secret belongs to and takes one request from its rate limit
+func (st *APIKeyStore) authenticate(secret string) (*APIKey, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	key, ok := st.bySecret[sha256.Sum256([]byte(secret))]
+
+	if !ok || key.revoked {
+		return nil, newError(INVALID_API_KEY, "Invalid API key")
+	}
+
+	if wait, ok := key.limiter.take(st.now()); !ok {
+		return nil, &RetryAfterError{err: ErrRateLimited, retryAfter: wait}
+	}
+
+	return key, nil
+}
+
+// Rate limiter that refills a fixed number of tokens per second up to a burst
+type tokenBucket struct {
+	perSecond float64
+	burst     float64
+	tokens    float64
+	last      time.Time
+}
+
+func newTokenBucket(perSecond float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{perSecond: perSecond, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+// Takes one token if there's any left
+// Otherwise returns how long until the next token is refilled
+func (b *tokenBucket) take(now time.Time) (time.Duration, bool) {
+	b.tokens += now.Sub(b.last).Seconds() * b.perSecond
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 && b.perSecond <= 0 {
+		return 0, false
+	}
+
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / b.perSecond * float64(time.Second)), false
+	}
+
+	b.tokens--
+
+	return 0, true
+}
+
+// Returns n bytes read from random, encoded as hex
+func randomHex(random io.Reader, n int) (string, error) {
+	b := make([]byte, n)
+
+	if _, err := io.ReadFull(random, b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// Records which key initiated an operation, or why an account was frozen or unfrozen
+type AuditRecord struct {
+	keyID         string
+	transactionID uint32
+	// Account acted on by privileged operations
+	account   *Account
+	operation Operation
+	reason    string
+	err       error
+	at        time.Time
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+)
+
+// Returned when a payment is waiting for owners of a joint account to approve it
+var ErrApprovalRequired = newError(APPROVAL_REQUIRED, "Transaction requires approval from the account owners")
+
+// Checks if a payment from a joint account has every approval it needs
+// Moves it to PENDING_APPROVAL and returns ErrApprovalRequired if it doesn't
+func (s *Service) checkApprovals(t *Transaction) error {
+	a := t.sender
+
+	if a.requiredApprovals == 0 || t.amount <= a.approvalThreshold {
+		return nil
+	}
+
+	if t.state != OPEN && t.state != PENDING_APPROVAL {
+		return nil
+	}
+
+	if approvalCount(t) >= a.requiredApprovals {
+		return t.transition(OPEN)
+	}
+
+	if err := t.transition(PENDING_APPROVAL); err != nil {
+		return err
+	}
+
+	return ErrApprovalRequired
+}
+
+// Counts approvals given by current owners of the sender
+func approvalCount(t *Transaction) int {
+	count := 0
+
+	for _, owner := range t.sender.owners {
+		if t.approvals[owner] {
+			count++
+		}
+	}
+
+	return count
+}
+
+// Checks if someone owns an account
+func isOwner(a *Account, owner string) bool {
+	for _, o := range a.owners {
+		if o == owner {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Records an owner's approval, paying the transaction once enough owners approved
+// The payment's accounts are locked first, so concurrent approvals are counted one at a time and only one pays
+func (s *Service) Approve(ctx context.Context, role Role, t *Transaction, owner string) error {
+	if err := authorize(role, PAY); err != nil {
+		return err
+	}
+
+	ctx, release, err := s.lockAccounts(ctx, s.paymentAccounts(t)...)
+
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
+	if t.state != PENDING_APPROVAL {
+		return newError(INVALID_STATE, "Transaction is not waiting for approval")
+	}
+
+	if !isOwner(t.sender, owner) {
+		return newError(NOT_AN_OWNER, "Only owners of the sender can approve the transaction")
+	}
+
+	if t.approvals == nil {
+		t.approvals = map[string]bool{}
+	}
+
+	t.approvals[owner] = true
+
+	if approvalCount(t) < t.sender.requiredApprovals {
+		s.save(t)
+		return nil
+	}
+
+	return s.pay(ctx, t)
+}
+
+// Rejects a transaction waiting for approval, cancelling it
+func (s *Service) Reject(role Role, t *Transaction, owner string) error {
+	if err := authorize(role, CANCEL); err != nil {
+		return err
+	}
+
+	if t.state != PENDING_APPROVAL {
+		return newError(INVALID_STATE, "Transaction is not waiting for approval")
+	}
+
+	if !isOwner(t.sender, owner) {
+		return newError(NOT_AN_OWNER, "Only owners of the sender can reject the transaction")
+	}
+
+	return s.Cancel(role, t, "Rejected by "+owner)
+}
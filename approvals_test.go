@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParallelApprovalsPayOnce(t *testing.T) {
+	s := NewService(NewMemoryTokenVault(time.Hour))
+	owners := []string{"ana", "bruno", "carla", "davi"}
+	joint := &Account{id: 1, name: "Joint", balance: 1000, owners: owners, requiredApprovals: 2}
+	recipient := &Account{id: 2, name: "Recipient"}
+
+	for range 50 {
+		payment, err := NewTransfer().From(joint).To(recipient).Amount(10).Build()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Pay(context.Background(), OPERATOR, payment); !errors.Is(err, ErrApprovalRequired) {
+			t.Fatalf("paying returned %v", err)
+		}
+
+		var wg sync.WaitGroup
+
+		for _, owner := range owners {
+			wg.Go(func() {
+				// Approvals after the payment went through find it no longer waiting
+				if err := s.Approve(context.Background(), OPERATOR, payment, owner); err != nil && errorCode(err) != INVALID_STATE {
+					t.Error(err)
+				}
+			})
+		}
+
+		wg.Wait()
+
+		if payment.state != CLOSED {
+			t.Fatalf("payment is %s after every owner approved", payment.state)
+		}
+	}
+
+	if joint.balance != 500 || recipient.balance != 500 {
+		t.Fatalf("joint account has %d and recipient %d after 50 payments of 10", joint.balance, recipient.balance)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Interface for storing transactions that left the hot repository
+type ArchiveStore interface {
+	archive(t *Transaction) error
+	findArchived(tenant TenantID, id uint32) (*Transaction, error)
+	listArchived(tenant TenantID) ([]*Transaction, error)
+}
+
+// Keeps archived transactions in memory, apart from the hot repository
+type MemoryArchiveStore struct {
+	mu           sync.RWMutex
+	transactions map[TenantID]map[uint32]*Transaction
+}
+
+// Creates an empty in-memory archive
+func NewMemoryArchiveStore() *MemoryArchiveStore {
+	return &MemoryArchiveStore{transactions: map[TenantID]map[uint32]*Transaction{}}
+}
+
+func (st *MemoryArchiveStore) archive(t *Transaction) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.transactions[t.tenant] == nil {
+		st.transactions[t.tenant] = map[uint32]*Transaction{}
+	}
+
+	st.transactions[t.tenant][t.id] = t
+
+	return nil
+}
+
+func (st *MemoryArchiveStore) findArchived(tenant TenantID, id uint32) (*Transaction, error) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	t, ok := st.transactions[tenant][id]
+
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return t, nil
+}
+
+func (st *MemoryArchiveStore) listArchived(tenant TenantID) ([]*Transaction, error) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	transactions := make([]*Transaction, 0, len(st.transactions[tenant]))
+
+	for _, t := range st.transactions[tenant] {
+		transactions = append(transactions, t)
+	}
+
+	return transactions, nil
+}
+
+// Moves closed transactions older than retention to the archive
+// Returns how many transactions were archived
+func (s *Service) ArchiveClosed(role Role, tenant TenantID, retention time.Duration) (int, error) {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return 0, err
+	}
+
+	live := s.transactions(tenant)
+	transactions, err := query(live, closedIn(time.Time{}, s.now().Add(-retention)))
+
+	if err != nil {
+		return 0, err
+	}
+
+	archived := 0
+
+	for _, t := range transactions {
+		// Archive first so a failed delete leaves a copy in both stores rather than in none
+		if err := s.archive.archive(t); err != nil {
+			return archived, err
+		}
+
+		if err := live.delete(t.id); err != nil {
+			return archived, err
+		}
+
+		archived++
+	}
+
+	return archived, nil
+}
+
+// Finds a transaction that was moved to the archive
+func (s *Service) ArchivedTransaction(role Role, tenant TenantID, id uint32) (*Transaction, error) {
+	if err := authorize(role, READ); err != nil {
+		return nil, err
+	}
+
+	return s.archive.findArchived(tenant, id)
+}
@@ -0,0 +1,50 @@
+package main
+
+// Returned when a role tries an operation it wasn't granted
+var ErrForbidden = newError(FORBIDDEN, "Role is not allowed to perform this operation")
+
+// All of the possible roles of whoever calls the service
+type Role string
+
+const (
+	OWNER    Role = "owner"
+	OPERATOR Role = "operator"
+	AUDITOR  Role = "auditor"
+	ADMIN    Role = "admin"
+)
+
+// All of the operations gated by role
+type Operation string
+
+const (
+	READ      Operation = "read"
+	PAY       Operation = "pay"
+	CANCEL    Operation = "cancel"
+	CONFIGURE Operation = "configure"
+	// Recorded in the audit trail, not granted to roles
+	FREEZE        Operation = "freeze"
+	UNFREEZE      Operation = "unfreeze"
+	ADJUST        Operation = "adjust"
+	CORRECT_STATE Operation = "correct_state"
+	WAIVE_FEE     Operation = "waive_fee"
+)
+
+// Operations each role is allowed to perform
+var rolePermissions = map[Role][]Operation{
+	OWNER:    {READ, PAY, CANCEL},
+	OPERATOR: {READ, PAY, CANCEL},
+	AUDITOR:  {READ},
+	ADMIN:    {READ, PAY, CANCEL, CONFIGURE},
+}
+
+// Checks if a role can perform an operation
+// Returns ErrForbidden if it can't
+func authorize(role Role, op Operation) error {
+	for _, allowed := range rolePermissions[role] {
+		if allowed == op {
+			return nil
+		}
+	}
+
+	return ErrForbidden
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Returned when the processor queue is full and the submission was turned away
+var ErrBusy = newError(BUSY, "Service is busy, retry later")
+
+// All of the possible ways of handling a submission when the queue is full
+type ShedPolicy string
+
+const (
+	// Turn the new submission away
+	REJECT_NEW ShedPolicy = "reject_new"
+	// Hold the caller until there is room or its context is done
+	WAIT_FOR_ROOM ShedPolicy = "wait_for_room"
+	// Drop the newest submission of a lower priority to make room, reject if there is none
+	SHED_LOWER ShedPolicy = "shed_lower"
+)
+
+// Bounds the processor queue and decides what happens when it is full
+// A depth of zero means the queue is unbounded
+func (p *Processor) SetLimits(role Role, depth int, policy ShedPolicy, retryAfter time.Duration) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.depth, p.policy, p.retryAfter = depth, policy, retryAfter
+	p.room.Broadcast()
+
+	return nil
+}
+
+// Returns the error handed to submissions turned away
+func (p *Processor) busy() error {
+	return &RetryAfterError{err: ErrBusy, retryAfter: p.retryAfter}
+}
+
+// Makes room for a submission of the given priority, lock must be held
+// Returns ErrBusy wrapped with a retry-after when the policy says to turn it away
+func (p *Processor) admit(ctx context.Context, priority Priority) error {
+	if p.depth == 0 || p.queued() < p.depth {
+		return nil
+	}
+
+	switch p.policy {
+	case WAIT_FOR_ROOM:
+		// Wakes the wait below if the caller gives up
+		stop := context.AfterFunc(ctx, func() {
+			p.mu.Lock()
+			p.room.Broadcast()
+			p.mu.Unlock()
+		})
+		defer stop()
+
+		for p.depth > 0 && p.queued() >= p.depth && !p.closed {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			p.room.Wait()
+		}
+
+		return nil
+	case SHED_LOWER:
+		for i := len(priorities) - 1; i >= 0 && priorities[i] != priority; i-- {
+			q := p.queues[priorities[i]]
+
+			if len(q) > 0 {
+				shed := q[len(q)-1]
+				p.queues[priorities[i]] = q[:len(q)-1]
+				shed.result <- p.busy()
+				return nil
+			}
+		}
+
+		return p.busy()
+	default:
+		return p.busy()
+	}
+}
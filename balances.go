@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+)
+
+// Interface for where account balances live, locally or in an external core banking system
+type BalanceProvider interface {
+	balance(ctx context.Context, a *Account) (uint32, error)
+	// Holds funds of an account, failing with ErrInsufficientFunds when it can't cover them
+	reserve(ctx context.Context, a *Account, amount uint32) error
+	// Gives back funds held by reserve
+	release(ctx context.Context, a *Account, amount uint32) error
+	// Takes funds held by reserve out of the account
+	capture(ctx context.Context, a *Account, amount uint32) error
+	// Adds funds to an account
+	deposit(ctx context.Context, a *Account, amount uint32) error
+}
+
+// Keeps balances in the accounts themselves, reserving funds takes them out right away
+type LocalBalanceProvider struct{}
+
+func (p *LocalBalanceProvider) balance(ctx context.Context, a *Account) (uint32, error) {
+	return a.balance, nil
+}
+
+func (p *LocalBalanceProvider) reserve(ctx context.Context, a *Account, amount uint32) error {
+	if a.balance < amount {
+		return ErrInsufficientFunds
+	}
+
+	a.balance -= amount
+
+	return nil
+}
+
+func (p *LocalBalanceProvider) release(ctx context.Context, a *Account, amount uint32) error {
+	a.balance += amount
+
+	return nil
+}
+
+func (p *LocalBalanceProvider) capture(ctx context.Context, a *Account, amount uint32) error {
+	return nil
+}
+
+func (p *LocalBalanceProvider) deposit(ctx context.Context, a *Account, amount uint32) error {
+	a.balance += amount
+
+	return nil
+}
+
+// Funds taken from or added to one account by a payment
+type fundsLeg struct {
+	account *Account
+	amount  uint32
+	// Returned instead of ErrInsufficientFunds when this account can't cover its leg
+	insufficient error
+}
+
+// Moves the funds of a payment, reserving every debit before anything is captured or deposited
+// When a reservation fails the ones before it are released, and when a capture or deposit fails the legs already applied
+// are undone, so nothing moves either way
+func moveFunds(ctx context.Context, p BalanceProvider, debits []fundsLeg, credits []fundsLeg) error {
+	if err := holdFunds(ctx, p, debits); err != nil {
+		return err
+	}
+
+	// Past this point the funds are held, finish even if the caller gave up
+	return settleHeldFunds(context.WithoutCancel(ctx), p, debits, credits)
+}
+
+// Reserves every debit of a payment, releasing the ones before when a reservation fails
+// Handlers that must wait for a decision before funds move hold them with this, then settle or release them
+func holdFunds(ctx context.Context, p BalanceProvider, debits []fundsLeg) error {
+	p = &journalingBalanceProvider{next: p}
+
+	for i, d := range debits {
+		if d.amount == 0 {
+			continue
+		}
+
+		if err := p.reserve(ctx, d.account, d.amount); err != nil {
+			releaseLegs(context.WithoutCancel(ctx), p, debits[:i])
+
+			if errors.Is(err, ErrInsufficientFunds) && d.insufficient != nil {
+				return d.insufficient
+			}
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Captures the debits held by holdFunds and deposits the credits
+// When a capture or deposit fails the legs already applied are undone, and the held debits are given back
+func settleHeldFunds(ctx context.Context, p BalanceProvider, debits []fundsLeg, credits []fundsLeg) error {
+	p = &journalingBalanceProvider{next: p}
+
+	for i, d := range debits {
+		if d.amount == 0 {
+			continue
+		}
+
+		if err := p.capture(ctx, d.account, d.amount); err != nil {
+			releaseLegs(ctx, p, debits[i:])
+			refundLegs(ctx, p, debits[:i])
+			return err
+		}
+	}
+
+	for i, c := range credits {
+		if err := p.deposit(ctx, c.account, c.amount); err != nil {
+			withdrawLegs(ctx, p, credits[:i])
+			refundLegs(ctx, p, debits)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Gives back the debits held by holdFunds of a payment that won't go through
+func releaseHeldFunds(ctx context.Context, p BalanceProvider, debits []fundsLeg) {
+	releaseLegs(ctx, &journalingBalanceProvider{next: p}, debits)
+}
+
+// Gives back funds reserved but not captured
+// Compensations can't fail the payment any further, their failures are logged for reconciliation
+func releaseLegs(ctx context.Context, p BalanceProvider, legs []fundsLeg) {
+	for _, l := range legs {
+		if l.amount == 0 {
+			continue
+		}
+
+		if err := p.release(ctx, l.account, l.amount); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Deposits captured funds back into the accounts they were taken from
+func refundLegs(ctx context.Context, p BalanceProvider, legs []fundsLeg) {
+	for _, l := range legs {
+		if l.amount == 0 {
+			continue
+		}
+
+		if err := p.deposit(ctx, l.account, l.amount); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Takes deposited funds back out of the accounts they were added to
+func withdrawLegs(ctx context.Context, p BalanceProvider, legs []fundsLeg) {
+	for _, l := range legs {
+		if l.amount == 0 {
+			continue
+		}
+
+		err := p.reserve(ctx, l.account, l.amount)
+
+		if err == nil {
+			err = p.capture(ctx, l.account, l.amount)
+		}
+
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Returns the provider handlers move funds with, local balances unless one was given
+func balancesOrLocal(p BalanceProvider) BalanceProvider {
+	if p == nil {
+		return &LocalBalanceProvider{}
+	}
+
+	return p
+}
+
+// Makes payments check and move funds through an external provider, nil goes back to local balances
+func (s *Service) SetBalanceProvider(role Role, p BalanceProvider) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.balances = p
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// All of the categories a transaction can be filed under
+type Category string
+
+const (
+	UNCATEGORIZED Category = ""
+	GROCERIES     Category = "groceries"
+	RENT          Category = "rent"
+	SALARY        Category = "salary"
+	UTILITIES     Category = "utilities"
+	TRANSPORT     Category = "transport"
+	LEISURE       Category = "leisure"
+)
+
+// Sums what an account paid per category in closed transactions between from and to
+func (s *Service) spendByCategory(a *Account, from time.Time, to time.Time) (map[Category]uint32, error) {
+	transactions, err := query(s.transactions(a.tenant), closedSentBy(a), closedIn(from, to))
+
+	if err != nil {
+		return nil, err
+	}
+
+	spend := map[Category]uint32{}
+
+	for _, t := range transactions {
+		spend[t.category] += t.amount
+	}
+
+	return spend, nil
+}
+
+// Publishes an event when a payment takes its category over the sender's monthly budget
+func (s *Service) checkBudget(t *Transaction) {
+	s.mu.RLock()
+	budget, ok := t.sender.budgets[t.category]
+	s.mu.RUnlock()
+
+	if !ok {
+		return
+	}
+
+	year, month, _ := t.closedAt.Date()
+	from := time.Date(year, month, 1, 0, 0, 0, 0, t.closedAt.Location())
+
+	spend, err := s.spendByCategory(t.sender, from, from.AddDate(0, 1, 0))
+
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	spent := spend[t.category]
+
+	if spent > budget && spent-t.amount <= budget {
+		s.publish(Event{
+			kind:        BUDGET_EXCEEDED,
+			transaction: t,
+			account:     t.sender,
+			detail:      fmt.Sprintf("%s spending %d is over the budget of %d", t.category, spent, budget),
+		})
+	}
+}
+
+// Returns what an account paid per category between from and to
+func (s *Service) SpendByCategory(role Role, a *Account, from time.Time, to time.Time) (map[Category]uint32, error) {
+	if err := authorize(role, READ); err != nil {
+		return nil, err
+	}
+
+	return s.spendByCategory(a, from, to)
+}
+
+// Sets how much an account may spend on a category each month
+func (s *Service) SetBudget(role Role, a *Account, category Category, monthly uint32) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if a.budgets == nil {
+		a.budgets = map[Category]uint32{}
+	}
+
+	a.budgets[category] = monthly
+
+	return nil
+}
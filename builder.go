@@ -0,0 +1,175 @@
+package main
+
+import "time"
+
+// Assembles a transaction step by step and checks it once, at Build
+type TransactionBuilder struct {
+	t Transaction
+	// First problem found while setting fields, returned by Build
+	err error
+	// Clock the transfer is created by
+	now func() time.Time
+}
+
+// Starts building an open debit transfer
+func NewTransfer() *TransactionBuilder {
+	return &TransactionBuilder{t: Transaction{state: OPEN, paymentMethod: DEBIT}, now: time.Now}
+}
+
+// Starts building an open debit transfer created by the service's clock, e.g. a sandbox's
+func (s *Service) NewTransfer() *TransactionBuilder {
+	b := NewTransfer()
+	b.now = s.now
+	return b
+}
+
+func (b *TransactionBuilder) From(a *Account) *TransactionBuilder {
+	if a == nil {
+		return b.fail(newError(INVALID_ARGUMENT, "Transfers need a sender and a recipient"))
+	}
+
+	b.t.sender = a
+	b.t.tenant = a.tenant
+	return b
+}
+
+func (b *TransactionBuilder) To(a *Account) *TransactionBuilder {
+	if a == nil {
+		return b.fail(newError(INVALID_ARGUMENT, "Transfers need a sender and a recipient"))
+	}
+
+	b.t.recipient = a
+	return b
+}
+
+// Keeps the first problem found, so Build reports it
+func (b *TransactionBuilder) fail(err error) *TransactionBuilder {
+	if b.err == nil {
+		b.err = err
+	}
+
+	return b
+}
+
+func (b *TransactionBuilder) Amount(amount uint32) *TransactionBuilder {
+	b.t.amount = amount
+	return b
+}
+
+func (b *TransactionBuilder) Via(method PaymentMethod) *TransactionBuilder {
+	b.t.paymentMethod = method
+	return b
+}
+
+// Sets the tokenized card charged by credit transfers
+func (b *TransactionBuilder) WithCard(token string) *TransactionBuilder {
+	b.t.cardToken = token
+	return b
+}
+
+func (b *TransactionBuilder) WithMemo(memo string) *TransactionBuilder {
+	b.t.memo = memo
+	return b
+}
+
+func (b *TransactionBuilder) WithReference(reference string) *TransactionBuilder {
+	b.t.reference = reference
+	return b
+}
+
+func (b *TransactionBuilder) WithCategory(category Category) *TransactionBuilder {
+	b.t.category = category
+	return b
+}
+
+// Sets when the transaction lapses if it isn't paid
+func (b *TransactionBuilder) ExpiresAt(at time.Time) *TransactionBuilder {
+	b.t.expiresAt = at
+	return b
+}
+
+func (b *TransactionBuilder) WithMetadata(key string, value string) *TransactionBuilder {
+	if b.t.metadata == nil {
+		b.t.metadata = map[string]string{}
+	}
+
+	b.t.metadata[key] = value
+	return b
+}
+
+func (b *TransactionBuilder) WithPromoCode(code string) *TransactionBuilder {
+	b.t.promoCode = code
+	return b
+}
+
+func (b *TransactionBuilder) WithPriority(priority Priority) *TransactionBuilder {
+	if priority != "" && !priority.valid() {
+		return b.fail(ErrUnknownPriority)
+	}
+
+	b.t.priority = priority
+	return b
+}
+
+// Sets the HMAC the client computed over the transaction, with the nonce and expiry it signed
+// Services with a signing secret only pay transactions signed with it
+func (b *TransactionBuilder) Signed(signature string, nonce string, expiresAt time.Time) *TransactionBuilder {
+	b.t.signature = signature
+	b.t.nonce = nonce
+	b.t.signatureExpiresAt = expiresAt
+	return b
+}
+
+// Sets the id of the transaction, the service hands one out when it's left zero
+func (b *TransactionBuilder) WithID(id uint32) *TransactionBuilder {
+	b.t.id = id
+	return b
+}
+
+// Checks the transfer and returns it, ready to be paid by the service
+func (b *TransactionBuilder) Build() (*Transaction, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	t := b.t
+
+	if t.sender == nil || t.recipient == nil {
+		return nil, newError(INVALID_ARGUMENT, "Transfers need a sender and a recipient")
+	}
+
+	if t.sender.id == t.recipient.id {
+		return nil, ErrSelfTransfer
+	}
+
+	if t.sender.tenant != t.recipient.tenant {
+		return nil, ErrCrossTenant
+	}
+
+	if t.amount == 0 {
+		return nil, newError(INVALID_AMOUNT, "Transfers need an amount")
+	}
+
+	// Methods registered with the service are only known to it, it rejects unknown ones at payment
+	switch t.paymentMethod {
+	case CREDIT:
+		if t.cardToken == "" {
+			return nil, newError(INVALID_CARD_TOKEN, "Credit transfers need a card token")
+		}
+	case "":
+		return nil, newError(UNSUPPORTED_PAYMENT_METHOD, "Could find a valid handler")
+	}
+
+	if t.metadata != nil {
+		metadata := make(map[string]string, len(t.metadata))
+		for k, v := range t.metadata {
+			metadata[k] = v
+		}
+		t.metadata = metadata
+	}
+
+	// Latency is counted from here, a payment paid later still took the time it waited
+	t.createdAt = b.now()
+
+	return &t, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"time"
+)
+
+// Returned when a payment would take its recipient above the maximum balance of its type of account
+var ErrBalanceCapExceeded = newError(BALANCE_CAP_EXCEEDED, "Payment would take the recipient above its maximum balance")
+
+// All of the types of accounts balance caps are set for
+type AccountType string
+
+const (
+	PERSONAL_ACCOUNT AccountType = "personal"
+	JOINT_ACCOUNT    AccountType = "joint"
+	MERCHANT_ACCOUNT AccountType = "merchant"
+	WALLET_ACCOUNT   AccountType = "wallet"
+)
+
+// Returns the type of an account, wallets first since they can belong to any other type
+func (a *Account) accountType() AccountType {
+	switch {
+	case a.parent != nil:
+		return WALLET_ACCOUNT
+	case a.merchant:
+		return MERCHANT_ACCOUNT
+	case len(a.owners) > 1:
+		return JOINT_ACCOUNT
+	default:
+		return PERSONAL_ACCOUNT
+	}
+}
+
+// Refuses to credit amount to an account when it would take it above the cap of its type of account
+// The service's own accounts, e.g. fee and tax accounts, are never capped
+func (s *Service) checkBalanceCap(ctx context.Context, a *Account, amount uint32) error {
+	if s.houseAccount(a) {
+		return nil
+	}
+
+	s.mu.RLock()
+	limit, ok := s.balanceCaps[a.accountType()]
+	balances := s.balances
+	s.mu.RUnlock()
+
+	if !ok {
+		return nil
+	}
+
+	balance, err := balancesOrLocal(balances).balance(ctx, a)
+
+	if err != nil {
+		return err
+	}
+
+	if uint64(balance)+uint64(amount) > uint64(limit) {
+		return ErrBalanceCapExceeded
+	}
+
+	return nil
+}
+
+// Sets the most an account of a type can hold, zero removes the cap
+func (s *Service) SetBalanceCap(role Role, accountType AccountType, limit uint32) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if limit == 0 {
+		delete(s.balanceCaps, accountType)
+		return nil
+	}
+
+	s.balanceCaps[accountType] = limit
+
+	return nil
+}
+
+// Models a payment at or above the regulatory threshold, as handed to compliance teams
+type ThresholdReport struct {
+	Tenant        TenantID      `json:"tenant"`
+	TransactionID uint32        `json:"transaction_id"`
+	Sender        uint32        `json:"sender"`
+	SenderName    string        `json:"sender_name"`
+	Recipient     uint32        `json:"recipient"`
+	RecipientName string        `json:"recipient_name"`
+	Amount        uint32        `json:"amount"`
+	Currency      string        `json:"currency,omitempty"`
+	Method        PaymentMethod `json:"method"`
+	ClosedAt      time.Time     `json:"closed_at"`
+	// Threshold in force when the payment was made
+	Threshold uint32 `json:"threshold"`
+}
+
+// Files a threshold report for a closed payment at or above the reporting threshold
+// Failures to store the report are logged, the payment already went through
+func (s *Service) reportThreshold(t *Transaction) {
+	s.mu.RLock()
+	threshold := s.reportingThreshold
+	s.mu.RUnlock()
+
+	if threshold == 0 || t.amount < threshold {
+		return
+	}
+
+	report := &ThresholdReport{
+		Tenant:        t.tenant,
+		TransactionID: t.id,
+		Sender:        t.sender.id,
+		SenderName:    t.sender.name,
+		Recipient:     t.recipient.id,
+		RecipientName: t.recipient.name,
+		Amount:        t.amount,
+		Currency:      t.sender.currency,
+		Method:        t.paymentMethod,
+		ClosedAt:      t.closedAt,
+		Threshold:     threshold,
+	}
+
+	if err := s.thresholdReports.save(report); err != nil {
+		log.Println(err)
+	}
+}
+
+// Sets the amount from which payments are reported to compliance, zero stops reporting
+func (s *Service) SetReportingThreshold(role Role, amount uint32) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reportingThreshold = amount
+
+	return nil
+}
+
+// Returns the threshold reports of a tenant's payments closed in [from, to)
+func (s *Service) ThresholdReports(role Role, tenant TenantID, from time.Time, to time.Time) ([]*ThresholdReport, error) {
+	if err := authorize(role, READ); err != nil {
+		return nil, err
+	}
+
+	return query(s.thresholdReports, func(r *ThresholdReport) bool {
+		return r.Tenant == tenant && !r.ClosedAt.Before(from) && r.ClosedAt.Before(to)
+	})
+}
+
+// Writes the threshold reports of a tenant's payments closed in [from, to) as newline delimited JSON
+func (s *Service) ExportThresholdReports(role Role, tenant TenantID, from time.Time, to time.Time, w io.Writer) error {
+	reports, err := s.ThresholdReports(role, tenant, from, to)
+
+	if err != nil {
+		return err
+	}
+
+	out := json.NewEncoder(w)
+
+	for _, r := range reports {
+		if err := out.Encode(r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Returned when a payment is waiting for the payer to confirm it
+var ErrConfirmationRequired = newError(CONFIRMATION_REQUIRED, "Transaction requires confirmation")
+
+// Interface for the second step a payer goes through before a large payment
+type Confirmer interface {
+	// Checks the code provided by the payer
+	// Returns an error if it doesn't confirm the transaction
+	verify(t *Transaction, code string) error
+}
+
+// Confirms transactions with time-based one-time passwords (RFC 6238)
+type TOTPConfirmer struct {
+	secret []byte
+	period time.Duration
+	digits int
+	// Number of periods before and after the current one that are still accepted
+	skew int
+	now  func() time.Time
+}
+
+// Creates a confirmer for six digit codes that change every thirty seconds
+func NewTOTPConfirmer(secret []byte) *TOTPConfirmer {
+	return &TOTPConfirmer{
+		secret: secret,
+		period: 30 * time.Second,
+		digits: 6,
+		skew:   1,
+		now:    time.Now,
+	}
+}
+
+func (c *TOTPConfirmer) verify(t *Transaction, code string) error {
+	counter := c.now().Unix() / int64(c.period/time.Second)
+
+	for i := -c.skew; i <= c.skew; i++ {
+		if hmac.Equal([]byte(c.code(counter+int64(i))), []byte(code)) {
+			return nil
+		}
+	}
+
+	return newError(CONFIRMATION_FAILED, "Invalid confirmation code")
+}
+
+// Computes the code for one time step
+func (c *TOTPConfirmer) code(counter int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+
+	mac := hmac.New(sha1.New, c.secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < c.digits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", c.digits, value%mod)
+}
+
+// Confirms transactions by asking an external approver, e.g. a push notification
+type ApprovalConfirmer struct {
+	approve func(t *Transaction) bool
+}
+
+func (c *ApprovalConfirmer) verify(t *Transaction, code string) error {
+	if !c.approve(t) {
+		return newError(CONFIRMATION_FAILED, "Transaction was not approved")
+	}
+
+	return nil
+}
+
+// Settings for when payments need a second confirmation
+type ConfirmationPolicy struct {
+	// Payments above this amount must be confirmed
+	threshold uint32
+	// How long a payer has to confirm before the transaction goes back to OPEN
+	timeout   time.Duration
+	confirmer Confirmer
+}
+
+// Holds large payments until they are confirmed, then hands them to the next handler
+type ConfirmingTransactionHandler struct {
+	next   TransactionHandler
+	policy ConfirmationPolicy
+	now    func() time.Time
+}
+
+// Wraps a handler so payments above the policy threshold require confirmation
+func withConfirmation(next TransactionHandler, policy ConfirmationPolicy, now func() time.Time) *ConfirmingTransactionHandler {
+	return &ConfirmingTransactionHandler{next: next, policy: policy, now: now}
+}
+
+// Asks for confirmation of large payments, small ones are paid right away
+func (th *ConfirmingTransactionHandler) pay(ctx context.Context, t *Transaction) error {
+	if t.amount <= th.policy.threshold {
+		return th.next.pay(ctx, t)
+	}
+
+	if t.state == PENDING_CONFIRMATION && !th.timedOut(t) {
+		return ErrConfirmationRequired
+	}
+
+	if t.state != OPEN && t.state != PENDING_CONFIRMATION {
+		return th.next.pay(ctx, t)
+	}
+
+	if err := t.transition(PENDING_CONFIRMATION); err != nil {
+		return err
+	}
+
+	t.confirmationRequestedAt = th.now()
+
+	return ErrConfirmationRequired
+}
+
+// Checks the payer's code and, if valid, pays the transaction
+func (th *ConfirmingTransactionHandler) confirm(ctx context.Context, t *Transaction, code string) error {
+	if t.state != PENDING_CONFIRMATION {
+		return newError(INVALID_STATE, "Transaction is not waiting for confirmation")
+	}
+
+	if th.timedOut(t) {
+		if err := t.transition(OPEN); err != nil {
+			return err
+		}
+		return newError(CONFIRMATION_FAILED, "Confirmation timed out")
+	}
+
+	if err := th.policy.confirmer.verify(t, code); err != nil {
+		return err
+	}
+
+	if err := t.transition(OPEN); err != nil {
+		return err
+	}
+
+	return th.next.pay(ctx, t)
+}
+
+// Checks if the payer took too long to confirm
+func (th *ConfirmingTransactionHandler) timedOut(t *Transaction) bool {
+	return th.now().Sub(t.confirmationRequestedAt) > th.policy.timeout
+}
+
+// Puts every payment of a tenant whose payer took too long to confirm back to OPEN, and returns them
+// Their promo code uses are given back, the payments have to be paid again from the start
+func (s *Service) ExpireConfirmations(ctx context.Context, role Role, tenant TenantID) ([]*Transaction, error) {
+	if err := authorize(role, PAY); err != nil {
+		return nil, err
+	}
+
+	transactions, err := s.repository.listTransactions(tenant)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []*Transaction
+
+	for _, t := range transactions {
+		timedOut, err := s.expireConfirmation(ctx, t)
+
+		if err != nil {
+			return expired, err
+		}
+
+		if timedOut {
+			expired = append(expired, t)
+		}
+	}
+
+	return expired, nil
+}
+
+// Puts a payment back to OPEN if it's waiting for a confirmation that timed out
+// The state is checked under the payment's locks, so a confirmation running at the same time wins or loses as a whole
+func (s *Service) expireConfirmation(ctx context.Context, t *Transaction) (bool, error) {
+	_, release, err := s.lockAccounts(ctx, s.paymentAccounts(t)...)
+
+	if err != nil {
+		return false, err
+	}
+
+	defer release()
+
+	th, ok := t.transactionHandler.(*ConfirmingTransactionHandler)
+
+	if !ok || t.state != PENDING_CONFIRMATION || !th.timedOut(t) {
+		return false, nil
+	}
+
+	if err := t.transition(OPEN); err != nil {
+		return false, err
+	}
+
+	s.releasePromoCode(t)
+	s.save(t)
+
+	return true, nil
+}
+
+// Confirms a transaction that is waiting for the payer's second factor
+func (t *Transaction) confirmPayment(ctx context.Context, code string) error {
+	th, ok := t.transactionHandler.(*ConfirmingTransactionHandler)
+
+	if !ok {
+		return newError(INVALID_STATE, "Transaction doesn't require confirmation")
+	}
+
+	return th.confirm(ctx, t, code)
+}
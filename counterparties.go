@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/url"
+	"time"
+)
+
+// Models how an account sees someone it transacts with, visible only to that account
+type CounterpartyProfile struct {
+	nickname string
+	// URL of a picture shown next to the counterparty
+	avatar string
+}
+
+// Returns the name an account shows for a counterparty, its nickname when it has one
+func (a *Account) displayName(counterparty *Account) string {
+	if p, ok := a.counterparties[counterparty.id]; ok && p.nickname != "" {
+		return p.nickname
+	}
+
+	return counterparty.name
+}
+
+// Sets the nickname and avatar an account shows for a counterparty, both empty forget them
+func (s *Service) SetCounterpartyProfile(role Role, a *Account, counterparty *Account, nickname string, avatar string) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	if a.tenant != counterparty.tenant {
+		return ErrCrossTenant
+	}
+
+	if avatar != "" {
+		u, err := url.Parse(avatar)
+
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return newError(INVALID_ARGUMENT, "Avatars must be http or https URLs")
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if nickname == "" && avatar == "" {
+		delete(a.counterparties, counterparty.id)
+		return nil
+	}
+
+	if a.counterparties == nil {
+		a.counterparties = map[uint32]CounterpartyProfile{}
+	}
+
+	a.counterparties[counterparty.id] = CounterpartyProfile{nickname: nickname, avatar: avatar}
+
+	return nil
+}
+
+// Returns the payments an account made or received between from and to, oldest first
+// Counterparties are shown the way the account sees them
+func (s *Service) History(role Role, a *Account, from time.Time, to time.Time) ([]StatementEntry, error) {
+	if err := authorize(role, READ); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.accountEntries(a, from, to)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"slices"
+	"time"
+)
+
+// Models a case where the credit surcharge is waived
+// A rule waives the surcharge when every field it sets matches the transaction
+type CreditWaiverRule struct {
+	Name string `json:"name"`
+	// Categories of the merchants whose payments are waived, empty for every payment
+	// The category is the one set on the recipient, the payer's own t.category can't earn a waiver
+	Categories []Category `json:"categories,omitempty"`
+	// Grace period the rule applies in, zero bounds are open
+	From time.Time `json:"from,omitempty"`
+	To   time.Time `json:"to,omitempty"`
+	// Tenant the rule applies to, empty for every tenant
+	Tenant TenantID `json:"tenant,omitempty"`
+}
+
+// Checks if a rule waives the surcharge of a transaction made at a time
+func (r CreditWaiverRule) waives(t *Transaction, at time.Time) bool {
+	if len(r.Categories) > 0 && (!t.recipient.merchant || !slices.Contains(r.Categories, t.recipient.merchantCategory)) {
+		return false
+	}
+
+	if !r.From.IsZero() && at.Before(r.From) {
+		return false
+	}
+
+	if !r.To.IsZero() && !at.Before(r.To) {
+		return false
+	}
+
+	return r.Tenant == "" || r.Tenant == t.tenant
+}
+
+// Rules deciding when credit payments are free of the surcharge
+type CreditWaiverRules struct {
+	Rules []CreditWaiverRule `json:"rules"`
+}
+
+// Reads waiver rules from a JSON config, e.g. {"rules": [{"name": "groceries", "categories": ["groceries"]}]}
+func LoadCreditWaiverRules(r io.Reader) (*CreditWaiverRules, error) {
+	var rules CreditWaiverRules
+
+	if err := json.NewDecoder(r).Decode(&rules); err != nil {
+		return nil, err
+	}
+
+	for _, rule := range rules.Rules {
+		if !rule.From.IsZero() && !rule.To.IsZero() && !rule.From.Before(rule.To) {
+			return nil, newError(INVALID_ARGUMENT, "Waiver rules must end after they start")
+		}
+	}
+
+	return &rules, nil
+}
+
+// Returns the first rule waiving the surcharge of a transaction made at a time
+func (rs *CreditWaiverRules) evaluate(t *Transaction, at time.Time) (CreditWaiverRule, bool) {
+	if rs == nil {
+		return CreditWaiverRule{}, false
+	}
+
+	for _, r := range rs.Rules {
+		if r.waives(t, at) {
+			return r, true
+		}
+	}
+
+	return CreditWaiverRule{}, false
+}
+
+// Sets what a merchant sells, which credit waiver rules are matched against
+func (s *Service) SetMerchantCategory(role Role, a *Account, category Category) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	if !a.merchant {
+		return newError(INVALID_ARGUMENT, "Only merchants have a category")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a.merchantCategory = category
+
+	return nil
+}
+
+// Sets the rules waiving the credit surcharge, nil charges it on every credit payment
+func (s *Service) SetCreditWaiverRules(role Role, rules *CreditWaiverRules) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.creditWaivers = rules
+
+	return nil
+}
+
+// Returns what the sender of a credit transaction would owe if it were paid now, and the rule waiving its surcharge if any
+func (s *Service) CreditCharge(role Role, t *Transaction) (uint32, string, error) {
+	if err := authorize(role, READ); err != nil {
+		return 0, "", err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rule, waived := s.creditWaivers.evaluate(t, s.now())
+
+	return creditCharge(t, s.roundingFor(CREDIT), waived), rule.Name, nil
+}
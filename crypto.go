@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Returned while a crypto payment waits for funds to reach the deposit address
+var ErrAwaitingChain = newError(CHAIN_CONFIRMATIONS_PENDING, "Transaction is waiting for funds on the chain")
+
+// Interface for watching a blockchain for deposits
+type ChainWatcher interface {
+	// Returns a fresh address the payer sends a transaction's funds to
+	newAddress(ctx context.Context, t *Transaction) (string, error)
+	// Returns the confirmations of the deepest transfer of at least amount to address, zero when none was seen
+	confirmations(ctx context.Context, address string, amount uint32) (uint32, error)
+}
+
+// Models how crypto payments are tracked
+type CryptoPolicy struct {
+	watcher ChainWatcher
+	// Confirmations needed before the recipient is credited
+	required uint32
+	// How long the payer has to send the funds
+	expiry time.Duration
+}
+
+// Models dependencies used to pay a transaction of type crypto
+type CryptoTransactionHandler struct {
+	policy *CryptoPolicy
+	now    func() time.Time
+}
+
+// Handles transactions of type crypto
+// Hands out a deposit address and leaves the transaction waiting, TrackCryptoPayments closes it
+func (th *CryptoTransactionHandler) pay(ctx context.Context, t *Transaction) error {
+	if t.sender.id == t.recipient.id {
+		return ErrSelfTransfer
+	}
+
+	if t.state == CLOSED {
+		return ErrTransactionClosed
+	}
+
+	if t.state == EXPIRED {
+		return ErrTransactionExpired
+	}
+
+	if t.state == CANCELLED {
+		return ErrTransactionCancelled
+	}
+
+	if t.state == AWAITING_CHAIN {
+		return ErrAwaitingChain
+	}
+
+	if err := t.checkTransition(AWAITING_CHAIN); err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	address, err := th.policy.watcher.newAddress(ctx, t)
+
+	if err != nil {
+		return err
+	}
+
+	t.depositAddress = address
+	t.depositExpiresAt = th.now().Add(th.policy.expiry)
+
+	if err := t.transition(AWAITING_CHAIN); err != nil {
+		return err
+	}
+
+	return ErrAwaitingChain
+}
+
+// Closes the crypto payments of a tenant whose deposits are confirmed, and expires the ones past their deadline
+// Returns the transactions that were closed or expired
+func (s *Service) TrackCryptoPayments(ctx context.Context, role Role, tenant TenantID) ([]*Transaction, error) {
+	if err := authorize(role, PAY); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	policy, balances := s.crypto, s.balances
+	s.mu.RUnlock()
+
+	if policy == nil {
+		return nil, newError(MISCONFIGURED, "Crypto transactions require a chain watcher")
+	}
+
+	transactions, err := s.repository.listTransactions(tenant)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var done []*Transaction
+
+	for _, t := range transactions {
+		// The chain is asked without holding the locks, the state is checked again before anything moves
+		_, release, err := s.lockAccounts(ctx, t.sender, t.recipient)
+
+		if err != nil {
+			return done, err
+		}
+
+		waiting, address := t.state == AWAITING_CHAIN, t.depositAddress
+		release()
+
+		if !waiting {
+			continue
+		}
+
+		confirmations, err := policy.watcher.confirmations(ctx, address, t.amount)
+
+		if err != nil {
+			return done, err
+		}
+
+		tracked, err := s.trackCryptoPayment(ctx, balances, t, confirmations >= policy.required)
+
+		if err != nil {
+			return done, err
+		}
+
+		if tracked {
+			done = append(done, t)
+		}
+	}
+
+	return done, nil
+}
+
+// Closes a crypto payment whose deposit is confirmed, or expires it when it is past its deadline
+// The state is checked again under the payment's locks, so concurrent runs can't both credit the recipient
+// Returns whether the payment was closed or expired
+func (s *Service) trackCryptoPayment(ctx context.Context, balances BalanceProvider, t *Transaction, confirmed bool) (bool, error) {
+	ctx, release, err := s.lockAccounts(ctx, s.paymentAccounts(t)...)
+
+	if err != nil {
+		return false, err
+	}
+
+	defer release()
+
+	if t.state != AWAITING_CHAIN {
+		return false, nil
+	}
+
+	if confirmed {
+		return true, s.settleInbound(ctx, balances, t)
+	}
+
+	if !s.now().After(t.depositExpiresAt) {
+		return false, nil
+	}
+
+	if err := t.transition(EXPIRED); err != nil {
+		return false, err
+	}
+
+	s.releasePromoCode(t)
+	s.save(t)
+	s.notify(ctx, TRANSACTION_EXPIRED, t, "")
+
+	return true, nil
+}
+
+// Credits the recipient of a payment whose funds came in from outside the service, e.g. from the chain or a card gateway
+// Takes the payment's account locks, or reuses them when the caller holds them
+// Only payments still waiting for the chain or the gateway are credited, once
+func (s *Service) settleInbound(ctx context.Context, balances BalanceProvider, t *Transaction) error {
+	ctx, release, err := s.lockAccounts(ctx, s.paymentAccounts(t)...)
+
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
+	if t.state != AWAITING_CHAIN && t.state != AWAITING_GATEWAY {
+		return newError(INVALID_STATE, "Transaction is not waiting for inbound funds")
+	}
+
+	senderBefore, recipientBefore := t.sender.balance, t.recipient.balance
+
+	if err := t.checkTransition(CLOSED); err != nil {
+		return err
+	}
+
+	// The recipient may have been credited since the payment was accepted
+	if err := s.checkBalanceCap(ctx, t.recipient, t.amount); err != nil {
+		return err
+	}
+
+	journalCtx, sequence, err := s.journalBegin(ctx, t)
+
+	if err != nil {
+		return err
+	}
+
+	err = moveFunds(journalCtx, balancesOrLocal(balances), nil, []fundsLeg{{account: t.recipient, amount: t.amount}})
+
+	if err == nil {
+		err = t.transition(CLOSED)
+		t.closedAt = s.now()
+	}
+
+	s.save(t)
+	s.journalEnd(sequence, err)
+
+	if err != nil {
+		return err
+	}
+
+	s.afterPayment(ctx, t, senderBefore, recipientBefore)
+
+	return nil
+}
+
+// Turns crypto payments on, tracked by policy, or off when it's nil
+func (s *Service) SetCryptoPolicy(role Role, policy *CryptoPolicy) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.crypto = policy
+
+	return nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How many recent events and failed payments the dashboard shows
+const dashboardHistory = 10
+
+// Moves the cursor of an ANSI terminal to the top left corner and clears the screen
+const clearScreen = "\x1b[H\x1b[2J"
+
+// Terminal view of a tenant's balances, the processor queue, recent events and failed payments
+// Sits in front of the service's event publisher, events still reach the publisher it replaced
+type Dashboard struct {
+	service *Service
+	// Nil when payments aren't queued, the queue isn't shown then
+	processor *Processor
+	tenant    TenantID
+	out       io.Writer
+
+	mu       sync.Mutex
+	next     EventPublisher
+	events   []Event
+	failures []Event
+}
+
+// Creates a dashboard of a tenant that draws to out
+func NewDashboard(s *Service, p *Processor, tenant TenantID, out io.Writer) *Dashboard {
+	return &Dashboard{service: s, processor: p, tenant: tenant, out: out}
+}
+
+func (d *Dashboard) publish(e Event) {
+	d.mu.Lock()
+	d.events = keepRecent(d.events, e)
+
+	if e.kind == TRANSACTION_FAILED {
+		d.failures = keepRecent(d.failures, e)
+	}
+
+	next := d.next
+	d.mu.Unlock()
+
+	if next != nil {
+		next.publish(e)
+	}
+}
+
+// Appends an event, dropping the oldest ones past the dashboard history
+func keepRecent(events []Event, e Event) []Event {
+	events = append(events, e)
+
+	if len(events) > dashboardHistory {
+		events = events[len(events)-dashboardHistory:]
+	}
+
+	return events
+}
+
+// Redraws the dashboard every interval until ctx is done, then gives the service its publisher back
+func (d *Dashboard) Run(ctx context.Context, role Role, interval time.Duration) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	d.service.mu.RLock()
+	previous := d.service.events
+	d.service.mu.RUnlock()
+
+	d.mu.Lock()
+	d.next = previous
+	d.mu.Unlock()
+
+	if err := d.service.SetEventPublisher(role, d); err != nil {
+		return err
+	}
+
+	defer d.service.SetEventPublisher(role, previous)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := d.render(ctx, role); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Draws the whole dashboard once
+func (d *Dashboard) render(ctx context.Context, role Role) error {
+	accounts, err := d.service.Accounts(role, d.tenant)
+
+	if err != nil {
+		return err
+	}
+
+	slices.SortFunc(accounts, func(a, b *Account) int { return int(a.id) - int(b.id) })
+
+	var b strings.Builder
+	b.WriteString(clearScreen)
+	fmt.Fprintf(&b, "dip  tenant %q  %s\n\nACCOUNTS\n", d.tenant, d.service.now().Format(time.TimeOnly))
+
+	for _, a := range accounts {
+		balance, err := d.service.Balance(ctx, role, a)
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(&b, "  %3d  %-24s %16s\n", a.id, d.service.Redact(PII_NAME, a.name), NewMoney(int64(balance), a.currency).Format(defaultLocale))
+	}
+
+	if d.processor != nil {
+		stats := d.processor.Stats()
+
+		fmt.Fprintf(&b, "\nQUEUE\n  %d waiting (high %d, normal %d, low %d)\n", stats.depth, stats.queued[HIGH], stats.queued[NORMAL], stats.queued[LOW])
+		fmt.Fprintf(&b, "  %d of %d workers busy, %d paid\n", stats.busy, stats.workers, stats.processed)
+		fmt.Fprintf(&b, "  wait p50 %s p95 %s, latency p50 %s p95 %s\n", stats.waitP50, stats.waitP95, stats.latencyP50, stats.latencyP95)
+	}
+
+	d.mu.Lock()
+	events, failures := slices.Clone(d.events), slices.Clone(d.failures)
+	d.mu.Unlock()
+
+	b.WriteString("\nRECENT EVENTS\n")
+
+	for _, e := range slices.Backward(events) {
+		fmt.Fprintf(&b, "  %s  %-30s %s\n", e.at.Format(time.TimeOnly), e.kind, e.subject())
+	}
+
+	b.WriteString("\nFAILED PAYMENTS\n")
+
+	for _, e := range slices.Backward(failures) {
+		t := e.transaction
+		fmt.Fprintf(&b, "  %s  #%-6d %3d -> %-3d %12s  %s\n", e.at.Format(time.TimeOnly), t.id, t.sender.id, t.recipient.id,
+			NewMoney(int64(t.amount), t.sender.currency).Format(defaultLocale), e.detail)
+	}
+
+	_, err = io.WriteString(d.out, b.String())
+
+	return err
+}
+
+// Describes what an event is about in one line
+func (e Event) subject() string {
+	if e.transaction != nil {
+		return fmt.Sprintf("transaction %d %s", e.transaction.id, e.detail)
+	}
+
+	if e.account != nil {
+		return fmt.Sprintf("account %d %s", e.account.id, e.detail)
+	}
+
+	return fmt.Sprintf("tenant %q %s", e.tenant, e.detail)
+}
+
+// Runs the dashboard over a demo service that keeps paying random transfers, until interrupted
+// Started by passing tui to the binary
+func runDashboard() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	service := NewService(NewMemoryTokenVault(24 * time.Hour))
+	house := &Account{id: 1, name: "House", balance: 100000}
+	accounts := []*Account{
+		{id: 2, name: "Gustavo", balance: 5000},
+		{id: 3, name: "Pedro", balance: 2000},
+		{id: 4, name: "Online store", balance: 500},
+		{id: 5, name: "Coffee shop", balance: 100},
+	}
+
+	service.SetFeeAccount(ADMIN, house)
+
+	// The dashboard shows the events, logging them too would scroll it away
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, a := range append(accounts, house) {
+		if err := service.AddAccount(ADMIN, a); err != nil {
+			return err
+		}
+	}
+
+	processor := NewProcessor(service, 4, time.Second)
+	defer processor.Close()
+
+	go func() {
+		for ctx.Err() == nil {
+			from, to := accounts[rand.Intn(len(accounts))], accounts[rand.Intn(len(accounts))]
+			priority := priorities[rand.Intn(len(priorities))]
+			t, err := service.NewTransfer().From(from).To(to).Amount(uint32(rand.Intn(900) + 1)).Via(CASH).WithPriority(priority).Build()
+
+			if err == nil {
+				processor.Submit(ctx, OPERATOR, t)
+			}
+
+			time.Sleep(200 * time.Millisecond)
+		}
+	}()
+
+	return NewDashboard(service, processor, "", os.Stdout).Run(ctx, ADMIN, time.Second)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Models an amount an account locks away until a maturity date in exchange for interest
+type Deposit struct {
+	id      uint32
+	account *Account
+	amount  uint32
+	// Interest paid at each maturity, in hundredths of a percent of the amount
+	basisPoints uint32
+	term        time.Duration
+	maturity    time.Time
+	// Locks the amount for another term at maturity instead of paying it out
+	autoRenew bool
+	// Share of the amount kept by the house on early withdrawal, in hundredths of a percent
+	penaltyBasisPoints uint32
+	closed             bool
+}
+
+// Locks part of an account's balance until the deposit matures
+// The house holds the amount in the meantime, it's posted there and back like any other transfer
+func (s *Service) OpenDeposit(ctx context.Context, role Role, a *Account, amount uint32, basisPoints uint32, term time.Duration, autoRenew bool, penaltyBasisPoints uint32) (*Deposit, error) {
+	if err := authorize(role, PAY); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	house, ok := s.feeAccounts[a.tenant]
+	s.lastDepositID++
+	d := &Deposit{
+		id:                 s.lastDepositID,
+		account:            a,
+		amount:             amount,
+		basisPoints:        basisPoints,
+		term:               term,
+		maturity:           s.now().Add(term),
+		autoRenew:          autoRenew,
+		penaltyBasisPoints: penaltyBasisPoints,
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		return nil, ErrNoFeeAccount
+	}
+
+	ctx, release, err := s.lockAccounts(ctx, a, house)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer release()
+
+	id := strconv.FormatUint(uint64(d.id), 10)
+
+	if _, err := s.postTransfer(ctx, a, house, amount, map[string]string{"deposit_opened": id}); err != nil {
+		if errors.Is(err, ErrInsufficientFunds) {
+			return nil, newError(INSUFFICIENT_FUNDS, "Account doesn't have enough balance to open the deposit")
+		}
+
+		return nil, err
+	}
+
+	if err := s.deposits.save(d); err != nil {
+		if _, undo := s.postTransfer(context.WithoutCancel(ctx), house, a, amount, map[string]string{"deposit_released": id}); undo != nil {
+			return nil, errors.Join(err, undo)
+		}
+
+		return nil, err
+	}
+
+	a.lockedBalance += amount
+
+	return d, nil
+}
+
+// Pays interest on every matured deposit, then renews or releases it
+func (s *Service) ProcessMaturedDeposits(ctx context.Context, role Role) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	now := s.now()
+
+	s.mu.RLock()
+	matured, err := query(s.deposits, func(d *Deposit) bool {
+		return !d.closed && !d.maturity.After(now)
+	})
+	s.mu.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+
+	for _, d := range matured {
+		// Moving the maturity on claims the term, so a run overlapping this one doesn't pay it again
+		s.mu.Lock()
+		claimed := !d.closed && !d.maturity.After(now)
+		previous := d.maturity
+		if claimed {
+			d.maturity = d.maturity.Add(d.term)
+		}
+		s.mu.Unlock()
+
+		if !claimed {
+			continue
+		}
+
+		if err := s.payDepositInterest(ctx, d); err != nil {
+			s.mu.Lock()
+			d.maturity = previous
+			s.mu.Unlock()
+			errs = append(errs, err)
+			continue
+		}
+
+		// A deposit that can't be released stays locked for the next term
+		if !d.autoRenew {
+			if err := s.releaseDeposit(ctx, d); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Releases a deposit before it matures, keeping the penalty for the house
+func (s *Service) WithdrawDepositEarly(ctx context.Context, role Role, d *Deposit) error {
+	if err := authorize(role, PAY); err != nil {
+		return err
+	}
+
+	if err := s.releaseDeposit(ctx, d); err != nil {
+		return err
+	}
+
+	penalty := s.defaultRounding().share(d.amount, d.penaltyBasisPoints)
+
+	if penalty == 0 {
+		return nil
+	}
+
+	s.mu.RLock()
+	house, ok := s.feeAccounts[d.account.tenant]
+	s.mu.RUnlock()
+
+	if !ok {
+		return ErrNoFeeAccount
+	}
+
+	metadata := map[string]string{"deposit_penalty": strconv.FormatUint(uint64(d.id), 10)}
+	_, err := s.postTransfer(ctx, d.account, house, penalty, metadata)
+
+	return err
+}
+
+// Posts a deposit's amount from the house back to the account and closes the deposit
+func (s *Service) releaseDeposit(ctx context.Context, d *Deposit) error {
+	s.mu.Lock()
+	if d.closed {
+		s.mu.Unlock()
+		return newError(INVALID_STATE, "Deposit is already closed")
+	}
+	d.closed = true
+	house, ok := s.feeAccounts[d.account.tenant]
+	s.mu.Unlock()
+
+	if !ok {
+		s.reopenDeposit(d)
+		return ErrNoFeeAccount
+	}
+
+	ctx, release, err := s.lockAccounts(ctx, d.account, house)
+
+	if err != nil {
+		s.reopenDeposit(d)
+		return err
+	}
+
+	defer release()
+
+	metadata := map[string]string{"deposit_released": strconv.FormatUint(uint64(d.id), 10)}
+
+	if _, err := s.postTransfer(ctx, house, d.account, d.amount, metadata); err != nil {
+		s.reopenDeposit(d)
+		return err
+	}
+
+	d.account.lockedBalance -= d.amount
+
+	if err := s.deposits.save(d); err != nil {
+		log.Println(err)
+	}
+
+	return nil
+}
+
+// Marks a deposit open again after releasing it failed
+func (s *Service) reopenDeposit(d *Deposit) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d.closed = false
+}
+
+// Pays a deposit's interest from the house to the account
+func (s *Service) payDepositInterest(ctx context.Context, d *Deposit) error {
+	interest := s.defaultRounding().share(d.amount, d.basisPoints)
+
+	if interest == 0 {
+		return nil
+	}
+
+	s.mu.RLock()
+	house, ok := s.feeAccounts[d.account.tenant]
+	s.mu.RUnlock()
+
+	if !ok {
+		return ErrNoFeeAccount
+	}
+
+	metadata := map[string]string{"deposit_interest": strconv.FormatUint(uint64(d.id), 10)}
+	_, err := s.postTransfer(ctx, house, d.account, interest, metadata)
+
+	return err
+}
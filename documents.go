@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Returned when a document logo isn't a JPEG image
+var ErrInvalidLogo = newError(INVALID_ARGUMENT, "Logo must be a JPEG image")
+
+// Models who customer-facing documents come from, drawn at the top and bottom of their pages
+type DocumentBranding struct {
+	name string
+	// Lines under the name, e.g. the address and tax id
+	details []string
+	// JPEG drawn at the top right of the first page, nil for none
+	logo   []byte
+	footer string
+}
+
+// Models how a tenant's documents look
+// Templates render the lines of the body, see renderPDF for how lines are laid out
+type DocumentStyle struct {
+	branding  DocumentBranding
+	statement *template.Template
+	receipt   *template.Template
+}
+
+// Lays out a monthly statement, fed a statementDocument
+var defaultStatementTemplate = template.Must(template.New("statement").Parse(`# Statement
+Account: {{.Account}}
+Period:  {{.Period}}
+---
+{{printf "%-10s  %11s  %-24s  %16s" "Date" "Transaction" "Counterparty" "Amount"}}
+{{range .Entries}}{{printf "%-10s  %11d  %-24.24s  %16s" .Date .Transaction .Counterparty .Amount}}
+{{end}}---
+Received: {{.Received}}
+Sent:     {{.Sent}}
+`))
+
+// Lays out the receipt of a payment, fed a receiptDocument
+var defaultReceiptTemplate = template.Must(template.New("receipt").Parse(`# Receipt
+Transaction: {{.Transaction}}
+Paid at:     {{.PaidAt}}
+From:        {{.From}}
+To:          {{.To}}
+{{with .Reference}}Reference:   {{.}}
+{{end}}{{with .Memo}}Memo:        {{.}}
+{{end}}---
+Amount:      {{.Amount}}
+{{with .Fee}}Fee:         {{.}}
+{{end}}`))
+
+// Creates a style with the default templates for documents from a company
+func NewDocumentStyle(name string) *DocumentStyle {
+	return &DocumentStyle{
+		branding:  DocumentBranding{name: name},
+		statement: defaultStatementTemplate,
+		receipt:   defaultReceiptTemplate,
+	}
+}
+
+// Style of tenants that didn't set one, documents carry no branding
+var defaultDocumentStyle = NewDocumentStyle("")
+
+// Sets the lines drawn under the company name
+func (d *DocumentStyle) Details(lines ...string) *DocumentStyle {
+	d.branding.details = lines
+	return d
+}
+
+// Sets the JPEG drawn at the top right of the first page
+func (d *DocumentStyle) Logo(jpeg []byte) *DocumentStyle {
+	d.branding.logo = jpeg
+	return d
+}
+
+// Sets the text at the bottom of every page
+func (d *DocumentStyle) Footer(text string) *DocumentStyle {
+	d.branding.footer = text
+	return d
+}
+
+// Replaces the template monthly statements are laid out with
+func (d *DocumentStyle) StatementTemplate(t *template.Template) *DocumentStyle {
+	d.statement = t
+	return d
+}
+
+// Replaces the template receipts are laid out with
+func (d *DocumentStyle) ReceiptTemplate(t *template.Template) *DocumentStyle {
+	d.receipt = t
+	return d
+}
+
+// Values statement templates are fed, amounts already formatted in the account's locale
+type statementDocument struct {
+	Account  string
+	Period   string
+	Entries  []statementDocumentEntry
+	Received string
+	Sent     string
+}
+
+type statementDocumentEntry struct {
+	Date         string
+	Transaction  uint32
+	Counterparty string
+	Memo         string
+	Amount       string
+}
+
+// Values receipt templates are fed, amounts already formatted in the payer's locale
+type receiptDocument struct {
+	Transaction uint32
+	PaidAt      string
+	From        string
+	To          string
+	Reference   string
+	Memo        string
+	Amount      string
+	// Empty when no fee was charged
+	Fee string
+}
+
+// Renders a template and lays out its lines in the style's branding
+func (d *DocumentStyle) render(t *template.Template, data any) ([]byte, error) {
+	var body bytes.Buffer
+
+	if err := t.Execute(&body, data); err != nil {
+		return nil, err
+	}
+
+	return renderPDF(strings.Split(strings.TrimRight(body.String(), "\n"), "\n"), d.branding)
+}
+
+// Renders a monthly statement as a PDF
+func (st *MonthlyStatement) pdf(style *DocumentStyle) ([]byte, error) {
+	money := func(amount int64) string {
+		return NewMoney(amount, st.account.currency).Format(st.account.locale)
+	}
+
+	doc := statementDocument{
+		Account:  st.account.name,
+		Period:   st.period.Format("2006-01"),
+		Received: money(int64(st.received)),
+		Sent:     money(int64(st.sent)),
+	}
+
+	for _, e := range st.entries {
+		doc.Entries = append(doc.Entries, statementDocumentEntry{
+			Date:         e.at.UTC().Format(time.DateOnly),
+			Transaction:  e.transactionID,
+			Counterparty: e.counterparty,
+			Memo:         e.memo,
+			Amount:       money(e.amount),
+		})
+	}
+
+	return style.render(style.statement, doc)
+}
+
+// Returns the style of a tenant's documents
+func (s *Service) documentStyle(tenant TenantID) *DocumentStyle {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if style, ok := s.documentStyles[tenant]; ok {
+		return style
+	}
+
+	return defaultDocumentStyle
+}
+
+// Changes how a tenant's statements and receipts look, nil goes back to the unbranded default
+func (s *Service) SetDocumentStyle(role Role, tenant TenantID, style *DocumentStyle) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	if style != nil && style.branding.logo != nil {
+		if _, _, err := pdfImage(style.branding.logo); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if style == nil {
+		delete(s.documentStyles, tenant)
+		return nil
+	}
+
+	s.documentStyles[tenant] = style
+
+	return nil
+}
+
+// Renders an account's statement for the month period is in as a PDF
+func (s *Service) StatementPDF(role Role, a *Account, period time.Time) ([]byte, error) {
+	if err := authorize(role, READ); err != nil {
+		return nil, err
+	}
+
+	st, err := s.monthlyStatement(a, monthStart(period))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return st.pdf(s.documentStyle(a.tenant))
+}
+
+// Renders the receipt of a paid transaction as a PDF, for the payer
+func (s *Service) ReceiptPDF(role Role, t *Transaction) ([]byte, error) {
+	if err := authorize(role, READ); err != nil {
+		return nil, err
+	}
+
+	if t.state != CLOSED {
+		return nil, newError(INVALID_STATE, "Receipts are only issued for paid transactions")
+	}
+
+	locale := t.preferredLocale()
+	doc := receiptDocument{
+		Transaction: t.id,
+		PaidAt:      t.closedAt.UTC().Format(time.DateTime) + " UTC",
+		From:        t.sender.name,
+		To:          t.sender.displayName(t.recipient),
+		Reference:   t.reference,
+		Memo:        t.memo,
+		Amount:      NewMoney(int64(t.amount), t.sender.currency).Format(locale),
+	}
+
+	if t.fee != 0 {
+		doc.Fee = NewMoney(t.fee, t.sender.currency).Format(locale)
+	}
+
+	style := s.documentStyle(t.tenant)
+
+	return style.render(style.receipt, doc)
+}
@@ -0,0 +1,1148 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Version of the dump format, bumped on any change that isn't backwards compatible
+const DumpSchemaV1 = "dip.dump.v1"
+
+// Wire form of a full dump of the service
+// The checksum is the SHA-256 of the data as encoded in the dump, so truncated or edited dumps are refused
+type DumpV1 struct {
+	Schema     string     `json:"schema"`
+	ExportedAt time.Time  `json:"exported_at"`
+	Checksum   string     `json:"checksum"`
+	Data       DumpDataV1 `json:"data"`
+}
+
+// Records held by a dump, accounts are referred to by tenant and id
+type DumpDataV1 struct {
+	Accounts     []AccountV1     `json:"accounts"`
+	Transactions []TransactionV1 `json:"transactions"`
+	FeeAccounts  []FeeAccountV1  `json:"fee_accounts"`
+	Mandates     []MandateV1     `json:"mandates"`
+	Loans        []LoanV1        `json:"loans"`
+	Deposits     []DepositV1     `json:"deposits"`
+	Statements   []StatementV1   `json:"statements"`
+	Aliases      []AliasV1       `json:"aliases"`
+	// Transactions moved out of the hot repository by ArchiveClosed
+	ArchivedTransactions []TransactionV1    `json:"archived_transactions"`
+	Payouts              []PayoutV1         `json:"payouts"`
+	ThresholdReports     []*ThresholdReport `json:"threshold_reports"`
+	PromoCodes           []PromoCodeV1      `json:"promo_codes"`
+	DayCloses            []DayCloseV1       `json:"day_closes"`
+}
+
+// Wire form of an account, parent is zero for top level accounts
+type AccountV1 struct {
+	Tenant            TenantID            `json:"tenant"`
+	ID                uint32              `json:"id"`
+	Parent            uint32              `json:"parent,omitempty"`
+	Name              string              `json:"name"`
+	Balance           uint32              `json:"balance"`
+	Tags              []string            `json:"tags,omitempty"`
+	Owners            []string            `json:"owners,omitempty"`
+	ApprovalThreshold uint32              `json:"approval_threshold,omitempty"`
+	RequiredApprovals int                 `json:"required_approvals,omitempty"`
+	Email             string              `json:"email,omitempty"`
+	Phone             string              `json:"phone,omitempty"`
+	LockedBalance     uint32              `json:"locked_balance,omitempty"`
+	CreditLimit       uint32              `json:"credit_limit,omitempty"`
+	CreditUsed        uint32              `json:"credit_used,omitempty"`
+	UnbilledCredit    uint32              `json:"unbilled_credit,omitempty"`
+	Merchant          bool                `json:"merchant,omitempty"`
+	MerchantCategory  Category            `json:"merchant_category,omitempty"`
+	Budgets           map[Category]uint32 `json:"budgets,omitempty"`
+	AlertThresholds   []uint32            `json:"alert_thresholds,omitempty"`
+	Locale            Locale              `json:"locale,omitempty"`
+	Currency          string              `json:"currency,omitempty"`
+	Frozen            bool                `json:"frozen,omitempty"`
+	StatementFormat   StatementFormat     `json:"statement_format,omitempty"`
+	// Nil for accounts that get every notification
+	NotificationPreferences *NotificationPreferencesV1 `json:"notification_preferences,omitempty"`
+	// Keyed by the counterparty's account id
+	Counterparties map[uint32]CounterpartyProfileV1 `json:"counterparties,omitempty"`
+}
+
+// Wire form of how an account sees a counterparty
+type CounterpartyProfileV1 struct {
+	Nickname string `json:"nickname,omitempty"`
+	Avatar   string `json:"avatar,omitempty"`
+}
+
+// Wire form of notification preferences, the location is an IANA time zone name
+type NotificationPreferencesV1 struct {
+	Channels  []NotificationChannel `json:"channels,omitempty"`
+	Muted     []NotificationKind    `json:"muted,omitempty"`
+	QuietFrom time.Duration         `json:"quiet_from,omitempty"`
+	QuietTo   time.Duration         `json:"quiet_to,omitempty"`
+	Location  string                `json:"location,omitempty"`
+	MinAmount uint32                `json:"min_amount,omitempty"`
+}
+
+// Wire form of a transaction, sender and recipient are account ids of its tenant
+type TransactionV1 struct {
+	Tenant        TenantID          `json:"tenant"`
+	ID            uint32            `json:"id"`
+	Amount        uint32            `json:"amount"`
+	Sender        uint32            `json:"sender"`
+	Recipient     uint32            `json:"recipient"`
+	State         TransactionState  `json:"state"`
+	Method        PaymentMethod     `json:"method"`
+	CardToken     string            `json:"card_token,omitempty"`
+	InitiatedBy   string            `json:"initiated_by,omitempty"`
+	CancelReason  string            `json:"cancel_reason,omitempty"`
+	CreatedAt     time.Time         `json:"created_at,omitempty"`
+	ClosedAt      time.Time         `json:"closed_at,omitempty"`
+	ExpiresAt     time.Time         `json:"expires_at,omitempty"`
+	Category      Category          `json:"category,omitempty"`
+	Memo          string            `json:"memo,omitempty"`
+	Reference     string            `json:"reference,omitempty"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	Fee           int64             `json:"fee,omitempty"`
+	PromoCode     string            `json:"promo_code,omitempty"`
+	FeeDiscount   uint8             `json:"fee_discount,omitempty"`
+	Approvals     map[string]bool   `json:"approvals,omitempty"`
+	MandateID     uint32            `json:"mandate_id,omitempty"`
+	Locale        Locale            `json:"locale,omitempty"`
+	Reversed      uint32            `json:"reversed,omitempty"`
+	FeeWaived     bool              `json:"fee_waived,omitempty"`
+	SLAFlagged    bool              `json:"sla_flagged,omitempty"`
+	PromoRedeemed bool              `json:"promo_redeemed,omitempty"`
+	HandlerKey    string            `json:"handler_key,omitempty"`
+	ConfirmAsked  time.Time         `json:"confirmation_requested_at,omitempty"`
+}
+
+// Wire form of the fee account of a tenant
+type FeeAccountV1 struct {
+	Tenant  TenantID `json:"tenant"`
+	Account uint32   `json:"account"`
+}
+
+// Wire form of a mandate
+type MandateV1 struct {
+	Tenant   TenantID `json:"tenant"`
+	ID       uint32   `json:"id"`
+	Payer    uint32   `json:"payer"`
+	Merchant uint32   `json:"merchant"`
+	Limit    uint32   `json:"limit"`
+	Revoked  bool     `json:"revoked,omitempty"`
+	Pending  []uint32 `json:"pending,omitempty"`
+}
+
+// Wire form of one installment of a loan
+type InstallmentV1 struct {
+	DueDate   time.Time `json:"due_date"`
+	Principal uint32    `json:"principal"`
+	Interest  uint32    `json:"interest"`
+	Paid      bool      `json:"paid,omitempty"`
+}
+
+// Wire form of a loan
+type LoanV1 struct {
+	Tenant       TenantID        `json:"tenant"`
+	ID           uint32          `json:"id"`
+	Account      uint32          `json:"account"`
+	BasisPoints  uint32          `json:"basis_points"`
+	Principal    uint32          `json:"principal"`
+	Outstanding  uint32          `json:"outstanding"`
+	Installments []InstallmentV1 `json:"installments"`
+	Closed       bool            `json:"closed,omitempty"`
+}
+
+// Wire form of a term deposit, the term is in nanoseconds
+type DepositV1 struct {
+	Tenant             TenantID      `json:"tenant"`
+	ID                 uint32        `json:"id"`
+	Account            uint32        `json:"account"`
+	Amount             uint32        `json:"amount"`
+	BasisPoints        uint32        `json:"basis_points"`
+	Term               time.Duration `json:"term"`
+	Maturity           time.Time     `json:"maturity"`
+	AutoRenew          bool          `json:"auto_renew,omitempty"`
+	PenaltyBasisPoints uint32        `json:"penalty_basis_points,omitempty"`
+	Closed             bool          `json:"closed,omitempty"`
+}
+
+// Wire form of a credit statement
+type StatementV1 struct {
+	Tenant            TenantID  `json:"tenant"`
+	Account           uint32    `json:"account"`
+	ClosedAt          time.Time `json:"closed_at"`
+	DueDate           time.Time `json:"due_date"`
+	Amount            uint32    `json:"amount"`
+	Paid              uint32    `json:"paid,omitempty"`
+	InterestChargedAt time.Time `json:"interest_charged_at,omitempty"`
+}
+
+// Wire form of an alias of an account
+type AliasV1 struct {
+	Tenant  TenantID `json:"tenant"`
+	Alias   string   `json:"alias"`
+	Account uint32   `json:"account"`
+}
+
+// Wire form of a payment counted in a payout
+type PayoutReceiptV1 struct {
+	TransactionID uint32        `json:"transaction_id"`
+	Method        PaymentMethod `json:"method"`
+	Amount        uint32        `json:"amount"`
+}
+
+// Wire form of a payout, the transaction is the sweep, live or archived
+type PayoutV1 struct {
+	Tenant      TenantID          `json:"tenant"`
+	ID          uint32            `json:"id"`
+	Merchant    uint32            `json:"merchant"`
+	Transaction uint32            `json:"transaction"`
+	Receipts    []PayoutReceiptV1 `json:"receipts,omitempty"`
+}
+
+// Wire form of how many times an account redeemed a promo code
+type PromoRedemptionV1 struct {
+	Tenant  TenantID `json:"tenant"`
+	Account uint32   `json:"account"`
+	Uses    int      `json:"uses"`
+}
+
+// Wire form of a promo code
+type PromoCodeV1 struct {
+	Code          string              `json:"code"`
+	Discount      uint8               `json:"discount"`
+	MaxUses       int                 `json:"max_uses,omitempty"`
+	PerAccountCap int                 `json:"per_account_cap,omitempty"`
+	Methods       []PaymentMethod     `json:"methods,omitempty"`
+	ExpiresAt     time.Time           `json:"expires_at,omitempty"`
+	Uses          int                 `json:"uses,omitempty"`
+	Redemptions   []PromoRedemptionV1 `json:"redemptions,omitempty"`
+}
+
+// Wire form of a line of a trial balance
+type TrialBalanceLineV1 struct {
+	Account string `json:"account"`
+	Debits  uint64 `json:"debits"`
+	Credits uint64 `json:"credits"`
+}
+
+// Wire form of an account whose balance moved differently from its postings
+type LedgerBreakV1 struct {
+	Account uint32 `json:"account"`
+	Posted  int64  `json:"posted"`
+	Moved   int64  `json:"moved"`
+}
+
+// Wire form of a day close, the latest one of a tenant is where its ledger is closed
+type DayCloseV1 struct {
+	Tenant       TenantID             `json:"tenant"`
+	From         time.Time            `json:"from"`
+	Cutoff       time.Time            `json:"cutoff"`
+	Lines        []TrialBalanceLineV1 `json:"lines,omitempty"`
+	Debits       uint64               `json:"debits"`
+	Credits      uint64               `json:"credits"`
+	ReconciledAt time.Time            `json:"reconciled_at"`
+	Balances     map[uint32]int64     `json:"balances,omitempty"`
+	Breaks       []LedgerBreakV1      `json:"breaks,omitempty"`
+}
+
+// Returns the checksum of the data of a dump
+func dumpChecksum(data DumpDataV1) (string, error) {
+	encoded, err := json.Marshal(data)
+
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(encoded)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Writes every tenant's accounts, aliases, transactions live and archived, fee accounts, schedules, payouts, reports, promo codes and day closes as a versioned dump
+// Journals, sagas and configuration aren't included, they belong to the deployment rather than its data
+func (s *Service) Export(role Role, w io.Writer) error {
+	if err := authorize(role, READ); err != nil {
+		return err
+	}
+
+	tenants, err := s.repository.tenants()
+
+	if err != nil {
+		return err
+	}
+
+	var data DumpDataV1
+	var transactions []*Transaction
+
+	for _, tenant := range tenants {
+		found, err := s.repository.listTransactions(tenant)
+
+		if err != nil {
+			return err
+		}
+
+		transactions = append(transactions, found...)
+
+		archived, err := s.archive.listArchived(tenant)
+
+		if err != nil {
+			return err
+		}
+
+		for _, t := range archived {
+			data.ArchivedTransactions = append(data.ArchivedTransactions, transactionV1(t))
+		}
+
+		for alias, id := range s.aliases.list(tenant) {
+			data.Aliases = append(data.Aliases, AliasV1{Tenant: tenant, Alias: alias, Account: id})
+		}
+	}
+
+	payouts, err := s.payouts.list()
+
+	if err != nil {
+		return err
+	}
+
+	for _, p := range payouts {
+		wire := PayoutV1{Tenant: p.merchant.tenant, ID: p.id, Merchant: p.merchant.id, Transaction: p.transaction.id}
+		for _, r := range p.receipts {
+			wire.Receipts = append(wire.Receipts, PayoutReceiptV1{TransactionID: r.transactionID, Method: r.method, Amount: r.amount})
+		}
+		data.Payouts = append(data.Payouts, wire)
+	}
+
+	if data.ThresholdReports, err = s.thresholdReports.list(); err != nil {
+		return err
+	}
+
+	dayCloses, err := s.dayCloses.list()
+
+	if err != nil {
+		return err
+	}
+
+	for _, d := range dayCloses {
+		wire := DayCloseV1{Tenant: d.tenant, From: d.from, Cutoff: d.cutoff, Debits: d.debits, Credits: d.credits, ReconciledAt: d.reconciledAt, Balances: d.balances}
+		for _, line := range d.lines {
+			wire.Lines = append(wire.Lines, TrialBalanceLineV1{Account: line.account, Debits: line.debits, Credits: line.credits})
+		}
+		for _, b := range d.breaks {
+			wire.Breaks = append(wire.Breaks, LedgerBreakV1{Account: b.account, Posted: b.posted, Moved: b.moved})
+		}
+		data.DayCloses = append(data.DayCloses, wire)
+	}
+
+	mandates, err := s.mandates.list()
+
+	if err != nil {
+		return err
+	}
+
+	loans, err := s.loans.list()
+
+	if err != nil {
+		return err
+	}
+
+	deposits, err := s.deposits.list()
+
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+
+	for _, tenant := range tenants {
+		accounts, err := s.repository.listAccounts(tenant)
+
+		if err != nil {
+			s.mu.RUnlock()
+			return err
+		}
+
+		for _, a := range accounts {
+			data.Accounts = append(data.Accounts, accountV1(a))
+
+			for _, st := range s.statements[a] {
+				data.Statements = append(data.Statements, StatementV1{
+					Tenant:            a.tenant,
+					Account:           a.id,
+					ClosedAt:          st.closedAt,
+					DueDate:           st.dueDate,
+					Amount:            st.amount,
+					Paid:              st.paid,
+					InterestChargedAt: st.interestChargedAt,
+				})
+			}
+		}
+	}
+
+	for tenant, house := range s.feeAccounts {
+		data.FeeAccounts = append(data.FeeAccounts, FeeAccountV1{Tenant: tenant, Account: house.id})
+	}
+
+	for _, p := range s.promoCodes {
+		wire := PromoCodeV1{Code: p.code, Discount: p.discount, MaxUses: p.maxUses, PerAccountCap: p.perAccountCap, Methods: slices.Clone(p.methods), ExpiresAt: p.expiresAt, Uses: p.uses}
+		for a, uses := range p.redemptions {
+			wire.Redemptions = append(wire.Redemptions, PromoRedemptionV1{Tenant: a.tenant, Account: a.id, Uses: uses})
+		}
+		sort.Slice(wire.Redemptions, func(i, j int) bool {
+			a, b := wire.Redemptions[i], wire.Redemptions[j]
+			return a.Tenant < b.Tenant || a.Tenant == b.Tenant && a.Account < b.Account
+		})
+		data.PromoCodes = append(data.PromoCodes, wire)
+	}
+
+	for _, t := range transactions {
+		data.Transactions = append(data.Transactions, transactionV1(t))
+	}
+
+	for _, m := range mandates {
+		data.Mandates = append(data.Mandates, MandateV1{
+			Tenant:   m.payer.tenant,
+			ID:       m.id,
+			Payer:    m.payer.id,
+			Merchant: m.merchant.id,
+			Limit:    m.limit,
+			Revoked:  m.revoked,
+			Pending:  m.pending,
+		})
+	}
+
+	for _, l := range loans {
+		wire := LoanV1{
+			Tenant:      l.account.tenant,
+			ID:          l.id,
+			Account:     l.account.id,
+			BasisPoints: l.basisPoints,
+			Principal:   l.principal,
+			Outstanding: l.outstanding,
+			Closed:      l.closed,
+		}
+		for _, in := range l.installments {
+			wire.Installments = append(wire.Installments, InstallmentV1{DueDate: in.dueDate, Principal: in.principal, Interest: in.interest, Paid: in.paid})
+		}
+		data.Loans = append(data.Loans, wire)
+	}
+
+	for _, d := range deposits {
+		data.Deposits = append(data.Deposits, DepositV1{
+			Tenant:             d.account.tenant,
+			ID:                 d.id,
+			Account:            d.account.id,
+			Amount:             d.amount,
+			BasisPoints:        d.basisPoints,
+			Term:               d.term,
+			Maturity:           d.maturity,
+			AutoRenew:          d.autoRenew,
+			PenaltyBasisPoints: d.penaltyBasisPoints,
+			Closed:             d.closed,
+		})
+	}
+
+	s.mu.RUnlock()
+
+	data.sort()
+
+	checksum, err := dumpChecksum(data)
+
+	if err != nil {
+		return err
+	}
+
+	return json.NewEncoder(w).Encode(DumpV1{Schema: DumpSchemaV1, ExportedAt: s.now(), Checksum: checksum, Data: data})
+}
+
+// Orders every record by tenant and id, so the same data always gives the same dump
+func (d *DumpDataV1) sort() {
+	sort.Slice(d.Accounts, func(i, j int) bool {
+		a, b := d.Accounts[i], d.Accounts[j]
+		return a.Tenant < b.Tenant || a.Tenant == b.Tenant && a.ID < b.ID
+	})
+	sort.Slice(d.Transactions, func(i, j int) bool {
+		a, b := d.Transactions[i], d.Transactions[j]
+		return a.Tenant < b.Tenant || a.Tenant == b.Tenant && a.ID < b.ID
+	})
+	sort.Slice(d.FeeAccounts, func(i, j int) bool {
+		return d.FeeAccounts[i].Tenant < d.FeeAccounts[j].Tenant
+	})
+	sort.Slice(d.Mandates, func(i, j int) bool { return d.Mandates[i].ID < d.Mandates[j].ID })
+	sort.Slice(d.Loans, func(i, j int) bool { return d.Loans[i].ID < d.Loans[j].ID })
+	sort.Slice(d.Deposits, func(i, j int) bool { return d.Deposits[i].ID < d.Deposits[j].ID })
+	sort.SliceStable(d.Statements, func(i, j int) bool {
+		a, b := d.Statements[i], d.Statements[j]
+		return a.Tenant < b.Tenant || a.Tenant == b.Tenant && a.Account < b.Account
+	})
+	sort.Slice(d.Aliases, func(i, j int) bool {
+		a, b := d.Aliases[i], d.Aliases[j]
+		return a.Tenant < b.Tenant || a.Tenant == b.Tenant && a.Alias < b.Alias
+	})
+	sort.Slice(d.ArchivedTransactions, func(i, j int) bool {
+		a, b := d.ArchivedTransactions[i], d.ArchivedTransactions[j]
+		return a.Tenant < b.Tenant || a.Tenant == b.Tenant && a.ID < b.ID
+	})
+	sort.Slice(d.Payouts, func(i, j int) bool { return d.Payouts[i].ID < d.Payouts[j].ID })
+	sort.Slice(d.ThresholdReports, func(i, j int) bool {
+		a, b := d.ThresholdReports[i], d.ThresholdReports[j]
+		return a.Tenant < b.Tenant || a.Tenant == b.Tenant && a.TransactionID < b.TransactionID
+	})
+	sort.Slice(d.PromoCodes, func(i, j int) bool { return d.PromoCodes[i].Code < d.PromoCodes[j].Code })
+	sort.Slice(d.DayCloses, func(i, j int) bool {
+		a, b := d.DayCloses[i], d.DayCloses[j]
+		return a.Tenant < b.Tenant || a.Tenant == b.Tenant && a.Cutoff.Before(b.Cutoff)
+	})
+}
+
+// Converts an account to its wire form
+func accountV1(a *Account) AccountV1 {
+	wire := AccountV1{
+		Tenant:            a.tenant,
+		ID:                a.id,
+		Name:              a.name,
+		Balance:           a.balance,
+		Tags:              a.tags,
+		Owners:            a.owners,
+		ApprovalThreshold: a.approvalThreshold,
+		RequiredApprovals: a.requiredApprovals,
+		Email:             a.email,
+		Phone:             a.phone,
+		LockedBalance:     a.lockedBalance,
+		CreditLimit:       a.creditLimit,
+		CreditUsed:        a.creditUsed,
+		UnbilledCredit:    a.unbilledCredit,
+		Merchant:          a.merchant,
+		MerchantCategory:  a.merchantCategory,
+		Budgets:           a.budgets,
+		AlertThresholds:   a.alertThresholds,
+		Locale:            a.locale,
+		Currency:          a.currency,
+		Frozen:            a.frozen,
+		StatementFormat:   a.statementFormat,
+	}
+
+	if a.parent != nil {
+		wire.Parent = a.parent.id
+	}
+
+	for id, p := range a.counterparties {
+		if wire.Counterparties == nil {
+			wire.Counterparties = map[uint32]CounterpartyProfileV1{}
+		}
+
+		wire.Counterparties[id] = CounterpartyProfileV1{Nickname: p.nickname, Avatar: p.avatar}
+	}
+
+	if p := a.notificationPreferences; p != nil {
+		wire.NotificationPreferences = &NotificationPreferencesV1{
+			Channels:  p.channels,
+			Muted:     p.muted,
+			QuietFrom: p.quietFrom,
+			QuietTo:   p.quietTo,
+			MinAmount: p.minAmount,
+		}
+
+		if p.location != nil {
+			wire.NotificationPreferences.Location = p.location.String()
+		}
+	}
+
+	return wire
+}
+
+// Converts a transaction to its wire form
+func transactionV1(t *Transaction) TransactionV1 {
+	return TransactionV1{
+		Tenant:        t.tenant,
+		ID:            t.id,
+		Amount:        t.amount,
+		Sender:        t.sender.id,
+		Recipient:     t.recipient.id,
+		State:         t.state,
+		Method:        t.paymentMethod,
+		CardToken:     t.cardToken,
+		InitiatedBy:   t.initiatedBy,
+		CancelReason:  t.cancelReason,
+		CreatedAt:     t.createdAt,
+		ClosedAt:      t.closedAt,
+		ExpiresAt:     t.expiresAt,
+		Category:      t.category,
+		Memo:          t.memo,
+		Reference:     t.reference,
+		Metadata:      t.metadata,
+		Fee:           t.fee,
+		PromoCode:     t.promoCode,
+		FeeDiscount:   t.feeDiscount,
+		Approvals:     t.approvals,
+		MandateID:     t.mandateID,
+		Locale:        t.locale,
+		Reversed:      t.reversed,
+		FeeWaived:     t.feeWaived,
+		SLAFlagged:    t.slaFlagged,
+		PromoRedeemed: t.promoRedeemed,
+		HandlerKey:    t.handlerKey,
+		ConfirmAsked:  t.confirmationRequestedAt,
+	}
+}
+
+// Loads a dump written by Export into the service
+// The whole dump is checked before anything is written: its version, its checksum,
+// that every record refers to accounts it holds, and that none of its records already exist
+func (s *Service) Import(role Role, r io.Reader) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	var dump DumpV1
+
+	if err := json.NewDecoder(r).Decode(&dump); err != nil {
+		return newError(INVALID_ARGUMENT, "Dump is not valid JSON")
+	}
+
+	if dump.Schema != DumpSchemaV1 {
+		return newError(INVALID_ARGUMENT, "Unsupported dump version")
+	}
+
+	checksum, err := dumpChecksum(dump.Data)
+
+	if err != nil {
+		return err
+	}
+
+	if checksum != dump.Checksum {
+		return newError(INVALID_ARGUMENT, "Dump checksum doesn't match its data")
+	}
+
+	data := dump.Data
+	accounts := map[recordKey]*Account{}
+	account := func(tenant TenantID, id uint32) (*Account, error) {
+		a, ok := accounts[recordKey{tenant, id}]
+		if !ok {
+			return nil, newError(INVALID_ARGUMENT, "Dump refers to an account it doesn't hold")
+		}
+		return a, nil
+	}
+
+	for _, wire := range data.Accounts {
+		key := recordKey{wire.Tenant, uint32(wire.ID)}
+
+		if _, ok := accounts[key]; ok {
+			return newError(INVALID_ARGUMENT, "Dump holds the same account twice")
+		}
+
+		if _, err := s.repository.findAccount(wire.Tenant, wire.ID); err == nil {
+			return newError(ALREADY_EXISTS, "Account id is already taken")
+		}
+
+		accounts[key] = &Account{
+			id:                wire.ID,
+			tenant:            wire.Tenant,
+			name:              wire.Name,
+			balance:           wire.Balance,
+			tags:              wire.Tags,
+			owners:            wire.Owners,
+			approvalThreshold: wire.ApprovalThreshold,
+			requiredApprovals: wire.RequiredApprovals,
+			email:             wire.Email,
+			phone:             wire.Phone,
+			lockedBalance:     wire.LockedBalance,
+			creditLimit:       wire.CreditLimit,
+			creditUsed:        wire.CreditUsed,
+			unbilledCredit:    wire.UnbilledCredit,
+			merchant:          wire.Merchant,
+			merchantCategory:  wire.MerchantCategory,
+			budgets:           wire.Budgets,
+			alertThresholds:   wire.AlertThresholds,
+			locale:            wire.Locale,
+			currency:          wire.Currency,
+			frozen:            wire.Frozen,
+			statementFormat:   wire.StatementFormat,
+		}
+
+		if p := wire.NotificationPreferences; p != nil {
+			preferences := &NotificationPreferences{
+				channels:  p.Channels,
+				muted:     p.Muted,
+				quietFrom: p.QuietFrom,
+				quietTo:   p.QuietTo,
+				minAmount: p.MinAmount,
+			}
+
+			if p.Location != "" {
+				location, err := time.LoadLocation(p.Location)
+
+				if err != nil {
+					return err
+				}
+
+				preferences.location = location
+			}
+
+			accounts[key].notificationPreferences = preferences
+		}
+
+		for id, p := range wire.Counterparties {
+			if accounts[key].counterparties == nil {
+				accounts[key].counterparties = map[uint32]CounterpartyProfile{}
+			}
+
+			accounts[key].counterparties[id] = CounterpartyProfile{nickname: p.Nickname, avatar: p.Avatar}
+		}
+	}
+
+	for _, wire := range data.Accounts {
+		if wire.Parent == 0 {
+			continue
+		}
+
+		parent, err := account(wire.Tenant, wire.Parent)
+
+		if err != nil {
+			return err
+		}
+
+		a, _ := account(wire.Tenant, wire.ID)
+		a.parent = parent
+		parent.wallets = append(parent.wallets, a)
+	}
+
+	// Every record is keyed as kind and id, ids of one kind must be new to the dump and the service
+	seen := map[string]bool{}
+	claim := func(key string, exists func() bool) error {
+		if seen[key] {
+			return newError(INVALID_ARGUMENT, "Dump holds the same record twice")
+		}
+		if exists() {
+			return newError(ALREADY_EXISTS, "Dump holds records the service already has")
+		}
+		seen[key] = true
+		return nil
+	}
+
+	imported := map[recordKey]*Transaction{}
+	transaction := func(wire TransactionV1) (*Transaction, error) {
+		key := fmt.Sprintf("transaction:%s:%d", wire.Tenant, wire.ID)
+
+		err := claim(key, func() bool {
+			_, live := s.repository.findTransaction(wire.Tenant, wire.ID)
+			_, archived := s.archive.findArchived(wire.Tenant, wire.ID)
+			return live == nil || archived == nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		sender, err := account(wire.Tenant, wire.Sender)
+
+		if err != nil {
+			return nil, err
+		}
+
+		recipient, err := account(wire.Tenant, wire.Recipient)
+
+		if err != nil {
+			return nil, err
+		}
+
+		t := &Transaction{
+			id:            wire.ID,
+			tenant:        wire.Tenant,
+			amount:        wire.Amount,
+			sender:        sender,
+			recipient:     recipient,
+			state:         wire.State,
+			paymentMethod: wire.Method,
+			cardToken:     wire.CardToken,
+			initiatedBy:   wire.InitiatedBy,
+			cancelReason:  wire.CancelReason,
+			createdAt:     wire.CreatedAt,
+			closedAt:      wire.ClosedAt,
+			expiresAt:     wire.ExpiresAt,
+			category:      wire.Category,
+			memo:          wire.Memo,
+			reference:     wire.Reference,
+			metadata:      wire.Metadata,
+			fee:           wire.Fee,
+			promoCode:     wire.PromoCode,
+			feeDiscount:   wire.FeeDiscount,
+			approvals:     wire.Approvals,
+			mandateID:     wire.MandateID,
+			locale:        wire.Locale,
+			reversed:      wire.Reversed,
+			feeWaived:     wire.FeeWaived,
+			slaFlagged:    wire.SLAFlagged,
+			promoRedeemed: wire.PromoRedeemed,
+			handlerKey:    wire.HandlerKey,
+		}
+		t.confirmationRequestedAt = wire.ConfirmAsked
+		imported[recordKey{t.tenant, t.id}] = t
+
+		return t, nil
+	}
+
+	transactions := make([]*Transaction, 0, len(data.Transactions))
+
+	for _, wire := range data.Transactions {
+		t, err := transaction(wire)
+
+		if err != nil {
+			return err
+		}
+
+		transactions = append(transactions, t)
+	}
+
+	archived := make([]*Transaction, 0, len(data.ArchivedTransactions))
+
+	for _, wire := range data.ArchivedTransactions {
+		t, err := transaction(wire)
+
+		if err != nil {
+			return err
+		}
+
+		archived = append(archived, t)
+	}
+
+	aliases := map[string]*Account{}
+
+	for _, wire := range data.Aliases {
+		a, err := account(wire.Tenant, wire.Account)
+
+		if err != nil {
+			return err
+		}
+
+		alias := normalizeAlias(wire.Alias)
+		err = claim("alias:"+string(wire.Tenant)+":"+alias, func() bool {
+			_, err := s.aliases.resolve(wire.Tenant, alias)
+			return err == nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		aliases[alias] = a
+	}
+
+	feeAccounts := map[TenantID]*Account{}
+
+	for _, wire := range data.FeeAccounts {
+		house, err := account(wire.Tenant, wire.Account)
+
+		if err != nil {
+			return err
+		}
+
+		feeAccounts[wire.Tenant] = house
+	}
+
+	mandates := make([]*Mandate, 0, len(data.Mandates))
+
+	for _, wire := range data.Mandates {
+		payer, err := account(wire.Tenant, wire.Payer)
+
+		if err != nil {
+			return err
+		}
+
+		merchant, err := account(wire.Tenant, wire.Merchant)
+
+		if err != nil {
+			return err
+		}
+
+		if err := claim(fmt.Sprintf("mandate:%d", wire.ID), func() bool { _, err := s.mandates.get(wire.ID); return err == nil }); err != nil {
+			return err
+		}
+
+		mandates = append(mandates, &Mandate{id: wire.ID, payer: payer, merchant: merchant, limit: wire.Limit, revoked: wire.Revoked, pending: wire.Pending})
+	}
+
+	loans := make([]*Loan, 0, len(data.Loans))
+
+	for _, wire := range data.Loans {
+		a, err := account(wire.Tenant, wire.Account)
+
+		if err != nil {
+			return err
+		}
+
+		if err := claim(fmt.Sprintf("loan:%d", wire.ID), func() bool { _, err := s.loans.get(wire.ID); return err == nil }); err != nil {
+			return err
+		}
+
+		l := &Loan{id: wire.ID, account: a, basisPoints: wire.BasisPoints, principal: wire.Principal, outstanding: wire.Outstanding, closed: wire.Closed}
+
+		for _, in := range wire.Installments {
+			l.installments = append(l.installments, &Installment{dueDate: in.DueDate, principal: in.Principal, interest: in.Interest, paid: in.Paid})
+		}
+
+		loans = append(loans, l)
+	}
+
+	deposits := make([]*Deposit, 0, len(data.Deposits))
+
+	for _, wire := range data.Deposits {
+		a, err := account(wire.Tenant, wire.Account)
+
+		if err != nil {
+			return err
+		}
+
+		if err := claim(fmt.Sprintf("deposit:%d", wire.ID), func() bool { _, err := s.deposits.get(wire.ID); return err == nil }); err != nil {
+			return err
+		}
+
+		deposits = append(deposits, &Deposit{
+			id:                 wire.ID,
+			account:            a,
+			amount:             wire.Amount,
+			basisPoints:        wire.BasisPoints,
+			term:               wire.Term,
+			maturity:           wire.Maturity,
+			autoRenew:          wire.AutoRenew,
+			penaltyBasisPoints: wire.PenaltyBasisPoints,
+			closed:             wire.Closed,
+		})
+	}
+
+	statements := map[*Account][]*Statement{}
+
+	for _, wire := range data.Statements {
+		a, err := account(wire.Tenant, wire.Account)
+
+		if err != nil {
+			return err
+		}
+
+		statements[a] = append(statements[a], &Statement{
+			account:           a,
+			closedAt:          wire.ClosedAt,
+			dueDate:           wire.DueDate,
+			amount:            wire.Amount,
+			paid:              wire.Paid,
+			interestChargedAt: wire.InterestChargedAt,
+		})
+	}
+
+	payouts := make([]*Payout, 0, len(data.Payouts))
+
+	for _, wire := range data.Payouts {
+		merchant, err := account(wire.Tenant, wire.Merchant)
+
+		if err != nil {
+			return err
+		}
+
+		t, ok := imported[recordKey{wire.Tenant, wire.Transaction}]
+
+		if !ok {
+			return newError(INVALID_ARGUMENT, "Dump refers to a transaction it doesn't hold")
+		}
+
+		if err := claim(fmt.Sprintf("payout:%d", wire.ID), func() bool { _, err := s.payouts.get(wire.ID); return err == nil }); err != nil {
+			return err
+		}
+
+		p := &Payout{id: wire.ID, merchant: merchant, transaction: t}
+
+		for _, r := range wire.Receipts {
+			p.receipts = append(p.receipts, PayoutReceipt{transactionID: r.TransactionID, method: r.Method, amount: r.Amount})
+		}
+
+		payouts = append(payouts, p)
+	}
+
+	for _, r := range data.ThresholdReports {
+		key := recordKey{r.Tenant, r.TransactionID}
+
+		if err := claim(fmt.Sprintf("report:%s:%d", r.Tenant, r.TransactionID), func() bool { _, err := s.thresholdReports.get(key); return err == nil }); err != nil {
+			return err
+		}
+	}
+
+	promoCodes := make([]*PromoCode, 0, len(data.PromoCodes))
+
+	for _, wire := range data.PromoCodes {
+		err := claim("promo:"+wire.Code, func() bool {
+			s.mu.RLock()
+			defer s.mu.RUnlock()
+			_, ok := s.promoCodes[wire.Code]
+			return ok
+		})
+
+		if err != nil {
+			return err
+		}
+
+		p := &PromoCode{code: wire.Code, discount: wire.Discount, maxUses: wire.MaxUses, perAccountCap: wire.PerAccountCap, methods: slices.Clone(wire.Methods), expiresAt: wire.ExpiresAt, uses: wire.Uses, redemptions: map[*Account]int{}}
+
+		for _, r := range wire.Redemptions {
+			a, err := account(r.Tenant, r.Account)
+
+			if err != nil {
+				return err
+			}
+
+			p.redemptions[a] = r.Uses
+		}
+
+		promoCodes = append(promoCodes, p)
+	}
+
+	dayCloses := make([]*DayClose, 0, len(data.DayCloses))
+
+	for _, wire := range data.DayCloses {
+		key := dayCloseKey{wire.Tenant, wire.Cutoff}
+
+		if err := claim("close:"+string(wire.Tenant)+":"+wire.Cutoff.String(), func() bool { _, err := s.dayCloses.get(key); return err == nil }); err != nil {
+			return err
+		}
+
+		d := &DayClose{tenant: wire.Tenant, from: wire.From, cutoff: wire.Cutoff, debits: wire.Debits, credits: wire.Credits, reconciledAt: wire.ReconciledAt, balances: wire.Balances}
+
+		for _, line := range wire.Lines {
+			d.lines = append(d.lines, TrialBalanceLine{account: line.Account, debits: line.Debits, credits: line.Credits})
+		}
+
+		for _, b := range wire.Breaks {
+			d.breaks = append(d.breaks, LedgerBreak{account: b.Account, posted: b.Posted, moved: b.Moved})
+		}
+
+		dayCloses = append(dayCloses, d)
+	}
+
+	all := make([]*Account, 0, len(accounts))
+	for _, a := range accounts {
+		all = append(all, a)
+	}
+
+	if err := s.repository.saveAccounts(all); err != nil {
+		return err
+	}
+
+	for _, t := range transactions {
+		if err := s.repository.saveTransaction(t); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range mandates {
+		if err := s.mandates.save(m); err != nil {
+			return err
+		}
+	}
+
+	for _, l := range loans {
+		if err := s.loans.save(l); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range deposits {
+		if err := s.deposits.save(d); err != nil {
+			return err
+		}
+	}
+
+	for _, t := range archived {
+		if err := s.archive.archive(t); err != nil {
+			return err
+		}
+	}
+
+	for alias, a := range aliases {
+		if err := s.aliases.register(a, alias); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range payouts {
+		if err := s.payouts.save(p); err != nil {
+			return err
+		}
+	}
+
+	for _, r := range data.ThresholdReports {
+		if err := s.thresholdReports.save(r); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range dayCloses {
+		if err := s.dayCloses.save(d); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for tenant, house := range feeAccounts {
+		s.feeAccounts[tenant] = house
+	}
+
+	for a, st := range statements {
+		s.statements[a] = st
+	}
+
+	for _, p := range promoCodes {
+		s.promoCodes[p.code] = p
+	}
+
+	// Ledgers stay closed where the dump left them
+	for _, d := range dayCloses {
+		if d.cutoff.After(s.ledgerCutoffs[d.tenant]) {
+			s.ledgerCutoffs[d.tenant] = d.cutoff
+		}
+	}
+
+	// Handlers aren't part of the dump, payments waiting for their payer get the ones that confirm them back
+	for _, t := range transactions {
+		if t.state != PENDING_CONFIRMATION {
+			continue
+		}
+
+		t.states = s.states
+
+		if err := s.bindHandler(t); err != nil {
+			return err
+		}
+	}
+
+	// Subscribed accounts get statements from the month of the import on
+	for _, a := range all {
+		if a.statementFormat != "" {
+			s.statementsDue[a] = monthStart(s.now())
+		}
+	}
+
+	// Records created after the import must not reuse imported ids
+	for _, t := range imported {
+		s.lastTransactionID = max(s.lastTransactionID, t.id)
+	}
+	for _, m := range mandates {
+		s.lastMandateID = max(s.lastMandateID, m.id)
+	}
+	for _, l := range loans {
+		s.lastLoanID = max(s.lastLoanID, l.id)
+	}
+	for _, d := range deposits {
+		s.lastDepositID = max(s.lastDepositID, d.id)
+	}
+	for _, p := range payouts {
+		s.lastPayoutID = max(s.lastPayoutID, p.id)
+	}
+
+	return nil
+}
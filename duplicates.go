@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Returned when a payment is blocked as a likely double submission
+var ErrDuplicateTransaction = newError(DUPLICATE_TRANSACTION, "Transaction looks like a duplicate of a recent payment")
+
+// All of the possible reactions to a likely duplicate
+type DuplicateAction string
+
+const (
+	WARN  DuplicateAction = "warn"
+	BLOCK DuplicateAction = "block"
+)
+
+// Payment remembered by the duplicate detector
+type recentPayment struct {
+	transactionID uint32
+	senderID      uint32
+	recipientID   uint32
+	amount        uint32
+	at            time.Time
+}
+
+// Flags payments with the same sender, recipient and amount as a recent one
+type DuplicateDetector struct {
+	mu     sync.Mutex
+	window time.Duration
+	action DuplicateAction
+	now    func() time.Time
+	recent []recentPayment
+}
+
+// Creates a detector that compares payments made within window of each other
+func NewDuplicateDetector(window time.Duration, action DuplicateAction) *DuplicateDetector {
+	return &DuplicateDetector{window: window, action: action, now: time.Now}
+}
+
+// Checks a transaction against recent payments
+// Returns ErrDuplicateTransaction if it matches one and the detector blocks duplicates
+func (d *DuplicateDetector) check(t *Transaction) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.forgetOld()
+
+	for _, p := range d.recent {
+		if p.senderID != t.sender.id || p.recipientID != t.recipient.id || p.amount != t.amount {
+			continue
+		}
+
+		if d.action == BLOCK {
+			return ErrDuplicateTransaction
+		}
+
+		log.Printf("Transaction %d looks like a duplicate of transaction %d", t.id, p.transactionID)
+
+		return nil
+	}
+
+	return nil
+}
+
+// Remembers a payment that went through
+func (d *DuplicateDetector) record(t *Transaction) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.recent = append(d.recent, recentPayment{
+		transactionID: t.id,
+		senderID:      t.sender.id,
+		recipientID:   t.recipient.id,
+		amount:        t.amount,
+		at:            d.now(),
+	})
+}
+
+// Drops payments older than the window
+// Must be called with the lock held
+func (d *DuplicateDetector) forgetOld() {
+	cutoff := d.now().Add(-d.window)
+	kept := d.recent[:0]
+
+	for _, p := range d.recent {
+		if p.at.After(cutoff) {
+			kept = append(kept, p)
+		}
+	}
+
+	d.recent = kept
+}
+
+// Checks payments for duplicates before handing them to the next handler
+type DuplicateCheckingTransactionHandler struct {
+	next     TransactionHandler
+	detector *DuplicateDetector
+}
+
+func (th *DuplicateCheckingTransactionHandler) pay(ctx context.Context, t *Transaction) error {
+	if err := th.detector.check(t); err != nil {
+		return err
+	}
+
+	if err := th.next.pay(ctx, t); err != nil {
+		return err
+	}
+
+	th.detector.record(t)
+
+	return nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// One ledger account of a trial balance
+type TrialBalanceLine struct {
+	account string
+	debits  uint64
+	credits uint64
+}
+
+// Models the end-of-day close of a tenant's ledger
+type DayClose struct {
+	tenant TenantID
+	// Postings closed between the previous cutoff and this one are covered
+	from   time.Time
+	cutoff time.Time
+	lines  []TrialBalanceLine
+	// Debits and credits of every line, equal unless the ledger is off
+	debits  uint64
+	credits uint64
+	// Balances of the tenant's accounts when the close was made, which the next close reconciles from
+	reconciledAt time.Time
+	balances     map[uint32]int64
+	// Accounts whose balances moved by something other than what was posted since the previous close
+	breaks []LedgerBreak
+}
+
+// Models an account whose balance moved differently from its postings
+type LedgerBreak struct {
+	account uint32
+	// Moved by the transactions closed since the previous close
+	posted int64
+	// Moved in fact
+	moved int64
+}
+
+// Identifies a close by its tenant and cutoff
+type dayCloseKey struct {
+	tenant TenantID
+	cutoff time.Time
+}
+
+// Returns whether the debits of the close equal its credits and every balance moved as posted
+func (d *DayClose) balanced() bool {
+	return d.debits == d.credits && len(d.breaks) == 0
+}
+
+// Closes a tenant's ledger at cutoff and returns the trial balance of the postings since the previous close
+// The balances of the tenant's accounts are reconciled against the transactions closed since the previous close
+// Daily totals before the cutoff are moved into the rollup history, and an imbalance raises a critical event
+func (s *Service) CloseDay(role Role, tenant TenantID, cutoff time.Time) (*DayClose, error) {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return nil, err
+	}
+
+	if cutoff.After(s.now()) {
+		return nil, newError(INVALID_ARGUMENT, "Cutoff can't be in the future")
+	}
+
+	s.mu.Lock()
+	from := s.ledgerCutoffs[tenant]
+	if !cutoff.After(from) {
+		s.mu.Unlock()
+		return nil, newError(INVALID_STATE, "Ledger is already closed at the cutoff")
+	}
+	// Later closes start from here, so nothing before the cutoff is counted twice
+	s.ledgerCutoffs[tenant] = cutoff
+	house, rollup := s.feeAccounts[tenant], s.rollup
+	s.mu.Unlock()
+
+	// Puts the cutoff back when the close can't be made, so it can be tried again
+	rollback := func(err error) (*DayClose, error) {
+		s.mu.Lock()
+		s.ledgerCutoffs[tenant] = from
+		s.mu.Unlock()
+		return nil, err
+	}
+
+	transactions, err := s.closedBetween(tenant, from, cutoff)
+
+	if err != nil {
+		return rollback(err)
+	}
+
+	byAccount := map[string]*TrialBalanceLine{}
+	dc := &DayClose{tenant: tenant, from: from, cutoff: cutoff}
+
+	for _, t := range transactions {
+		for _, p := range defaultChartOfAccounts.postings(t, house, nil) {
+			line, ok := byAccount[p.account]
+			if !ok {
+				line = &TrialBalanceLine{account: p.account}
+				byAccount[p.account] = line
+			}
+
+			if p.amount > 0 {
+				line.debits += uint64(p.amount)
+				dc.debits += uint64(p.amount)
+			} else {
+				line.credits += uint64(-p.amount)
+				dc.credits += uint64(-p.amount)
+			}
+		}
+	}
+
+	for _, line := range byAccount {
+		dc.lines = append(dc.lines, *line)
+	}
+
+	sort.Slice(dc.lines, func(i, j int) bool {
+		return dc.lines[i].account < dc.lines[j].account
+	})
+
+	if err := s.reconcileBalances(tenant, house, dc); err != nil {
+		return rollback(err)
+	}
+
+	if err := s.dayCloses.save(dc); err != nil {
+		return rollback(err)
+	}
+
+	if rollup != nil {
+		rollup.seal(tenant, cutoff)
+	}
+
+	if dc.debits != dc.credits {
+		s.publish(Event{
+			kind:   LEDGER_IMBALANCE,
+			tenant: tenant,
+			detail: fmt.Sprintf("closed at %s with %d in debits and %d in credits", cutoff.Format(time.RFC3339), dc.debits, dc.credits),
+		})
+	}
+
+	for _, b := range dc.breaks {
+		e := Event{
+			kind:   LEDGER_IMBALANCE,
+			tenant: tenant,
+			detail: fmt.Sprintf("moved %d since the previous close but %d was posted", b.moved, b.posted),
+		}
+
+		if a, err := s.repository.findAccount(tenant, b.account); err == nil {
+			e.account = a
+		} else {
+			e.detail = fmt.Sprintf("account %d %s", b.account, e.detail)
+		}
+
+		s.publish(e)
+	}
+
+	return dc, nil
+}
+
+// Takes a snapshot of the balances of a tenant's accounts and checks how they moved since the previous close against the transactions closed in between
+// Statement payments, deposits and adjustments are posted as transfers, so any other movement is a break
+// The accounts are locked while at it, so no payment is halfway through, and the first close only takes the snapshot
+func (s *Service) reconcileBalances(tenant TenantID, house *Account, dc *DayClose) error {
+	accounts, err := s.repository.listAccounts(tenant)
+
+	if err != nil {
+		return err
+	}
+
+	if house != nil {
+		accounts = append(accounts, house)
+	}
+
+	_, release, err := s.lockAccounts(context.Background(), accounts...)
+
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
+	previous, err := s.lastDayClose(tenant)
+
+	if err != nil {
+		return err
+	}
+
+	transactions, err := s.repository.listTransactions(tenant)
+
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	dc.reconciledAt = s.now()
+	dc.balances = map[uint32]int64{}
+	for _, a := range accounts {
+		dc.balances[a.id] = int64(a.balance)
+	}
+	s.mu.RUnlock()
+
+	if previous == nil {
+		return nil
+	}
+
+	posted := map[uint32]int64{}
+
+	for _, t := range transactions {
+		if t.state != CLOSED || !t.closedAt.After(previous.reconciledAt) || t.closedAt.After(dc.reconciledAt) {
+			continue
+		}
+
+		for a, effect := range replayEffects(t, house) {
+			posted[a.id] += effect.balance
+		}
+	}
+
+	for id, balance := range dc.balances {
+		before, ok := previous.balances[id]
+
+		// Accounts opened since are reconciled from the next close on
+		if !ok {
+			continue
+		}
+
+		if moved := balance - before; moved != posted[id] {
+			dc.breaks = append(dc.breaks, LedgerBreak{account: id, posted: posted[id], moved: moved})
+		}
+	}
+
+	sort.Slice(dc.breaks, func(i, j int) bool {
+		return dc.breaks[i].account < dc.breaks[j].account
+	})
+
+	return nil
+}
+
+// Returns the latest close of a tenant's ledger, nil when it was never closed
+func (s *Service) lastDayClose(tenant TenantID) (*DayClose, error) {
+	closes, err := query(s.dayCloses, func(d *DayClose) bool { return d.tenant == tenant })
+
+	if err != nil {
+		return nil, err
+	}
+
+	var last *DayClose
+
+	for _, d := range closes {
+		if last == nil || d.cutoff.After(last.cutoff) {
+			last = d
+		}
+	}
+
+	return last, nil
+}
+
+// Returns every close of a tenant's ledger, oldest first
+func (s *Service) DayCloses(role Role, tenant TenantID) ([]*DayClose, error) {
+	if err := authorize(role, READ); err != nil {
+		return nil, err
+	}
+
+	closes, err := query(s.dayCloses, func(d *DayClose) bool { return d.tenant == tenant })
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(closes, func(i, j int) bool {
+		return closes[i].cutoff.Before(closes[j].cutoff)
+	})
+
+	return closes, nil
+}
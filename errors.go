@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// Machine-readable codes attached to every domain error, so clients can branch on them
+type ErrorCode string
+
+const (
+	INSUFFICIENT_FUNDS             ErrorCode = "DIP-1001"
+	SELF_TRANSFER                  ErrorCode = "DIP-1002"
+	TRANSACTION_CLOSED             ErrorCode = "DIP-1003"
+	TRANSACTION_EXPIRED_ERROR      ErrorCode = "DIP-1004"
+	TRANSACTION_CANCELLED_ERROR    ErrorCode = "DIP-1005"
+	INVALID_STATE                  ErrorCode = "DIP-1006"
+	CREDIT_LIMIT_EXCEEDED          ErrorCode = "DIP-1007"
+	FEE_ACCOUNT_INSUFFICIENT_FUNDS ErrorCode = "DIP-1008"
+	DUPLICATE_TRANSACTION          ErrorCode = "DIP-1009"
+	CROSS_TENANT                   ErrorCode = "DIP-1010"
+	INVALID_AMOUNT                 ErrorCode = "DIP-1011"
+	UNSUPPORTED_PAYMENT_METHOD     ErrorCode = "DIP-1012"
+	PAYMENT_REFUSED                ErrorCode = "DIP-1013"
+	CHAIN_CONFIRMATIONS_PENDING    ErrorCode = "DIP-1014"
+	INVALID_TRANSITION             ErrorCode = "DIP-1015"
+	GATEWAY_SETTLEMENT_PENDING     ErrorCode = "DIP-1016"
+	BALANCE_CAP_EXCEEDED           ErrorCode = "DIP-1017"
+	AMOUNT_BELOW_MINIMUM           ErrorCode = "DIP-1018"
+	AMOUNT_ABOVE_MAXIMUM           ErrorCode = "DIP-1019"
+	HANDLER_DECISION_PENDING       ErrorCode = "DIP-1020"
+	FORBIDDEN                      ErrorCode = "DIP-2001"
+	INVALID_API_KEY                ErrorCode = "DIP-2002"
+	RATE_LIMITED                   ErrorCode = "DIP-2003"
+	INVALID_SIGNATURE              ErrorCode = "DIP-2004"
+	CONFIRMATION_REQUIRED          ErrorCode = "DIP-2005"
+	CONFIRMATION_FAILED            ErrorCode = "DIP-2006"
+	APPROVAL_REQUIRED              ErrorCode = "DIP-2007"
+	NOT_AN_OWNER                   ErrorCode = "DIP-2008"
+	INVALID_CARD_TOKEN             ErrorCode = "DIP-2009"
+	INVALID_PROMO_CODE             ErrorCode = "DIP-2010"
+	ACCOUNT_FROZEN_ERROR           ErrorCode = "DIP-2011"
+	NOT_FOUND                      ErrorCode = "DIP-3001"
+	ALREADY_EXISTS                 ErrorCode = "DIP-3002"
+	MISCONFIGURED                  ErrorCode = "DIP-3003"
+	INVALID_ARGUMENT               ErrorCode = "DIP-3004"
+	PAYMENT_TIMEOUT                ErrorCode = "DIP-4001"
+	NOTIFICATION_FAILED            ErrorCode = "DIP-4002"
+	BUSY                           ErrorCode = "DIP-4003"
+	INTERNAL                       ErrorCode = "DIP-9999"
+)
+
+// Short names of the codes, stable like the codes themselves
+var errorCodeNames = map[ErrorCode]string{
+	INSUFFICIENT_FUNDS:             "insufficient_funds",
+	SELF_TRANSFER:                  "self_transfer",
+	TRANSACTION_CLOSED:             "transaction_closed",
+	TRANSACTION_EXPIRED_ERROR:      "transaction_expired",
+	TRANSACTION_CANCELLED_ERROR:    "transaction_cancelled",
+	INVALID_STATE:                  "invalid_state",
+	CREDIT_LIMIT_EXCEEDED:          "credit_limit_exceeded",
+	FEE_ACCOUNT_INSUFFICIENT_FUNDS: "fee_account_insufficient_funds",
+	DUPLICATE_TRANSACTION:          "duplicate_transaction",
+	CROSS_TENANT:                   "cross_tenant",
+	INVALID_AMOUNT:                 "invalid_amount",
+	UNSUPPORTED_PAYMENT_METHOD:     "unsupported_payment_method",
+	PAYMENT_REFUSED:                "payment_refused",
+	CHAIN_CONFIRMATIONS_PENDING:    "chain_confirmations_pending",
+	INVALID_TRANSITION:             "invalid_transition",
+	GATEWAY_SETTLEMENT_PENDING:     "gateway_settlement_pending",
+	BALANCE_CAP_EXCEEDED:           "balance_cap_exceeded",
+	AMOUNT_BELOW_MINIMUM:           "amount_below_minimum",
+	AMOUNT_ABOVE_MAXIMUM:           "amount_above_maximum",
+	HANDLER_DECISION_PENDING:       "handler_decision_pending",
+	FORBIDDEN:                      "forbidden",
+	INVALID_API_KEY:                "invalid_api_key",
+	RATE_LIMITED:                   "rate_limited",
+	INVALID_SIGNATURE:              "invalid_signature",
+	CONFIRMATION_REQUIRED:          "confirmation_required",
+	CONFIRMATION_FAILED:            "confirmation_failed",
+	APPROVAL_REQUIRED:              "approval_required",
+	NOT_AN_OWNER:                   "not_an_owner",
+	INVALID_CARD_TOKEN:             "invalid_card_token",
+	INVALID_PROMO_CODE:             "invalid_promo_code",
+	ACCOUNT_FROZEN_ERROR:           "account_frozen",
+	NOT_FOUND:                      "not_found",
+	ALREADY_EXISTS:                 "already_exists",
+	MISCONFIGURED:                  "misconfigured",
+	INVALID_ARGUMENT:               "invalid_argument",
+	PAYMENT_TIMEOUT:                "payment_timeout",
+	NOTIFICATION_FAILED:            "notification_failed",
+	BUSY:                           "busy",
+	INTERNAL:                       "internal",
+}
+
+// Returns the short name of a code, e.g. insufficient_funds
+func (c ErrorCode) name() string {
+	return errorCodeNames[c]
+}
+
+// Models a domain error together with its machine-readable code
+type CodedError struct {
+	code    ErrorCode
+	message string
+}
+
+// Creates a domain error with a code
+func newError(code ErrorCode, message string) *CodedError {
+	return &CodedError{code: code, message: message}
+}
+
+func (e *CodedError) Error() string {
+	return e.message
+}
+
+// Wraps an error the caller can recover from by trying again after a while
+type RetryAfterError struct {
+	err        *CodedError
+	retryAfter time.Duration
+}
+
+func (e *RetryAfterError) Error() string {
+	return e.err.Error()
+}
+
+func (e *RetryAfterError) Unwrap() error {
+	return e.err
+}
+
+// Returns the code of the first coded error in err's chain
+// Errors that don't come from the domain, like I/O failures, are INTERNAL
+func errorCode(err error) ErrorCode {
+	var coded *CodedError
+
+	if errors.As(err, &coded) {
+		return coded.code
+	}
+
+	return INTERNAL
+}
+
+// Errors shared by every payment handler
+var (
+	ErrSelfTransfer         = newError(SELF_TRANSFER, "One account can't make a transaction to itself")
+	ErrTransactionClosed    = newError(TRANSACTION_CLOSED, "Can't pay an already closed transaction")
+	ErrTransactionExpired   = newError(TRANSACTION_EXPIRED_ERROR, "Transaction expired")
+	ErrTransactionCancelled = newError(TRANSACTION_CANCELLED_ERROR, "Can't pay a cancelled transaction")
+	ErrInsufficientFunds    = newError(INSUFFICIENT_FUNDS, "Sender doesn't have enough balance to make transaction")
+	ErrNoFeeAccount         = newError(MISCONFIGURED, "Tenant has no fee account")
+)
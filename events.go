@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// All of the possible kinds of events
+type EventKind string
+
+const (
+	TRANSACTION_CANCELLED EventKind = "transaction.cancelled"
+	BALANCE_ALERT         EventKind = "account.balance_alert"
+	BUDGET_EXCEEDED       EventKind = "account.budget_exceeded"
+	ACCOUNT_FROZEN        EventKind = "account.frozen"
+	ACCOUNT_UNFROZEN      EventKind = "account.unfrozen"
+	SLA_BREACHED          EventKind = "transaction.sla_breached"
+	EXPIRY_REMINDER       EventKind = "transaction.expiry_reminder"
+	TRANSACTION_FAILED    EventKind = "transaction.failed"
+	// Critical, the ledger's debits and credits don't match
+	LEDGER_IMBALANCE EventKind = "ledger.imbalance"
+)
+
+// Models something that happened to a transaction or account
+type Event struct {
+	kind EventKind
+	// Set on events about a whole tenant, the others take it from their transaction or account
+	tenant      TenantID
+	transaction *Transaction
+	account     *Account
+	detail      string
+	at          time.Time
+}
+
+// Interface for delivering events to whoever is interested in them
+type EventPublisher interface {
+	publish(e Event)
+}
+
+// Writes events to the standard logger
+type LogEventPublisher struct{}
+
+func (p *LogEventPublisher) publish(e Event) {
+	if e.transaction != nil {
+		log.Printf("%s: transaction %d %s", e.kind, e.transaction.id, e.detail)
+		return
+	}
+
+	if e.account != nil {
+		log.Printf("%s: account %d %s", e.kind, e.account.id, e.detail)
+		return
+	}
+
+	log.Printf("%s: tenant %q %s", e.kind, e.tenant, e.detail)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Version of the event contract, bumped on any change that isn't backwards compatible
+const EventSchemaV1 = "dip.event.v1"
+
+// Wire form of an event, described by schemas/event.v1.schema.json and schemas/event.v1.proto
+// Fields can be added but never renamed or removed
+type EventV1 struct {
+	Schema        string    `json:"schema"`
+	Kind          EventKind `json:"kind"`
+	Tenant        TenantID  `json:"tenant"`
+	TransactionID uint32    `json:"transaction_id,omitempty"`
+	AccountID     uint32    `json:"account_id,omitempty"`
+	Detail        string    `json:"detail,omitempty"`
+	At            time.Time `json:"at"`
+}
+
+// Converts an event to its wire form
+func (e Event) v1() EventV1 {
+	wire := EventV1{Schema: EventSchemaV1, Kind: e.kind, Tenant: e.tenant, Detail: e.detail, At: e.at}
+
+	if e.transaction != nil {
+		wire.Tenant = e.transaction.tenant
+		wire.TransactionID = e.transaction.id
+	}
+
+	if e.account != nil {
+		wire.Tenant = e.account.tenant
+		wire.AccountID = e.account.id
+	}
+
+	return wire
+}
+
+// Writes events as newline delimited JSON following the versioned schema
+type JSONEventPublisher struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+// Creates a publisher that writes to w
+func NewJSONEventPublisher(w io.Writer) *JSONEventPublisher {
+	return &JSONEventPublisher{encoder: json.NewEncoder(w)}
+}
+
+func (p *JSONEventPublisher) publish(e Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.encoder.Encode(e.v1()); err != nil {
+		log.Println(err)
+	}
+}
+
+// How long the receiver of a webhook delivery should accept its signature
+const webhookSignatureTTL = 5 * time.Minute
+
+// Posts events as JSON to a receiver's endpoint, following the versioned schema
+// Every delivery is signed in the Dip-Signature header, so the receiver can check it came from the service
+type WebhookEventPublisher struct {
+	endpoint string
+	secret   []byte
+	client   *http.Client
+	now      func() time.Time
+}
+
+// Creates a publisher that delivers to endpoint, signed with secret
+func NewWebhookEventPublisher(endpoint string, secret []byte) *WebhookEventPublisher {
+	return &WebhookEventPublisher{
+		endpoint: endpoint,
+		secret:   secret,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		now:      time.Now,
+	}
+}
+
+// Delivery failures are logged, events are never retried
+func (p *WebhookEventPublisher) publish(e Event) {
+	if err := p.deliver(e); err != nil {
+		log.Println(err)
+	}
+}
+
+// Posts one event to the endpoint
+func (p *WebhookEventPublisher) deliver(e Event) error {
+	body, err := json.Marshal(e.v1())
+
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, p.endpoint, bytes.NewReader(body))
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(signatureHeader, signWebhookPayload(p.secret, body, rand.Text(), p.now().Add(webhookSignatureTTL)))
+
+	res, err := p.client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("webhook endpoint answered with status %d", res.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Returned by handlers and repositories when a fault is injected in their place
+var ErrInjectedFault = newError(INTERNAL, "Injected fault")
+
+// Models the failures injected into a service to test how its users cope with them
+// Rates go from 0, never, to 1, every call
+type FaultInjector struct {
+	mu     sync.Mutex
+	random *rand.Rand
+	// Chance a payment handler fails instead of paying
+	handlerErrorRate float64
+	// Chance a repository call is delayed, and by how much
+	latencyRate float64
+	latency     time.Duration
+	// Chance a repository call fails
+	repositoryErrorRate float64
+	// Chance an event is never published
+	dropRate float64
+}
+
+// Creates an injector that injects nothing yet, drawing its chances from seed so runs can be repeated
+func NewFaultInjector(seed uint64) *FaultInjector {
+	return &FaultInjector{random: rand.New(rand.NewPCG(seed, seed))}
+}
+
+// Fails payment handlers at rate
+func (f *FaultInjector) HandlerErrors(rate float64) *FaultInjector {
+	f.handlerErrorRate = rate
+	return f
+}
+
+// Delays repository calls by latency at rate
+func (f *FaultInjector) RepositoryLatency(rate float64, latency time.Duration) *FaultInjector {
+	f.latencyRate = rate
+	f.latency = latency
+	return f
+}
+
+// Fails repository calls at rate
+func (f *FaultInjector) RepositoryErrors(rate float64) *FaultInjector {
+	f.repositoryErrorRate = rate
+	return f
+}
+
+// Drops events at rate
+func (f *FaultInjector) DroppedEvents(rate float64) *FaultInjector {
+	f.dropRate = rate
+	return f
+}
+
+// Draws whether something happening at rate happens this time
+func (f *FaultInjector) roll(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.random.Float64() < rate
+}
+
+// Runs before every repository call, sleeping or failing as the rates say
+func (f *FaultInjector) repositoryCall() error {
+	if f.roll(f.latencyRate) {
+		time.Sleep(f.latency)
+	}
+
+	if f.roll(f.repositoryErrorRate) {
+		return ErrInjectedFault
+	}
+
+	return nil
+}
+
+// Fails payments as the injector says before the handler sees them
+type FaultyTransactionHandler struct {
+	next   TransactionHandler
+	faults *FaultInjector
+}
+
+func (th *FaultyTransactionHandler) pay(ctx context.Context, t *Transaction) error {
+	if th.faults.roll(th.faults.handlerErrorRate) {
+		return ErrInjectedFault
+	}
+
+	return th.next.pay(ctx, t)
+}
+
+// Delays and fails the calls of another repository as the injector says
+type FaultyRepository struct {
+	next   Repository
+	faults *FaultInjector
+}
+
+func (r *FaultyRepository) saveAccount(a *Account) error {
+	if err := r.faults.repositoryCall(); err != nil {
+		return err
+	}
+
+	return r.next.saveAccount(a)
+}
+
+func (r *FaultyRepository) saveAccounts(accounts []*Account) error {
+	if err := r.faults.repositoryCall(); err != nil {
+		return err
+	}
+
+	return r.next.saveAccounts(accounts)
+}
+
+func (r *FaultyRepository) findAccount(tenant TenantID, id uint32) (*Account, error) {
+	if err := r.faults.repositoryCall(); err != nil {
+		return nil, err
+	}
+
+	return r.next.findAccount(tenant, id)
+}
+
+func (r *FaultyRepository) listAccounts(tenant TenantID) ([]*Account, error) {
+	if err := r.faults.repositoryCall(); err != nil {
+		return nil, err
+	}
+
+	return r.next.listAccounts(tenant)
+}
+
+func (r *FaultyRepository) findAccounts(tenant TenantID, q AccountQuery) ([]*Account, error) {
+	if err := r.faults.repositoryCall(); err != nil {
+		return nil, err
+	}
+
+	return r.next.findAccounts(tenant, q)
+}
+
+func (r *FaultyRepository) saveTransaction(t *Transaction) error {
+	if err := r.faults.repositoryCall(); err != nil {
+		return err
+	}
+
+	return r.next.saveTransaction(t)
+}
+
+func (r *FaultyRepository) findTransaction(tenant TenantID, id uint32) (*Transaction, error) {
+	if err := r.faults.repositoryCall(); err != nil {
+		return nil, err
+	}
+
+	return r.next.findTransaction(tenant, id)
+}
+
+func (r *FaultyRepository) listTransactions(tenant TenantID) ([]*Transaction, error) {
+	if err := r.faults.repositoryCall(); err != nil {
+		return nil, err
+	}
+
+	return r.next.listTransactions(tenant)
+}
+
+func (r *FaultyRepository) deleteTransaction(tenant TenantID, id uint32) error {
+	if err := r.faults.repositoryCall(); err != nil {
+		return err
+	}
+
+	return r.next.deleteTransaction(tenant, id)
+}
+
+func (r *FaultyRepository) tenants() ([]TenantID, error) {
+	if err := r.faults.repositoryCall(); err != nil {
+		return nil, err
+	}
+
+	return r.next.tenants()
+}
+
+// Drops the events of another publisher as the injector says
+type FaultyEventPublisher struct {
+	next   EventPublisher
+	faults *FaultInjector
+}
+
+func (p *FaultyEventPublisher) publish(e Event) {
+	if p.faults.roll(p.faults.dropRate) {
+		return
+	}
+
+	p.next.publish(e)
+}
+
+// Injects the faults of f into the service's handlers, repository and events, nil takes them out
+// Like SetRepository, must be called before the service takes traffic
+func (s *Service) InjectFaults(role Role, f *FaultInjector) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r, ok := s.repository.(*FaultyRepository); ok {
+		s.repository = r.next
+	}
+
+	if p, ok := s.events.(*FaultyEventPublisher); ok {
+		s.events = p.next
+	}
+
+	s.faults = f
+
+	if f != nil {
+		s.repository = &FaultyRepository{next: s.repository, faults: f}
+		s.events = &FaultyEventPublisher{next: s.events, faults: f}
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"time"
+)
+
+// Sets the house account that collects a tenant's fees and funds its discounts
+func (s *Service) SetFeeAccount(role Role, a *Account) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.feeAccounts[a.tenant] = a
+
+	return nil
+}
+
+// Checks if an account holds the service's own funds: the fee, exchange, reward pool or tax account of its tenant
+func (s *Service) houseAccount(a *Account) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.feeAccounts[a.tenant] == a {
+		return true
+	}
+
+	for _, exchange := range s.exchangeAccounts {
+		if exchange == a {
+			return true
+		}
+	}
+
+	if s.gatewayClearing[a.tenant] == a {
+		return true
+	}
+
+	return (s.rewards != nil && s.rewards.pool == a) || (s.tax != nil && s.tax.taxAccount == a)
+}
+
+// Models the fees a tenant collected over a period
+type FeeReport struct {
+	// Surcharges posted to the fee account
+	collected uint64
+	// Discounts the fee account funded
+	funded uint64
+	// What the fee account gained, negative when discounts outweighed fees
+	net int64
+}
+
+// Sums the fees posted to a tenant's fee account by transactions closed between from and to
+func (s *Service) FeeReport(role Role, tenant TenantID, from time.Time, to time.Time) (FeeReport, error) {
+	if err := authorize(role, READ); err != nil {
+		return FeeReport{}, err
+	}
+
+	s.mu.RLock()
+	_, ok := s.feeAccounts[tenant]
+	s.mu.RUnlock()
+
+	if !ok {
+		return FeeReport{}, ErrNoFeeAccount
+	}
+
+	transactions, err := s.closedBetween(tenant, from, to)
+
+	if err != nil {
+		return FeeReport{}, err
+	}
+
+	var report FeeReport
+
+	for _, t := range transactions {
+		if t.fee > 0 {
+			report.collected += uint64(t.fee)
+		} else {
+			report.funded += uint64(-t.fee)
+		}
+		report.net += t.fee
+	}
+
+	return report, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Returned when a payment involves an account frozen after too many blocked payments
+var ErrAccountFrozen = newError(ACCOUNT_FROZEN_ERROR, "Account is frozen")
+
+// Codes of the errors that count as a blocked payment
+var blockedPaymentCodes = map[ErrorCode]bool{
+	DUPLICATE_TRANSACTION: true,
+	RATE_LIMITED:          true,
+	INVALID_SIGNATURE:     true,
+	INVALID_CARD_TOKEN:    true,
+	CONFIRMATION_FAILED:   true,
+	PAYMENT_REFUSED:       true,
+}
+
+// Freezes the sender once it has this many blocked payments within the window
+type FreezeRule struct {
+	blocked int
+	window  time.Duration
+}
+
+// Keeps track of blocked payments and decides when a sender must be frozen
+type FreezeRules struct {
+	mu    sync.Mutex
+	rules []FreezeRule
+	// When each sender's recent payments were blocked, oldest first
+	history map[*Account][]time.Time
+}
+
+// Creates rules that freeze a sender as soon as any of them is broken
+func NewFreezeRules(rules ...FreezeRule) *FreezeRules {
+	return &FreezeRules{rules: rules, history: map[*Account][]time.Time{}}
+}
+
+// Records a blocked payment of a sender
+// Returns the rule it broke, if any
+func (r *FreezeRules) record(a *Account, at time.Time) (FreezeRule, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var longest time.Duration
+	for _, rule := range r.rules {
+		if rule.window > longest {
+			longest = rule.window
+		}
+	}
+
+	history := append(r.history[a], at)
+	for len(history) > 0 && at.Sub(history[0]) > longest {
+		history = history[1:]
+	}
+	r.history[a] = history
+
+	for _, rule := range r.rules {
+		count := 0
+		for _, blockedAt := range history {
+			if at.Sub(blockedAt) <= rule.window {
+				count++
+			}
+		}
+
+		if count >= rule.blocked {
+			delete(r.history, a)
+			return rule, true
+		}
+	}
+
+	return FreezeRule{}, false
+}
+
+// Returns ErrAccountFrozen when either side of the transaction is frozen
+func (s *Service) checkFrozen(t *Transaction) error {
+	return s.checkAccountsFrozen(t.sender, t.recipient)
+}
+
+// Returns ErrAccountFrozen if any of the accounts is frozen
+func (s *Service) checkAccountsFrozen(accounts ...*Account) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, a := range accounts {
+		if a.frozen {
+			return ErrAccountFrozen
+		}
+	}
+
+	return nil
+}
+
+// Counts a failed payment against its sender when it was blocked, freezing the sender if a rule is broken
+func (s *Service) watchBlockedPayments(t *Transaction, err error) {
+	s.mu.RLock()
+	rules := s.freezeRules
+	s.mu.RUnlock()
+
+	if rules == nil || err == nil || !blockedPaymentCodes[errorCode(err)] {
+		return
+	}
+
+	rule, broken := rules.record(t.sender, s.now())
+
+	if !broken {
+		return
+	}
+
+	reason := fmt.Sprintf("%d blocked payments within %s", rule.blocked, rule.window)
+
+	s.mu.Lock()
+	t.sender.frozen = true
+	s.auditTrail = append(s.auditTrail, AuditRecord{
+		transactionID: t.id,
+		account:       t.sender,
+		operation:     FREEZE,
+		reason:        reason,
+		at:            s.now(),
+	})
+	s.mu.Unlock()
+
+	s.publish(Event{kind: ACCOUNT_FROZEN, account: t.sender, detail: reason})
+}
+
+// Lets a frozen account make and receive payments again
+// The reason is kept in the audit trail
+func (s *Service) Unfreeze(role Role, a *Account, reason string) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	if reason == "" {
+		return newError(INVALID_ARGUMENT, "Unfreezing an account needs a reason")
+	}
+
+	s.mu.Lock()
+	if !a.frozen {
+		s.mu.Unlock()
+		return newError(INVALID_STATE, "Account is not frozen")
+	}
+
+	a.frozen = false
+	s.auditTrail = append(s.auditTrail, AuditRecord{
+		account:   a,
+		operation: UNFREEZE,
+		reason:    reason,
+		at:        s.now(),
+	})
+	s.mu.Unlock()
+
+	s.publish(Event{kind: ACCOUNT_UNFROZEN, account: a, detail: s.Redact(PII_NOTE, reason)})
+
+	return nil
+}
+
+// Changes the rules that freeze senders with too many blocked payments
+// Nil rules turn freezing off, accounts already frozen stay frozen
+func (s *Service) SetFreezeRules(role Role, rules *FreezeRules) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.freezeRules = rules
+
+	return nil
+}
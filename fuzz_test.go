@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// All of the operations a fuzz program is made of
+type fuzzOp byte
+
+const (
+	FUZZ_CREATE_ACCOUNT fuzzOp = iota
+	FUZZ_PAY
+	FUZZ_CANCEL
+	FUZZ_REFUND
+	FUZZ_EXPIRE
+	// Runs the next few operations at the same time
+	FUZZ_CONCURRENTLY
+	fuzzOps
+)
+
+var fuzzOpNames = [fuzzOps]string{"create account", "pay", "cancel", "refund", "expire", "concurrently"}
+
+func (op fuzzOp) String() string {
+	return fuzzOpNames[op]
+}
+
+// Most accounts a program creates, so programs stay small enough to read
+const fuzzMaxAccounts = 200
+
+// Most operations run at the same time
+const fuzzMaxConcurrent = 4
+
+// Reads the operations of a program and their operands, running out of bytes reads zeros
+type fuzzReader struct {
+	program []byte
+	next    int
+}
+
+func (r *fuzzReader) done() bool {
+	return r.next >= len(r.program)
+}
+
+func (r *fuzzReader) byte() byte {
+	if r.done() {
+		return 0
+	}
+
+	r.next++
+
+	return r.program[r.next-1]
+}
+
+// Picks one of n things, n must not be zero
+func (r *fuzzReader) index(n int) int {
+	return int(r.byte()) % n
+}
+
+// Models the state a fuzz program runs against and what it expects of it
+type fuzzRun struct {
+	service *Service
+	house   *Account
+
+	mu           sync.Mutex
+	accounts     []*Account
+	transactions []*Transaction
+	// Card token of each account, for credit payments
+	cards map[*Account]string
+	// Balance each account was created with, the ledger must explain every change since
+	opening map[*Account]int64
+	// Money put into the service by created accounts, balances must always add up to it
+	funded uint64
+	// Terminal states transactions reached, which they must never leave
+	final map[*Transaction]TransactionState
+}
+
+// Runs programs of operations against a fresh sandbox service, checking the ledger invariants after every step
+// Errors returned by the service are expected and don't fail a program
+// Steps run at the same time only replay the same way when they don't race, the others are exact
+func FuzzPayments(f *testing.F) {
+	f.Add([]byte{0, 100, 0, 0, 50, 0, 1, 0, 1, 20, 0})
+	f.Add([]byte{0, 100, 10, 0, 0, 0, 1, 0, 1, 30, 2, 3, 0, 10, 1, 1, 0, 40, 2})
+	f.Add([]byte{0, 200, 0, 0, 0, 0, 5, 3, 1, 0, 1, 90, 1, 1, 1, 0, 90, 0, 3, 0, 60})
+	f.Add([]byte{0, 50, 50, 0, 50, 50, 5, 4, 1, 0, 1, 40, 2, 1, 1, 0, 40, 2, 3, 0, 20, 4, 0})
+
+	f.Fuzz(func(t *testing.T, program []byte) {
+		r := &fuzzReader{program: program}
+		run := newFuzzRun(t)
+
+		for step := 0; !r.done(); step++ {
+			op := fuzzOp(r.index(int(fuzzOps)))
+
+			if op == FUZZ_CONCURRENTLY {
+				run.concurrently(t, r)
+			} else {
+				run.prepare(t, op, r)()
+			}
+
+			if reason := run.check(); reason != "" {
+				t.Fatalf("step %d (%s): %s", step, op, reason)
+			}
+		}
+	})
+}
+
+// Creates a sandbox service with a funded house account
+func newFuzzRun(t *testing.T) *fuzzRun {
+	s := NewSandboxService(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), 0)
+
+	house := &Account{id: 1, name: "House", balance: 1 << 20}
+
+	if err := s.AddAccount(ADMIN, house); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.SetFeeAccount(ADMIN, house); err != nil {
+		t.Fatal(err)
+	}
+
+	return &fuzzRun{
+		service: s,
+		house:   house,
+		cards:   map[*Account]string{},
+		opening: map[*Account]int64{house: int64(house.balance)},
+		funded:  uint64(house.balance),
+		final:   map[*Transaction]TransactionState{},
+	}
+}
+
+// Runs the next few operations of the program at the same time, and waits for them
+func (run *fuzzRun) concurrently(t *testing.T, r *fuzzReader) {
+	var wg sync.WaitGroup
+
+	for range 2 + r.index(fuzzMaxConcurrent-1) {
+		op := fuzzOp(r.index(int(fuzzOps)))
+
+		if op == FUZZ_CONCURRENTLY {
+			continue
+		}
+
+		wg.Go(run.prepare(t, op, r))
+	}
+
+	wg.Wait()
+}
+
+// Reads the operands of an operation from the program, and returns what runs it
+func (run *fuzzRun) prepare(t *testing.T, op fuzzOp, r *fuzzReader) func() {
+	ctx := context.Background()
+	s := run.service
+
+	switch op {
+	case FUZZ_CREATE_ACCOUNT:
+		balance, limit := uint32(r.byte())*10, uint32(r.byte())*10
+
+		run.mu.Lock()
+		defer run.mu.Unlock()
+
+		if len(run.accounts) == fuzzMaxAccounts {
+			return func() {}
+		}
+
+		// Accounts are created up front, so those made in the same batch get different ids
+		id := uint32(len(run.accounts) + 2)
+		a := &Account{id: id, name: "Account", balance: balance, creditLimit: limit}
+		card, err := s.tokenVault.tokenize("4242424242424" + strconv.Itoa(1000+int(id)))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.AddAccount(ADMIN, a); err != nil {
+			t.Fatal(err)
+		}
+
+		run.accounts = append(run.accounts, a)
+		run.cards[a] = card
+		run.opening[a] = int64(balance)
+		run.funded += uint64(balance)
+
+		return func() {}
+	case FUZZ_PAY:
+		from, to, amount, method := r.byte(), r.byte(), uint32(r.byte()), r.byte()
+
+		run.mu.Lock()
+		defer run.mu.Unlock()
+
+		if len(run.accounts) == 0 {
+			return func() {}
+		}
+
+		sender := run.accounts[int(from)%len(run.accounts)]
+		b := NewTransfer().From(sender).To(run.accounts[int(to)%len(run.accounts)]).Amount(amount)
+
+		switch method % 3 {
+		case 1:
+			b.Via(CASH)
+		case 2:
+			b.Via(CREDIT).WithCard(run.cards[sender])
+		}
+
+		payment, err := b.Build()
+
+		if err != nil {
+			return func() {}
+		}
+
+		run.transactions = append(run.transactions, payment)
+
+		return func() { s.Pay(ctx, OPERATOR, payment) }
+	case FUZZ_CANCEL:
+		if payment := run.transaction(r); payment != nil {
+			return func() { s.Cancel(OPERATOR, payment, "fuzz") }
+		}
+	case FUZZ_REFUND:
+		if payment := run.transaction(r); payment != nil {
+			amount := uint32(r.byte())
+
+			return func() {
+				if refund, err := s.Refund(ctx, OPERATOR, payment, amount); err == nil {
+					run.mu.Lock()
+					run.transactions = append(run.transactions, refund)
+					run.mu.Unlock()
+				}
+			}
+		}
+	case FUZZ_EXPIRE:
+		if payment := run.transaction(r); payment != nil {
+			return func() { s.Expire(ctx, OPERATOR, payment) }
+		}
+	}
+
+	return func() {}
+}
+
+// Picks one of the transactions made so far, nil when there are none
+func (run *fuzzRun) transaction(r *fuzzReader) *Transaction {
+	i := r.byte()
+
+	run.mu.Lock()
+	defer run.mu.Unlock()
+
+	if len(run.transactions) == 0 {
+		return nil
+	}
+
+	return run.transactions[int(i)%len(run.transactions)]
+}
+
+// Returns the first invariant that doesn't hold, empty when they all do
+func (run *fuzzRun) check() string {
+	accounts := append([]*Account{run.house}, run.accounts...)
+	var total uint64
+
+	for _, a := range accounts {
+		total += uint64(a.balance)
+	}
+
+	if total != run.funded {
+		return fmt.Sprintf("balances add up to %d but %d was put in", total, run.funded)
+	}
+
+	entries, _, err := run.service.ledgerLog().after(0)
+
+	if err != nil {
+		return err.Error()
+	}
+
+	posted := map[uint32]int{}
+	moved := map[string]int64{}
+
+	for _, e := range entries {
+		posted[e.transactionID]++
+
+		var sum int64
+
+		for _, p := range e.postings {
+			sum += p.amount
+			moved[p.account] += p.amount
+		}
+
+		if sum != 0 {
+			return fmt.Sprintf("ledger entry %d doesn't balance, its postings add up to %d", e.sequence, sum)
+		}
+	}
+
+	// What the ledger says each account gained and owes must be what its balance and credit actually did
+	for _, a := range accounts {
+		name := defaultChartOfAccounts.name(a, run.house, nil)
+
+		if delta := int64(a.balance) - run.opening[a]; moved[name] != delta {
+			return fmt.Sprintf("ledger moved %d on account %d but its balance changed by %d", moved[name], a.id, delta)
+		}
+
+		if owed := -moved[name+":Credit"]; owed != int64(a.creditUsed) {
+			return fmt.Sprintf("ledger has account %d owing %d of credit but it used %d", a.id, owed, a.creditUsed)
+		}
+	}
+
+	for _, t := range run.transactions {
+		if state, ok := run.final[t]; ok && t.state != state {
+			return fmt.Sprintf("transaction %d left terminal state %s for %s", t.id, state, t.state)
+		}
+
+		switch t.state {
+		case CLOSED, CANCELLED, EXPIRED:
+			run.final[t] = t.state
+		}
+
+		if t.reversed > t.amount {
+			return fmt.Sprintf("transaction %d reversed %d of %d", t.id, t.reversed, t.amount)
+		}
+
+		if t.state == CLOSED && posted[t.id] != 1 {
+			return fmt.Sprintf("closed transaction %d was posted to the ledger %d times", t.id, posted[t.id])
+		}
+
+		if t.state != CLOSED && posted[t.id] != 0 {
+			return fmt.Sprintf("transaction %d was posted to the ledger but is %s", t.id, t.state)
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+)
+
+// Rate between two currencies, with the spread the house keeps on conversions
+type ExchangeRate struct {
+	// Units of the target currency per unit of the source, in millionths
+	micros uint64
+	// Share of the converted amount kept by the house
+	spreadBasisPoints uint32
+}
+
+// Interface for looking up exchange rates
+type ExchangeRateProvider interface {
+	rate(ctx context.Context, from string, to string) (ExchangeRate, error)
+}
+
+// Serves rates that were set by hand
+type StaticRateProvider struct {
+	mu    sync.RWMutex
+	rates map[[2]string]ExchangeRate
+}
+
+// Creates a provider with no rates
+func NewStaticRateProvider() *StaticRateProvider {
+	return &StaticRateProvider{rates: map[[2]string]ExchangeRate{}}
+}
+
+// Sets the rate from one currency to another, the opposite direction needs a rate of its own
+func (p *StaticRateProvider) set(from string, to string, rate ExchangeRate) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.rates[[2]string{from, to}] = rate
+}
+
+func (p *StaticRateProvider) rate(ctx context.Context, from string, to string) (ExchangeRate, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	rate, ok := p.rates[[2]string{from, to}]
+
+	if !ok {
+		return ExchangeRate{}, newError(NOT_FOUND, "No exchange rate for the currency pair")
+	}
+
+	return rate, nil
+}
+
+// Models a conversion between two accounts of the same owner
+type Exchange struct {
+	from   *Account
+	to     *Account
+	amount uint32
+	rate   ExchangeRate
+	// What the target account got, after the spread
+	converted uint32
+	// What the house kept, in the target currency
+	spread uint32
+	// Source currency into the house account of that currency, then target currency out of the house account of the other
+	legs [2]*Transaction
+	// Saga the legs were posted by, which undid the first when the second failed
+	saga *Saga
+}
+
+// Checks if two accounts belong to the same owner, as wallets of one account or by a shared owner
+func sameOwner(a *Account, b *Account) bool {
+	if a.root() == b.root() {
+		return true
+	}
+
+	for _, owner := range a.root().owners {
+		for _, other := range b.root().owners {
+			if owner == other {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Makes a hold the house's funds in its currency for the exchanges of its tenant
+func (s *Service) SetExchangeAccount(role Role, a *Account) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.exchangeAccounts[tenantKey{a.tenant, a.currency}] = a
+
+	return nil
+}
+
+// Returns the house account holding a tenant's funds in a currency, the fee account when it's in that currency
+// Caller must hold s.mu
+func (s *Service) exchangeAccount(tenant TenantID, currency string) *Account {
+	if a, ok := s.exchangeAccounts[tenantKey{tenant, currency}]; ok {
+		return a
+	}
+
+	if house := s.feeAccounts[tenant]; house != nil && house.currency == currency {
+		return house
+	}
+
+	return nil
+}
+
+// Converts funds between two accounts of the same owner held in different currencies
+// The source amount goes to the house account of its currency and the converted amount, less the spread, comes out of the house account of the target currency
+// Both legs run as a saga, so the first is undone when the second fails, and accounts must be saved in the repository
+func (s *Service) Exchange(ctx context.Context, role Role, from *Account, to *Account, amount uint32) (*Exchange, error) {
+	if err := authorize(role, PAY); err != nil {
+		return nil, err
+	}
+
+	if from.tenant != to.tenant {
+		return nil, ErrCrossTenant
+	}
+
+	if !sameOwner(from, to) {
+		return nil, newError(INVALID_ARGUMENT, "Exchanges need accounts of the same owner")
+	}
+
+	if from.currency == to.currency {
+		return nil, newError(INVALID_ARGUMENT, "Accounts already share a currency")
+	}
+
+	s.mu.RLock()
+	rates := s.rates
+	source, target := s.exchangeAccount(from.tenant, from.currency), s.exchangeAccount(to.tenant, to.currency)
+	s.mu.RUnlock()
+
+	if rates == nil {
+		return nil, newError(MISCONFIGURED, "Service has no exchange rate provider")
+	}
+
+	if source == nil || target == nil {
+		return nil, newError(MISCONFIGURED, "Service has no house account in the currency")
+	}
+
+	rate, err := rates.rate(ctx, from.currency, to.currency)
+
+	if err != nil {
+		return nil, err
+	}
+
+	gross := uint64(amount) * rate.micros / 1_000_000
+
+	if gross == 0 || gross > uint64(^uint32(0)) {
+		return nil, newError(INVALID_AMOUNT, "Invalid amount")
+	}
+
+	spread := s.defaultRounding().share(uint32(gross), rate.spreadBasisPoints)
+	e := &Exchange{from: from, to: to, amount: amount, rate: rate, converted: uint32(gross) - spread, spread: spread}
+
+	ctx, release, err := s.lockAccounts(ctx, from, to, source, target)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer release()
+
+	s.mu.RLock()
+	frozen := from.frozen || to.frozen
+	s.mu.RUnlock()
+
+	if frozen {
+		return nil, ErrAccountFrozen
+	}
+
+	if err := s.checkBalanceCap(ctx, to, e.converted); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.lastExchangeID++
+	id := strconv.FormatUint(uint64(s.lastExchangeID), 10)
+	s.mu.Unlock()
+
+	metadata := map[string]string{
+		"exchange":       id,
+		"fx_rate_micros": strconv.FormatUint(rate.micros, 10),
+		"fx_spread":      strconv.FormatUint(uint64(spread), 10),
+	}
+
+	sg, posted, err := s.startSaga(ctx, []TransferLeg{{from, source, amount}, {target, to, e.converted}}, metadata)
+
+	if err != nil {
+		return nil, err
+	}
+
+	e.saga, e.legs = sg, [2]*Transaction{posted[0], posted[1]}
+
+	e.legs[1].fee = int64(spread)
+	s.save(e.legs[1])
+
+	return e, nil
+}
+
+// Makes exchanges use rates from p
+func (s *Service) SetExchangeRateProvider(role Role, p ExchangeRateProvider) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rates = p
+
+	return nil
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Interface for card processors that authorize and capture payments outside the service
+type Gateway interface {
+	// Holds the amount of a transaction on the card behind a processor payment method
+	authorize(ctx context.Context, t *Transaction, paymentMethod string) (GatewayPayment, error)
+	// Collects an authorized payment
+	capture(ctx context.Context, id string) (GatewayPayment, error)
+	// Gives back part or all of a captured payment
+	// The key names the refund, retries with the same key refund only once
+	refund(ctx context.Context, id string, amount uint32, key string) error
+	// Checks a webhook delivery and returns the update it carries
+	reconcile(payload []byte, signature string) (GatewayEvent, error)
+}
+
+// All of the possible states of a payment at the processor
+type GatewayStatus string
+
+const (
+	GATEWAY_AUTHORIZED GatewayStatus = "authorized"
+	GATEWAY_CAPTURED   GatewayStatus = "captured"
+	GATEWAY_FAILED     GatewayStatus = "failed"
+	GATEWAY_REFUNDED   GatewayStatus = "refunded"
+	// Waiting on the payer, e.g. for 3-D Secure
+	GATEWAY_PENDING GatewayStatus = "pending"
+)
+
+// Models a payment as the processor sees it
+type GatewayPayment struct {
+	id     string
+	status GatewayStatus
+}
+
+// Models an update pushed by the processor
+type GatewayEvent struct {
+	// Id of the delivery, the same on every retry of it
+	id      string
+	payment GatewayPayment
+	// Transaction the payment was made for, read from the metadata sent at authorization
+	tenant        TenantID
+	transactionID uint32
+	// What the processor refunded of the payment so far, across every refund, set on refunds
+	refunded uint32
+}
+
+// Talks to Stripe's PaymentIntents API
+type StripeGateway struct {
+	// API base, https://api.stripe.com unless testing against a mock
+	baseURL       string
+	secretKey     string
+	webhookSecret string
+	currency      string
+	// Oldest webhook signature accepted
+	tolerance time.Duration
+	client    *http.Client
+	now       func() time.Time
+}
+
+// Creates a gateway for a Stripe account
+func NewStripeGateway(secretKey string, webhookSecret string, currency string) *StripeGateway {
+	return &StripeGateway{
+		baseURL:       "https://api.stripe.com",
+		secretKey:     secretKey,
+		webhookSecret: webhookSecret,
+		currency:      currency,
+		tolerance:     5 * time.Minute,
+		client:        &http.Client{Timeout: 30 * time.Second},
+		now:           time.Now,
+	}
+}
+
+// The parts of a PaymentIntent the gateway reads
+type stripeIntent struct {
+	ID       string            `json:"id"`
+	Status   string            `json:"status"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// Error body returned by Stripe
+type stripeError struct {
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Maps PaymentIntent statuses to gateway statuses
+func (i stripeIntent) status() GatewayStatus {
+	switch i.Status {
+	case "requires_capture":
+		return GATEWAY_AUTHORIZED
+	case "succeeded":
+		return GATEWAY_CAPTURED
+	case "canceled", "requires_payment_method":
+		return GATEWAY_FAILED
+	default:
+		return GATEWAY_PENDING
+	}
+}
+
+// Posts a form to the Stripe API and decodes the answer into out
+// The idempotency key makes retries of the same call safe
+func (g *StripeGateway) post(ctx context.Context, path string, form url.Values, idempotencyKey string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.baseURL+path, strings.NewReader(form.Encode()))
+
+	if err != nil {
+		return err
+	}
+
+	req.SetBasicAuth(g.secretKey, "")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	res, err := g.client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		var e stripeError
+		json.NewDecoder(res.Body).Decode(&e)
+
+		if e.Error.Message == "" {
+			e.Error.Message = res.Status
+		}
+
+		return newError(PAYMENT_REFUSED, e.Error.Message)
+	}
+
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+func (g *StripeGateway) authorize(ctx context.Context, t *Transaction, paymentMethod string) (GatewayPayment, error) {
+	id := strconv.FormatUint(uint64(t.id), 10)
+	form := url.Values{
+		"amount":                {strconv.FormatUint(uint64(t.amount), 10)},
+		"currency":              {g.currency},
+		"payment_method":        {paymentMethod},
+		"capture_method":        {"manual"},
+		"confirm":               {"true"},
+		"metadata[tenant]":      {string(t.tenant)},
+		"metadata[transaction]": {id},
+	}
+
+	var intent stripeIntent
+
+	if err := g.post(ctx, "/v1/payment_intents", form, "authorize-"+string(t.tenant)+"-"+id, &intent); err != nil {
+		return GatewayPayment{}, err
+	}
+
+	return GatewayPayment{id: intent.ID, status: intent.status()}, nil
+}
+
+func (g *StripeGateway) capture(ctx context.Context, id string) (GatewayPayment, error) {
+	var intent stripeIntent
+
+	if err := g.post(ctx, "/v1/payment_intents/"+url.PathEscape(id)+"/capture", url.Values{}, "capture-"+id, &intent); err != nil {
+		return GatewayPayment{}, err
+	}
+
+	return GatewayPayment{id: intent.ID, status: intent.status()}, nil
+}
+
+func (g *StripeGateway) refund(ctx context.Context, id string, amount uint32, key string) error {
+	form := url.Values{
+		"payment_intent": {id},
+		"amount":         {strconv.FormatUint(uint64(amount), 10)},
+	}
+
+	var refund struct {
+		ID string `json:"id"`
+	}
+
+	return g.post(ctx, "/v1/refunds", form, "refund-"+id+"-"+key, &refund)
+}
+
+// Stripe event envelope, only the PaymentIntent and Charge events are used
+type stripeEvent struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	Data struct {
+		Object struct {
+			stripeIntent
+			// Set on charge events
+			PaymentIntent  string `json:"payment_intent"`
+			AmountRefunded uint32 `json:"amount_refunded"`
+		} `json:"object"`
+	} `json:"data"`
+}
+
+func (g *StripeGateway) reconcile(payload []byte, signature string) (GatewayEvent, error) {
+	if err := g.verifySignature(payload, signature); err != nil {
+		return GatewayEvent{}, err
+	}
+
+	var e stripeEvent
+
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return GatewayEvent{}, err
+	}
+
+	object := e.Data.Object
+	payment := GatewayPayment{id: object.ID, status: object.status()}
+
+	switch e.Type {
+	case "payment_intent.amount_capturable_updated":
+		payment.status = GATEWAY_AUTHORIZED
+	case "payment_intent.succeeded":
+		payment.status = GATEWAY_CAPTURED
+	case "payment_intent.payment_failed", "payment_intent.canceled":
+		payment.status = GATEWAY_FAILED
+	case "charge.refunded":
+		payment = GatewayPayment{id: object.PaymentIntent, status: GATEWAY_REFUNDED}
+	default:
+		return GatewayEvent{}, newError(INVALID_ARGUMENT, "Unsupported gateway event")
+	}
+
+	// Charges carry the total refunded so far, refunds may be partial
+	event := GatewayEvent{id: e.ID, payment: payment, tenant: TenantID(object.Metadata["tenant"]), refunded: object.AmountRefunded}
+
+	if id, err := strconv.ParseUint(object.Metadata["transaction"], 10, 32); err == nil {
+		event.transactionID = uint32(id)
+	}
+
+	return event, nil
+}
+
+// Checks a Stripe-Signature header, t=<unix time>,v1=<hex HMAC-SHA256 of "<t>.<payload>">
+func (g *StripeGateway) verifySignature(payload []byte, header string) error {
+	var timestamp string
+	var signatures []string
+
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(part, "=")
+
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+
+	if err != nil || g.now().Sub(time.Unix(seconds, 0)) > g.tolerance {
+		return ErrInvalidSignature
+	}
+
+	mac := hmac.New(sha256.New, []byte(g.webhookSecret))
+	io.WriteString(mac, timestamp+".")
+	mac.Write(payload)
+	expected := hex.EncodeToString(mac.Sum(nil))
+
+	for _, signature := range signatures {
+		if hmac.Equal([]byte(expected), []byte(signature)) {
+			return nil
+		}
+	}
+
+	return ErrInvalidSignature
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"text/template"
+)
+
+// Identifies a language messages can be rendered in, as a BCP 47 tag
+type Locale string
+
+const (
+	EN    Locale = "en"
+	PT_BR Locale = "pt-BR"
+)
+
+// Locale used when nothing better is known, messages are written in it
+const defaultLocale = EN
+
+// Returns the locales to try in order, e.g. pt-BR, pt and then en
+func (l Locale) fallbacks() []Locale {
+	chain := []Locale{}
+
+	if l != "" {
+		chain = append(chain, l)
+	}
+
+	if i := strings.Index(string(l), "-"); i > 0 {
+		chain = append(chain, l[:i])
+	}
+
+	return append(chain, defaultLocale)
+}
+
+// Translations of the error messages, keyed by the english message
+var errorTranslations = map[Locale]map[string]string{
+	PT_BR: {
+		"Account doesn't have enough balance to open the deposit":      "A conta não tem saldo suficiente para abrir o depósito",
+		"Account doesn't have enough balance to pay the statement":     "A conta não tem saldo suficiente para pagar a fatura",
+		"Account is not locked by the operation":                       "A conta não está bloqueada pela operação",
+		"Accounts already share a currency":                            "As contas já têm a mesma moeda",
+		"Accounts are already locked by the operation":                 "As contas já estão bloqueadas pela operação",
+		"Accounts can't be deleted":                                    "Contas não podem ser excluídas",
+		"Accounts need an id":                                          "As contas precisam de um id",
+		"Account has no email address":                                 "A conta não tem endereço de e-mail",
+		"Account has no phone number":                                  "A conta não tem número de telefone",
+		"Account id is already taken":                                  "O id da conta já está em uso",
+		"Account is frozen":                                            "A conta está congelada",
+		"Account is not frozen":                                        "A conta não está congelada",
+		"Adjustments need an amount":                                   "Ajustes precisam de um valor",
+		"Alias can't be empty":                                         "O apelido não pode ser vazio",
+		"Alias is already taken":                                       "O apelido já está em uso",
+		"Amount is above the mandate limit":                            "O valor está acima do limite do mandato",
+		"Amount is above the maximum of the payment method":            "O valor está acima do máximo do método de pagamento",
+		"Amount is below the minimum of the payment method":            "O valor está abaixo do mínimo do método de pagamento",
+		"Amount is more than what is left of the transaction":          "O valor é maior do que o que resta da transação",
+		"Amount is more than what is owed on the statement":            "O valor é maior do que o devido na fatura",
+		"Amount is not in the currency of the accounts":                "O valor não está na moeda das contas",
+		"Amounts need a currency":                                      "Valores precisam de uma moeda",
+		"Avatars must be http or https URLs":                           "Avatares precisam ser URLs http ou https",
+		"Can't pay a cancelled transaction":                            "Não é possível pagar uma transação cancelada",
+		"Can't pay an already closed transaction":                      "Não é possível pagar uma transação já fechada",
+		"Card number can't be empty":                                   "O número do cartão não pode ser vazio",
+		"Card token expired":                                           "O token do cartão expirou",
+		"Cash transactions require a fee account":                      "Transações em dinheiro exigem uma conta de tarifas",
+		"Closed transactions can only be corrected through the ledger": "Transações fechadas só podem ser corrigidas pelo livro contábil",
+		"Confirmation timed out":                                       "A confirmação expirou",
+		"Corrections need a reason":                                    "Correções precisam de um motivo",
+		"Could find a valid handler":                                   "Não foi possível encontrar um processador válido",
+		"Credit transactions require a fee account":                    "Transações de crédito exigem uma conta de tarifas",
+		"Credit transactions require a token vault":                    "Transações de crédito exigem um cofre de tokens",
+		"Credit transfers need a card token":                           "Transferências de crédito precisam de um token de cartão",
+		"Crypto transactions require a chain watcher":                  "Transações cripto exigem um observador de blockchain",
+		"Cutoff can't be in the future":                                "O horário de corte não pode estar no futuro",
+		"Deposit is already closed":                                    "O depósito já está encerrado",
+		"Dump checksum doesn't match its data":                         "O checksum do dump não confere com os dados",
+		"Dump holds records the service already has":                   "O dump contém registros que o serviço já tem",
+		"Dump holds the same account twice":                            "O dump contém a mesma conta duas vezes",
+		"Dump holds the same record twice":                             "O dump contém o mesmo registro duas vezes",
+		"Dump is not valid JSON":                                       "O dump não é um JSON válido",
+		"Dump refers to a transaction it doesn't hold":                 "O dump se refere a uma transação que ele não contém",
+		"Dump refers to an account it doesn't hold":                    "O dump se refere a uma conta que ele não contém",
+		"Endpoint version was retired":                                 "A versão do endpoint foi desativada",
+		"Exchanges need accounts of the same owner":                    "Câmbios precisam de contas do mesmo titular",
+		"Fee account doesn't have enough balance to fund the credit":   "A conta de tarifas não tem saldo suficiente para financiar o crédito",
+		"Fee account doesn't have enough balance to fund the discount": "A conta de tarifas não tem saldo suficiente para financiar o desconto",
+		"Fee was already waived":                                       "A tarifa já foi dispensada",
+		"Amounts must be whole units":                                  "Valores devem ser unidades inteiras",
+		"Gateway payment doesn't match the transaction":                "O pagamento do gateway não corresponde à transação",
+		"Gateway refunds require a clearing account":                   "Reembolsos pelo gateway exigem uma conta de compensação",
+		"Injected fault":                                               "Falha injetada",
+		"Invalid amount":                                               "Valor inválido",
+		"Invalid API key":                                              "Chave de API inválida",
+		"Invalid BIC":                                                  "BIC inválido",
+		"Invalid confirmation code":                                    "Código de confirmação inválido",
+		"Invalid promo code":                                           "Código promocional inválido",
+		"Invalid transaction signature":                                "Assinatura da transação inválida",
+		"Ledger is already closed at the cutoff":                       "O livro contábil já está fechado no horário de corte",
+		"Ledger sequence is no longer kept":                            "A sequência do razão não é mais mantida",
+		"Ledger sequence is not a number":                              "A sequência do razão não é um número",
+		"Loan is already repaid":                                       "O empréstimo já foi quitado",
+		"Loans need a principal and at least one installment":          "Empréstimos precisam de um principal e de pelo menos uma parcela",
+		"Logo must be a JPEG image":                                    "O logotipo precisa ser uma imagem JPEG",
+		"Mandate was revoked":                                          "O mandato foi revogado",
+		"Minimum amount can't be above the maximum":                    "O valor mínimo não pode ser maior que o máximo",
+		"No exchange rate for the currency pair":                       "Não há taxa de câmbio para o par de moedas",
+		"Not found":                                                    "Não encontrado",
+		"One account can't grant a mandate to itself":                  "Uma conta não pode conceder um mandato a si mesma",
+		"One account can't make a transaction to itself":               "Uma conta não pode fazer uma transação para si mesma",
+		"Only closed transactions can be reversed":                     "Apenas transações fechadas podem ser estornadas",
+		"Only merchants have a category":                               "Apenas comerciantes têm uma categoria",
+		"Only owners of the sender can approve the transaction":        "Apenas titulares do pagador podem aprovar a transação",
+		"Only owners of the sender can reject the transaction":         "Apenas titulares do pagador podem rejeitar a transação",
+		"Payment declined by the sandbox":                              "Pagamento recusado pela sandbox",
+		"Payment method is already handled by the service":             "O método de pagamento já é tratado pelo serviço",
+		"Payment method's handler didn't answer":                       "O processador do meio de pagamento não respondeu",
+		"Payment timed out":                                            "O pagamento excedeu o tempo limite",
+		"Payment was declined by the gateway":                          "O pagamento foi recusado pelo gateway",
+		"Payment would take the recipient above its maximum balance":   "O pagamento levaria o recebedor acima do saldo máximo",
+		"Plugin Handler doesn't implement ExternalHandler":             "O Handler do plugin não implementa ExternalHandler",
+		"Processor is closed":                                          "O processador está fechado",
+		"Processors need at least one worker":                          "Processadores precisam de pelo menos um worker",
+		"Promo codes can't discount more than the whole fee":           "Códigos promocionais não podem descontar mais do que a tarifa inteira",
+		"Rate limit exceeded":                                          "Limite de requisições excedido",
+		"Receipts are only issued for paid transactions":               "Recibos só são emitidos para transações pagas",
+		"Remote handlers need an HTTP client":                          "Handlers remotos precisam de um cliente HTTP",
+		"Request body is not a valid transaction":                      "O corpo da requisição não é uma transação válida",
+		"Reversals need an amount":                                     "Estornos precisam de um valor",
+		"Role is not allowed to perform this operation":                "O papel não tem permissão para realizar esta operação",
+		"Sagas need at least one leg":                                  "Sagas precisam de pelo menos uma etapa",
+		"Sender doesn't have enough balance to make transaction":       "O pagador não tem saldo suficiente para fazer a transação",
+		"Sender doesn't have enough credit to make transaction":        "O pagador não tem crédito suficiente para fazer a transação",
+		"Service has no account rate limiter":                          "O serviço não tem limitador de requisições por conta",
+		"Service has no exchange rate provider":                        "O serviço não tem provedor de taxas de câmbio",
+		"Service has no house account in the currency":                 "O serviço não tem conta da casa na moeda",
+		"Service has no notifier for the channel":                      "O serviço não tem notificador para o canal",
+		"Service is busy, retry later":                                 "O serviço está ocupado, tente novamente mais tarde",
+		"Service is not a sandbox":                                     "O serviço não é uma sandbox",
+		"Tenant has no fee account":                                    "O inquilino não tem conta de tarifas",
+		"Transaction is not waiting for inbound funds":                 "Transação não está aguardando fundos externos",
+		"Transaction is waiting for its handler to decide":             "Transação está aguardando a decisão do seu processador",
+		"Transaction is waiting for the gateway":                       "A transação está aguardando o gateway",
+		"Transaction is waiting for the payment method's handler":      "Transação está aguardando o processador do meio de pagamento",
+		"Transaction signature expired":                                "Assinatura da transação expirou",
+		"Transaction signature was already used":                       "Assinatura da transação já foi usada",
+		"Transfers need a sender and a recipient":                      "Transferências precisam de um pagador e de um recebedor",
+		"Transfers need an amount":                                     "Transferências precisam de um valor",
+		"Transaction can't move to that state":                         "A transação não pode passar para esse estado",
+		"Transaction doesn't require confirmation":                     "A transação não exige confirmação",
+		"Transaction expired":                                          "A transação expirou",
+		"Transaction is not waiting for approval":                      "A transação não está aguardando aprovação",
+		"Transaction is not waiting for confirmation":                  "A transação não está aguardando confirmação",
+		"Transaction has no fee to waive":                              "A transação não tem tarifa a dispensar",
+		"Transaction is waiting for funds on the chain":                "A transação está aguardando fundos na blockchain",
+		"Transaction looks like a duplicate of a recent payment":       "A transação parece duplicar um pagamento recente",
+		"Transaction requires approval from the account owners":        "A transação exige aprovação dos titulares da conta",
+		"Transaction requires confirmation":                            "A transação exige confirmação",
+		"Transaction was not approved":                                 "A transação não foi aprovada",
+		"Transactions can't cross tenants":                             "Transações não podem atravessar inquilinos",
+		"Unfreezing an account needs a reason":                         "Descongelar uma conta exige um motivo",
+		"Unknown priority":                                             "Prioridade desconhecida",
+		"Unknown statement format":                                     "Formato de extrato desconhecido",
+		"Unsupported dump version":                                     "Versão de dump não suportada",
+		"Unsupported gateway event":                                    "Evento de gateway não suportado",
+		"Unknown adjustment reason":                                    "Motivo de ajuste desconhecido",
+		"Unknown API key":                                              "Chave de API desconhecida",
+		"Unknown ledger format":                                        "Formato de livro contábil desconhecido",
+		"Unknown card token":                                           "Token de cartão desconhecido",
+		"Unknown notification kind":                                    "Tipo de notificação desconhecido",
+		"Waiver rules must end after they start":                       "Regras de isenção precisam terminar depois de começar",
+		"Wallets belong to different accounts":                         "As carteiras pertencem a contas diferentes",
+		"Warmup needs a cached repository":                             "O aquecimento precisa de um repositório com cache",
+	},
+}
+
+// Renders an error in the first locale of the fallback chain that translates it
+// Errors without a translation keep their english message
+func localizeError(err error, locale Locale) string {
+	var coded *CodedError
+
+	if !errors.As(err, &coded) {
+		return err.Error()
+	}
+
+	for _, l := range locale.fallbacks() {
+		if message, ok := errorTranslations[l][coded.message]; ok {
+			return message
+		}
+	}
+
+	return err.Error()
+}
+
+// Returns the locale messages about a transaction are rendered in
+// The locale asked for by the request that submitted it wins over the payer's preference
+func (t *Transaction) preferredLocale() Locale {
+	if t.locale != "" {
+		return t.locale
+	}
+
+	return t.sender.locale
+}
+
+// Renders an error in the locale asked for by a request
+func (s *Service) LocalizeError(err error, locale Locale) string {
+	return localizeError(err, locale)
+}
+
+// Returns the templates of a kind of notification in the first locale of the chain that has them
+func notificationTemplatesFor(kind NotificationKind, locale Locale) ([2]*template.Template, bool) {
+	for _, l := range locale.fallbacks() {
+		if templates, ok := notificationTemplates[l][kind]; ok {
+			return templates, true
+		}
+	}
+
+	return [2]*template.Template{}, false
+}
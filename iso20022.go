@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Namespace of the pacs.008 messages written by the service
+// pain.001 files are read whatever their version, only the fields below are used
+const pacs008Namespace = "urn:iso:std:iso:20022:tech:xsd:pacs.008.001.08"
+
+// Business identifier code of a financial institution, 8 or 11 characters
+var isoBIC = regexp.MustCompile(`^[A-Z]{6}[A-Z2-9][A-NP-Z0-9]([A-Z0-9]{3})?$`)
+
+// Account identification as used by both messages, account ids go in Othr/Id
+type isoAccount struct {
+	ID string `xml:"Id>Othr>Id"`
+}
+
+// Amount with its currency attribute
+type isoAmount struct {
+	Currency string `xml:"Ccy,attr"`
+	Value    string `xml:",chardata"`
+}
+
+// The parts of a pain.001 credit transfer initiation the service uses
+type pain001Document struct {
+	MessageID string `xml:"CstmrCdtTrfInitn>GrpHdr>MsgId"`
+	Payments  []struct {
+		ID           string     `xml:"PmtInfId"`
+		DebtorAcct   isoAccount `xml:"DbtrAcct"`
+		Transactions []struct {
+			EndToEndID   string     `xml:"PmtId>EndToEndId"`
+			Amount       isoAmount  `xml:"Amt>InstdAmt"`
+			CreditorAcct isoAccount `xml:"CdtrAcct"`
+			Remittance   string     `xml:"RmtInf>Ustrd"`
+		} `xml:"CdtTrfTxInf"`
+	} `xml:"CstmrCdtTrfInitn>PmtInf"`
+}
+
+// Parses an ISO 20022 amount, which must be a whole number of units
+func parseISOAmount(value string) (uint32, error) {
+	whole, fraction, _ := strings.Cut(strings.TrimSpace(value), ".")
+
+	if strings.Trim(fraction, "0") != "" {
+		return 0, newError(INVALID_AMOUNT, "Amounts must be whole units")
+	}
+
+	amount, err := strconv.ParseUint(whole, 10, 32)
+
+	if err != nil || amount == 0 {
+		return 0, newError(INVALID_AMOUNT, "Invalid amount")
+	}
+
+	return uint32(amount), nil
+}
+
+// Finds the account an ISO 20022 account identification refers to
+func (s *Service) isoAccount(tenant TenantID, acct isoAccount) (*Account, error) {
+	id, err := strconv.ParseUint(acct.ID, 10, 32)
+
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	return s.repository.findAccount(tenant, uint32(id))
+}
+
+// Reads a pain.001 credit transfer initiation into a batch of open debit transactions
+// Nothing is saved unless every transfer in the file is valid, the batch is paid like any other transactions
+func (s *Service) ImportPain001(role Role, tenant TenantID, r io.Reader) ([]*Transaction, error) {
+	if err := authorize(role, PAY); err != nil {
+		return nil, err
+	}
+
+	var doc pain001Document
+
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	var batch []*Transaction
+
+	for _, p := range doc.Payments {
+		sender, err := s.isoAccount(tenant, p.DebtorAcct)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, tx := range p.Transactions {
+			recipient, err := s.isoAccount(tenant, tx.CreditorAcct)
+
+			if err != nil {
+				return nil, err
+			}
+
+			amount, err := parseISOAmount(tx.Amount.Value)
+
+			if err != nil {
+				return nil, err
+			}
+
+			// Amounts are moved as they are, so they must be in the currency of both accounts
+			if tx.Amount.Currency == "" {
+				return nil, newError(INVALID_AMOUNT, "Amounts need a currency")
+			}
+
+			if !holdsCurrency(sender, tx.Amount.Currency) || !holdsCurrency(recipient, tx.Amount.Currency) {
+				return nil, newError(INVALID_AMOUNT, "Amount is not in the currency of the accounts")
+			}
+
+			batch = append(batch, &Transaction{
+				tenant:        tenant,
+				amount:        amount,
+				sender:        sender,
+				recipient:     recipient,
+				state:         OPEN,
+				paymentMethod: DEBIT,
+				reference:     tx.EndToEndID,
+				memo:          tx.Remittance,
+				metadata: map[string]string{
+					"pain001_msg_id":     doc.MessageID,
+					"pain001_pmt_inf_id": p.ID,
+					"pain001_instd_ccy":  tx.Amount.Currency,
+				},
+			})
+		}
+	}
+
+	now := s.now()
+
+	for _, t := range batch {
+		t.id = s.newTransactionID()
+		t.createdAt = now
+		s.save(t)
+	}
+
+	return batch, nil
+}
+
+// Checks if an account is held in a currency, accounts without one take any
+func holdsCurrency(a *Account, currency string) bool {
+	return a.currency == "" || a.currency == currency
+}
+
+// Party of a pacs.008 transfer
+type pacs008Party struct {
+	Name string `xml:"Nm"`
+}
+
+// Financial institution of a pacs.008 transfer, named by its BIC
+type pacs008Agent struct {
+	BIC string `xml:"FinInstnId>BICFI"`
+}
+
+// One executed transfer of a pacs.008 message, fields in the order the schema requires
+type pacs008Transaction struct {
+	EndToEndID       string         `xml:"PmtId>EndToEndId"`
+	TxID             string         `xml:"PmtId>TxId"`
+	Amount           isoAmount      `xml:"IntrBkSttlmAmt"`
+	SettledOn        string         `xml:"IntrBkSttlmDt"`
+	ChargeBearer     string         `xml:"ChrgBr"`
+	InstructingAgent pacs008Agent   `xml:"InstgAgt"`
+	InstructedAgent  pacs008Agent   `xml:"InstdAgt"`
+	Debtor           pacs008Party   `xml:"Dbtr"`
+	DebtorAcct       isoAccount     `xml:"DbtrAcct"`
+	DebtorAgent      pacs008Agent   `xml:"DbtrAgt"`
+	CreditorAgent    pacs008Agent   `xml:"CdtrAgt"`
+	Creditor         pacs008Party   `xml:"Cdtr"`
+	CreditorAcct     isoAccount     `xml:"CdtrAcct"`
+	Remittance       *isoRemittance `xml:"RmtInf,omitempty"`
+}
+
+// Unstructured remittance information, left out when there is none
+type isoRemittance struct {
+	Unstructured string `xml:"Ustrd"`
+}
+
+// FI to FI customer credit transfer, as written by the service
+type pacs008Document struct {
+	XMLName      xml.Name             `xml:"Document"`
+	Namespace    string               `xml:"xmlns,attr"`
+	MessageID    string               `xml:"FIToFICstmrCdtTrf>GrpHdr>MsgId"`
+	CreatedAt    string               `xml:"FIToFICstmrCdtTrf>GrpHdr>CreDtTm"`
+	Count        int                  `xml:"FIToFICstmrCdtTrf>GrpHdr>NbOfTxs"`
+	Settlement   string               `xml:"FIToFICstmrCdtTrf>GrpHdr>SttlmInf>SttlmMtd"`
+	Transactions []pacs008Transaction `xml:"FIToFICstmrCdtTrf>CdtTrfTxInf"`
+}
+
+// Writes the transfers between customers a tenant executed between from and to as a pacs.008 message, in the order they closed
+// The service's institution, bic, is the agent of both sides and instructs the institution named by instructedBIC
+// Transfers to and from the service's own accounts, e.g. fees and rewards, are left out
+func (s *Service) ExportPacs008(role Role, tenant TenantID, from time.Time, to time.Time, currency string, bic string, instructedBIC string, w io.Writer) error {
+	if err := authorize(role, READ); err != nil {
+		return err
+	}
+
+	if !isoBIC.MatchString(bic) || !isoBIC.MatchString(instructedBIC) {
+		return newError(INVALID_ARGUMENT, "Invalid BIC")
+	}
+
+	closed, err := s.closedBetween(tenant, from, to)
+
+	if err != nil {
+		return err
+	}
+
+	var transactions []*Transaction
+
+	for _, t := range closed {
+		if !s.houseAccount(t.sender) && !s.houseAccount(t.recipient) {
+			transactions = append(transactions, t)
+		}
+	}
+
+	sort.Slice(transactions, func(i, j int) bool {
+		if transactions[i].closedAt.Equal(transactions[j].closedAt) {
+			return transactions[i].id < transactions[j].id
+		}
+		return transactions[i].closedAt.Before(transactions[j].closedAt)
+	})
+
+	now := s.now()
+	doc := pacs008Document{
+		Namespace:  pacs008Namespace,
+		MessageID:  "DIP-" + strconv.FormatInt(now.UnixNano(), 36),
+		CreatedAt:  now.UTC().Format(time.RFC3339),
+		Count:      len(transactions),
+		Settlement: "CLRG",
+	}
+
+	for _, t := range transactions {
+		id := strconv.FormatUint(uint64(t.id), 10)
+		endToEnd := t.reference
+
+		if endToEnd == "" {
+			endToEnd = "NOTPROVIDED"
+		}
+
+		doc.Transactions = append(doc.Transactions, pacs008Transaction{
+			EndToEndID:       endToEnd,
+			TxID:             id,
+			Amount:           isoAmount{Currency: currency, Value: strconv.FormatUint(uint64(t.amount), 10)},
+			SettledOn:        t.closedAt.Format("2006-01-02"),
+			ChargeBearer:     "SLEV",
+			InstructingAgent: pacs008Agent{BIC: bic},
+			InstructedAgent:  pacs008Agent{BIC: instructedBIC},
+			Debtor:           pacs008Party{Name: t.sender.name},
+			DebtorAcct:       isoAccount{ID: strconv.FormatUint(uint64(t.sender.id), 10)},
+			DebtorAgent:      pacs008Agent{BIC: bic},
+			CreditorAgent:    pacs008Agent{BIC: bic},
+			Creditor:         pacs008Party{Name: t.recipient.name},
+			CreditorAcct:     isoAccount{ID: strconv.FormatUint(uint64(t.recipient.id), 10)},
+		})
+
+		if t.memo != "" {
+			doc.Transactions[len(doc.Transactions)-1].Remittance = &isoRemittance{Unstructured: t.memo}
+		}
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+
+	if err := encoder.Encode(doc); err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, "\n")
+
+	return err
+}
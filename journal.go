@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// All of the possible kinds of journal records
+type JournalOutcome string
+
+const (
+	// Intent to change balances, written before the change
+	JOURNAL_BEGIN JournalOutcome = "begin"
+	// One change made by the operation, written once it's applied
+	JOURNAL_APPLIED JournalOutcome = "applied"
+	JOURNAL_COMMIT  JournalOutcome = "commit"
+	JOURNAL_ABORT   JournalOutcome = "abort"
+)
+
+// Change an operation made to an account, undone by applying its inverse
+type AccountDelta struct {
+	AccountID      uint32 `json:"account_id"`
+	Balance        int64  `json:"balance,omitempty"`
+	CreditUsed     int64  `json:"credit_used,omitempty"`
+	UnbilledCredit int64  `json:"unbilled_credit,omitempty"`
+	// Written by recovery once it applied the inverse of the latest change not yet undone
+	Undone bool `json:"undone,omitempty"`
+}
+
+// Models one line of the write-ahead journal
+type JournalRecord struct {
+	Sequence      uint64         `json:"seq"`
+	Outcome       JournalOutcome `json:"outcome"`
+	Tenant        TenantID       `json:"tenant,omitempty"`
+	TransactionID uint32         `json:"transaction_id,omitempty"`
+	// Changes applied so far, in the order they were applied
+	Deltas []AccountDelta `json:"deltas,omitempty"`
+}
+
+// Interface for recording balance changes as they are applied
+type Journal interface {
+	// Records the intent and returns the sequence that ends it
+	begin(tenant TenantID, transactionID uint32) (uint64, error)
+	// Records a change the operation applied
+	applied(sequence uint64, delta AccountDelta) error
+	end(sequence uint64, outcome JournalOutcome) error
+	// Returns the begin records with no commit or abort after them, with the changes applied under them
+	pending() ([]JournalRecord, error)
+}
+
+// Keeps the journal in memory, which only guards against failures inside the process
+type MemoryJournal struct {
+	mu       sync.Mutex
+	sequence uint64
+	open     map[uint64]JournalRecord
+}
+
+// Creates an empty in-memory journal
+func NewMemoryJournal() *MemoryJournal {
+	return &MemoryJournal{open: map[uint64]JournalRecord{}}
+}
+
+func (j *MemoryJournal) begin(tenant TenantID, transactionID uint32) (uint64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.sequence++
+	j.open[j.sequence] = JournalRecord{Sequence: j.sequence, Outcome: JOURNAL_BEGIN, Tenant: tenant, TransactionID: transactionID}
+
+	return j.sequence, nil
+}
+
+func (j *MemoryJournal) applied(sequence uint64, delta AccountDelta) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if r, ok := j.open[sequence]; ok {
+		r.Deltas = append(r.Deltas, delta)
+		j.open[sequence] = r
+	}
+
+	return nil
+}
+
+func (j *MemoryJournal) end(sequence uint64, outcome JournalOutcome) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	delete(j.open, sequence)
+
+	return nil
+}
+
+func (j *MemoryJournal) pending() ([]JournalRecord, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	records := make([]JournalRecord, 0, len(j.open))
+
+	for _, r := range j.open {
+		records = append(records, r)
+	}
+
+	return records, nil
+}
+
+// Appends the journal to a file as JSON lines, synced to disk before every balance change
+type FileJournal struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	sequence uint64
+}
+
+// Opens the journal at path, creating it if needed, and carries on from its last sequence
+func OpenFileJournal(path string) (*FileJournal, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	j := &FileJournal{path: path, file: file}
+	records, err := j.read()
+
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	for _, r := range records {
+		j.sequence = max(j.sequence, r.Sequence)
+	}
+
+	return j, nil
+}
+
+// Closes the journal file
+func (j *FileJournal) Close() error {
+	return j.file.Close()
+}
+
+// Returns every record in the file, in the order they were written
+// A torn last line, left by a crash while writing it, is ignored
+func (j *FileJournal) read() ([]JournalRecord, error) {
+	file, err := os.Open(j.path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var records []JournalRecord
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		var r JournalRecord
+
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			continue
+		}
+
+		records = append(records, r)
+	}
+
+	return records, scanner.Err()
+}
+
+// Writes a record and waits for it to reach the disk
+func (j *FileJournal) write(r JournalRecord) error {
+	line, err := json.Marshal(r)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	return j.file.Sync()
+}
+
+func (j *FileJournal) begin(tenant TenantID, transactionID uint32) (uint64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.sequence++
+	r := JournalRecord{Sequence: j.sequence, Outcome: JOURNAL_BEGIN, Tenant: tenant, TransactionID: transactionID}
+
+	return j.sequence, j.write(r)
+}
+
+func (j *FileJournal) applied(sequence uint64, delta AccountDelta) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.write(JournalRecord{Sequence: sequence, Outcome: JOURNAL_APPLIED, Deltas: []AccountDelta{delta}})
+}
+
+func (j *FileJournal) end(sequence uint64, outcome JournalOutcome) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.write(JournalRecord{Sequence: sequence, Outcome: outcome})
+}
+
+func (j *FileJournal) pending() ([]JournalRecord, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	records, err := j.read()
+
+	if err != nil {
+		return nil, err
+	}
+
+	open := map[uint64]JournalRecord{}
+	var order []uint64
+
+	for _, r := range records {
+		switch r.Outcome {
+		case JOURNAL_BEGIN:
+			open[r.Sequence] = r
+			order = append(order, r.Sequence)
+		case JOURNAL_APPLIED:
+			if begun, ok := open[r.Sequence]; ok {
+				begun.Deltas = append(begun.Deltas, r.Deltas...)
+				open[r.Sequence] = begun
+			}
+		default:
+			delete(open, r.Sequence)
+		}
+	}
+
+	var pending []JournalRecord
+
+	for _, seq := range order {
+		if r, ok := open[seq]; ok {
+			pending = append(pending, r)
+		}
+	}
+
+	return pending, nil
+}
+
+// Context key of the journal record an operation's changes are written under
+type journalScopeKey struct{}
+
+// Journal record an operation's changes are written under
+type journalScope struct {
+	journal  Journal
+	sequence uint64
+}
+
+// Records the intent to change balances for a transaction
+// Returns the ctx that changes are journaled with, and zero when the service has no journal
+func (s *Service) journalBegin(ctx context.Context, t *Transaction) (context.Context, uint64, error) {
+	s.mu.RLock()
+	journal := s.journal
+	s.mu.RUnlock()
+
+	if journal == nil {
+		return ctx, 0, nil
+	}
+
+	sequence, err := journal.begin(t.tenant, t.id)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return context.WithValue(ctx, journalScopeKey{}, &journalScope{journal: journal, sequence: sequence}), sequence, nil
+}
+
+// Records a change just applied to an account by the operation in ctx, if it's journaled
+// Changes are written once applied, so recovery never undoes one that didn't happen
+// Failures are logged, the change can't be taken back by then
+func journalApplied(ctx context.Context, a *Account, delta AccountDelta) {
+	scope, ok := ctx.Value(journalScopeKey{}).(*journalScope)
+
+	if !ok {
+		return
+	}
+
+	delta.AccountID = a.id
+
+	if err := scope.journal.applied(scope.sequence, delta); err != nil {
+		log.Println(err)
+	}
+}
+
+// Wraps a balance provider so the changes it applies are journaled under the operation in ctx
+// Captures change nothing on their own, reserving already took the funds
+type journalingBalanceProvider struct {
+	next BalanceProvider
+}
+
+func (p *journalingBalanceProvider) balance(ctx context.Context, a *Account) (uint32, error) {
+	return p.next.balance(ctx, a)
+}
+
+func (p *journalingBalanceProvider) reserve(ctx context.Context, a *Account, amount uint32) error {
+	if err := p.next.reserve(ctx, a, amount); err != nil {
+		return err
+	}
+
+	journalApplied(ctx, a, AccountDelta{Balance: -int64(amount)})
+
+	return nil
+}
+
+func (p *journalingBalanceProvider) release(ctx context.Context, a *Account, amount uint32) error {
+	if err := p.next.release(ctx, a, amount); err != nil {
+		return err
+	}
+
+	journalApplied(ctx, a, AccountDelta{Balance: int64(amount)})
+
+	return nil
+}
+
+func (p *journalingBalanceProvider) capture(ctx context.Context, a *Account, amount uint32) error {
+	return p.next.capture(ctx, a, amount)
+}
+
+func (p *journalingBalanceProvider) deposit(ctx context.Context, a *Account, amount uint32) error {
+	if err := p.next.deposit(ctx, a, amount); err != nil {
+		return err
+	}
+
+	journalApplied(ctx, a, AccountDelta{Balance: int64(amount)})
+
+	return nil
+}
+
+// Records the outcome of a journaled change, once the transaction is saved
+// Failures are logged, at worst recovery restores balances the change had already settled
+func (s *Service) journalEnd(sequence uint64, err error) {
+	s.mu.RLock()
+	journal := s.journal
+	s.mu.RUnlock()
+
+	if journal == nil || sequence == 0 {
+		return
+	}
+
+	outcome := JOURNAL_COMMIT
+
+	if err != nil {
+		outcome = JOURNAL_ABORT
+	}
+
+	if err := journal.end(sequence, outcome); err != nil {
+		log.Println(err)
+	}
+}
+
+// Undoes the balance changes a crash left without an outcome, so no money is created or destroyed
+// Each change is taken back by applying its inverse under the account's lock, so changes made by other operations are kept
+// Closed transactions are reopened so they can be paid again
+// Must run at startup, before the service takes payments
+func (s *Service) RecoverJournal(role Role) (int, error) {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return 0, err
+	}
+
+	s.mu.RLock()
+	journal := s.journal
+	s.mu.RUnlock()
+
+	if journal == nil {
+		return 0, nil
+	}
+
+	pending, err := journal.pending()
+
+	if err != nil {
+		return 0, err
+	}
+
+	var errs []error
+
+	for i := len(pending) - 1; i >= 0; i-- {
+		if err := s.undoJournalRecord(journal, pending[i]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return len(pending), errors.Join(errs...)
+}
+
+// Applies the inverse of each change of one record, newest first, and marks it aborted
+// Every inverse applied is journaled under the record, so a recovery that stopped halfway carries on from where it stopped
+func (s *Service) undoJournalRecord(journal Journal, r JournalRecord) error {
+	var changes []AccountDelta
+	undone := 0
+
+	for _, delta := range r.Deltas {
+		if delta.Undone {
+			undone++
+		} else {
+			changes = append(changes, delta)
+		}
+	}
+
+	for _, delta := range slices.Backward(changes[:len(changes)-min(undone, len(changes))]) {
+		if err := s.undoDelta(r.Tenant, delta); err != nil {
+			return err
+		}
+
+		if err := journal.applied(r.Sequence, AccountDelta{AccountID: delta.AccountID, Undone: true}); err != nil {
+			return err
+		}
+	}
+
+	t, err := s.repository.findTransaction(r.Tenant, r.TransactionID)
+
+	if err == nil && t.state == CLOSED {
+		t.state = OPEN
+		t.closedAt = time.Time{}
+		t.fee = 0
+		s.save(t)
+	}
+
+	return journal.end(r.Sequence, JOURNAL_ABORT)
+}
+
+// Applies the inverse of one change to its account, holding the account's lock
+// Balances move through the balance provider, like the change did
+func (s *Service) undoDelta(tenant TenantID, delta AccountDelta) error {
+	a, err := s.repository.findAccount(tenant, delta.AccountID)
+
+	if err != nil {
+		return err
+	}
+
+	ctx, release, err := s.lockAccounts(context.Background(), a)
+
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
+	s.mu.RLock()
+	balances := balancesOrLocal(s.balances)
+	s.mu.RUnlock()
+
+	switch {
+	case delta.Balance < 0:
+		err = balances.deposit(ctx, a, uint32(-delta.Balance))
+	case delta.Balance > 0:
+		if err = balances.reserve(ctx, a, uint32(delta.Balance)); err == nil {
+			err = balances.capture(ctx, a, uint32(delta.Balance))
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	a.creditUsed = uint32(int64(a.creditUsed) - delta.CreditUsed)
+	a.unbilledCredit = uint32(int64(a.unbilledCredit) - delta.UnbilledCredit)
+
+	return s.repository.saveAccount(a)
+}
+
+// Makes the service journal every balance change, nil turns journaling off
+func (s *Service) SetJournal(role Role, journal Journal) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.journal = journal
+
+	return nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// All of the possible plain-text accounting formats
+type LedgerFormat string
+
+const (
+	BEANCOUNT  LedgerFormat = "beancount"
+	LEDGER_CLI LedgerFormat = "ledger"
+)
+
+// Maps the accounts of a tenant to the names they get in an exported ledger
+type ChartOfAccounts struct {
+	// Names given to specific accounts, by id
+	accounts map[uint32]string
+	// Parent of the customer accounts without a name of their own
+	customers string
+	// Name of the tenant's fee account
+	house string
+	// Parent of the credit each customer owes
+	credit string
+	// Clearing accounts funds paid from outside the service come in through, on the chain or at a card gateway
+	chain   string
+	gateway string
+	// Commodity amounts are written in
+	commodity string
+}
+
+// Chart used when the caller doesn't provide one
+var defaultChartOfAccounts = ChartOfAccounts{
+	customers: "Liabilities:Customers",
+	house:     "Assets:House",
+	credit:    "Assets:Receivables:Credit",
+	chain:     "Assets:Clearing:Chain",
+	gateway:   "Assets:Clearing:Gateway",
+	commodity: "DIP",
+}
+
+// Returns the ledger name of an account, with its name redacted by r
+func (c ChartOfAccounts) name(a *Account, house *Account, r Redactor) string {
+	if name, ok := c.accounts[a.id]; ok {
+		return name
+	}
+
+	if a == house {
+		return c.house
+	}
+
+	return c.customers + ":" + ledgerComponent(a, r)
+}
+
+// Turns an account into a valid ledger account component, e.g. Gustavo-1
+// Components start with a capital letter and hold only letters, digits and dashes
+func ledgerComponent(a *Account, redactor Redactor) string {
+	var b strings.Builder
+
+	for _, r := range redact(redactor, PII_NAME, a.name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('-')
+		}
+	}
+
+	name := strings.Trim(b.String(), "-")
+
+	if name == "" {
+		name = "Account"
+	}
+
+	runes := []rune(name)
+	runes[0] = unicode.ToUpper(runes[0])
+
+	return fmt.Sprintf("%s-%d", string(runes), a.id)
+}
+
+// One leg of a ledger entry
+type posting struct {
+	account string
+	amount  int64
+}
+
+// Returns the legs of a closed transaction, which always sum to zero
+func (c ChartOfAccounts) postings(t *Transaction, house *Account, r Redactor) []posting {
+	sender, recipient := c.name(t.sender, house, r), c.name(t.recipient, house, r)
+	amount := int64(t.amount)
+
+	switch {
+	case t.paymentMethod == CRYPTO:
+		// The sender paid on the chain, the recipient is credited from the deposit address
+		return []posting{
+			{c.chain, -amount},
+			{recipient, amount},
+		}
+	case t.metadata["gateway_refund"] != "":
+		// The recipient gives back what the gateway refunded to the sender's card
+		return []posting{
+			{sender, -amount},
+			{c.gateway, amount},
+		}
+	case t.gatewayPaymentID != "":
+		// The sender paid by card, the recipient is credited once the gateway settles
+		return []posting{
+			{c.gateway, -amount},
+			{recipient, amount},
+		}
+	case t.metadata["credit_waived_from"] != "":
+		// The house gives up part of what the sender owes on credit
+		return []posting{
+			{c.credit + ":" + ledgerComponent(t.sender, r), -amount},
+			{sender + ":Credit", amount},
+		}
+	case t.paymentMethod == CREDIT:
+		// The house pays the recipient, the sender owes the amount and the surcharge
+		charge := amount + t.fee
+		return []posting{
+			{c.house, -amount},
+			{recipient, amount},
+			{c.credit + ":" + ledgerComponent(t.sender, r), charge},
+			{sender + ":Credit", -charge},
+		}
+	case t.paymentMethod == CASH:
+		// The fee is negative, the house funds the discount
+		return []posting{
+			{sender, -(amount + t.fee)},
+			{c.house, t.fee},
+			{recipient, amount},
+		}
+	default:
+		return []posting{
+			{sender, -amount},
+			{recipient, amount},
+		}
+	}
+}
+
+// Writes the closed transactions of a tenant in a plain-text accounting format
+// Uses the default chart of accounts when chart is nil
+func (s *Service) ExportLedger(role Role, tenant TenantID, format LedgerFormat, chart *ChartOfAccounts, w io.Writer) error {
+	if err := authorize(role, READ); err != nil {
+		return err
+	}
+
+	c := defaultChartOfAccounts
+
+	if chart != nil {
+		c = *chart
+	}
+
+	transactions, err := s.repository.listTransactions(tenant)
+
+	if err != nil {
+		return err
+	}
+
+	var closed []*Transaction
+
+	for _, t := range transactions {
+		if t.state == CLOSED {
+			closed = append(closed, t)
+		}
+	}
+
+	sort.Slice(closed, func(i, j int) bool {
+		if closed[i].closedAt.Equal(closed[j].closedAt) {
+			return closed[i].id < closed[j].id
+		}
+		return closed[i].closedAt.Before(closed[j].closedAt)
+	})
+
+	s.mu.RLock()
+	house := s.feeAccounts[tenant]
+	s.mu.RUnlock()
+
+	switch format {
+	case BEANCOUNT:
+		return c.writeBeancount(w, closed, house, s.redactor())
+	case LEDGER_CLI:
+		return c.writeLedger(w, closed, house, s.redactor())
+	default:
+		return newError(INVALID_ARGUMENT, "Unknown ledger format")
+	}
+}
+
+// Writes entries in Beancount syntax, opening every account on the date it is first used
+func (c ChartOfAccounts) writeBeancount(w io.Writer, transactions []*Transaction, house *Account, r Redactor) error {
+	opened := map[string]bool{}
+
+	for _, t := range transactions {
+		date := t.closedAt.Format("2006-01-02")
+		legs := c.postings(t, house, r)
+
+		for _, p := range legs {
+			if !opened[p.account] {
+				opened[p.account] = true
+				if _, err := fmt.Fprintf(w, "%s open %s %s\n", date, p.account, c.commodity); err != nil {
+					return err
+				}
+			}
+		}
+
+		if _, err := fmt.Fprintf(w, "%s * %q %q\n  id: \"%d\"\n", date, redact(r, PII_NAME, t.sender.name), ledgerNarration(t, r), t.id); err != nil {
+			return err
+		}
+
+		for _, p := range legs {
+			if _, err := fmt.Fprintf(w, "  %s  %d %s\n", p.account, p.amount, c.commodity); err != nil {
+				return err
+			}
+		}
+
+		if _, err := fmt.Fprintln(w); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Writes entries in ledger-cli syntax
+func (c ChartOfAccounts) writeLedger(w io.Writer, transactions []*Transaction, house *Account, r Redactor) error {
+	for _, t := range transactions {
+		if _, err := fmt.Fprintf(w, "%s * %s\n    ; id: %d\n", t.closedAt.Format("2006/01/02"), ledgerNarration(t, r), t.id); err != nil {
+			return err
+		}
+
+		for _, p := range c.postings(t, house, r) {
+			if _, err := fmt.Fprintf(w, "    %s    %d %s\n", p.account, p.amount, c.commodity); err != nil {
+				return err
+			}
+		}
+
+		if _, err := fmt.Fprintln(w); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the description of a ledger entry, the memo when there is one
+func ledgerNarration(t *Transaction, r Redactor) string {
+	if t.memo != "" {
+		return redact(r, PII_NOTE, t.memo)
+	}
+
+	return fmt.Sprintf("Transaction %d", t.id)
+}
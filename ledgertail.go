@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Returned when a tail resumes from a sequence the log no longer keeps
+var ErrLedgerSequenceGone = newError(INVALID_ARGUMENT, "Ledger sequence is no longer kept")
+
+// Models a closed transaction as posted to the ledger
+// Sequences start at one and grow by one with every entry, across tenants
+type LedgerEntry struct {
+	sequence      uint64
+	tenant        TenantID
+	transactionID uint32
+	paymentMethod PaymentMethod
+	// Sender and recipient, the accounts a filter matches on
+	accounts []uint32
+	// Legs and reference as they were when posted, redacted by the service's policy
+	postings  []posting
+	reference string
+	postedAt  time.Time
+}
+
+// Wire form of a ledger entry, described by schemas/ledger.v1.proto
+// Fields can be added but never renamed or removed
+type LedgerEntryV1 struct {
+	Sequence      uint64        `json:"seq"`
+	Tenant        TenantID      `json:"tenant"`
+	TransactionID uint32        `json:"transaction_id"`
+	PaymentMethod PaymentMethod `json:"payment_method"`
+	Reference     string        `json:"reference,omitempty"`
+	Postings      []PostingV1   `json:"postings"`
+	PostedAt      time.Time     `json:"posted_at"`
+}
+
+// Wire form of one leg of a ledger entry, negative amounts are debits
+type PostingV1 struct {
+	Account string `json:"account"`
+	Amount  int64  `json:"amount"`
+}
+
+// Converts a ledger entry to its wire form
+func (e LedgerEntry) v1() LedgerEntryV1 {
+	wire := LedgerEntryV1{
+		Sequence:      e.sequence,
+		Tenant:        e.tenant,
+		TransactionID: e.transactionID,
+		PaymentMethod: e.paymentMethod,
+		Reference:     e.reference,
+		PostedAt:      e.postedAt,
+	}
+
+	for _, p := range e.postings {
+		wire.Postings = append(wire.Postings, PostingV1{Account: p.account, Amount: p.amount})
+	}
+
+	return wire
+}
+
+// Selects the ledger entries a tail streams
+type LedgerFilter struct {
+	tenant TenantID
+	// Only entries that move funds of one of these accounts, empty for every entry of the tenant
+	accounts []uint32
+}
+
+// Checks if an entry is one the filter selects
+func (f LedgerFilter) matches(e LedgerEntry) bool {
+	if e.tenant != f.tenant {
+		return false
+	}
+
+	return len(f.accounts) == 0 || slices.ContainsFunc(e.accounts, func(id uint32) bool { return slices.Contains(f.accounts, id) })
+}
+
+// Entries kept in memory by a ledger log, older ones are only served from its file
+const ledgerLogWindow = 100_000
+
+// Line of a ledger log file
+type ledgerLine struct {
+	LedgerEntryV1
+	Accounts []uint32 `json:"accounts"`
+}
+
+// Entries posted to the ledger in order, kept so tails can resume from a sequence
+// Only the last entries are kept in memory. A log opened on a file appends every entry to it, so sequences carry on
+// across restarts and tails can resume from any of them
+type LedgerLog struct {
+	mu sync.Mutex
+	// Last entries posted, oldest first
+	entries  []LedgerEntry
+	sequence uint64
+	window   int
+	// Nil for a log kept only in memory
+	file *os.File
+	path string
+	// Closed and replaced whenever an entry is posted, wakes up the tails
+	posted chan struct{}
+}
+
+// Creates an empty ledger log kept in memory
+func NewLedgerLog() *LedgerLog {
+	return &LedgerLog{window: ledgerLogWindow, posted: make(chan struct{})}
+}
+
+// Opens the ledger log at path, creating it if needed, and carries on from its last sequence
+func OpenFileLedgerLog(path string) (*LedgerLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	l := &LedgerLog{window: ledgerLogWindow, file: file, path: path, posted: make(chan struct{})}
+	entries, err := l.read(0)
+
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if len(entries) > 0 {
+		l.sequence = entries[len(entries)-1].sequence
+	}
+
+	l.entries = entries[max(len(entries)-l.window, 0):]
+
+	return l, nil
+}
+
+// Closes the file of the log, if it has one
+func (l *LedgerLog) Close() error {
+	if l.file == nil {
+		return nil
+	}
+
+	return l.file.Close()
+}
+
+// Returns the entries of the file after a sequence, in order
+// A torn last line, left by a crash while writing it, is ignored
+func (l *LedgerLog) read(sequence uint64) ([]LedgerEntry, error) {
+	file, err := os.Open(l.path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var entries []LedgerEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+
+	for scanner.Scan() {
+		var line ledgerLine
+
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil || line.Sequence <= sequence {
+			continue
+		}
+
+		e := LedgerEntry{
+			sequence:      line.Sequence,
+			tenant:        line.Tenant,
+			transactionID: line.TransactionID,
+			paymentMethod: line.PaymentMethod,
+			accounts:      line.Accounts,
+			reference:     line.Reference,
+			postedAt:      line.PostedAt,
+		}
+
+		for _, p := range line.Postings {
+			e.postings = append(e.postings, posting{account: p.Account, amount: p.Amount})
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, scanner.Err()
+}
+
+// Appends an entry and wakes up the tails waiting for it
+// The entry is numbered and kept even if writing it to the file fails, so tails still get it
+func (l *LedgerLog) post(t *Transaction, postings []posting, reference string, at time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sequence++
+	e := LedgerEntry{
+		sequence:      l.sequence,
+		tenant:        t.tenant,
+		transactionID: t.id,
+		paymentMethod: t.paymentMethod,
+		accounts:      []uint32{t.sender.id, t.recipient.id},
+		postings:      postings,
+		reference:     reference,
+		postedAt:      at,
+	}
+
+	l.entries = append(l.entries, e)
+
+	if len(l.entries) > l.window {
+		l.entries = slices.Delete(l.entries, 0, len(l.entries)-l.window)
+	}
+
+	close(l.posted)
+	l.posted = make(chan struct{})
+
+	if l.file == nil {
+		return nil
+	}
+
+	line, err := json.Marshal(ledgerLine{LedgerEntryV1: e.v1(), Accounts: e.accounts})
+
+	if err != nil {
+		return err
+	}
+
+	_, err = l.file.Write(append(line, '\n'))
+
+	return err
+}
+
+// Returns the entries after a sequence, and a channel closed once more are posted
+// Sequences older than the entries in memory are read back from the file, or refused when the log has none
+func (l *LedgerLog) after(sequence uint64) ([]LedgerEntry, <-chan struct{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if sequence >= l.sequence {
+		return nil, l.posted, nil
+	}
+
+	if first := l.entries[0].sequence; sequence+1 < first {
+		if l.file == nil {
+			return nil, nil, ErrLedgerSequenceGone
+		}
+
+		entries, err := l.read(sequence)
+
+		return entries, l.posted, err
+	}
+
+	return slices.Clone(l.entries[sequence+1-l.entries[0].sequence:]), l.posted, nil
+}
+
+// Makes the service post its ledger to a log, e.g. one opened on a file so tails survive restarts
+func (s *Service) SetLedgerLog(role Role, ledger *LedgerLog) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ledger = ledger
+
+	return nil
+}
+
+// Posts a closed transaction to the ledger log
+func (s *Service) postToLedger(t *Transaction) {
+	s.mu.RLock()
+	house := s.feeAccounts[t.tenant]
+	s.mu.RUnlock()
+
+	r := s.redactor()
+
+	if err := s.ledgerLog().post(t, defaultChartOfAccounts.postings(t, house, r), redact(r, PII_REFERENCE, t.reference), s.now()); err != nil {
+		log.Println(err)
+	}
+}
+
+// Returns the log the ledger is posted to
+func (s *Service) ledgerLog() *LedgerLog {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.ledger
+}
+
+// Streams the ledger entries the filter selects to send as they are posted, starting after the from sequence
+// Zero streams the whole ledger, a mirror resumes with the last sequence it got
+// Blocks until ctx is done or send fails, this is what a TailLedger server streaming call runs
+func (s *Service) TailLedger(ctx context.Context, role Role, filter LedgerFilter, from uint64, send func(LedgerEntryV1) error) error {
+	if err := authorize(role, READ); err != nil {
+		return err
+	}
+
+	for {
+		entries, posted, err := s.ledgerLog().after(from)
+
+		if err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			from = e.sequence
+
+			if !filter.matches(e) {
+				continue
+			}
+
+			if err := send(e.v1()); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-posted:
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Models one payment of a loan's amortization schedule
+type Installment struct {
+	dueDate   time.Time
+	principal uint32
+	interest  uint32
+	paid      bool
+}
+
+// Models money lent by the house to an account
+type Loan struct {
+	id      uint32
+	account *Account
+	// Interest charged each month, in hundredths of a percent
+	basisPoints  uint32
+	principal    uint32
+	outstanding  uint32
+	installments []*Installment
+	closed       bool
+}
+
+// Outcome of one installment collected during a run
+type InstallmentResult struct {
+	loan        *Loan
+	installment *Installment
+	err         error
+}
+
+// Splits a loan into equal monthly installments of principal plus interest
+// The last installment absorbs whatever rounding left over
+func amortize(principal uint32, basisPoints uint32, months int, start time.Time, rounding RoundingPolicy) []*Installment {
+	rate := float64(basisPoints) / 10000
+	payment := float64(principal) / float64(months)
+
+	if rate > 0 {
+		payment = float64(principal) * rate / (1 - math.Pow(1+rate, -float64(months)))
+	}
+
+	installments := make([]*Installment, months)
+	remaining := principal
+
+	for i := range installments {
+		interest := rounding.share(remaining, basisPoints)
+		part := uint32(math.Round(payment)) - interest
+
+		if i == months-1 || part > remaining {
+			part = remaining
+		}
+
+		installments[i] = &Installment{
+			dueDate:   start.AddDate(0, i+1, 0),
+			principal: part,
+			interest:  interest,
+		}
+		remaining -= part
+	}
+
+	return installments
+}
+
+// Lends principal from the house to an account, repaid in monthly installments
+func (s *Service) DisburseLoan(ctx context.Context, role Role, a *Account, principal uint32, basisPoints uint32, months int) (*Loan, error) {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return nil, err
+	}
+
+	if months <= 0 || principal == 0 {
+		return nil, newError(INVALID_AMOUNT, "Loans need a principal and at least one installment")
+	}
+
+	s.mu.Lock()
+	house, ok := s.feeAccounts[a.tenant]
+	s.lastLoanID++
+	id := s.lastLoanID
+	s.mu.Unlock()
+
+	if !ok {
+		return nil, ErrNoFeeAccount
+	}
+
+	metadata := map[string]string{"loan_disbursement": strconv.FormatUint(uint64(id), 10)}
+
+	if _, err := s.postTransfer(ctx, house, a, principal, metadata); err != nil {
+		return nil, err
+	}
+
+	loan := &Loan{
+		id:           id,
+		account:      a,
+		basisPoints:  basisPoints,
+		principal:    principal,
+		outstanding:  principal,
+		installments: amortize(principal, basisPoints, months, s.now(), s.defaultRounding()),
+	}
+
+	if err := s.loans.save(loan); err != nil {
+		return nil, err
+	}
+
+	return loan, nil
+}
+
+// Collects every installment that is due and not yet paid
+func (s *Service) CollectInstallments(ctx context.Context, role Role) ([]InstallmentResult, error) {
+	if err := authorize(role, PAY); err != nil {
+		return nil, err
+	}
+
+	loans, err := s.loans.list()
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.now()
+	var results []InstallmentResult
+
+	for _, l := range loans {
+		results = append(results, s.collectDue(ctx, l, now)...)
+	}
+
+	return results, nil
+}
+
+// Collects the installments of a loan due by now and not yet paid
+// The loan's accounts stay locked from the check to the write, so overlapping runs and early repayments can't collect twice
+func (s *Service) collectDue(ctx context.Context, l *Loan, now time.Time) []InstallmentResult {
+	ctx, release, err := s.lockLoan(ctx, l)
+
+	if err != nil {
+		return []InstallmentResult{{loan: l, err: err}}
+	}
+
+	defer release()
+
+	var results []InstallmentResult
+
+	for _, in := range l.installments {
+		s.mu.RLock()
+		due := !l.closed && !in.paid && !in.dueDate.After(now)
+		s.mu.RUnlock()
+
+		if !due {
+			continue
+		}
+
+		err := s.repayLoan(ctx, l, in.principal+in.interest)
+
+		if err == nil {
+			s.mu.Lock()
+			in.paid = true
+			l.outstanding -= in.principal
+			l.closed = l.outstanding == 0
+			s.mu.Unlock()
+		}
+
+		results = append(results, InstallmentResult{loan: l, installment: in, err: err})
+	}
+
+	return results
+}
+
+// Pays off what is left of a loan's principal ahead of schedule, with no further interest
+func (s *Service) RepayLoanEarly(ctx context.Context, role Role, l *Loan) error {
+	if err := authorize(role, PAY); err != nil {
+		return err
+	}
+
+	ctx, release, err := s.lockLoan(ctx, l)
+
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
+	s.mu.RLock()
+	closed, outstanding := l.closed, l.outstanding
+	s.mu.RUnlock()
+
+	if closed {
+		return newError(INVALID_STATE, "Loan is already repaid")
+	}
+
+	if err := s.repayLoan(ctx, l, outstanding); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	for _, in := range l.installments {
+		in.paid = true
+	}
+	l.outstanding = 0
+	l.closed = true
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Locks the borrower of a loan and the house it repays, which every repayment of the loan holds
+func (s *Service) lockLoan(ctx context.Context, l *Loan) (context.Context, func(), error) {
+	s.mu.RLock()
+	house := s.feeAccounts[l.account.tenant]
+	s.mu.RUnlock()
+
+	return s.lockAccounts(ctx, l.account, house)
+}
+
+// Moves a repayment from the borrower back to the house
+func (s *Service) repayLoan(ctx context.Context, l *Loan, amount uint32) error {
+	s.mu.RLock()
+	house, ok := s.feeAccounts[l.account.tenant]
+	s.mu.RUnlock()
+
+	if !ok {
+		return ErrNoFeeAccount
+	}
+
+	metadata := map[string]string{"loan_repayment": strconv.FormatUint(uint64(l.id), 10)}
+	_, err := s.postTransfer(ctx, l.account, house, amount, metadata)
+
+	return err
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// Returned when code running under WithAccountsLocked touches an account it didn't lock
+var ErrAccountNotLocked = newError(INVALID_STATE, "Account is not locked by the operation")
+
+// Per-account locks, taken in tenant and id order so two operations never wait on each other
+// Locks are channels so waiting for them can be cancelled
+type AccountLocks struct {
+	mu    sync.Mutex
+	locks map[recordKey]chan struct{}
+}
+
+// Creates an empty lock table
+func NewAccountLocks() *AccountLocks {
+	return &AccountLocks{locks: map[recordKey]chan struct{}{}}
+}
+
+// Returns the lock of an account, creating it on first use
+func (l *AccountLocks) lock(key recordKey) chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lock, ok := l.locks[key]
+
+	if !ok {
+		lock = make(chan struct{}, 1)
+		l.locks[key] = lock
+	}
+
+	return lock
+}
+
+// Context key of the accounts an operation holds the locks of
+type heldLocksKey struct{}
+
+// Locks held by an operation running under WithAccountsLocked
+type heldLocks struct {
+	keys []recordKey
+}
+
+// Takes the locks of accounts in order, skipping the ones the operation in ctx already holds
+// Operations holding locks can't take more, so they can't wait on each other in a cycle
+func (l *AccountLocks) acquire(ctx context.Context, keys []recordKey) (func(), error) {
+	keys = slices.Clone(keys)
+	slices.SortFunc(keys, func(a, b recordKey) int {
+		if a.tenant != b.tenant {
+			if a.tenant < b.tenant {
+				return -1
+			}
+			return 1
+		}
+		return int(a.id) - int(b.id)
+	})
+	keys = slices.Compact(keys)
+
+	if held, ok := ctx.Value(heldLocksKey{}).(*heldLocks); ok {
+		for _, key := range keys {
+			if !slices.Contains(held.keys, key) {
+				return nil, ErrAccountNotLocked
+			}
+		}
+
+		return func() {}, nil
+	}
+
+	var taken []chan struct{}
+	release := func() {
+		for _, lock := range slices.Backward(taken) {
+			<-lock
+		}
+	}
+
+	for _, key := range keys {
+		lock := l.lock(key)
+
+		select {
+		case lock <- struct{}{}:
+			taken = append(taken, lock)
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		}
+	}
+
+	return release, nil
+}
+
+// Returns the lock keys of accounts, skipping nil ones
+func accountKeys(accounts ...*Account) []recordKey {
+	keys := make([]recordKey, 0, len(accounts))
+
+	for _, a := range accounts {
+		if a != nil {
+			keys = append(keys, recordKey{a.tenant, a.id})
+		}
+	}
+
+	return keys
+}
+
+// Locks accounts for an operation and returns the ctx that payments and postings made by it reuse the locks with
+// When ctx already holds locks nothing is taken, and accounts it doesn't hold fail with ErrAccountNotLocked
+func (s *Service) lockAccounts(ctx context.Context, accounts ...*Account) (context.Context, func(), error) {
+	keys := accountKeys(accounts...)
+	release, err := s.accountLocks.acquire(ctx, keys)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, ok := ctx.Value(heldLocksKey{}).(*heldLocks); ok {
+		return ctx, release, nil
+	}
+
+	return context.WithValue(ctx, heldLocksKey{}, &heldLocks{keys: keys}), release, nil
+}
+
+// Returns every account a payment may move funds of, which its locks must cover
+// Besides the sender and recipient, the fee account collects fees and funds discounts, and rewards and tax are posted right after
+func (s *Service) paymentAccounts(t *Transaction) []*Account {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	accounts := []*Account{t.sender, t.recipient}
+
+	if t.paymentMethod != DEBIT && t.paymentMethod != CRYPTO {
+		accounts = append(accounts, s.feeAccounts[t.tenant])
+	}
+
+	if s.rewards != nil && s.rewards.pool.tenant == t.tenant && s.rewards.rewardFor(t, s.rounding) > 0 {
+		accounts = append(accounts, s.rewards.pool)
+	}
+
+	if s.tax != nil && t.recipient.merchant && s.tax.taxAccount.tenant == t.tenant {
+		accounts = append(accounts, s.tax.taxAccount)
+	}
+
+	return accounts
+}
+
+// Locks the accounts of a tenant and runs fn, so it can make several payments and adjustments on them atomically
+// Payments and adjustments made with the ctx given to fn reuse the locks, those touching other accounts fail with ErrAccountNotLocked
+// That includes the fee, reward pool and tax accounts a payment moves funds of, see paymentAccounts
+// Payments elsewhere wait for fn to return before touching the locked accounts
+func (s *Service) WithAccountsLocked(ctx context.Context, role Role, tenant TenantID, ids []uint32, fn func(ctx context.Context) error) error {
+	if err := authorize(role, PAY); err != nil {
+		return err
+	}
+
+	if _, ok := ctx.Value(heldLocksKey{}).(*heldLocks); ok {
+		return newError(INVALID_STATE, "Accounts are already locked by the operation")
+	}
+
+	keys := make([]recordKey, len(ids))
+
+	for i, id := range ids {
+		keys[i] = recordKey{tenant, id}
+	}
+
+	release, err := s.accountLocks.acquire(ctx, keys)
+
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
+	return fn(context.WithValue(ctx, heldLocksKey{}, &heldLocks{keys: keys}))
+}
@@ -1,16 +1,62 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"log"
+	"os"
+	"time"
 )
 
 // Models an account in a bank
 type Account struct {
-	id           uint8
+	id           uint32
+	tenant       TenantID
 	name         string
 	balance      uint32
 	transactions []Transaction
+	// Free form labels used to find the account
+	tags []string
+	// Account a wallet belongs to, nil for top level accounts
+	parent *Account
+	// Wallets kept under the account
+	wallets []*Account
+	// People who own a joint account, empty for single owner accounts
+	owners []string
+	// Payments above this amount need approvals from the owners
+	approvalThreshold uint32
+	// How many owners must approve a payment above the threshold
+	requiredApprovals int
+	// Contacts used to notify the owner of the account
+	email string
+	phone string
+	// Balance locked in term deposits, which payments can't use
+	lockedBalance uint32
+	// Most the account can owe on credit payments
+	creditLimit uint32
+	// What the account owes on credit, billed or not
+	creditUsed uint32
+	// Credit charges not yet on a statement
+	unbilledCredit uint32
+	// Merchants have tax withheld on the payments they receive
+	merchant bool
+	// What a merchant sells, which decides the credit surcharges waived on payments to it
+	merchantCategory Category
+	// Monthly spending limit of each category
+	budgets map[Category]uint32
+	// Balances that raise an alert when a payment takes the account below them
+	alertThresholds []uint32
+	// Locale the owner wants messages in, empty for the default
+	locale Locale
+	// ISO 4217 code of the balance, empty for the tenant's default currency
+	currency string
+	// Frozen accounts can't make or receive payments until an admin unfreezes them
+	frozen bool
+	// Format monthly statements are delivered in, empty for accounts that didn't opt in
+	statementFormat StatementFormat
+	// Which notifications the owner wants, nil for all of them
+	notificationPreferences *NotificationPreferences
+	// How the owner sees the accounts it transacts with, by account id
+	counterparties map[uint32]CounterpartyProfile
 }
 
 // All of the possible payment methods
@@ -20,38 +66,109 @@ const (
 	CREDIT PaymentMethod = "C"
 	DEBIT  PaymentMethod = "D"
 	CASH   PaymentMethod = "S"
+	CRYPTO PaymentMethod = "Y"
 )
 
 // All of the possible states of a transaction
 type TransactionState string
 
 const (
-	OPEN    TransactionState = "O"
-	EXPIRED TransactionState = "E"
-	CLOSED  TransactionState = "C"
+	OPEN                 TransactionState = "O"
+	EXPIRED              TransactionState = "E"
+	CLOSED               TransactionState = "C"
+	PENDING_CONFIRMATION TransactionState = "P"
+	CANCELLED            TransactionState = "X"
+	PENDING_APPROVAL     TransactionState = "A"
+	// Crypto payments waiting for the deposit to be confirmed on the chain
+	AWAITING_CHAIN TransactionState = "B"
+	// Gateway payments waiting for the processor to settle the capture
+	AWAITING_GATEWAY TransactionState = "G"
+	// Payments of a registered handler that didn't decide in time, the sender's funds stay held until it does
+	AWAITING_HANDLER TransactionState = "H"
 )
 
 // Models the transaction one account can make to another
 type Transaction struct {
-	id                 uint8
+	id                 uint32
+	tenant             TenantID
 	amount             uint32
 	sender             *Account
 	recipient          *Account
 	state              TransactionState
 	paymentMethod      PaymentMethod
 	transactionHandler TransactionHandler
+	// Opaque card token, only used by credit transactions
+	cardToken string
+	// When the payer was asked to confirm the transaction
+	confirmationRequestedAt time.Time
+	// API key that submitted the transaction, empty when submitted by a person
+	initiatedBy string
+	// HMAC of the transaction payload, checked when the service has a signing secret
+	signature string
+	// Used once per signature, so a signed transaction can't be submitted twice, and until when the signature is valid
+	nonce              string
+	signatureExpiresAt time.Time
+	// Why the transaction was abandoned, only set once it's cancelled
+	cancelReason string
+	// When the transaction was built or imported, or first received by the service otherwise
+	createdAt time.Time
+	// Set once the transaction was flagged for staying open past its method's SLA target
+	slaFlagged bool
+	// When the transaction was paid
+	closedAt time.Time
+	category Category
+	// Free text written by the payer
+	memo string
+	// Identifier of the payment in the integrator's own systems, e.g. an order number
+	reference string
+	// Extra values integrators attach to correlate the payment with their records
+	metadata map[string]string
+	// Posted to the fee account, negative when the fee account funded a discount
+	fee int64
+	// Promo code applied to the transaction
+	promoCode string
+	// Percentage of the fee waived by the promo code
+	feeDiscount uint8
+	// Set while the transaction holds one of the promo code's uses
+	promoRedeemed bool
+	// Idempotency key the payment's external handler is asked with, the same on every attempt
+	handlerKey string
+	// Owners of the sender who approved the transaction
+	approvals map[string]bool
+	// Mandate the transaction was collected under, zero for sender-initiated payments
+	mandateID uint32
+	// Locale asked for by the request that submitted the transaction, empty to use the payer's
+	locale Locale
+	// How urgently the processor should pay the transaction, empty for normal
+	priority Priority
+	// Machine the state moves through, the default one when nil
+	states *StateMachine
+	// Address crypto payers send the funds to, and until when
+	depositAddress   string
+	depositExpiresAt time.Time
+	// When the transaction lapses if it isn't paid, zero when it doesn't
+	expiresAt time.Time
+	// Reminders of the deadline already sent, by how long before it they were due
+	remindersSent []time.Duration
+	// Payment at the card gateway, e.g. a Stripe PaymentIntent id
+	gatewayPaymentID string
+	// Sent back to the sender by refunds and chargebacks
+	reversed uint32
+	// Whether support staff gave the fee back to the sender
+	feeWaived bool
 }
 
 // Interface for handling paying transactions
 type TransactionHandler interface {
 	// Pays an open transaction
 	// Returns an error if the transaction is invalid
-	pay(t *Transaction) error
+	// Returns the context error if it's done before balances are touched
+	pay(ctx context.Context, t *Transaction) error
 }
 
 // Pays transaction
-func (t *Transaction) makePayment() error {
-	err := t.transactionHandler.pay(t)
+func (t *Transaction) makePayment(ctx context.Context) error {
+	err := t.transactionHandler.pay(ctx, t)
 
 	if err != nil {
 		return err
@@ -60,108 +177,245 @@ func (t *Transaction) makePayment() error {
 	return nil
 }
 
+// Abandons a transaction that was created but not paid
+func (t *Transaction) Cancel(reason string) error {
+	if err := t.transition(CANCELLED); err != nil {
+		return err
+	}
+
+	t.cancelReason = reason
+
+	return nil
+}
+
+// Models what handlers need from outside of the transaction
+type HandlerDependencies struct {
+	tokenVault TokenVault
+	// House account that collects fees and funds discounts
+	feeAccount *Account
+	rounding   RoundingPolicy
+	// Where balances are checked and moved, local balances when nil
+	balances BalanceProvider
+	crypto   *CryptoPolicy
+	now      func() time.Time
+	// Rules waiving the credit surcharge, nil when it's always charged
+	creditWaivers *CreditWaiverRules
+}
+
 // Chooses what handler should be used with each transaction
-func (t *Transaction) selectTransactionHandler() error {
+func (t *Transaction) selectTransactionHandler(deps HandlerDependencies) error {
 	switch t.paymentMethod {
 	case CREDIT:
-		t.transactionHandler = &CreditTransactionHandler{}
+		if deps.tokenVault == nil {
+			return newError(MISCONFIGURED, "Credit transactions require a token vault")
+		}
+		if deps.feeAccount == nil {
+			return newError(MISCONFIGURED, "Credit transactions require a fee account")
+		}
+		t.transactionHandler = &CreditTransactionHandler{tokenVault: deps.tokenVault, feeAccount: deps.feeAccount, rounding: deps.rounding, balances: deps.balances, waivers: deps.creditWaivers, now: deps.now}
 		return nil
 	case CASH:
-		t.transactionHandler = &CashTransactionHandler{}
+		if deps.feeAccount == nil {
+			return newError(MISCONFIGURED, "Cash transactions require a fee account")
+		}
+		t.transactionHandler = &CashTransactionHandler{feeAccount: deps.feeAccount, rounding: deps.rounding, balances: deps.balances}
 		return nil
 	case DEBIT:
-		t.transactionHandler = &DebitTransactionHandler{}
+		t.transactionHandler = &DebitTransactionHandler{balances: deps.balances}
+		return nil
+	case CRYPTO:
+		if deps.crypto == nil {
+			return newError(MISCONFIGURED, "Crypto transactions require a chain watcher")
+		}
+		t.transactionHandler = &CryptoTransactionHandler{policy: deps.crypto, now: deps.now}
 		return nil
 	default:
-		return errors.New("Could find a valid handler")
+		return newError(UNSUPPORTED_PAYMENT_METHOD, "Could find a valid handler")
 	}
 }
 
 // Models dependencies used to pay a transaction of type credit
-type CreditTransactionHandler struct{}
+// The fee account acts as the card issuer, lending what is paid on credit
+type CreditTransactionHandler struct {
+	tokenVault TokenVault
+	feeAccount *Account
+	rounding   RoundingPolicy
+	balances   BalanceProvider
+	waivers    *CreditWaiverRules
+	now        func() time.Time
+}
 
 // Handles transactions of type credit
-func (th *CreditTransactionHandler) pay(t *Transaction) error {
+func (th *CreditTransactionHandler) pay(ctx context.Context, t *Transaction) error {
 	if t.sender.id == t.recipient.id {
-		return errors.New("One account can't make a transaction to itself")
+		return ErrSelfTransfer
 	}
 
 	if t.state == CLOSED {
-		return errors.New("Can't pay an already closed transaction")
+		return ErrTransactionClosed
 	}
 
 	if t.state == EXPIRED {
-		return errors.New("Transaction expired")
+		return ErrTransactionExpired
+	}
+
+	if t.state == CANCELLED {
+		return ErrTransactionCancelled
 	}
 
-	if t.sender.balance < uint32(float64(t.amount)*1.10) {
-		return errors.New("Sender doesn't have enough balance to make transaction")
+	if err := t.checkTransition(CLOSED); err != nil {
+		return err
 	}
 
-	t.sender.balance -= uint32(float64(t.amount) * 1.10)
-	t.recipient.balance += uint32(float64(t.amount) * 1.10)
-	t.state = CLOSED
+	if _, err := th.tokenVault.detokenize(t.cardToken); err != nil {
+		return err
+	}
 
-	return nil
+	_, waived := th.waivers.evaluate(t, th.now())
+	charge := creditCharge(t, th.rounding, waived)
+
+	if t.sender.creditUsed+charge > t.sender.creditLimit {
+		return newError(CREDIT_LIMIT_EXCEEDED, "Sender doesn't have enough credit to make transaction")
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// The house lends the amount, the sender owes it back with the surcharge on the next statement
+	err := moveFunds(ctx, balancesOrLocal(th.balances),
+		[]fundsLeg{{th.feeAccount, t.amount, newError(FEE_ACCOUNT_INSUFFICIENT_FUNDS, "Fee account doesn't have enough balance to fund the credit")}},
+		[]fundsLeg{{account: t.recipient, amount: t.amount}})
+
+	if err != nil {
+		return err
+	}
+
+	t.sender.creditUsed += charge
+	t.sender.unbilledCredit += charge
+	journalApplied(ctx, t.sender, AccountDelta{CreditUsed: int64(charge), UnbilledCredit: int64(charge)})
+	t.fee = int64(charge - t.amount)
+
+	return t.transition(CLOSED)
+}
+
+// Returns what the sender pays for a credit transaction, surcharge included
+// Promo codes can discount part or all of the surcharge, waiver rules all of it
+func creditCharge(t *Transaction, rounding RoundingPolicy, waived bool) uint32 {
+	if waived {
+		return t.amount
+	}
+
+	// 10% surcharge, less the percentage waived by the promo code
+	surcharge := rounding.share(t.amount, 10*uint32(100-t.feeDiscount))
+
+	return t.amount + surcharge
 }
 
 // Models dependencies used to pay a transaction of type cash
-type CashTransactionHandler struct{}
+type CashTransactionHandler struct {
+	feeAccount *Account
+	rounding   RoundingPolicy
+	balances   BalanceProvider
+}
 
 // Handles transactions of type cash
-func (th *CashTransactionHandler) pay(t *Transaction) error {
+func (th *CashTransactionHandler) pay(ctx context.Context, t *Transaction) error {
 	if t.sender.id == t.recipient.id {
-		return errors.New("One account can't make a transaction to itself")
+		return ErrSelfTransfer
 	}
 
 	if t.state == CLOSED {
-		return errors.New("Can't pay an already closed transaction")
+		return ErrTransactionClosed
 	}
 
 	if t.state == EXPIRED {
-		return errors.New("Transaction expired")
+		return ErrTransactionExpired
 	}
 
-	if t.sender.balance < uint32(float64(t.amount)*0.90) {
-		return errors.New("Sender doesn't have enough balance to make transaction")
+	if t.state == CANCELLED {
+		return ErrTransactionCancelled
 	}
 
-	t.sender.balance -= uint32(float64(t.amount) * 0.90)
-	t.recipient.balance += uint32(float64(t.amount) * 0.90)
-	t.state = CLOSED
+	if err := t.checkTransition(CLOSED); err != nil {
+		return err
+	}
 
-	return nil
+	// 10% discount, funded by the fee account
+	charge := t.amount - th.rounding.share(t.amount, 1000)
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := moveFunds(ctx, balancesOrLocal(th.balances),
+		[]fundsLeg{
+			{account: t.sender, amount: charge},
+			{th.feeAccount, t.amount - charge, newError(FEE_ACCOUNT_INSUFFICIENT_FUNDS, "Fee account doesn't have enough balance to fund the discount")},
+		},
+		[]fundsLeg{{account: t.recipient, amount: t.amount}})
+
+	if err != nil {
+		return err
+	}
+
+	t.fee = -int64(t.amount - charge)
+
+	return t.transition(CLOSED)
 }
 
 // Models dependencies used to pay a transaction of type debit
-type DebitTransactionHandler struct{}
+type DebitTransactionHandler struct {
+	balances BalanceProvider
+}
 
 // Handles transactions of type debit
-func (th *DebitTransactionHandler) pay(t *Transaction) error {
+func (th *DebitTransactionHandler) pay(ctx context.Context, t *Transaction) error {
 	if t.sender.id == t.recipient.id {
-		return errors.New("One account can't make a transaction to itself")
+		return ErrSelfTransfer
 	}
 
 	if t.state == CLOSED {
-		return errors.New("Can't pay an already closed transaction")
+		return ErrTransactionClosed
 	}
 
 	if t.state == EXPIRED {
-		return errors.New("Transaction expired")
+		return ErrTransactionExpired
 	}
 
-	if t.sender.balance < t.amount {
-		return errors.New("Sender doesn't have enough balance to make transaction")
+	if t.state == CANCELLED {
+		return ErrTransactionCancelled
 	}
 
-	t.sender.balance -= t.amount
-	t.recipient.balance += t.amount
-	t.state = CLOSED
+	if err := t.checkTransition(CLOSED); err != nil {
+		return err
+	}
 
-	return nil
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := moveFunds(ctx, balancesOrLocal(th.balances),
+		[]fundsLeg{{account: t.sender, amount: t.amount}},
+		[]fundsLeg{{account: t.recipient, amount: t.amount}})
+
+	if err != nil {
+		return err
+	}
+
+	return t.transition(CLOSED)
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "tui" {
+		if err := runDashboard(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	vault := NewMemoryTokenVault(24 * time.Hour)
+
 	gustavo := &Account{
 		id:      1,
 		name:    "My first account",
@@ -174,27 +428,25 @@ func main() {
 		balance: 5,
 	}
 
-	transaction := &Transaction{
-		id:            1,
-		amount:        55,
-		sender:        gustavo,
-		recipient:     pedro,
-		state:         OPEN,
-		paymentMethod: CASH,
+	house := &Account{
+		id:      3,
+		name:    "House",
+		balance: 1000,
 	}
 
-	err := transaction.selectTransactionHandler()
+	service := NewService(vault)
+	service.SetFeeAccount(ADMIN, house)
 
-	if err != nil {
-		log.Println(err)
-	}
+	transaction, err := service.NewTransfer().From(gustavo).To(pedro).Amount(55).Via(CASH).Build()
 
-	err = transaction.makePayment()
+	if err == nil {
+		err = service.Pay(context.Background(), OPERATOR, transaction)
+	}
 
 	if err != nil {
 		log.Println(err)
 	}
 
-	log.Println("Gustavo's balance: ", gustavo.balance)
-	log.Println("Pedro's balance: ", pedro.balance)
+	log.Println("Gustavo's balance:", NewMoney(int64(gustavo.balance), gustavo.currency).Format(defaultLocale))
+	log.Println("Pedro's balance:", NewMoney(int64(pedro.balance), pedro.currency).Format(defaultLocale))
 }
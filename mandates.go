@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+)
+
+// Models a payer's authorization for a merchant to pull funds from their account
+type Mandate struct {
+	id       uint32
+	payer    *Account
+	merchant *Account
+	// Largest amount a single collection may pull
+	limit   uint32
+	revoked bool
+	// Amounts requested by the merchant, pulled on the next collection run
+	pending []uint32
+}
+
+// Outcome of one collection made during a run
+type CollectionResult struct {
+	mandate     *Mandate
+	transaction *Transaction
+	err         error
+}
+
+// Authorizes a merchant to pull up to limit per collection from the payer
+func (s *Service) CreateMandate(role Role, payer *Account, merchant *Account, limit uint32) (*Mandate, error) {
+	if err := authorize(role, PAY); err != nil {
+		return nil, err
+	}
+
+	if payer.id == merchant.id {
+		return nil, newError(SELF_TRANSFER, "One account can't grant a mandate to itself")
+	}
+
+	if payer.tenant != merchant.tenant {
+		return nil, ErrCrossTenant
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastMandateID++
+	m := &Mandate{id: s.lastMandateID, payer: payer, merchant: merchant, limit: limit}
+
+	if err := s.mandates.save(m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Stops a merchant from pulling any more funds, dropping collections not yet made
+func (s *Service) RevokeMandate(role Role, m *Mandate) error {
+	if err := authorize(role, CANCEL); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m.revoked = true
+	m.pending = nil
+
+	return nil
+}
+
+// Queues an amount the merchant wants to collect on the next run
+func (s *Service) RequestCollection(role Role, m *Mandate, amount uint32) error {
+	if err := authorize(role, PAY); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if m.revoked {
+		return newError(INVALID_STATE, "Mandate was revoked")
+	}
+
+	if amount > m.limit {
+		return newError(INVALID_AMOUNT, "Amount is above the mandate limit")
+	}
+
+	m.pending = append(m.pending, amount)
+
+	return nil
+}
+
+// Pulls every requested amount from the payers, one debit transaction per collection
+func (s *Service) RunCollections(ctx context.Context, role Role) ([]CollectionResult, error) {
+	if err := authorize(role, PAY); err != nil {
+		return nil, err
+	}
+
+	type collection struct {
+		mandate *Mandate
+		amount  uint32
+	}
+
+	mandates, err := s.mandates.list()
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	var due []collection
+	for _, m := range mandates {
+		for _, amount := range m.pending {
+			due = append(due, collection{mandate: m, amount: amount})
+		}
+		m.pending = nil
+	}
+	s.mu.Unlock()
+
+	results := make([]CollectionResult, 0, len(due))
+
+	for _, c := range due {
+		t := &Transaction{
+			id:            s.newTransactionID(),
+			tenant:        c.mandate.payer.tenant,
+			amount:        c.amount,
+			sender:        c.mandate.payer,
+			recipient:     c.mandate.merchant,
+			state:         OPEN,
+			paymentMethod: DEBIT,
+			mandateID:     c.mandate.id,
+		}
+
+		err := s.Pay(ctx, role, t)
+		results = append(results, CollectionResult{mandate: c.mandate, transaction: t, err: err})
+	}
+
+	return results, nil
+}
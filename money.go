@@ -0,0 +1,200 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ISO 4217 codes of the currencies money can be formatted in with a symbol
+const (
+	BRL = "BRL"
+	USD = "USD"
+	EUR = "EUR"
+	GBP = "GBP"
+	JPY = "JPY"
+)
+
+// Digits after the decimal separator of each currency, currencies not listed have two
+var currencyDecimals = map[string]int{
+	JPY: 0,
+}
+
+// Symbols shown before amounts, currencies not listed show their code
+var currencySymbols = map[string]string{
+	BRL: "R$",
+	USD: "$",
+	EUR: "€",
+	GBP: "£",
+	JPY: "¥",
+}
+
+// How a locale writes amounts
+type moneyFormat struct {
+	thousands string
+	decimal   string
+	// Whether a space goes between the symbol and the number, e.g. R$ 10,00
+	spaced bool
+}
+
+// Amount formats of each locale
+var moneyFormats = map[Locale]moneyFormat{
+	EN:    {thousands: ",", decimal: ".", spaced: false},
+	PT_BR: {thousands: ".", decimal: ",", spaced: true},
+}
+
+// Models an amount in the smallest unit of a currency, e.g. cents
+type Money struct {
+	amount   int64
+	currency string
+}
+
+// Creates money of amount smallest units of currency, empty for the tenant's default currency
+func NewMoney(amount int64, currency string) Money {
+	return Money{amount: amount, currency: currency}
+}
+
+// Returns the digits after the decimal separator of the money's currency
+func (m Money) decimals() int {
+	if d, ok := currencyDecimals[m.currency]; ok {
+		return d
+	}
+
+	return 2
+}
+
+// Renders money the way a locale writes it, e.g. R$ 1.234,56 in pt-BR or $1,234.56 in en
+// Money without a currency is written without a symbol
+func (m Money) Format(locale Locale) string {
+	format := moneyFormats[defaultLocale]
+
+	for _, l := range locale.fallbacks() {
+		if f, ok := moneyFormats[l]; ok {
+			format = f
+			break
+		}
+	}
+
+	amount := m.amount
+	sign := ""
+
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	digits := strconv.FormatInt(amount, 10)
+	decimals := m.decimals()
+
+	if len(digits) <= decimals {
+		digits = strings.Repeat("0", decimals-len(digits)+1) + digits
+	}
+
+	whole, fraction := digits[:len(digits)-decimals], digits[len(digits)-decimals:]
+
+	var number strings.Builder
+
+	for i, digit := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			number.WriteString(format.thousands)
+		}
+		number.WriteRune(digit)
+	}
+
+	if decimals > 0 {
+		number.WriteString(format.decimal)
+		number.WriteString(fraction)
+	}
+
+	symbol, ok := currencySymbols[m.currency]
+
+	if !ok {
+		symbol = m.currency
+	}
+
+	if symbol == "" {
+		return sign + number.String()
+	}
+
+	if format.spaced || !ok {
+		return sign + symbol + " " + number.String()
+	}
+
+	return sign + symbol + number.String()
+}
+
+// Parses an amount of currency as people write it, e.g. R$ 1.234,56 or -1,234.5
+// The currency's symbol or code is optional, either separator is read as decimal when fewer digits than thousands follow it
+func ParseMoney(s string, currency string) (Money, error) {
+	m := Money{currency: currency}
+	s = strings.TrimSpace(s)
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+
+	if symbol, ok := currencySymbols[currency]; ok {
+		s = strings.TrimPrefix(s, symbol)
+	}
+
+	if currency != "" {
+		s = strings.TrimPrefix(s, currency)
+	}
+
+	s = strings.TrimSpace(s)
+
+	if strings.HasPrefix(s, "-") && !negative {
+		negative = true
+		s = s[1:]
+	}
+
+	if s == "" {
+		return Money{}, newError(INVALID_AMOUNT, "Invalid amount")
+	}
+
+	for _, r := range s {
+		if !unicode.IsDigit(r) && r != '.' && r != ',' {
+			return Money{}, newError(INVALID_AMOUNT, "Invalid amount")
+		}
+	}
+
+	whole, fraction := s, ""
+	decimals := m.decimals()
+
+	if i := strings.LastIndexAny(s, ".,"); i >= 0 {
+		after := len(s) - i - 1
+
+		if decimals > 0 && after > 0 && after <= decimals && after != 3 {
+			whole, fraction = s[:i], s[i+1:]
+		} else if after != 3 {
+			return Money{}, newError(INVALID_AMOUNT, "Invalid amount")
+		}
+	}
+
+	// Whatever separators are left group thousands
+	groups := strings.FieldsFunc(whole, func(r rune) bool { return r == '.' || r == ',' })
+
+	for i, g := range groups {
+		if i > 0 && len(g) != 3 {
+			return Money{}, newError(INVALID_AMOUNT, "Invalid amount")
+		}
+	}
+
+	digits := strings.Join(groups, "") + fraction + strings.Repeat("0", decimals-len(fraction))
+
+	if digits == "" || strings.Count(whole, ".")+strings.Count(whole, ",") != max(len(groups)-1, 0) {
+		return Money{}, newError(INVALID_AMOUNT, "Invalid amount")
+	}
+
+	amount, err := strconv.ParseInt(digits, 10, 64)
+
+	if err != nil {
+		return Money{}, newError(INVALID_AMOUNT, "Invalid amount")
+	}
+
+	if negative {
+		amount = -amount
+	}
+
+	m.amount = amount
+
+	return m, nil
+}
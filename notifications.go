@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"text/template"
+)
+
+// All of the possible kinds of notifications
+type NotificationKind string
+
+const (
+	PAYMENT_SUCCEEDED   NotificationKind = "payment_succeeded"
+	PAYMENT_FAILED      NotificationKind = "payment_failed"
+	TRANSACTION_EXPIRED NotificationKind = "transaction_expired"
+	STATEMENT_READY     NotificationKind = "statement_ready"
+	PAYMENT_EXPIRING    NotificationKind = "payment_expiring"
+)
+
+// Models a message sent to the owner of an account
+type Notification struct {
+	kind        NotificationKind
+	account     *Account
+	transaction *Transaction
+	subject     string
+	body        string
+	// Files sent along, only email delivers them
+	attachments []Attachment
+}
+
+// Models a file sent along with a notification
+type Attachment struct {
+	name        string
+	contentType string
+	data        []byte
+}
+
+// Interface for delivering notifications to end users
+type Notifier interface {
+	notify(ctx context.Context, n Notification) error
+}
+
+// Values available to notification templates
+type notificationData struct {
+	ID        uint32
+	Amount    string
+	Sender    string
+	Recipient string
+	Detail    string
+}
+
+// Subject and body templates of each kind of notification, per locale
+var notificationTemplates = map[Locale]map[NotificationKind][2]*template.Template{
+	EN: {
+		PAYMENT_SUCCEEDED: {
+			template.Must(template.New("subject").Parse("Payment sent")),
+			template.Must(template.New("body").Parse("You paid {{.Amount}} to {{.Recipient}}. Transaction {{.ID}}.")),
+		},
+		PAYMENT_FAILED: {
+			template.Must(template.New("subject").Parse("Payment failed")),
+			template.Must(template.New("body").Parse("Your payment of {{.Amount}} to {{.Recipient}} failed: {{.Detail}}. Transaction {{.ID}}.")),
+		},
+		TRANSACTION_EXPIRED: {
+			template.Must(template.New("subject").Parse("Payment expired")),
+			template.Must(template.New("body").Parse("Your payment of {{.Amount}} to {{.Recipient}} expired before it was made. Transaction {{.ID}}.")),
+		},
+		PAYMENT_EXPIRING: {
+			template.Must(template.New("subject").Parse("Payment about to expire")),
+			template.Must(template.New("body").Parse("Your payment of {{.Amount}} to {{.Recipient}} expires at {{.Detail}} if it isn't made. Transaction {{.ID}}.")),
+		},
+		STATEMENT_READY: {
+			template.Must(template.New("subject").Parse("Your statement for {{.Detail}}")),
+			template.Must(template.New("body").Parse("The statement of {{.Sender}} for {{.Detail}} is attached.")),
+		},
+	},
+	PT_BR: {
+		PAYMENT_SUCCEEDED: {
+			template.Must(template.New("subject").Parse("Pagamento enviado")),
+			template.Must(template.New("body").Parse("Você pagou {{.Amount}} para {{.Recipient}}. Transação {{.ID}}.")),
+		},
+		PAYMENT_FAILED: {
+			template.Must(template.New("subject").Parse("Pagamento recusado")),
+			template.Must(template.New("body").Parse("Seu pagamento de {{.Amount}} para {{.Recipient}} falhou: {{.Detail}}. Transação {{.ID}}.")),
+		},
+		TRANSACTION_EXPIRED: {
+			template.Must(template.New("subject").Parse("Pagamento expirado")),
+			template.Must(template.New("body").Parse("Seu pagamento de {{.Amount}} para {{.Recipient}} expirou antes de ser feito. Transação {{.ID}}.")),
+		},
+		PAYMENT_EXPIRING: {
+			template.Must(template.New("subject").Parse("Pagamento prestes a expirar")),
+			template.Must(template.New("body").Parse("Seu pagamento de {{.Amount}} para {{.Recipient}} expira em {{.Detail}} se não for feito. Transação {{.ID}}.")),
+		},
+		STATEMENT_READY: {
+			template.Must(template.New("subject").Parse("Seu extrato de {{.Detail}}")),
+			template.Must(template.New("body").Parse("O extrato de {{.Sender}} de {{.Detail}} está em anexo.")),
+		},
+	},
+}
+
+// Builds the notification sent to the payer of a transaction, in the transaction's locale
+func renderNotification(kind NotificationKind, t *Transaction, detail string) (Notification, error) {
+	data := notificationData{
+		ID:        t.id,
+		Amount:    NewMoney(int64(t.amount), t.sender.currency).Format(t.preferredLocale()),
+		Sender:    t.sender.name,
+		Recipient: t.recipient.name,
+		Detail:    detail,
+	}
+
+	n, err := renderTemplates(kind, t.preferredLocale(), data)
+	n.account = t.sender
+	n.transaction = t
+
+	return n, err
+}
+
+// Builds the notification that delivers a monthly statement to the owner of its account
+func renderStatementNotification(st *MonthlyStatement, attachment Attachment) (Notification, error) {
+	data := notificationData{
+		Sender: st.account.name,
+		Detail: st.period.Format("2006-01"),
+	}
+
+	n, err := renderTemplates(STATEMENT_READY, st.account.locale, data)
+	n.account = st.account
+	n.attachments = []Attachment{attachment}
+
+	return n, err
+}
+
+// Renders the subject and body of a kind of notification in a locale
+func renderTemplates(kind NotificationKind, locale Locale, data notificationData) (Notification, error) {
+	templates, ok := notificationTemplatesFor(kind, locale)
+
+	if !ok {
+		return Notification{}, newError(NOTIFICATION_FAILED, "Unknown notification kind")
+	}
+
+	var subject, body bytes.Buffer
+
+	if err := templates[0].Execute(&subject, data); err != nil {
+		return Notification{}, err
+	}
+
+	if err := templates[1].Execute(&body, data); err != nil {
+		return Notification{}, err
+	}
+
+	return Notification{kind: kind, subject: subject.String(), body: body.String()}, nil
+}
+
+// Drops every notification, used when no provider is configured
+type NoopNotifier struct{}
+
+func (n *NoopNotifier) notify(ctx context.Context, notification Notification) error {
+	return nil
+}
+
+// Sends notifications by email through an SMTP server
+type SMTPNotifier struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (n *SMTPNotifier) notify(ctx context.Context, notification Notification) error {
+	if notification.account.email == "" {
+		return newError(NOTIFICATION_FAILED, "Account has no email address")
+	}
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n",
+		n.from, notification.account.email, notification.subject)
+
+	if len(notification.attachments) == 0 {
+		msg += "\r\n" + notification.body + "\r\n"
+	} else {
+		body, boundary, err := mimeMessage(notification)
+
+		if err != nil {
+			return err
+		}
+
+		msg += "MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=" + boundary + "\r\n\r\n" + body
+	}
+
+	return smtp.SendMail(n.addr, n.auth, n.from, []string{notification.account.email}, []byte(msg))
+}
+
+// Writes the body of a notification and its attachments as MIME parts, returning them and their boundary
+func mimeMessage(notification Notification) (string, string, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+
+	part, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+
+	if err != nil {
+		return "", "", err
+	}
+
+	fmt.Fprintf(part, "%s\r\n", notification.body)
+
+	for _, a := range notification.attachments {
+		part, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {a.contentType},
+			"Content-Disposition":       {fmt.Sprintf("attachment; filename=%q", a.name)},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+
+		if err != nil {
+			return "", "", err
+		}
+
+		encoded := base64.StdEncoding.EncodeToString(a.data)
+
+		for len(encoded) > 76 {
+			fmt.Fprintf(part, "%s\r\n", encoded[:76])
+			encoded = encoded[76:]
+		}
+
+		fmt.Fprintf(part, "%s\r\n", encoded)
+	}
+
+	if err := w.Close(); err != nil {
+		return "", "", err
+	}
+
+	return buf.String(), w.Boundary(), nil
+}
+
+// Sends notifications by SMS through a Twilio-style HTTP API
+type SMSNotifier struct {
+	// Endpoint that accepts form posts with To, From and Body
+	endpoint  string
+	accountID string
+	authToken string
+	from      string
+	client    *http.Client
+}
+
+func (n *SMSNotifier) notify(ctx context.Context, notification Notification) error {
+	if notification.account.phone == "" {
+		return newError(NOTIFICATION_FAILED, "Account has no phone number")
+	}
+
+	form := url.Values{}
+	form.Set("To", notification.account.phone)
+	form.Set("From", n.from)
+	form.Set("Body", notification.body)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.endpoint, strings.NewReader(form.Encode()))
+
+	if err != nil {
+		return err
+	}
+
+	req.SetBasicAuth(n.accountID, n.authToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := n.client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return newError(NOTIFICATION_FAILED, fmt.Sprintf("SMS provider answered with status %d", res.StatusCode))
+	}
+
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Models how a tenant's merchants are paid out
+type PayoutPolicy struct {
+	mu sync.Mutex
+	// Account merchant balances are swept into
+	settlement *Account
+	// Merchants are paid out only once their balance goes above it
+	threshold uint32
+	// Least time between two payout runs of the tenant
+	interval time.Duration
+	lastRun  time.Time
+	// When each merchant was last paid out, receipts after it go in the next payout
+	lastPayout map[*Account]time.Time
+}
+
+// Creates a policy that sweeps merchant balances above threshold into settlement at most once per interval
+func NewPayoutPolicy(settlement *Account, threshold uint32, interval time.Duration) *PayoutPolicy {
+	return &PayoutPolicy{
+		settlement: settlement,
+		threshold:  threshold,
+		interval:   interval,
+		lastPayout: map[*Account]time.Time{},
+	}
+}
+
+// One payment received by a merchant and included in a payout
+type PayoutReceipt struct {
+	transactionID uint32
+	method        PaymentMethod
+	amount        uint32
+}
+
+// Models a merchant's balance swept into the settlement account in one transaction
+type Payout struct {
+	id          uint32
+	merchant    *Account
+	transaction *Transaction
+	// Payments received since the previous payout
+	receipts []PayoutReceipt
+}
+
+// Sweeps the balances of merchants whose tenant is due a payout run
+// Merchants at or below the threshold are left for a later run
+func (s *Service) RunPayouts(ctx context.Context, role Role) ([]*Payout, error) {
+	if err := authorize(role, PAY); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	policies := make([]*PayoutPolicy, 0, len(s.payoutPolicies))
+	for _, p := range s.payoutPolicies {
+		policies = append(policies, p)
+	}
+	s.mu.RUnlock()
+
+	var payouts []*Payout
+
+	for _, p := range policies {
+		done, err := s.runPayoutPolicy(ctx, p)
+		payouts = append(payouts, done...)
+
+		if err != nil {
+			return payouts, err
+		}
+	}
+
+	return payouts, nil
+}
+
+// Pays out every merchant of a policy's tenant above the threshold, when the policy is due
+func (s *Service) runPayoutPolicy(ctx context.Context, p *PayoutPolicy) ([]*Payout, error) {
+	now := s.now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.lastRun.IsZero() && now.Sub(p.lastRun) < p.interval {
+		return nil, nil
+	}
+
+	p.lastRun = now
+	tenant := p.settlement.tenant
+
+	accounts, err := s.repository.listAccounts(tenant)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var payouts []*Payout
+
+	for _, a := range accounts {
+		s.mu.RLock()
+		balance := a.balance
+		s.mu.RUnlock()
+
+		if !a.merchant || a == p.settlement || balance <= p.threshold {
+			continue
+		}
+
+		receipts, err := s.payoutReceipts(a, p.lastPayout[a], now)
+
+		if err != nil {
+			return payouts, err
+		}
+
+		s.mu.Lock()
+		s.lastPayoutID++
+		id := s.lastPayoutID
+		s.mu.Unlock()
+
+		metadata := map[string]string{"payout": strconv.FormatUint(uint64(id), 10)}
+		t, err := s.postTransfer(ctx, a, p.settlement, balance, metadata)
+
+		if err != nil {
+			return payouts, err
+		}
+
+		p.lastPayout[a] = now
+		payout := &Payout{id: id, merchant: a, transaction: t, receipts: receipts}
+
+		if err := s.payouts.save(payout); err != nil {
+			return payouts, err
+		}
+
+		payouts = append(payouts, payout)
+	}
+
+	return payouts, nil
+}
+
+// Returns the payments a merchant received from its customers between from and to
+func (s *Service) payoutReceipts(merchant *Account, from time.Time, to time.Time) ([]PayoutReceipt, error) {
+	transactions, err := s.closedBetween(merchant.tenant, from, to)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	house := s.feeAccounts[merchant.tenant]
+	s.mu.RUnlock()
+
+	var receipts []PayoutReceipt
+
+	for _, t := range transactions {
+		if t.recipient == merchant && t.sender != house {
+			receipts = append(receipts, PayoutReceipt{transactionID: t.id, method: t.paymentMethod, amount: t.amount})
+		}
+	}
+
+	return receipts, nil
+}
+
+// Runs payouts every tick until ctx is done
+// Failed runs are logged and retried on the next tick
+func (s *Service) SchedulePayouts(ctx context.Context, role Role, tick time.Duration) error {
+	if err := authorize(role, PAY); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := s.RunPayouts(ctx, role); err != nil {
+					log.Println(err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Returns every payout made to a merchant
+func (s *Service) Payouts(role Role, merchant *Account) ([]*Payout, error) {
+	if err := authorize(role, READ); err != nil {
+		return nil, err
+	}
+
+	return query(s.payouts, func(p *Payout) bool { return p.merchant == merchant })
+}
+
+// Sets how the merchants of the settlement account's tenant are paid out
+func (s *Service) SetPayoutPolicy(role Role, p *PayoutPolicy) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.payoutPolicies[p.settlement.tenant] = p
+
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"image/jpeg"
+	"strings"
+)
+
+// Points an A4 page measures and is kept clear around its edges
+const (
+	pdfPageWidth  = 595
+	pdfPageHeight = 842
+	pdfMargin     = 50
+)
+
+// Height of the logo on the first page, its width follows its aspect ratio
+const pdfLogoHeight = 40
+
+// Writes the lines a document template rendered as a PDF of A4 pages
+// Lines starting with "# " are headings, "---" draws a rule and everything else is monospaced, so columns padded
+// by the template stay aligned. Only characters of the fonts' Windows-1252 encoding are kept, e.g. € and Latin-1,
+// other characters are replaced with ?
+func renderPDF(lines []string, branding DocumentBranding) ([]byte, error) {
+	// Objects 1 to 5 are the catalog, the page tree and the fonts, then the logo and a page and its content per page
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>",
+	}
+	resources := "/Font << /F1 3 0 R /F2 4 0 R /F3 5 0 R >>"
+	var logo string
+
+	if branding.logo != nil {
+		object, width, err := pdfImage(branding.logo)
+
+		if err != nil {
+			return nil, err
+		}
+
+		objects = append(objects, object)
+		resources += fmt.Sprintf(" /XObject << /Logo %d 0 R >>", len(objects))
+		logo = fmt.Sprintf("q %.2f 0 0 %d %.2f %d cm /Logo Do Q\n", width, pdfLogoHeight, pdfPageWidth-pdfMargin-width, pdfPageHeight-pdfMargin-pdfLogoHeight)
+	}
+
+	var pages []*strings.Builder
+	var y int
+
+	newPage := func() *strings.Builder {
+		page := &strings.Builder{}
+		pages = append(pages, page)
+		y = pdfPageHeight - pdfMargin
+
+		return page
+	}
+
+	page := newPage()
+
+	if branding.name != "" || logo != "" {
+		page.WriteString(logo)
+		y -= 16
+		fmt.Fprintf(page, "BT /F2 16 Tf %d %d Td (%s) Tj ET\n", pdfMargin, y, pdfString(branding.name))
+
+		for _, detail := range branding.details {
+			y -= 11
+			fmt.Fprintf(page, "BT /F1 9 Tf %d %d Td (%s) Tj ET\n", pdfMargin, y, pdfString(detail))
+		}
+
+		y = min(y, pdfPageHeight-pdfMargin-pdfLogoHeight) - 24
+	}
+
+	// Room kept at the bottom of every page for the footer
+	bottom := pdfMargin + 20
+
+	for _, line := range lines {
+		height := 11
+
+		if strings.HasPrefix(line, "# ") {
+			height = 24
+		}
+
+		if y-height < bottom {
+			page = newPage()
+		}
+
+		y -= height
+
+		switch {
+		case strings.HasPrefix(line, "# "):
+			fmt.Fprintf(page, "BT /F2 14 Tf %d %d Td (%s) Tj ET\n", pdfMargin, y+4, pdfString(line[2:]))
+		case line == "---":
+			fmt.Fprintf(page, "0.5 w %d %d m %d %d l S\n", pdfMargin, y+4, pdfPageWidth-pdfMargin, y+4)
+		default:
+			fmt.Fprintf(page, "BT /F3 9 Tf %d %d Td (%s) Tj ET\n", pdfMargin, y, pdfString(line))
+		}
+	}
+
+	kids := make([]string, len(pages))
+
+	for i, page := range pages {
+		footer := fmt.Sprintf("Page %d of %d", i+1, len(pages))
+
+		if branding.footer != "" {
+			footer = branding.footer + "  -  " + footer
+		}
+
+		fmt.Fprintf(page, "BT /F1 8 Tf %d %d Td (%s) Tj ET", pdfMargin, pdfMargin, pdfString(footer))
+
+		n := len(objects) + 1
+		kids[i] = fmt.Sprintf("%d 0 R", n)
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << %s >> /Contents %d 0 R >>", pdfPageWidth, pdfPageHeight, resources, n+1),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", page.Len(), page.String()),
+		)
+	}
+
+	objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages))
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+
+	for i, object := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+
+	return out.Bytes(), nil
+}
+
+// Embeds a JPEG as an image object, PDF readers decode it themselves
+// Returns the object and the width it is drawn at
+func pdfImage(data []byte) (string, float64, error) {
+	config, err := jpeg.DecodeConfig(bytes.NewReader(data))
+
+	if err != nil || config.Height == 0 {
+		return "", 0, ErrInvalidLogo
+	}
+
+	colorSpace := "/DeviceRGB"
+
+	switch config.ColorModel {
+	case color.GrayModel:
+		colorSpace = "/DeviceGray"
+	case color.CMYKModel:
+		colorSpace = "/DeviceCMYK"
+	}
+
+	object := fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace %s /BitsPerComponent 8 /Filter /DCTDecode /Length %d >>\nstream\n%s\nendstream",
+		config.Width, config.Height, colorSpace, len(data), data)
+
+	return object, float64(config.Width) * pdfLogoHeight / float64(config.Height), nil
+}
+
+// Codes of the Windows-1252 characters outside of Latin-1, which uses 0x80 to 0x9f for control characters
+var winAnsiCodes = map[rune]byte{
+	'€': 0x80, '‚': 0x82, 'ƒ': 0x83, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87, 'ˆ': 0x88,
+	'‰': 0x89, 'Š': 0x8a, '‹': 0x8b, 'Œ': 0x8c, 'Ž': 0x8e, '‘': 0x91, '’': 0x92, '“': 0x93,
+	'”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97, '˜': 0x98, '™': 0x99, 'š': 0x9a, '›': 0x9b,
+	'œ': 0x9c, 'ž': 0x9e, 'Ÿ': 0x9f,
+}
+
+// Escapes text for a PDF string literal
+func pdfString(s string) string {
+	var out strings.Builder
+
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			out.WriteByte('\\')
+			out.WriteRune(r)
+		case winAnsiCodes[r] != 0:
+			fmt.Fprintf(&out, "\\%03o", winAnsiCodes[r])
+		case r < 0x20 || (r > 0x7e && r < 0xa0) || r > 0xff:
+			out.WriteByte('?')
+		case r > 0x7e:
+			fmt.Fprintf(&out, "\\%03o", r)
+		default:
+			out.WriteRune(r)
+		}
+	}
+
+	return out.String()
+}
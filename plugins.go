@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"plugin"
+)
+
+// Returned while a payment waits for its handler to decide, which it didn't do in time
+var ErrAwaitingHandler = newError(HANDLER_DECISION_PENDING, "Transaction is waiting for the payment method's handler")
+
+// Returned by handlers that couldn't get a decision, the payment may have been approved
+var ErrHandlerUndecided = newError(HANDLER_DECISION_PENDING, "Payment method's handler didn't answer")
+
+// Builds the handler of a payment method registered from outside the package
+type HandlerFactory func(deps HandlerDependencies) TransactionHandler
+
+// Interface external handlers implement, only standard types so plugins don't need this package
+// Returning nil approves the payment, funds then move from the sender to the recipient
+// Returning an error wrapping context.Canceled or context.DeadlineExceeded leaves it undecided, the sender's funds stay
+// held and paying it again asks again with the same key, which is unique to the payment and the same on every attempt
+type ExternalHandler interface {
+	Pay(ctx context.Context, key string, id uint32, sender uint32, recipient uint32, amount uint32, metadata map[string]string) error
+}
+
+// Pays transactions of a proprietary method through an external handler
+type ExternalTransactionHandler struct {
+	external ExternalHandler
+	balances BalanceProvider
+}
+
+// Handles transactions of a method registered from outside the package
+// The sender's funds are held while the external handler decides, and given back if it refuses
+// When it doesn't decide in time they stay held, and the payment waits to be paid again to ask it again
+func (th *ExternalTransactionHandler) pay(ctx context.Context, t *Transaction) error {
+	if t.sender.id == t.recipient.id {
+		return ErrSelfTransfer
+	}
+
+	if t.state == CLOSED {
+		return ErrTransactionClosed
+	}
+
+	if t.state == EXPIRED {
+		return ErrTransactionExpired
+	}
+
+	if t.state == CANCELLED {
+		return ErrTransactionCancelled
+	}
+
+	balances := balancesOrLocal(th.balances)
+	debits := []fundsLeg{{account: t.sender, amount: t.amount}}
+	credits := []fundsLeg{{account: t.recipient, amount: t.amount}}
+
+	// A payment waiting for its handler already holds the funds
+	if t.state != AWAITING_HANDLER {
+		if err := t.checkTransition(CLOSED); err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if t.handlerKey == "" {
+			t.handlerKey = fmt.Sprintf("%s:%d:%s", t.tenant, t.id, rand.Text())
+		}
+
+		if err := holdFunds(ctx, balances, debits); err != nil {
+			return err
+		}
+	}
+
+	err := th.external.Pay(ctx, t.handlerKey, t.id, t.sender.id, t.recipient.id, t.amount, t.metadata)
+
+	switch {
+	case err != nil && undecided(err):
+		if err := t.transition(AWAITING_HANDLER); err != nil {
+			return err
+		}
+		return ErrAwaitingHandler
+	case err != nil:
+		releaseHeldFunds(context.WithoutCancel(ctx), balances, debits)
+
+		// An open payment may be tried again as a new payment, one that was waiting can't go back
+		if t.state == AWAITING_HANDLER {
+			if err := t.Cancel("Refused by the payment method's handler"); err != nil {
+				return err
+			}
+		} else {
+			t.handlerKey = ""
+		}
+
+		return err
+	}
+
+	// The external handler took the payment, settle it even if the caller gave up
+	if err := settleHeldFunds(context.WithoutCancel(ctx), balances, debits, credits); err != nil {
+		return err
+	}
+
+	return t.transition(CLOSED)
+}
+
+// Checks if an external handler's error leaves the payment undecided rather than refused
+func undecided(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errorCode(err) == HANDLER_DECISION_PENDING
+}
+
+// Makes the service pay a payment method with handlers built by factory
+// Built-in methods can't be replaced
+func (s *Service) RegisterHandler(role Role, method PaymentMethod, factory HandlerFactory) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	if method == CREDIT || method == DEBIT || method == CASH || method == CRYPTO || method == "" {
+		return newError(INVALID_ARGUMENT, "Payment method is already handled by the service")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.handlers[method] = factory
+
+	return nil
+}
+
+// Registers the handler exported as Handler by a Go plugin built with -buildmode=plugin
+func (s *Service) LoadHandlerPlugin(role Role, method PaymentMethod, path string) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	p, err := plugin.Open(path)
+
+	if err != nil {
+		return err
+	}
+
+	symbol, err := p.Lookup("Handler")
+
+	if err != nil {
+		return err
+	}
+
+	external, ok := symbol.(ExternalHandler)
+
+	if !ok {
+		return newError(INVALID_ARGUMENT, "Plugin Handler doesn't implement ExternalHandler")
+	}
+
+	return s.RegisterHandler(role, method, func(deps HandlerDependencies) TransactionHandler {
+		return &ExternalTransactionHandler{external: external, balances: deps.balances}
+	})
+}
+
+// Asks a remote service over HTTP whether to approve payments
+// The endpoint gets a JSON payment and answers 2xx to approve, or an error body to refuse
+// Every request for a payment carries its key as the Idempotency-Key, so the endpoint answers a retry with the outcome it already decided
+// When no answer comes back, the payment is left undecided rather than refused
+type RemoteHandler struct {
+	endpoint string
+	client   *http.Client
+	// Requests made for a payment before a network failure is given up on
+	attempts int
+}
+
+// Body posted to a remote handler
+type remotePayment struct {
+	ID        uint32            `json:"id"`
+	Sender    uint32            `json:"sender"`
+	Recipient uint32            `json:"recipient"`
+	Amount    uint32            `json:"amount"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+// Body a remote handler answers with when it refuses a payment
+type remoteRefusal struct {
+	Error string `json:"error"`
+}
+
+func (h *RemoteHandler) Pay(ctx context.Context, key string, id uint32, sender uint32, recipient uint32, amount uint32, metadata map[string]string) error {
+	body, err := json.Marshal(remotePayment{ID: id, Sender: sender, Recipient: recipient, Amount: amount, Metadata: metadata})
+
+	if err != nil {
+		return err
+	}
+
+	var res *http.Response
+
+	// A network failure may hide an approval, so the request is sent again instead of taking it as a refusal
+	for attempt := 0; attempt < max(h.attempts, 1); attempt++ {
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, h.endpoint, bytes.NewReader(body))
+
+		if err != nil {
+			return err
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", key)
+
+		if res, err = h.client.Do(req); err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+
+	// The request may have reached the endpoint, which may have approved it
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrHandlerUndecided, err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		var refusal remoteRefusal
+		json.NewDecoder(res.Body).Decode(&refusal)
+
+		if refusal.Error == "" {
+			refusal.Error = res.Status
+		}
+
+		return newError(PAYMENT_REFUSED, refusal.Error)
+	}
+
+	return nil
+}
+
+// Registers a payment method paid through a remote handler at endpoint
+func (s *Service) RegisterRemoteHandler(role Role, method PaymentMethod, endpoint string, client *http.Client) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	if client == nil {
+		return newError(INVALID_ARGUMENT, "Remote handlers need an HTTP client")
+	}
+
+	remote := &RemoteHandler{endpoint: endpoint, client: client, attempts: 3}
+
+	return s.RegisterHandler(role, method, func(deps HandlerDependencies) TransactionHandler {
+		return &ExternalTransactionHandler{external: remote, balances: deps.balances}
+	})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+)
+
+// All of the channels notifications can be delivered through
+type NotificationChannel string
+
+const (
+	EMAIL_CHANNEL NotificationChannel = "email"
+	SMS_CHANNEL   NotificationChannel = "sms"
+)
+
+// Models which notifications the owner of an account wants, and how
+// The zero value sends every notification through the service's default notifier
+type NotificationPreferences struct {
+	// Channels notifications go out through, empty for the default notifier
+	channels []NotificationChannel
+	// Kinds of notifications never sent
+	muted []NotificationKind
+	// Time of day, since midnight in location, when nothing is sent
+	// A window that ends before it starts goes over midnight
+	quietFrom time.Duration
+	quietTo   time.Duration
+	location  *time.Location
+	// Payments below it don't notify
+	minAmount uint32
+}
+
+// Starts preferences delivering through channels, or the default notifier when there are none
+func NewNotificationPreferences(channels ...NotificationChannel) *NotificationPreferences {
+	return &NotificationPreferences{channels: channels}
+}
+
+// Stops kinds of notifications from being sent
+func (p *NotificationPreferences) Mute(kinds ...NotificationKind) *NotificationPreferences {
+	p.muted = append(p.muted, kinds...)
+	return p
+}
+
+// Holds back notifications between from and to, as times of day in location
+func (p *NotificationPreferences) QuietHours(from time.Duration, to time.Duration, location *time.Location) *NotificationPreferences {
+	p.quietFrom = from
+	p.quietTo = to
+	p.location = location
+	return p
+}
+
+// Stops payments below amount from notifying
+func (p *NotificationPreferences) MinAmount(amount uint32) *NotificationPreferences {
+	p.minAmount = amount
+	return p
+}
+
+// Checks if it's quiet hours at a time
+func (p *NotificationPreferences) quiet(at time.Time) bool {
+	if p.quietFrom == p.quietTo {
+		return false
+	}
+
+	location := p.location
+	if location == nil {
+		location = time.UTC
+	}
+
+	local := at.In(location)
+	sinceMidnight := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute + time.Duration(local.Second())*time.Second
+
+	if p.quietFrom < p.quietTo {
+		return sinceMidnight >= p.quietFrom && sinceMidnight < p.quietTo
+	}
+
+	return sinceMidnight >= p.quietFrom || sinceMidnight < p.quietTo
+}
+
+// Checks if a notification should be sent at a time
+// Monthly statements were asked for explicitly, so only muting them stops them
+func (p *NotificationPreferences) wants(n Notification, at time.Time) bool {
+	if slices.Contains(p.muted, n.kind) {
+		return false
+	}
+
+	if n.kind == STATEMENT_READY {
+		return true
+	}
+
+	if n.transaction != nil && n.transaction.amount < p.minAmount {
+		return false
+	}
+
+	return !p.quiet(at)
+}
+
+// Delivers a notification the way the owner of its account prefers
+// Notifications the preferences rule out are dropped without an error
+func (s *Service) deliver(ctx context.Context, n Notification) error {
+	s.mu.RLock()
+	preferences := n.account.notificationPreferences
+	notifier := s.notifier
+	channels := map[NotificationChannel]Notifier{}
+	if preferences != nil {
+		for _, channel := range preferences.channels {
+			channels[channel] = s.channels[channel]
+		}
+	}
+	now := s.now()
+	s.mu.RUnlock()
+
+	if preferences == nil {
+		return notifier.notify(ctx, n)
+	}
+
+	if !preferences.wants(n, now) {
+		return nil
+	}
+
+	if len(preferences.channels) == 0 {
+		return notifier.notify(ctx, n)
+	}
+
+	var errs []error
+
+	for _, channel := range preferences.channels {
+		notifier, ok := channels[channel]
+
+		if !ok || notifier == nil {
+			errs = append(errs, newError(NOTIFICATION_FAILED, "Service has no notifier for the channel"))
+			continue
+		}
+
+		if err := notifier.notify(ctx, n); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Sets the notifier delivering a channel, nil turns the channel off
+func (s *Service) SetChannelNotifier(role Role, channel NotificationChannel, notifier Notifier) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if notifier == nil {
+		delete(s.channels, channel)
+		return nil
+	}
+
+	s.channels[channel] = notifier
+
+	return nil
+}
+
+// Sets which notifications the owner of an account gets, nil goes back to every notification through the default notifier
+func (s *Service) SetNotificationPreferences(role Role, a *Account, p *NotificationPreferences) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a.notificationPreferences = p
+
+	return nil
+}
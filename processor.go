@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// All of the possible priorities of a submitted transaction
+type Priority string
+
+const (
+	// Urgent payments, like instant transfers
+	HIGH   Priority = "high"
+	NORMAL Priority = "normal"
+	// Batch work that can wait
+	LOW Priority = "low"
+)
+
+// Order queues are served in when nothing is starving
+var priorities = []Priority{HIGH, NORMAL, LOW}
+
+// Returned when a transaction asks for a priority the processor doesn't have a queue for
+var ErrUnknownPriority = newError(INVALID_ARGUMENT, "Unknown priority")
+
+// Checks if the processor has a queue for a priority
+func (p Priority) valid() bool {
+	return slices.Contains(priorities, p)
+}
+
+// Models a transaction waiting in the processor queue
+type submission struct {
+	ctx        context.Context
+	t          *Transaction
+	enqueuedAt time.Time
+	result     chan error
+}
+
+// Pays submitted transactions in the background, urgent ones first
+// Anything that waited longer than maxWait is served before newer urgent work, so low priorities never starve
+type Processor struct {
+	service *Service
+	mu      sync.Mutex
+	ready   *sync.Cond
+	// Signalled when a worker takes a submission off the queue
+	room    *sync.Cond
+	queues  map[Priority][]*submission
+	maxWait time.Duration
+	// Most submissions that can wait in the queue, zero for no limit
+	depth      int
+	policy     ShedPolicy
+	retryAfter time.Duration
+	closed     bool
+	workers    sync.WaitGroup
+	// Closed once the processor is, stops the stats hooks
+	done chan struct{}
+	// Workers wanted, running and paying a transaction
+	target  int
+	running int
+	paying  int
+	// Payments made, and how long recent ones waited and took
+	processed uint64
+	waits     durationWindow
+	latencies durationWindow
+}
+
+// Creates a processor and starts its workers
+func NewProcessor(s *Service, workers int, maxWait time.Duration) *Processor {
+	p := &Processor{service: s, queues: map[Priority][]*submission{}, maxWait: maxWait, done: make(chan struct{}), target: workers, running: workers}
+	p.ready = sync.NewCond(&p.mu)
+	p.room = sync.NewCond(&p.mu)
+
+	for range workers {
+		p.workers.Add(1)
+		go p.work()
+	}
+
+	return p
+}
+
+// Queues a transaction to be paid by the workers
+// The returned channel gets the outcome of the payment once it is made
+func (p *Processor) Submit(ctx context.Context, role Role, t *Transaction) (<-chan error, error) {
+	if err := authorize(role, PAY); err != nil {
+		return nil, err
+	}
+
+	priority := t.priority
+
+	if priority == "" {
+		priority = NORMAL
+	}
+
+	if !priority.valid() {
+		return nil, ErrUnknownPriority
+	}
+
+	sub := &submission{ctx: ctx, t: t, enqueuedAt: p.service.now(), result: make(chan error, 1)}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.admit(ctx, priority); err != nil {
+		return nil, err
+	}
+
+	if p.closed {
+		return nil, newError(INVALID_STATE, "Processor is closed")
+	}
+
+	p.queues[priority] = append(p.queues[priority], sub)
+	p.ready.Signal()
+
+	return sub.result, nil
+}
+
+// Stops taking submissions and waits for the queued ones to be paid
+func (p *Processor) Close() {
+	p.mu.Lock()
+	if !p.closed {
+		close(p.done)
+	}
+	p.closed = true
+	p.ready.Broadcast()
+	p.room.Broadcast()
+	p.mu.Unlock()
+
+	p.workers.Wait()
+}
+
+// Pays queued transactions until the processor is closed and drained
+func (p *Processor) work() {
+	defer p.workers.Done()
+
+	for {
+		p.mu.Lock()
+
+		for p.queued() == 0 && !p.closed && p.running <= p.target {
+			p.ready.Wait()
+		}
+
+		// Workers above the target stop, unless the processor is draining
+		if p.queued() == 0 || (p.running > p.target && !p.closed) {
+			p.running--
+			// Hands the wake up over in case it was for a submission
+			p.ready.Signal()
+			p.mu.Unlock()
+			return
+		}
+
+		sub := p.next()
+
+		if sub == nil {
+			p.mu.Unlock()
+			continue
+		}
+
+		p.room.Signal()
+		p.paying++
+		p.mu.Unlock()
+
+		started := p.service.now()
+		err := p.service.pay(sub.ctx, sub.t)
+
+		p.mu.Lock()
+		p.paying--
+		p.record(sub, started, p.service.now())
+		p.mu.Unlock()
+
+		sub.result <- err
+	}
+}
+
+// Returns how many submissions are waiting, lock must be held
+func (p *Processor) queued() int {
+	n := 0
+
+	for _, priority := range priorities {
+		n += len(p.queues[priority])
+	}
+
+	return n
+}
+
+// Takes the next submission to pay, lock must be held
+// The oldest submission past maxWait goes first, otherwise the head of the highest priority queue
+// Returns nil when every queue is empty
+func (p *Processor) next() *submission {
+	now := p.service.now()
+	var pick, starving Priority
+
+	for _, priority := range priorities {
+		q := p.queues[priority]
+
+		if len(q) == 0 {
+			continue
+		}
+
+		if pick == "" {
+			pick = priority
+		}
+
+		if p.maxWait > 0 && now.Sub(q[0].enqueuedAt) > p.maxWait &&
+			(starving == "" || q[0].enqueuedAt.Before(p.queues[starving][0].enqueuedAt)) {
+			starving = priority
+		}
+	}
+
+	if starving != "" {
+		pick = starving
+	}
+
+	if pick == "" {
+		return nil
+	}
+
+	sub := p.queues[pick][0]
+	p.queues[pick] = p.queues[pick][1:]
+
+	return sub
+}
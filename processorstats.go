@@ -0,0 +1,152 @@
+package main
+
+import (
+	"slices"
+	"time"
+)
+
+// How many recent submissions latencies are computed over
+const statsWindow = 1024
+
+// Models the load of a processor at one moment, for embedding applications to size its worker pool with
+type ProcessorStats struct {
+	// Submissions waiting, in total and per priority
+	depth  int
+	queued map[Priority]int
+	// Workers running, and how many of them are paying a transaction
+	workers int
+	busy    int
+	// Share of workers paying a transaction, from 0 to 1
+	utilization float64
+	processed   uint64
+	// Time recent submissions waited in the queue
+	waitP50 time.Duration
+	waitP95 time.Duration
+	// Time recent submissions took to be paid
+	latencyP50 time.Duration
+	latencyP95 time.Duration
+}
+
+// Called with the stats of a processor on every tick of the interval it was registered with
+type StatsHook func(stats ProcessorStats)
+
+// Recent durations, oldest overwritten first
+type durationWindow struct {
+	samples []time.Duration
+	next    int
+}
+
+// Adds a duration, dropping the oldest once the window is full
+func (w *durationWindow) add(d time.Duration) {
+	if len(w.samples) < statsWindow {
+		w.samples = append(w.samples, d)
+		return
+	}
+
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % statsWindow
+}
+
+// Returns the median and 95th percentile of the window
+func (w *durationWindow) percentiles() (time.Duration, time.Duration) {
+	sorted := slices.Clone(w.samples)
+	slices.Sort(sorted)
+
+	return percentile(sorted, 0.5), percentile(sorted, 0.95)
+}
+
+// Records a payment made by a worker, lock must be held
+func (p *Processor) record(sub *submission, started time.Time, done time.Time) {
+	p.processed++
+	p.waits.add(started.Sub(sub.enqueuedAt))
+	p.latencies.add(done.Sub(started))
+}
+
+// Returns the current load of the processor
+func (p *Processor) Stats() ProcessorStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := ProcessorStats{
+		depth:     p.queued(),
+		queued:    map[Priority]int{},
+		workers:   p.running,
+		busy:      p.paying,
+		processed: p.processed,
+	}
+
+	for priority, q := range p.queues {
+		stats.queued[priority] = len(q)
+	}
+
+	if p.running > 0 {
+		stats.utilization = float64(p.paying) / float64(p.running)
+	}
+
+	stats.waitP50, stats.waitP95 = p.waits.percentiles()
+	stats.latencyP50, stats.latencyP95 = p.latencies.percentiles()
+
+	return stats
+}
+
+// Calls hook with the processor stats every interval until the processor is closed
+func (p *Processor) OnStats(role Role, interval time.Duration, hook StatsHook) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return newError(INVALID_STATE, "Processor is closed")
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-ticker.C:
+				hook(p.Stats())
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Grows or shrinks the worker pool to a number of workers
+// Workers paying a transaction finish it before they stop
+func (p *Processor) Resize(role Role, workers int) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	if workers < 1 {
+		return newError(INVALID_ARGUMENT, "Processors need at least one worker")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return newError(INVALID_STATE, "Processor is closed")
+	}
+
+	p.target = workers
+
+	for p.running < p.target {
+		p.running++
+		p.workers.Add(1)
+		go p.work()
+	}
+
+	// Idle workers above the target wake up to stop
+	p.ready.Broadcast()
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"slices"
+	"time"
+)
+
+// Returned when a promo code can't be applied to a transaction
+var ErrInvalidPromoCode = newError(INVALID_PROMO_CODE, "Invalid promo code")
+
+// Models a code that waives part or all of a transaction's fee
+type PromoCode struct {
+	code string
+	// Percentage of the fee waived, 100 waives it entirely
+	discount uint8
+	// How many times the code can be redeemed in total, zero means no limit
+	maxUses int
+	// How many times one account can redeem the code, zero means no limit
+	perAccountCap int
+	// Payment methods the code can be used with, empty for any
+	methods []PaymentMethod
+	// Zero when the code never expires
+	expiresAt   time.Time
+	uses        int
+	redemptions map[*Account]int
+}
+
+// Makes a promo code available to transactions
+func (s *Service) AddPromoCode(role Role, p *PromoCode) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	if p.discount > 100 {
+		return newError(INVALID_AMOUNT, "Promo codes can't discount more than the whole fee")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p.redemptions == nil {
+		p.redemptions = map[*Account]int{}
+	}
+
+	s.promoCodes[p.code] = p
+
+	return nil
+}
+
+// Checks the promo code of a transaction and applies its discount, its uses are counted by redeemPromoCode
+// Must be called with the lock held for reading
+func (s *Service) applyPromoCode(t *Transaction) error {
+	t.feeDiscount = 0
+
+	if t.promoCode == "" {
+		return nil
+	}
+
+	p, ok := s.promoCodes[t.promoCode]
+
+	if !ok || (!p.expiresAt.IsZero() && !s.now().Before(p.expiresAt)) {
+		return ErrInvalidPromoCode
+	}
+
+	if len(p.methods) > 0 && !slices.Contains(p.methods, t.paymentMethod) {
+		return ErrInvalidPromoCode
+	}
+
+	t.feeDiscount = p.discount
+
+	return nil
+}
+
+// Counts a use of the promo code of a transaction about to be paid, refusing it when the code is used up
+// Checked and counted under one lock so concurrent payments can't both take the last use
+func (s *Service) redeemPromoCode(t *Transaction) error {
+	if t.promoCode == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t.promoRedeemed {
+		return nil
+	}
+
+	p, ok := s.promoCodes[t.promoCode]
+
+	if !ok {
+		return ErrInvalidPromoCode
+	}
+
+	if p.maxUses > 0 && p.uses >= p.maxUses {
+		return ErrInvalidPromoCode
+	}
+
+	if p.perAccountCap > 0 && p.redemptions[t.sender] >= p.perAccountCap {
+		return ErrInvalidPromoCode
+	}
+
+	p.uses++
+	p.redemptions[t.sender]++
+	t.promoRedeemed = true
+
+	return nil
+}
+
+// Gives back the use a transaction counted once it can no longer be paid, or has to be paid again from the start
+// Transactions closed or waiting to complete keep theirs
+func (s *Service) releasePromoCode(t *Transaction) {
+	switch t.state {
+	case OPEN, EXPIRED, CANCELLED:
+	default:
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !t.promoRedeemed {
+		return
+	}
+
+	t.promoRedeemed = false
+
+	if p, ok := s.promoCodes[t.promoCode]; ok {
+		p.uses--
+		p.redemptions[t.sender]--
+
+		if p.redemptions[t.sender] <= 0 {
+			delete(p.redemptions, t.sender)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPromoCodeExpiry(t *testing.T) {
+	s := NewSandboxService(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), 0)
+	codes := []*PromoCode{
+		{code: "FOREVER", discount: 50},
+		{code: "LATER", discount: 50, expiresAt: s.now().Add(time.Hour)},
+		{code: "GONE", discount: 50, expiresAt: s.now()},
+	}
+
+	for _, p := range codes {
+		if err := s.AddPromoCode(ADMIN, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for code, want := range map[string]error{"FOREVER": nil, "LATER": nil, "GONE": ErrInvalidPromoCode} {
+		payment, err := s.NewTransfer().From(&Account{id: 1}).To(&Account{id: 2}).Amount(10).WithPromoCode(code).Build()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.mu.RLock()
+		err = s.applyPromoCode(payment)
+		s.mu.RUnlock()
+
+		if !errors.Is(err, want) {
+			t.Errorf("applying %s returned %v, want %v", code, err, want)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"strconv"
+)
+
+// Accounts written to the repository in one call
+const provisioningBatchSize = 500
+
+// Describes an account to provision
+type AccountSpec struct {
+	tenant   TenantID
+	id       uint32
+	name     string
+	tags     []string
+	email    string
+	phone    string
+	merchant bool
+	// What the merchant sells, see Account.merchantCategory
+	category Category
+	locale   Locale
+	currency string
+	// Handles registered in the alias directory for the account
+	aliases []string
+}
+
+// Outcome of provisioning one spec
+type AccountResult struct {
+	spec    AccountSpec
+	account *Account
+	err     error
+}
+
+// Provisions many accounts at once, e.g. for migrations and onboarding
+// Specs are checked up front, so one bad spec doesn't stop the others, and valid accounts are saved in batches
+func (s *Service) CreateAccounts(role Role, specs []AccountSpec) ([]AccountResult, error) {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return nil, err
+	}
+
+	results := make([]AccountResult, len(specs))
+	claimed := map[tenantKey]bool{}
+	var valid []int
+
+	for i, spec := range specs {
+		results[i].spec = spec
+		results[i].err = s.checkAccountSpec(spec, claimed)
+
+		if results[i].err == nil {
+			valid = append(valid, i)
+		}
+	}
+
+	for start := 0; start < len(valid); start += provisioningBatchSize {
+		var accounts []*Account
+		var batch []int
+
+		// Aliases are registered before the save so an account is never saved without them, and taken back if the save fails
+		for _, i := range valid[start:min(start+provisioningBatchSize, len(valid))] {
+			spec := specs[i]
+			a := &Account{
+				id:               spec.id,
+				tenant:           spec.tenant,
+				name:             spec.name,
+				tags:             spec.tags,
+				email:            spec.email,
+				phone:            spec.phone,
+				merchant:         spec.merchant,
+				merchantCategory: spec.category,
+				locale:           spec.locale,
+				currency:         spec.currency,
+			}
+
+			if err := s.aliases.registerAll(a, spec.aliases); err != nil {
+				results[i].err = err
+				continue
+			}
+
+			accounts = append(accounts, a)
+			batch = append(batch, i)
+		}
+
+		if len(accounts) == 0 {
+			continue
+		}
+
+		if err := s.repository.saveAccounts(accounts); err != nil {
+			for _, i := range batch {
+				for _, alias := range specs[i].aliases {
+					s.aliases.unregister(specs[i].tenant, alias)
+				}
+				results[i].err = err
+			}
+			continue
+		}
+
+		for j, i := range batch {
+			results[i].account = accounts[j]
+		}
+	}
+
+	return results, nil
+}
+
+// Identifies an account id or alias within a tenant
+type tenantKey struct {
+	tenant TenantID
+	value  string
+}
+
+// Returns why a spec can't be provisioned
+// Ids and aliases of valid specs are claimed, so later specs of the same batch can't reuse them
+func (s *Service) checkAccountSpec(spec AccountSpec, claimed map[tenantKey]bool) error {
+	if spec.id == 0 {
+		return newError(INVALID_ARGUMENT, "Accounts need an id")
+	}
+
+	if spec.category != UNCATEGORIZED && !spec.merchant {
+		return newError(INVALID_ARGUMENT, "Only merchants have a category")
+	}
+
+	id := tenantKey{spec.tenant, "id:" + strconv.Itoa(int(spec.id))}
+
+	if claimed[id] {
+		return newError(ALREADY_EXISTS, "Account id is already taken")
+	}
+
+	if _, err := s.repository.findAccount(spec.tenant, spec.id); err == nil {
+		return newError(ALREADY_EXISTS, "Account id is already taken")
+	}
+
+	keys := []tenantKey{id}
+
+	for _, alias := range spec.aliases {
+		normalized := normalizeAlias(alias)
+
+		if normalized == "" || normalized == "+" {
+			return newError(INVALID_ARGUMENT, "Alias can't be empty")
+		}
+
+		k := tenantKey{spec.tenant, "alias:" + normalized}
+
+		if claimed[k] {
+			return ErrAliasTaken
+		}
+
+		if _, err := s.aliases.resolve(spec.tenant, normalized); err == nil {
+			return ErrAliasTaken
+		}
+
+		keys = append(keys, k)
+	}
+
+	for _, k := range keys {
+		claimed[k] = true
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Rate and burst of a token bucket
+type RateLimit struct {
+	perSecond float64
+	burst     int
+}
+
+// Limits how many payments each sender account can submit
+// Accounts without a limit of their own share the default one, each with its own bucket
+type AccountRateLimiter struct {
+	mu        sync.Mutex
+	limit     RateLimit
+	overrides map[*Account]RateLimit
+	buckets   map[*Account]*tokenBucket
+}
+
+// Creates a limiter that applies limit to every account
+func NewAccountRateLimiter(limit RateLimit) *AccountRateLimiter {
+	return &AccountRateLimiter{
+		limit:     limit,
+		overrides: map[*Account]RateLimit{},
+		buckets:   map[*Account]*tokenBucket{},
+	}
+}
+
+// Takes one request from the account's bucket
+// Returns ErrRateLimited wrapped with a retry-after when the bucket is empty
+func (l *AccountRateLimiter) take(a *Account, now time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket, ok := l.buckets[a]
+
+	if !ok {
+		limit, ok := l.overrides[a]
+
+		if !ok {
+			limit = l.limit
+		}
+
+		bucket = newTokenBucket(limit.perSecond, limit.burst, now)
+		l.buckets[a] = bucket
+	}
+
+	if wait, ok := bucket.take(now); !ok {
+		return &RetryAfterError{err: ErrRateLimited, retryAfter: wait}
+	}
+
+	return nil
+}
+
+// Gives an account a limit of its own, starting with a full bucket
+func (l *AccountRateLimiter) override(a *Account, limit RateLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.overrides[a] = limit
+	delete(l.buckets, a)
+}
+
+// Checks the sender of a transaction against its rate limit, if the service has one
+func (s *Service) checkAccountRate(t *Transaction) error {
+	s.mu.RLock()
+	limiter := s.accountLimiter
+	s.mu.RUnlock()
+
+	if limiter == nil {
+		return nil
+	}
+
+	return limiter.take(t.sender, s.now())
+}
+
+// Limits the payments each sender account can submit, nil removes the limit
+func (s *Service) SetAccountRateLimiter(role Role, limiter *AccountRateLimiter) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.accountLimiter = limiter
+
+	return nil
+}
+
+// Gives one account a rate limit of its own
+func (s *Service) SetAccountRateLimit(role Role, a *Account, limit RateLimit) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	limiter := s.accountLimiter
+	s.mu.RUnlock()
+
+	if limiter == nil {
+		return newError(MISCONFIGURED, "Service has no account rate limiter")
+	}
+
+	limiter.override(a, limit)
+
+	return nil
+}
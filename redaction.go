@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+)
+
+// All of the kinds of personal data the service redacts
+type PIIField string
+
+const (
+	// Account names and the nicknames accounts give their counterparties
+	PII_NAME  PIIField = "name"
+	PII_ALIAS PIIField = "alias"
+	// References integrators attach to payments, e.g. order numbers
+	PII_REFERENCE PIIField = "reference"
+	// Free text written by people, like memos and cancel or freeze reasons
+	PII_NOTE PIIField = "note"
+)
+
+// Interface for hiding personal data before it leaves the service in logs, events and ledger exports
+// Documents addressed to the people the data is about, and regulatory reports, are never redacted
+type Redactor interface {
+	redact(field PIIField, value string) string
+}
+
+// Replaces values with their first runes followed by a fixed mask, so their length isn't leaked either
+type MaskingRedactor struct {
+	// Fields masked, empty for every field
+	fields []PIIField
+	keep   int
+}
+
+// Creates a redactor that keeps the first keep runes of the given fields, or of every field when none are given
+func NewMaskingRedactor(keep int, fields ...PIIField) *MaskingRedactor {
+	return &MaskingRedactor{fields: fields, keep: keep}
+}
+
+func (r *MaskingRedactor) redact(field PIIField, value string) string {
+	if value == "" || (len(r.fields) > 0 && !slices.Contains(r.fields, field)) {
+		return value
+	}
+
+	runes := []rune(value)
+
+	return string(runes[:min(r.keep, len(runes))]) + "****"
+}
+
+// Replaces values with a keyed hash, so records about the same person can still be joined without revealing them
+type HashingRedactor struct {
+	key []byte
+	// Fields hashed, empty for every field
+	fields []PIIField
+}
+
+// Creates a redactor that hashes the given fields, or every field when none are given, with key
+func NewHashingRedactor(key []byte, fields ...PIIField) *HashingRedactor {
+	return &HashingRedactor{key: key, fields: fields}
+}
+
+func (r *HashingRedactor) redact(field PIIField, value string) string {
+	if value == "" || (len(r.fields) > 0 && !slices.Contains(r.fields, field)) {
+		return value
+	}
+
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write([]byte(field))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+
+	return string(field) + "-" + hex.EncodeToString(mac.Sum(nil)[:6])
+}
+
+// Redacts a value with r, nil keeps it as is
+func redact(r Redactor, field PIIField, value string) string {
+	if r == nil {
+		return value
+	}
+
+	return r.redact(field, value)
+}
+
+// Returns the redactor of the service, nil when nothing is redacted
+func (s *Service) redactor() Redactor {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.redaction
+}
+
+// Redacts a value as the service's policy says, for embedding applications to log their own records the same way
+func (s *Service) Redact(field PIIField, value string) string {
+	return redact(s.redactor(), field, value)
+}
+
+// Changes how personal data is redacted, nil turns redaction off
+func (s *Service) SetRedactor(role Role, r Redactor) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.redaction = r
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"log"
+	"slices"
+	"time"
+)
+
+// Returns when an unpaid transaction lapses, zero when it never does
+// Crypto payments lapse when their deposit address does
+func (t *Transaction) deadline() time.Time {
+	if !t.expiresAt.IsZero() {
+		return t.expiresAt
+	}
+
+	return t.depositExpiresAt
+}
+
+// Checks if a transaction is still waiting to be paid
+func (t *Transaction) unpaid() bool {
+	switch t.state {
+	case OPEN, PENDING_CONFIRMATION, PENDING_APPROVAL, AWAITING_CHAIN:
+		return true
+	default:
+		return false
+	}
+}
+
+// Sets how long before their deadline payers are reminded of unpaid transactions, e.g. 24h and 1h
+func (s *Service) SetExpiryReminders(role Role, before ...time.Duration) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expiryReminders = slices.Clone(before)
+
+	return nil
+}
+
+// Reminds payers of unpaid transactions coming up to their deadline, and expires the ones past it
+// Each reminder is sent once per transaction, a run that missed several sends only the latest one
+func (s *Service) SendExpiryReminders(ctx context.Context, role Role) error {
+	if err := authorize(role, CANCEL); err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	reminders := slices.Clone(s.expiryReminders)
+	now := s.now()
+	s.mu.RUnlock()
+
+	tenants, err := s.repository.tenants()
+
+	if err != nil {
+		return err
+	}
+
+	for _, tenant := range tenants {
+		transactions, err := s.repository.listTransactions(tenant)
+
+		if err != nil {
+			return err
+		}
+
+		for _, t := range transactions {
+			deadline := t.deadline()
+
+			if !t.unpaid() || deadline.IsZero() {
+				continue
+			}
+
+			if !now.Before(deadline) {
+				if err := s.Expire(ctx, role, t); err != nil {
+					log.Println(err)
+				}
+				continue
+			}
+
+			s.remind(ctx, t, reminders, deadline.Sub(now))
+		}
+	}
+
+	return nil
+}
+
+// Sends the closest reminder a transaction is due and hasn't had, left is the time until its deadline
+func (s *Service) remind(ctx context.Context, t *Transaction, reminders []time.Duration, left time.Duration) {
+	var due time.Duration
+
+	for _, before := range reminders {
+		if left <= before && (due == 0 || before < due) {
+			due = before
+		}
+	}
+
+	s.mu.Lock()
+	sent := due == 0 || slices.ContainsFunc(t.remindersSent, func(before time.Duration) bool { return before <= due })
+	if !sent {
+		t.remindersSent = append(t.remindersSent, due)
+	}
+	s.mu.Unlock()
+
+	if sent {
+		return
+	}
+
+	s.save(t)
+	s.publish(Event{kind: EXPIRY_REMINDER, transaction: t, detail: due.String()})
+	s.notify(ctx, PAYMENT_EXPIRING, t, t.deadline().UTC().Format("2006-01-02 15:04 MST"))
+}
+
+// Sends due reminders and expires lapsed transactions every tick until ctx is done
+func (s *Service) ScheduleExpiryReminders(ctx context.Context, role Role, tick time.Duration) error {
+	if err := authorize(role, CANCEL); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.SendExpiryReminders(ctx, role); err != nil {
+					log.Println(err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// Balances of an account as rebuilt by a replay
+type ReplayedAccount struct {
+	account    *Account
+	balance    int64
+	creditUsed int64
+}
+
+// Models the ledger of a tenant rebuilt up to a point of its history
+type Replay struct {
+	tenant TenantID
+	// Closed transactions replayed, in the order they closed
+	replayed []*Transaction
+	// Closed transactions after the point, whose effects were taken out of the current balances
+	undone   []*Transaction
+	accounts map[*Account]*ReplayedAccount
+	// Balances when the replay was made, which the replayed ones are diffed against
+	current map[*Account]ReplayedAccount
+	house   *Account
+}
+
+// How an account's balances differ between a replay and now
+type ReplayDiff struct {
+	account    *Account
+	then       ReplayedAccount
+	now        ReplayedAccount
+	undoneByID []uint32
+}
+
+// Returns what a closed transaction did to the balances and credit of each account it touched
+// Payment methods handled outside the package are assumed to move the amount like a debit
+func replayEffects(t *Transaction, house *Account) map[*Account]ReplayedAccount {
+	amount := int64(t.amount)
+	effects := map[*Account]ReplayedAccount{}
+	add := func(a *Account, balance int64, credit int64) {
+		if a == nil {
+			return
+		}
+		e := effects[a]
+		e.account = a
+		e.balance += balance
+		e.creditUsed += credit
+		effects[a] = e
+	}
+
+	switch {
+	case t.paymentMethod == CRYPTO || t.gatewayPaymentID != "":
+		// The funds came in from the chain or the card gateway
+		add(t.recipient, amount, 0)
+	case t.metadata["credit_waived_from"] != "":
+		// No balance moved, the sender owes less on credit
+		add(t.sender, 0, -amount)
+	case t.paymentMethod == CREDIT:
+		add(house, -amount, 0)
+		add(t.recipient, amount, 0)
+		add(t.sender, 0, amount+t.fee)
+	case t.paymentMethod == CASH:
+		add(t.sender, -(amount + t.fee), 0)
+		add(house, t.fee, 0)
+		add(t.recipient, amount, 0)
+	default:
+		add(t.sender, -amount, 0)
+		add(t.recipient, amount, 0)
+	}
+
+	return effects
+}
+
+// Rebuilds a tenant's balances as they were at a moment, by taking out of the current balances every transaction closed after it
+func (s *Service) ReplayAt(role Role, tenant TenantID, at time.Time) (*Replay, error) {
+	if err := authorize(role, READ); err != nil {
+		return nil, err
+	}
+
+	return s.replay(tenant, func(_ int, t *Transaction) bool { return !t.closedAt.After(at) })
+}
+
+// Rebuilds a tenant's balances as they were right after its sequence-th closed transaction, counting from one
+func (s *Service) ReplayThrough(role Role, tenant TenantID, sequence int) (*Replay, error) {
+	if err := authorize(role, READ); err != nil {
+		return nil, err
+	}
+
+	return s.replay(tenant, func(i int, _ *Transaction) bool { return i < sequence })
+}
+
+// Rebuilds a tenant's balances with only the closed transactions keep accepts, given their position in closing order
+// Only closed transactions are undone, changes made outside of them such as statement payments stay in
+func (s *Service) replay(tenant TenantID, keep func(i int, t *Transaction) bool) (*Replay, error) {
+	transactions, err := s.repository.listTransactions(tenant)
+
+	if err != nil {
+		return nil, err
+	}
+
+	accounts, err := s.repository.listAccounts(tenant)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var closed []*Transaction
+
+	for _, t := range transactions {
+		if t.state == CLOSED {
+			closed = append(closed, t)
+		}
+	}
+
+	sort.Slice(closed, func(i, j int) bool {
+		if closed[i].closedAt.Equal(closed[j].closedAt) {
+			return closed[i].id < closed[j].id
+		}
+		return closed[i].closedAt.Before(closed[j].closedAt)
+	})
+
+	r := &Replay{tenant: tenant, accounts: map[*Account]*ReplayedAccount{}, current: map[*Account]ReplayedAccount{}}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	r.house = s.feeAccounts[tenant]
+	snapshot := func(a *Account) *ReplayedAccount {
+		if _, ok := r.current[a]; !ok {
+			r.current[a] = ReplayedAccount{account: a, balance: int64(a.balance), creditUsed: int64(a.creditUsed)}
+			replayed := r.current[a]
+			r.accounts[a] = &replayed
+		}
+		return r.accounts[a]
+	}
+
+	for _, a := range accounts {
+		snapshot(a)
+	}
+
+	for i, t := range closed {
+		if keep(i, t) {
+			r.replayed = append(r.replayed, t)
+			continue
+		}
+
+		r.undone = append(r.undone, t)
+
+		for a, e := range replayEffects(t, r.house) {
+			replayed := snapshot(a)
+			replayed.balance -= e.balance
+			replayed.creditUsed -= e.creditUsed
+		}
+	}
+
+	return r, nil
+}
+
+// Returns the accounts whose balances changed since the replayed point, with the transactions that changed them
+func (r *Replay) diff() []ReplayDiff {
+	var diffs []ReplayDiff
+
+	for a, then := range r.accounts {
+		now := r.current[a]
+
+		if then.balance == now.balance && then.creditUsed == now.creditUsed {
+			continue
+		}
+
+		d := ReplayDiff{account: a, then: *then, now: now}
+
+		for _, t := range r.undone {
+			if _, touched := replayEffects(t, r.house)[a]; touched {
+				d.undoneByID = append(d.undoneByID, t.id)
+			}
+		}
+
+		diffs = append(diffs, d)
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].account.id < diffs[j].account.id
+	})
+
+	return diffs
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Identifies a record of a tenant
+type recordKey struct {
+	tenant TenantID
+	id     uint32
+}
+
+// Sends writes to a primary repository and balance and history reads to a replica
+// Records written within the stickiness window are read from the primary, so a just-paid transaction is seen as paid
+type ReplicatedRepository struct {
+	primary Repository
+	replica Repository
+	// Zero turns read-your-writes off
+	stickiness time.Duration
+	now        func() time.Time
+
+	mu           sync.Mutex
+	accounts     map[recordKey]time.Time
+	transactions map[recordKey]time.Time
+	// Writes in the order they were made, so the ones the replica caught up with are forgotten from the front
+	writes []recentWrite
+}
+
+// One write remembered by a replicated repository
+type recentWrite struct {
+	written map[recordKey]time.Time
+	key     recordKey
+	at      time.Time
+}
+
+// Creates a repository that reads from replica, except for records written to primary in the last stickiness
+func NewReplicatedRepository(primary Repository, replica Repository, stickiness time.Duration) *ReplicatedRepository {
+	return &ReplicatedRepository{
+		primary:      primary,
+		replica:      replica,
+		stickiness:   stickiness,
+		now:          time.Now,
+		accounts:     map[recordKey]time.Time{},
+		transactions: map[recordKey]time.Time{},
+	}
+}
+
+// Remembers a write so reads of the record go to the primary for a while
+func (r *ReplicatedRepository) wrote(written map[recordKey]time.Time, key recordKey) {
+	if r.stickiness == 0 {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	written[key] = now
+	r.writes = append(r.writes, recentWrite{written: written, key: key, at: now})
+
+	// Forget writes the replica has had time to catch up with, unless the record was written again since
+	for len(r.writes) > 0 && now.Sub(r.writes[0].at) > r.stickiness {
+		w := r.writes[0]
+		if w.written[w.key].Equal(w.at) {
+			delete(w.written, w.key)
+		}
+		r.writes = r.writes[1:]
+	}
+}
+
+// Returns the repository a record should be read from
+func (r *ReplicatedRepository) readFrom(written map[recordKey]time.Time, key recordKey) Repository {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if at, ok := written[key]; ok && r.now().Sub(at) <= r.stickiness {
+		return r.primary
+	}
+
+	return r.replica
+}
+
+func (r *ReplicatedRepository) saveAccount(a *Account) error {
+	if err := r.primary.saveAccount(a); err != nil {
+		return err
+	}
+
+	r.wrote(r.accounts, recordKey{a.tenant, a.id})
+
+	return nil
+}
+
+// Always read from the primary, replicas may not have seen a new tenant yet
+func (r *ReplicatedRepository) tenants() ([]TenantID, error) {
+	return r.primary.tenants()
+}
+
+func (r *ReplicatedRepository) saveAccounts(accounts []*Account) error {
+	if err := r.primary.saveAccounts(accounts); err != nil {
+		return err
+	}
+
+	for _, a := range accounts {
+		r.wrote(r.accounts, recordKey{a.tenant, a.id})
+	}
+
+	return nil
+}
+
+func (r *ReplicatedRepository) findAccount(tenant TenantID, id uint32) (*Account, error) {
+	return r.readFrom(r.accounts, recordKey{tenant, id}).findAccount(tenant, id)
+}
+
+func (r *ReplicatedRepository) listAccounts(tenant TenantID) ([]*Account, error) {
+	return r.replica.listAccounts(tenant)
+}
+
+func (r *ReplicatedRepository) findAccounts(tenant TenantID, q AccountQuery) ([]*Account, error) {
+	return r.replica.findAccounts(tenant, q)
+}
+
+func (r *ReplicatedRepository) saveTransaction(t *Transaction) error {
+	if err := r.primary.saveTransaction(t); err != nil {
+		return err
+	}
+
+	r.wrote(r.transactions, recordKey{t.tenant, t.id})
+
+	return nil
+}
+
+func (r *ReplicatedRepository) findTransaction(tenant TenantID, id uint32) (*Transaction, error) {
+	return r.readFrom(r.transactions, recordKey{tenant, id}).findTransaction(tenant, id)
+}
+
+func (r *ReplicatedRepository) listTransactions(tenant TenantID) ([]*Transaction, error) {
+	return r.replica.listTransactions(tenant)
+}
+
+func (r *ReplicatedRepository) deleteTransaction(tenant TenantID, id uint32) error {
+	if err := r.primary.deleteTransaction(tenant, id); err != nil {
+		return err
+	}
+
+	r.wrote(r.transactions, recordKey{tenant, id})
+
+	return nil
+}
+
+// Changes where accounts and transactions are stored
+// Must be called before the service takes traffic, lookups don't hold the service lock
+func (s *Service) SetRepository(role Role, r Repository) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.repository = r
+
+	return nil
+}
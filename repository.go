@@ -0,0 +1,300 @@
+package main
+
+import (
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Returned when an account or transaction doesn't exist in a tenant
+var ErrNotFound = newError(NOT_FOUND, "Not found")
+
+// Identifies one of the independent banks or apps served by a deployment
+type TenantID string
+
+// Interface for persisting accounts and transactions
+// Every lookup is scoped to a single tenant
+type Repository interface {
+	saveAccount(a *Account) error
+	// Saves many accounts in one write, for bulk provisioning
+	saveAccounts(accounts []*Account) error
+	findAccount(tenant TenantID, id uint32) (*Account, error)
+	listAccounts(tenant TenantID) ([]*Account, error)
+	findAccounts(tenant TenantID, q AccountQuery) ([]*Account, error)
+	saveTransaction(t *Transaction) error
+	findTransaction(tenant TenantID, id uint32) (*Transaction, error)
+	listTransactions(tenant TenantID) ([]*Transaction, error)
+	deleteTransaction(tenant TenantID, id uint32) error
+	// Returns every tenant with accounts or transactions, ordered by id
+	tenants() ([]TenantID, error)
+}
+
+// Criteria used to search accounts by name and tags
+type AccountQuery struct {
+	// Case-insensitive text to look for
+	text string
+	// Only match names and tags that start with the text
+	prefix bool
+	// Accounts skipped before the page starts, negative offsets start at the first account
+	offset int
+	// Most accounts returned, zero means no limit
+	limit int
+}
+
+// Checks if the account name or one of its tags matches the query
+func (q AccountQuery) matches(a *Account) bool {
+	text := strings.ToLower(q.text)
+	match := func(s string) bool {
+		s = strings.ToLower(s)
+		if q.prefix {
+			return strings.HasPrefix(s, text)
+		}
+		return strings.Contains(s, text)
+	}
+
+	if match(a.name) {
+		return true
+	}
+
+	for _, tag := range a.tags {
+		if match(tag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the page of accounts selected by offset and limit
+func (q AccountQuery) page(accounts []*Account) []*Account {
+	offset := max(q.offset, 0)
+
+	if offset >= len(accounts) {
+		return nil
+	}
+
+	accounts = accounts[offset:]
+
+	if q.limit > 0 && q.limit < len(accounts) {
+		accounts = accounts[:q.limit]
+	}
+
+	return accounts
+}
+
+// Number of shards used by NewMemoryRepository
+const defaultShards = 64
+
+// Part of the in-memory repository, guarded by its own lock
+type memoryShard struct {
+	mu           sync.RWMutex
+	accounts     map[TenantID]map[uint32]*Account
+	transactions map[TenantID]map[uint32]*Transaction
+}
+
+// Keeps accounts and transactions in memory, partitioned by tenant
+// Records are spread across shards with a lock each, so unrelated writes don't wait on each other
+type MemoryRepository struct {
+	shards []*memoryShard
+}
+
+// Creates an empty in-memory repository
+func NewMemoryRepository() *MemoryRepository {
+	return NewShardedMemoryRepository(defaultShards)
+}
+
+// Creates an empty in-memory repository with n shards
+func NewShardedMemoryRepository(n int) *MemoryRepository {
+	r := &MemoryRepository{shards: make([]*memoryShard, max(n, 1))}
+
+	for i := range r.shards {
+		r.shards[i] = &memoryShard{
+			accounts:     map[TenantID]map[uint32]*Account{},
+			transactions: map[TenantID]map[uint32]*Transaction{},
+		}
+	}
+
+	return r
+}
+
+// Returns the shard a record of a tenant lives in
+func (r *MemoryRepository) shard(tenant TenantID, id uint32) *memoryShard {
+	h := fnv.New32a()
+	h.Write([]byte(tenant))
+	h.Write([]byte{byte(id), byte(id >> 8), byte(id >> 16), byte(id >> 24)})
+
+	return r.shards[h.Sum32()%uint32(len(r.shards))]
+}
+
+func (r *MemoryRepository) saveAccount(a *Account) error {
+	sh := r.shard(a.tenant, a.id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if sh.accounts[a.tenant] == nil {
+		sh.accounts[a.tenant] = map[uint32]*Account{}
+	}
+
+	sh.accounts[a.tenant][a.id] = a
+
+	return nil
+}
+
+func (r *MemoryRepository) tenants() ([]TenantID, error) {
+	seen := map[TenantID]bool{}
+
+	for _, sh := range r.shards {
+		sh.mu.RLock()
+		for tenant := range sh.accounts {
+			seen[tenant] = true
+		}
+		for tenant := range sh.transactions {
+			seen[tenant] = true
+		}
+		sh.mu.RUnlock()
+	}
+
+	tenants := make([]TenantID, 0, len(seen))
+
+	for tenant := range seen {
+		tenants = append(tenants, tenant)
+	}
+
+	sort.Slice(tenants, func(i, j int) bool {
+		return tenants[i] < tenants[j]
+	})
+
+	return tenants, nil
+}
+
+// Takes the lock of each shard once for all of its accounts
+func (r *MemoryRepository) saveAccounts(accounts []*Account) error {
+	byShard := map[*memoryShard][]*Account{}
+
+	for _, a := range accounts {
+		sh := r.shard(a.tenant, a.id)
+		byShard[sh] = append(byShard[sh], a)
+	}
+
+	for sh, accounts := range byShard {
+		sh.mu.Lock()
+		for _, a := range accounts {
+			if sh.accounts[a.tenant] == nil {
+				sh.accounts[a.tenant] = map[uint32]*Account{}
+			}
+			sh.accounts[a.tenant][a.id] = a
+		}
+		sh.mu.Unlock()
+	}
+
+	return nil
+}
+
+func (r *MemoryRepository) findAccount(tenant TenantID, id uint32) (*Account, error) {
+	sh := r.shard(tenant, id)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	a, ok := sh.accounts[tenant][id]
+
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return a, nil
+}
+
+// Calls fn with the accounts of a tenant, one shard at a time
+// Only one shard is locked at once, so the result isn't a snapshot of every shard at the same moment
+func (r *MemoryRepository) eachAccount(tenant TenantID, fn func(a *Account)) {
+	for _, sh := range r.shards {
+		sh.mu.RLock()
+		for _, a := range sh.accounts[tenant] {
+			fn(a)
+		}
+		sh.mu.RUnlock()
+	}
+}
+
+func (r *MemoryRepository) listAccounts(tenant TenantID) ([]*Account, error) {
+	var accounts []*Account
+
+	r.eachAccount(tenant, func(a *Account) {
+		accounts = append(accounts, a)
+	})
+
+	return accounts, nil
+}
+
+func (r *MemoryRepository) findAccounts(tenant TenantID, q AccountQuery) ([]*Account, error) {
+	var found []*Account
+
+	r.eachAccount(tenant, func(a *Account) {
+		if q.matches(a) {
+			found = append(found, a)
+		}
+	})
+
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].id < found[j].id
+	})
+
+	return q.page(found), nil
+}
+
+func (r *MemoryRepository) saveTransaction(t *Transaction) error {
+	sh := r.shard(t.tenant, t.id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if sh.transactions[t.tenant] == nil {
+		sh.transactions[t.tenant] = map[uint32]*Transaction{}
+	}
+
+	sh.transactions[t.tenant][t.id] = t
+
+	return nil
+}
+
+func (r *MemoryRepository) findTransaction(tenant TenantID, id uint32) (*Transaction, error) {
+	sh := r.shard(tenant, id)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	t, ok := sh.transactions[tenant][id]
+
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return t, nil
+}
+
+func (r *MemoryRepository) listTransactions(tenant TenantID) ([]*Transaction, error) {
+	var transactions []*Transaction
+
+	for _, sh := range r.shards {
+		sh.mu.RLock()
+		for _, t := range sh.transactions[tenant] {
+			transactions = append(transactions, t)
+		}
+		sh.mu.RUnlock()
+	}
+
+	return transactions, nil
+}
+
+func (r *MemoryRepository) deleteTransaction(tenant TenantID, id uint32) error {
+	sh := r.shard(tenant, id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if _, ok := sh.transactions[tenant][id]; !ok {
+		return ErrNotFound
+	}
+
+	delete(sh.transactions[tenant], id)
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+)
+
+// Models a cashback rule, e.g. 1% back on credit payments over 100
+type RewardRule struct {
+	paymentMethod PaymentMethod
+	// Payments below this amount earn nothing
+	minAmount uint32
+	// Share of the amount paid back, in hundredths of a percent
+	basisPoints uint32
+}
+
+// Pays rewards to senders out of a pool account
+type RewardsEngine struct {
+	mu    sync.Mutex
+	pool  *Account
+	rules []RewardRule
+	// Rewards paid to each account so far
+	accrued map[*Account]uint32
+}
+
+// Creates an engine that pays rewards out of pool
+func NewRewardsEngine(pool *Account, rules []RewardRule) *RewardsEngine {
+	return &RewardsEngine{pool: pool, rules: rules, accrued: map[*Account]uint32{}}
+}
+
+// Returns the reward a payment earns, adding up every rule it matches
+func (e *RewardsEngine) rewardFor(t *Transaction, rounding RoundingPolicy) uint32 {
+	var reward uint32
+
+	for _, r := range e.rules {
+		if r.paymentMethod == t.paymentMethod && t.amount >= r.minAmount {
+			reward += rounding.share(t.amount, r.basisPoints)
+		}
+	}
+
+	return reward
+}
+
+// Pays the reward a transaction earned as a separate transaction from the pool
+// Failures are logged, the rewarded payment already went through
+func (s *Service) postReward(ctx context.Context, e *RewardsEngine, t *Transaction) {
+	// Reward payouts don't earn rewards themselves
+	if t.sender == e.pool || t.sender.tenant != e.pool.tenant {
+		return
+	}
+
+	amount := e.rewardFor(t, s.defaultRounding())
+
+	if amount == 0 {
+		return
+	}
+
+	metadata := map[string]string{"reward_for": strconv.FormatUint(uint64(t.id), 10)}
+
+	if _, err := s.postTransfer(ctx, e.pool, t.sender, amount, metadata); err != nil {
+		log.Println(err)
+		return
+	}
+
+	e.mu.Lock()
+	e.accrued[t.sender] += amount
+	e.mu.Unlock()
+}
+
+// Returns the rewards an account earned so far
+func (s *Service) Rewards(role Role, a *Account) (uint32, error) {
+	if err := authorize(role, READ); err != nil {
+		return 0, err
+	}
+
+	s.mu.RLock()
+	e := s.rewards
+	s.mu.RUnlock()
+
+	if e == nil {
+		return 0, nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.accrued[a], nil
+}
+
+// Changes how rewards are earned
+// A nil engine turns rewards off
+func (s *Service) SetRewardsEngine(role Role, e *RewardsEngine) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rewards = e
+
+	return nil
+}
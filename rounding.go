@@ -0,0 +1,79 @@
+package main
+
+// All of the possible ways of rounding fractions of the smallest currency unit
+type RoundingPolicy string
+
+const (
+	// Rounds halves away from zero, the default when no policy is set
+	HALF_UP RoundingPolicy = "half_up"
+	// Rounds halves to the nearest even unit, also known as banker's rounding
+	HALF_EVEN RoundingPolicy = "half_even"
+	// Drops any fraction
+	FLOOR RoundingPolicy = "floor"
+)
+
+// Returns a share of an amount given in hundredths of a percent, rounded with the policy
+func (p RoundingPolicy) share(amount uint32, basisPoints uint32) uint32 {
+	n := uint64(amount) * uint64(basisPoints)
+	q, r := n/10000, n%10000
+
+	switch p {
+	case FLOOR:
+	case HALF_EVEN:
+		if r > 5000 || (r == 5000 && q%2 == 1) {
+			q++
+		}
+	default:
+		if r >= 5000 {
+			q++
+		}
+	}
+
+	return uint32(q)
+}
+
+// Returns the policy used for a payment method, falling back to the service policy
+// Must be called with the lock held for reading
+func (s *Service) roundingFor(method PaymentMethod) RoundingPolicy {
+	if p, ok := s.methodRounding[method]; ok {
+		return p
+	}
+
+	return s.rounding
+}
+
+// Returns the policy used for interest and postings the service makes itself
+func (s *Service) defaultRounding() RoundingPolicy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.rounding
+}
+
+// Changes how fees and interest are rounded
+func (s *Service) SetRoundingPolicy(role Role, p RoundingPolicy) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rounding = p
+
+	return nil
+}
+
+// Changes how the fees of one payment method are rounded
+func (s *Service) SetMethodRoundingPolicy(role Role, method PaymentMethod, p RoundingPolicy) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.methodRounding[method] = p
+
+	return nil
+}
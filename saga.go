@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"maps"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// All of the possible states of a saga
+type SagaState string
+
+const (
+	SAGA_RUNNING     SagaState = "running"
+	SAGA_COMPLETED   SagaState = "completed"
+	SAGA_COMPENSATED SagaState = "compensated"
+	// Compensation itself failed, the saga needs to be repaired by hand
+	SAGA_FAILED SagaState = "failed"
+)
+
+// Models one step of a saga and the step that undoes it
+type SagaStep struct {
+	name       string
+	action     func(ctx context.Context) error
+	compensate func(ctx context.Context) error
+}
+
+// One movement of a multi-leg transfer, e.g. a conversion, the transfer itself or a fee posting
+type TransferLeg struct {
+	from   *Account
+	to     *Account
+	amount uint32
+}
+
+// Leg as persisted with the saga, accounts are kept by id
+type sagaLeg struct {
+	from   uint32
+	to     uint32
+	amount uint32
+}
+
+// Persisted state of a saga, enough to rebuild its steps after a crash
+type Saga struct {
+	id     uint32
+	tenant TenantID
+	legs   []sagaLeg
+	// Added to the metadata of every posting of the saga, e.g. the exchange it makes
+	metadata map[string]string
+	state    SagaState
+	// How many steps ran and weren't compensated
+	completed int
+	err       string
+	updatedAt time.Time
+}
+
+// Interface for persisting sagas
+type SagaStore interface {
+	saveSaga(sg Saga) error
+	listSagas(state SagaState) ([]Saga, error)
+}
+
+// Keeps sagas in memory
+type MemorySagaStore struct {
+	mu    sync.RWMutex
+	sagas map[uint32]Saga
+}
+
+// Creates an empty in-memory saga store
+func NewMemorySagaStore() *MemorySagaStore {
+	return &MemorySagaStore{sagas: map[uint32]Saga{}}
+}
+
+func (st *MemorySagaStore) saveSaga(sg Saga) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	sg.legs = append([]sagaLeg(nil), sg.legs...)
+	st.sagas[sg.id] = sg
+
+	return nil
+}
+
+func (st *MemorySagaStore) listSagas(state SagaState) ([]Saga, error) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	var sagas []Saga
+
+	for _, sg := range st.sagas {
+		if sg.state == state {
+			sagas = append(sagas, sg)
+		}
+	}
+
+	return sagas, nil
+}
+
+// Stores the current state of a saga
+// Failures are logged, recovery reads progress back from the posted transactions
+func (s *Service) saveSaga(sg *Saga) {
+	sg.updatedAt = s.now()
+
+	s.mu.RLock()
+	store := s.sagas
+	s.mu.RUnlock()
+
+	if err := store.saveSaga(*sg); err != nil {
+		log.Println(err)
+	}
+}
+
+// Runs the steps of a saga from the first one not completed yet
+// When a step fails, the completed ones are compensated in reverse order
+func (s *Service) runSaga(ctx context.Context, sg *Saga, steps []SagaStep) error {
+	for sg.completed < len(steps) {
+		if err := steps[sg.completed].action(ctx); err != nil {
+			sg.err = err.Error()
+			// Compensation must run to the end even if the caller gave up
+			return s.compensateSaga(context.WithoutCancel(ctx), sg, steps, err)
+		}
+
+		sg.completed++
+		s.saveSaga(sg)
+	}
+
+	sg.state = SAGA_COMPLETED
+	s.saveSaga(sg)
+
+	return nil
+}
+
+// Undoes the completed steps of a saga, newest first, and returns the error that caused it
+func (s *Service) compensateSaga(ctx context.Context, sg *Saga, steps []SagaStep, cause error) error {
+	for sg.completed > 0 {
+		step := steps[sg.completed-1]
+
+		if err := step.compensate(ctx); err != nil {
+			sg.state = SAGA_FAILED
+			sg.err = "compensating " + step.name + ": " + err.Error()
+			s.saveSaga(sg)
+			return errors.Join(cause, err)
+		}
+
+		sg.completed--
+		s.saveSaga(sg)
+	}
+
+	sg.state = SAGA_COMPENSATED
+	s.saveSaga(sg)
+
+	return cause
+}
+
+// Builds the steps of a transfer saga, each leg posts a transfer and compensates by posting it back
+// Postings carry the saga and leg in their metadata so recovery can tell which ones happened
+// Returns the steps and the transfers they post, filled in as the legs run
+func (s *Service) transferSteps(sg *Saga) ([]SagaStep, []*Transaction, error) {
+	steps := make([]SagaStep, 0, len(sg.legs))
+	posted := make([]*Transaction, len(sg.legs))
+	id := strconv.FormatUint(uint64(sg.id), 10)
+	metadata := func(key string, n string) map[string]string {
+		m := maps.Clone(sg.metadata)
+		if m == nil {
+			m = map[string]string{}
+		}
+		m["saga"], m[key] = id, n
+		return m
+	}
+
+	for i, leg := range sg.legs {
+		from, err := s.repository.findAccount(sg.tenant, leg.from)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		to, err := s.repository.findAccount(sg.tenant, leg.to)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		n, amount := strconv.Itoa(i), leg.amount
+
+		steps = append(steps, SagaStep{
+			name: "leg " + n,
+			action: func(ctx context.Context) error {
+				t, err := s.postTransfer(ctx, from, to, amount, metadata("saga_leg", n))
+				posted[i] = t
+				return err
+			},
+			compensate: func(ctx context.Context) error {
+				_, err := s.postTransfer(ctx, to, from, amount, metadata("saga_compensates", n))
+				return err
+			},
+		})
+	}
+
+	return steps, posted, nil
+}
+
+// Moves funds through several legs that either all happen or are all undone
+// Accounts must be saved in the repository so the saga can be recovered after a crash
+func (s *Service) TransferSaga(ctx context.Context, role Role, legs []TransferLeg) (*Saga, error) {
+	if err := authorize(role, PAY); err != nil {
+		return nil, err
+	}
+
+	sg, _, err := s.startSaga(ctx, legs, nil)
+
+	return sg, err
+}
+
+// Saves and runs a transfer saga whose postings carry metadata
+// Returns the saga and the transfers its legs posted, which are undone again when it fails
+func (s *Service) startSaga(ctx context.Context, legs []TransferLeg, metadata map[string]string) (*Saga, []*Transaction, error) {
+	if len(legs) == 0 {
+		return nil, nil, newError(INVALID_ARGUMENT, "Sagas need at least one leg")
+	}
+
+	tenant := legs[0].from.tenant
+	persisted := make([]sagaLeg, 0, len(legs))
+
+	for _, leg := range legs {
+		if leg.from.tenant != tenant || leg.to.tenant != tenant {
+			return nil, nil, ErrCrossTenant
+		}
+
+		persisted = append(persisted, sagaLeg{from: leg.from.id, to: leg.to.id, amount: leg.amount})
+	}
+
+	id, err := s.newSagaID()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sg := &Saga{id: id, tenant: tenant, legs: persisted, metadata: metadata, state: SAGA_RUNNING}
+	steps, posted, err := s.transferSteps(sg)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.saveSaga(sg)
+
+	return sg, posted, s.runSaga(ctx, sg, steps)
+}
+
+// Returns the id of a new saga
+// The first id follows the largest one in the store, so sagas saved before a restart are never overwritten
+func (s *Service) newSagaID() (uint32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.sagaIDSeeded {
+		for _, state := range []SagaState{SAGA_RUNNING, SAGA_COMPLETED, SAGA_COMPENSATED, SAGA_FAILED} {
+			sagas, err := s.sagas.listSagas(state)
+
+			if err != nil {
+				return 0, err
+			}
+
+			for _, sg := range sagas {
+				s.lastSagaID = max(s.lastSagaID, sg.id)
+			}
+		}
+
+		s.sagaIDSeeded = true
+	}
+
+	s.lastSagaID++
+
+	return s.lastSagaID, nil
+}
+
+// Compensates the transfer sagas a crash left running
+// Progress is read back from the postings, a crash can happen between posting a leg and saving the saga
+func (s *Service) RecoverSagas(ctx context.Context, role Role) ([]*Saga, error) {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	store := s.sagas
+	s.mu.RUnlock()
+
+	running, err := store.listSagas(SAGA_RUNNING)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var recovered []*Saga
+	var errs []error
+
+	for i := range running {
+		sg := &running[i]
+
+		completed, err := s.postedLegs(sg)
+
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		steps, _, err := s.transferSteps(sg)
+
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		sg.completed = completed
+
+		if err := s.compensateSaga(ctx, sg, steps, nil); err != nil {
+			errs = append(errs, err)
+		}
+
+		recovered = append(recovered, sg)
+	}
+
+	return recovered, errors.Join(errs...)
+}
+
+// Returns how many legs of a saga were posted and not compensated
+func (s *Service) postedLegs(sg *Saga) (int, error) {
+	transactions, err := s.repository.listTransactions(sg.tenant)
+
+	if err != nil {
+		return 0, err
+	}
+
+	id := strconv.FormatUint(uint64(sg.id), 10)
+	posted := 0
+
+	for _, t := range transactions {
+		if t.metadata["saga"] != id {
+			continue
+		}
+
+		if _, ok := t.metadata["saga_leg"]; ok {
+			posted++
+		}
+
+		if _, ok := t.metadata["saga_compensates"]; ok {
+			posted--
+		}
+	}
+
+	return posted, nil
+}
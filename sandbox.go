@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Card payments of a sandbox, made through its fake gateway
+const SANDBOX_CARD PaymentMethod = "G"
+
+// Amounts that make sandbox payments fail the same way every time
+var sandboxAmounts = map[uint32]error{
+	402: ErrInsufficientFunds,
+	504: ErrPaymentTimeout,
+	666: newError(PAYMENT_REFUSED, "Payment declined by the sandbox"),
+}
+
+// Models the fake world of a sandbox service
+// The clock only moves when told to, so expiries, windows and reports come out the same on every run
+type Sandbox struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// Returns the sandbox time
+func (sb *Sandbox) clock() time.Time {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	return sb.now
+}
+
+// Creates a service for integrators to develop against, with no real money or providers behind it
+// The clock is frozen at start, API key secrets come from seed and payments of the sandbox amounts always fail
+func NewSandboxService(start time.Time, seed uint64) *Service {
+	sb := &Sandbox{now: start}
+
+	random := &lockedReader{r: rand.NewChaCha8(sandboxSeed(seed))}
+	vault := NewMemoryTokenVault(24 * time.Hour)
+	vault.now = sb.clock
+	vault.random = random
+
+	s := NewService(vault)
+	s.sandbox = sb
+	s.now = sb.clock
+	s.apiKeys.now = sb.clock
+	s.apiKeys.random = random
+	s.crypto = &CryptoPolicy{watcher: &SandboxChainWatcher{}, required: 1, expiry: time.Hour}
+	s.RegisterGateway(ADMIN, SANDBOX_CARD, &SandboxGateway{})
+
+	return s
+}
+
+// Spreads a seed over the 32 bytes ChaCha8 needs
+func sandboxSeed(seed uint64) [32]byte {
+	var b [32]byte
+
+	for i := range 4 {
+		for j := range 8 {
+			b[i*8+j] = byte(seed >> (8 * j))
+		}
+	}
+
+	return b
+}
+
+// Serializes reads of a source that isn't safe for concurrent use
+type lockedReader struct {
+	mu sync.Mutex
+	r  io.Reader
+}
+
+func (l *lockedReader) Read(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.r.Read(p)
+}
+
+// Moves the clock of a sandbox service forward
+func (s *Service) Advance(role Role, d time.Duration) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	sb := s.sandbox
+	s.mu.RUnlock()
+
+	if sb == nil {
+		return newError(MISCONFIGURED, "Service is not a sandbox")
+	}
+
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	sb.now = sb.now.Add(d)
+
+	return nil
+}
+
+// Fails payments of the sandbox amounts before the handler sees them
+type SandboxTransactionHandler struct {
+	next TransactionHandler
+}
+
+func (th *SandboxTransactionHandler) pay(ctx context.Context, t *Transaction) error {
+	if err, ok := sandboxAmounts[t.amount]; ok {
+		return err
+	}
+
+	return th.next.pay(ctx, t)
+}
+
+// Hands out addresses named after the transaction, whose funds are confirmed as soon as they are asked about
+type SandboxChainWatcher struct{}
+
+func (w *SandboxChainWatcher) newAddress(ctx context.Context, t *Transaction) (string, error) {
+	return fmt.Sprintf("sandbox:%s:%d", t.tenant, t.id), nil
+}
+
+func (w *SandboxChainWatcher) confirmations(ctx context.Context, address string, amount uint32) (uint32, error) {
+	return 1, nil
+}
+
+// Authorizes every card and leaves the capture for a callback posted to the webhook
+// Callbacks aren't signed, integrators post them to simulate the gateway
+type SandboxGateway struct{}
+
+// Body of a sandbox gateway callback
+type sandboxEvent struct {
+	ID          string        `json:"id"`
+	Payment     string        `json:"payment"`
+	Status      GatewayStatus `json:"status"`
+	Tenant      TenantID      `json:"tenant"`
+	Transaction uint32        `json:"transaction"`
+	// What was refunded so far, on refunds
+	Refunded uint32 `json:"refunded,omitempty"`
+}
+
+func (g *SandboxGateway) authorize(ctx context.Context, t *Transaction, paymentMethod string) (GatewayPayment, error) {
+	return GatewayPayment{id: "sandbox_" + string(t.tenant) + "_" + strconv.FormatUint(uint64(t.id), 10), status: GATEWAY_AUTHORIZED}, nil
+}
+
+func (g *SandboxGateway) capture(ctx context.Context, id string) (GatewayPayment, error) {
+	return GatewayPayment{id: id, status: GATEWAY_PENDING}, nil
+}
+
+func (g *SandboxGateway) refund(ctx context.Context, id string, amount uint32, key string) error {
+	return nil
+}
+
+func (g *SandboxGateway) reconcile(payload []byte, signature string) (GatewayEvent, error) {
+	var e sandboxEvent
+
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return GatewayEvent{}, err
+	}
+
+	return GatewayEvent{
+		id:            e.ID,
+		payment:       GatewayPayment{id: e.Payment, status: e.Status},
+		tenant:        e.Tenant,
+		transactionID: e.Transaction,
+		refunded:      e.Refunded,
+	}, nil
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The part of JSON Schema the published schemas use
+type jsonSchema struct {
+	Ref        string                 `json:"$ref"`
+	Defs       map[string]*jsonSchema `json:"$defs"`
+	Type       string                 `json:"type"`
+	Const      any                    `json:"const"`
+	Enum       []any                  `json:"enum"`
+	Pattern    string                 `json:"pattern"`
+	MinLength  int                    `json:"minLength"`
+	Minimum    *float64               `json:"minimum"`
+	Maximum    *float64               `json:"maximum"`
+	Required   []string               `json:"required"`
+	Properties map[string]*jsonSchema `json:"properties"`
+	// False or the schema of properties not listed
+	AdditionalProperties json.RawMessage `json:"additionalProperties"`
+	Items                *jsonSchema     `json:"items"`
+	AnyOf                []*jsonSchema   `json:"anyOf"`
+	AllOf                []*jsonSchema   `json:"allOf"`
+	// Then applies to values that follow If
+	If   *jsonSchema `json:"if"`
+	Then *jsonSchema `json:"then"`
+}
+
+// Reads a schema from the schemas directory
+func loadSchema(t *testing.T, name string) *jsonSchema {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("schemas", name))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var s jsonSchema
+
+	if err := json.Unmarshal(data, &s); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+
+	return &s
+}
+
+// Returns the definition a schema names, e.g. Transaction for #/$defs/Transaction
+func (root *jsonSchema) def(t *testing.T, name string) *jsonSchema {
+	t.Helper()
+
+	s, ok := root.Defs[name]
+
+	if !ok {
+		t.Fatalf("schema has no %s definition", name)
+	}
+
+	return s
+}
+
+// Returns why a decoded JSON value doesn't follow s, empty when it does
+func (root *jsonSchema) check(s *jsonSchema, value any, path string) string {
+	if s.Ref != "" {
+		return root.check(root.Defs[strings.TrimPrefix(s.Ref, "#/$defs/")], value, path)
+	}
+
+	for _, part := range s.AllOf {
+		if reason := root.check(part, value, path); reason != "" {
+			return reason
+		}
+	}
+
+	if s.If != nil && root.check(s.If, value, path) == "" {
+		if reason := root.check(s.Then, value, path); reason != "" {
+			return reason
+		}
+	}
+
+	if len(s.AnyOf) > 0 {
+		for _, option := range s.AnyOf {
+			if root.check(option, value, path) == "" {
+				return ""
+			}
+		}
+		return path + " matches none of its schemas"
+	}
+
+	if s.Const != nil && value != s.Const {
+		return fmt.Sprintf("%s is %v, not %v", path, value, s.Const)
+	}
+
+	if s.Enum != nil && !slices.Contains(s.Enum, value) {
+		return fmt.Sprintf("%s is %v, which isn't listed", path, value)
+	}
+
+	// Schemas without a type, e.g. in if and then, still constrain the objects they're applied to
+	if _, ok := value.(map[string]any); ok && s.Type == "" {
+		return root.checkObject(s, value.(map[string]any), path)
+	}
+
+	switch s.Type {
+	case "string":
+		v, ok := value.(string)
+
+		if !ok {
+			return path + " is not a string"
+		}
+
+		if len(v) < s.MinLength {
+			return fmt.Sprintf("%s is %q, which is too short", path, v)
+		}
+
+		if s.Pattern != "" && !regexp.MustCompile(s.Pattern).MatchString(v) {
+			return fmt.Sprintf("%s is %q, which doesn't match %s", path, v, s.Pattern)
+		}
+	case "integer":
+		v, ok := value.(float64)
+
+		if !ok || v != math.Trunc(v) {
+			return path + " is not an integer"
+		}
+
+		if (s.Minimum != nil && v < *s.Minimum) || (s.Maximum != nil && v > *s.Maximum) {
+			return fmt.Sprintf("%s is %v, which is out of range", path, v)
+		}
+	case "array":
+		v, ok := value.([]any)
+
+		if !ok {
+			return path + " is not an array"
+		}
+
+		for i, item := range v {
+			if reason := root.check(s.Items, item, fmt.Sprintf("%s[%d]", path, i)); reason != "" {
+				return reason
+			}
+		}
+	case "object":
+		v, ok := value.(map[string]any)
+
+		if !ok {
+			return path + " is not an object"
+		}
+
+		return root.checkObject(s, v, path)
+	}
+
+	return ""
+}
+
+// Returns why an object doesn't follow s, empty when it does
+func (root *jsonSchema) checkObject(s *jsonSchema, v map[string]any, path string) string {
+	for _, name := range s.Required {
+		if _, ok := v[name]; !ok {
+			return path + "." + name + " is missing"
+		}
+	}
+
+	for name, field := range v {
+		property, listed := s.Properties[name]
+
+		if !listed {
+			if string(s.AdditionalProperties) == "false" {
+				return path + "." + name + " is not in the schema"
+			}
+
+			if len(s.AdditionalProperties) == 0 {
+				continue
+			}
+
+			property = &jsonSchema{}
+			json.Unmarshal(s.AdditionalProperties, property)
+		}
+
+		if reason := root.check(property, field, path+"."+name); reason != "" {
+			return reason
+		}
+	}
+
+	return ""
+}
+
+// Encodes a wire value, checks it against its schema and decodes it back, which must give the same value
+func roundTrip[T any](t *testing.T, root *jsonSchema, s *jsonSchema, wire T) {
+	t.Helper()
+
+	data, err := json.Marshal(wire)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded any
+
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if reason := root.check(s, decoded, "$"); reason != "" {
+		t.Errorf("%T breaks its schema: %s\n%s", wire, reason, data)
+	}
+
+	var back T
+
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(back, wire) {
+		t.Errorf("%T changed on the way back\n got %+v\nwant %+v", wire, back, wire)
+	}
+}
+
+// Returns the values of every EventKind constant declared in the package
+func declaredEventKinds(t *testing.T) []string {
+	t.Helper()
+
+	files, err := filepath.Glob("*.go")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var kinds []string
+	fset := token.NewFileSet()
+
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+
+		f, err := parser.ParseFile(fset, name, nil, 0)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ast.Inspect(f, func(n ast.Node) bool {
+			spec, ok := n.(*ast.ValueSpec)
+
+			if !ok {
+				return true
+			}
+
+			if ident, ok := spec.Type.(*ast.Ident); !ok || ident.Name != "EventKind" {
+				return true
+			}
+
+			for _, value := range spec.Values {
+				if lit, ok := value.(*ast.BasicLit); ok {
+					kinds = append(kinds, strings.Trim(lit.Value, `"`))
+				}
+			}
+
+			return true
+		})
+	}
+
+	return kinds
+}
+
+func TestEventSchemasListEveryKind(t *testing.T) {
+	schema := loadSchema(t, "event.v1.schema.json")
+	proto, err := os.ReadFile("schemas/event.v1.proto")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kinds := declaredEventKinds(t)
+
+	if len(kinds) == 0 {
+		t.Fatal("found no event kinds")
+	}
+
+	for _, kind := range kinds {
+		if !slices.Contains(schema.Properties["kind"].Enum, any(kind)) {
+			t.Errorf("event.v1.schema.json doesn't list %s", kind)
+		}
+
+		if !strings.Contains(string(proto), kind) {
+			t.Errorf("event.v1.proto doesn't list %s", kind)
+		}
+	}
+}
+
+// Events of every kind, shaped as the service publishes them
+var eventSamples = func() map[EventKind]Event {
+	at := time.Date(2024, 3, 1, 12, 30, 0, 500, time.UTC)
+	account := &Account{id: 7, tenant: "acme"}
+	transaction := &Transaction{id: 42, tenant: "acme", sender: account}
+
+	return map[EventKind]Event{
+		TRANSACTION_CANCELLED: {kind: TRANSACTION_CANCELLED, transaction: transaction, detail: "Declined by the gateway", at: at},
+		BALANCE_ALERT:         {kind: BALANCE_ALERT, account: account, detail: "balance 40 fell below 50", at: at},
+		BUDGET_EXCEEDED:       {kind: BUDGET_EXCEEDED, transaction: transaction, account: account, detail: "food spending 120 is over the budget of 100", at: at},
+		ACCOUNT_FROZEN:        {kind: ACCOUNT_FROZEN, account: account, detail: "3 blocked payments in 1h0m0s", at: at},
+		ACCOUNT_UNFROZEN:      {kind: ACCOUNT_UNFROZEN, account: account, detail: "Checked with the customer", at: at},
+		SLA_BREACHED:          {kind: SLA_BREACHED, transaction: transaction, detail: "took 3s, target is 1s", at: at},
+		EXPIRY_REMINDER:       {kind: EXPIRY_REMINDER, transaction: transaction, detail: "1h0m0s", at: at},
+		TRANSACTION_FAILED:    {kind: TRANSACTION_FAILED, transaction: transaction, detail: "Insufficient funds", at: at},
+		LEDGER_IMBALANCE:      {kind: LEDGER_IMBALANCE, tenant: "acme", account: account, detail: "moved 12 since the previous close but 9 was posted", at: at},
+	}
+}()
+
+func TestEventV1RoundTrip(t *testing.T) {
+	schema := loadSchema(t, "event.v1.schema.json")
+
+	for _, kind := range declaredEventKinds(t) {
+		e, ok := eventSamples[EventKind(kind)]
+
+		if !ok {
+			t.Errorf("no sample of %s events, add one shaped as they are published", kind)
+			continue
+		}
+
+		roundTrip(t, schema, schema, e.v1())
+	}
+}
+
+func TestAPIV1RoundTrip(t *testing.T) {
+	schema := loadSchema(t, "api.v1.schema.json")
+	at := time.Date(2024, 3, 1, 12, 30, 0, 500, time.UTC)
+	sender := &Account{id: 1, tenant: "acme", name: "Gustavo"}
+	recipient := &Account{id: 2, tenant: "acme", name: "Online store"}
+	open := &Transaction{id: 3, tenant: "acme", sender: sender, recipient: recipient, amount: 55, state: OPEN, paymentMethod: DEBIT, createdAt: at}
+	closed := &Transaction{id: 4, tenant: "acme", sender: sender, recipient: recipient, amount: 55, fee: -2, state: CLOSED, paymentMethod: CASH, reference: "INV-1", createdAt: at, closedAt: at.Add(time.Second)}
+
+	roundTrip(t, schema, schema.def(t, "Account"), AccountResourceV1{ID: 1, Tenant: "acme", Name: "Gustavo", Balance: 150})
+	roundTrip(t, schema, schema.def(t, "Account"), AccountResourceV1{ID: 1, Tenant: "acme", Name: "Gustavo", Balance: 150, Currency: "EUR"})
+	roundTrip(t, schema, schema.def(t, "Transaction"), transactionResourceV1(open))
+	roundTrip(t, schema, schema.def(t, "Transaction"), transactionResourceV1(closed))
+	roundTrip(t, schema, schema.def(t, "TransactionRequest"), TransactionRequestV1{Sender: 1, Recipient: 2, Amount: 55})
+	roundTrip(t, schema, schema.def(t, "TransactionRequest"), TransactionRequestV1{
+		Sender:        1,
+		Recipient:     2,
+		Amount:        55,
+		PaymentMethod: CREDIT,
+		CardToken:     "tok_1",
+		Memo:          "Lunch",
+		Reference:     "INV-1",
+		Category:      "food",
+		PromoCode:     "WELCOME",
+		Metadata:      map[string]string{"order": "9"},
+	})
+
+	entry := LedgerEntry{sequence: 1, tenant: "acme", transactionID: 4, paymentMethod: CASH, accounts: []uint32{1, 2}, reference: "INV-1", postedAt: at}
+	entry.postings = defaultChartOfAccounts.postings(closed, nil, nil)
+	roundTrip(t, schema, schema.def(t, "LedgerEntry"), entry.v1())
+
+	// Data is decoded into a map, so the envelope is only checked against the schema
+	for _, envelope := range []APIEnvelope{
+		{Version: API_V1, Data: transactionResourceV1(closed)},
+		{Version: API_V1, Data: transactionResourceV1(open), Error: &APIError{Code: CONFIRMATION_REQUIRED, Name: CONFIRMATION_REQUIRED.name(), Message: "Confirm the payment"}},
+		{Version: API_V1, Error: &APIError{Code: NOT_FOUND, Name: NOT_FOUND.name(), Message: "Not found"}},
+	} {
+		data, err := json.Marshal(envelope)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var decoded any
+		json.Unmarshal(data, &decoded)
+
+		if reason := schema.check(schema, decoded, "$"); reason != "" {
+			t.Errorf("envelope breaks its schema: %s\n%s", reason, data)
+		}
+	}
+}
+
+// Every field of a wire type must be in its schema, and be required unless it's omitted when empty
+func TestSchemasDescribeEveryField(t *testing.T) {
+	event := loadSchema(t, "event.v1.schema.json")
+	api := loadSchema(t, "api.v1.schema.json")
+
+	for wire, s := range map[reflect.Type]*jsonSchema{
+		reflect.TypeFor[EventV1]():               event,
+		reflect.TypeFor[APIEnvelope]():           api.def(t, "Envelope"),
+		reflect.TypeFor[APIError]():              api.def(t, "Error"),
+		reflect.TypeFor[AccountResourceV1]():     api.def(t, "Account"),
+		reflect.TypeFor[TransactionResourceV1](): api.def(t, "Transaction"),
+		reflect.TypeFor[TransactionRequestV1]():  api.def(t, "TransactionRequest"),
+		reflect.TypeFor[LedgerEntryV1]():         api.def(t, "LedgerEntry"),
+		reflect.TypeFor[PostingV1]():             api.def(t, "Posting"),
+	} {
+		var fields []string
+
+		for field := range wire.Fields() {
+			name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+			fields = append(fields, name)
+			omitted := strings.Contains(options, "omitempty") || strings.Contains(options, "omitzero")
+
+			if _, ok := s.Properties[name]; !ok {
+				t.Errorf("%s.%s is not in its schema", wire.Name(), field.Name)
+			}
+
+			if !omitted && !slices.Contains(s.Required, name) {
+				t.Errorf("%s.%s is always sent but its schema doesn't require it", wire.Name(), field.Name)
+			}
+		}
+
+		for name := range s.Properties {
+			if !slices.Contains(fields, name) {
+				t.Errorf("schema of %s has %s, which the type doesn't", wire.Name(), name)
+			}
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import "strings"
+
+// Criteria used to search transactions, empty fields match everything
+type TransactionFilter struct {
+	reference string
+	// Case-insensitive text the memo must contain
+	memo string
+	// Every key must be present in the transaction metadata with the same value
+	metadata map[string]string
+}
+
+// Checks if a transaction meets every criterion of the filter
+func (f TransactionFilter) matches(t *Transaction) bool {
+	if f.reference != "" && f.reference != t.reference {
+		return false
+	}
+
+	if f.memo != "" && !strings.Contains(strings.ToLower(t.memo), strings.ToLower(f.memo)) {
+		return false
+	}
+
+	for key, value := range f.metadata {
+		if v, ok := t.metadata[key]; !ok || v != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns the transactions of a tenant that match a filter
+func (s *Service) FindTransactions(role Role, tenant TenantID, filter TransactionFilter) ([]*Transaction, error) {
+	transactions, err := s.Transactions(role, tenant)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var found []*Transaction
+
+	for _, t := range transactions {
+		if filter.matches(t) {
+			found = append(found, t)
+		}
+	}
+
+	return found, nil
+}
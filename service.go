@@ -0,0 +1,721 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Entry point for operating on accounts and transactions
+// Wires handlers to their dependencies and checks who is allowed to do what
+type Service struct {
+	mu         sync.RWMutex
+	tokenVault TokenVault
+	// Where payments check and move balances, local balances when nil
+	balances BalanceProvider
+	// Tracks crypto payments, nil when they are off
+	crypto *CryptoPolicy
+	// Handlers of payment methods registered from outside the package
+	handlers map[PaymentMethod]HandlerFactory
+	// Fee account of each tenant
+	feeAccounts  map[TenantID]*Account
+	confirmation *ConfirmationPolicy
+	duplicates   *DuplicateDetector
+	timeouts     map[PaymentMethod]time.Duration
+	slaTargets   map[PaymentMethod]time.Duration
+	apiKeys      *APIKeyStore
+	// Limits payments per sender, nil when there is no limit
+	accountLimiter *AccountRateLimiter
+	auditTrail     []AuditRecord
+	repository     Repository
+	archive        ArchiveStore
+	sagas          SagaStore
+	// Write-ahead journal of balance changes, nil when journaling is off
+	journal    Journal
+	rollup     *DailyRollup
+	rewards    *RewardsEngine
+	promoCodes map[string]*PromoCode
+	tax        *TaxPolicy
+	statements map[*Account][]*Statement
+	loans      Store[*Loan, uint32]
+	deposits   Store[*Deposit, uint32]
+	payouts    Store[*Payout, uint32]
+	dayCloses  Store[*DayClose, dayCloseKey]
+	aliases    *AliasDirectory
+	events     EventPublisher
+	notifier   Notifier
+	mandates   Store[*Mandate, uint32]
+	rounding   RoundingPolicy
+	// Rounding of the fees of specific payment methods, overriding the service policy
+	methodRounding map[PaymentMethod]RoundingPolicy
+	// Where each tenant's ledger was last closed
+	ledgerCutoffs map[TenantID]time.Time
+	// How each tenant's merchants are paid out
+	payoutPolicies map[TenantID]*PayoutPolicy
+	// Transitions transactions may make, and hooks run after them
+	states *StateMachine
+	// Freezes senders with too many blocked payments, nil when freezing is off
+	freezeRules *FreezeRules
+	// Notifiers of the channels accounts can choose in their preferences
+	channels map[NotificationChannel]Notifier
+	// Start of the next month each account opted into statements gets one for
+	statementsDue map[*Account]time.Time
+	// Fake world the service runs in, nil outside of a sandbox
+	sandbox *Sandbox
+	// Rules waiving the credit surcharge, nil when it's always charged
+	creditWaivers *CreditWaiverRules
+	// Most an account of each type can hold
+	balanceCaps map[AccountType]uint32
+	// Payments from this amount on are reported to compliance, zero when nothing is
+	reportingThreshold uint32
+	thresholdReports   Store[*ThresholdReport, recordKey]
+	// How long before their deadline payers are reminded of unpaid transactions
+	expiryReminders []time.Duration
+	// Held by payments and adjustments while they move an account's funds
+	accountLocks *AccountLocks
+	// Smallest and largest amounts each payment method takes
+	amountBounds map[PaymentMethod]AmountBounds
+	// Hides personal data in logs, events and ledger exports, nil when nothing is hidden
+	redaction Redactor
+	// How each tenant's statements and receipts look
+	documentStyles map[TenantID]*DocumentStyle
+	// Closed transactions in the order they were posted, streamed by ledger tails
+	ledger *LedgerLog
+	// Failures injected for resilience testing, nil when none are
+	faults *FaultInjector
+	// Rates used by exchanges, nil when exchanges are off
+	rates ExchangeRateProvider
+	// House account holding each tenant's funds in a currency for exchanges, by tenant and currency
+	exchangeAccounts map[tenantKey]*Account
+	// House account refunds made at a card gateway are posted to, by tenant
+	gatewayClearing map[TenantID]*Account
+	// Last ids handed out to records created by the service
+	lastTransactionID uint32
+	lastMandateID     uint32
+	lastLoanID        uint32
+	lastDepositID     uint32
+	lastSagaID        uint32
+	// Whether lastSagaID was read from the saga store, which outlives the service
+	sagaIDSeeded   bool
+	lastExchangeID uint32
+	lastPayoutID   uint32
+	// When set, every submitted transaction must be signed with it
+	signingSecret []byte
+	// Nonces of the signed transactions submitted so far
+	signatureNonces *SignatureNonces
+	now             func() time.Time
+}
+
+// Creates a service whose credit payments use the given vault
+func NewService(vault TokenVault) *Service {
+	return &Service{
+		tokenVault:     vault,
+		feeAccounts:    map[TenantID]*Account{},
+		timeouts:       map[PaymentMethod]time.Duration{},
+		amountBounds:   map[PaymentMethod]AmountBounds{},
+		slaTargets:     map[PaymentMethod]time.Duration{},
+		apiKeys:        NewAPIKeyStore(),
+		repository:     NewMemoryRepository(),
+		archive:        NewMemoryArchiveStore(),
+		events:         &LogEventPublisher{},
+		notifier:       &NoopNotifier{},
+		mandates:       NewMemoryStore(func(m *Mandate) uint32 { return m.id }),
+		promoCodes:     map[string]*PromoCode{},
+		statements:     map[*Account][]*Statement{},
+		loans:          NewMemoryStore(func(l *Loan) uint32 { return l.id }),
+		deposits:       NewMemoryStore(func(d *Deposit) uint32 { return d.id }),
+		payouts:        NewMemoryStore(func(p *Payout) uint32 { return p.id }),
+		payoutPolicies: map[TenantID]*PayoutPolicy{},
+		statementsDue:  map[*Account]time.Time{},
+		channels:       map[NotificationChannel]Notifier{},
+		balanceCaps:    map[AccountType]uint32{},
+		accountLocks:   NewAccountLocks(),
+		ledger:         NewLedgerLog(),
+		documentStyles: map[TenantID]*DocumentStyle{},
+		thresholdReports: NewMemoryStore(func(r *ThresholdReport) recordKey {
+			return recordKey{r.Tenant, r.TransactionID}
+		}),
+		dayCloses:        NewMemoryStore(func(d *DayClose) dayCloseKey { return dayCloseKey{d.tenant, d.cutoff} }),
+		ledgerCutoffs:    map[TenantID]time.Time{},
+		states:           NewStateMachine(),
+		aliases:          NewAliasDirectory(),
+		rounding:         HALF_UP,
+		methodRounding:   map[PaymentMethod]RoundingPolicy{},
+		sagas:            NewMemorySagaStore(),
+		handlers:         map[PaymentMethod]HandlerFactory{},
+		signatureNonces:  NewSignatureNonces(),
+		exchangeAccounts: map[tenantKey]*Account{},
+		gatewayClearing:  map[TenantID]*Account{},
+		now:              time.Now,
+	}
+}
+
+// Chooses the handler of a transaction and wraps it with the service policies
+func (s *Service) prepare(t *Transaction) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if t.tenant != t.sender.tenant || t.tenant != t.recipient.tenant {
+		return ErrCrossTenant
+	}
+
+	if bounds, ok := s.amountBounds[t.paymentMethod]; ok {
+		if err := bounds.check(t); err != nil {
+			return err
+		}
+	}
+
+	t.states = s.states
+
+	if s.signingSecret != nil {
+		if err := verifyTransactionSignature(s.signingSecret, t, s.now()); err != nil {
+			return err
+		}
+
+		if err := s.signatureNonces.claim(t, s.now()); err != nil {
+			return err
+		}
+	}
+
+	if err := s.applyPromoCode(t); err != nil {
+		return err
+	}
+
+	return s.bindHandler(t)
+}
+
+// Chooses the handler of a transaction and wraps it with the service policies, without checking the transaction again
+// Must be called with the lock held for reading
+func (s *Service) bindHandler(t *Transaction) error {
+	deps := HandlerDependencies{
+		tokenVault:    s.tokenVault,
+		feeAccount:    s.feeAccounts[t.tenant],
+		rounding:      s.roundingFor(t.paymentMethod),
+		balances:      s.balances,
+		crypto:        s.crypto,
+		now:           s.now,
+		creditWaivers: s.creditWaivers,
+	}
+
+	if factory, ok := s.handlers[t.paymentMethod]; ok {
+		t.transactionHandler = factory(deps)
+	} else if err := t.selectTransactionHandler(deps); err != nil {
+		return err
+	}
+
+	if s.sandbox != nil {
+		t.transactionHandler = &SandboxTransactionHandler{next: t.transactionHandler}
+	}
+
+	if s.faults != nil {
+		t.transactionHandler = &FaultyTransactionHandler{next: t.transactionHandler, faults: s.faults}
+	}
+
+	if s.duplicates != nil {
+		t.transactionHandler = &DuplicateCheckingTransactionHandler{next: t.transactionHandler, detector: s.duplicates}
+	}
+
+	// Confirmation goes last so confirmed payments still go through the other checks
+	if s.confirmation != nil {
+		t.transactionHandler = withConfirmation(t.transactionHandler, *s.confirmation, s.now)
+	}
+
+	return nil
+}
+
+// Pays an open transaction
+func (s *Service) Pay(ctx context.Context, role Role, t *Transaction) error {
+	if err := authorize(role, PAY); err != nil {
+		return err
+	}
+
+	return s.pay(ctx, t)
+}
+
+// Pays a transaction between accounts that aren't frozen, watching for blocked payments
+func (s *Service) pay(ctx context.Context, t *Transaction) error {
+	if err := s.checkFrozen(t); err != nil {
+		return err
+	}
+
+	ctx, release, err := s.lockAccounts(ctx, s.paymentAccounts(t)...)
+
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
+	if err := s.checkBalanceCap(ctx, t.recipient, t.amount); err != nil {
+		return err
+	}
+
+	err = s.attempt(ctx, t)
+	s.watchBlockedPayments(t, err)
+
+	return err
+}
+
+// Prepares a transaction within the sender's rate limit and pays it once every owner approval it needs is in
+func (s *Service) attempt(ctx context.Context, t *Transaction) error {
+	if err := s.checkAccountRate(t); err != nil {
+		return err
+	}
+
+	if t.id == 0 {
+		t.id = s.newTransactionID()
+	}
+
+	// Transactions built against the wall clock can look created in the future of a sandbox's clock, they count from now
+	if t.createdAt.IsZero() || t.createdAt.After(s.now()) {
+		t.createdAt = s.now()
+	}
+
+	if err := s.prepare(t); err != nil {
+		return err
+	}
+
+	if err := s.checkApprovals(t); err != nil {
+		s.save(t)
+		return err
+	}
+
+	if err := s.redeemPromoCode(t); err != nil {
+		return err
+	}
+
+	return s.execute(ctx, t, t.makePayment)
+}
+
+// Runs a handler call under the deadline configured for the transaction's payment method
+// Records the outcome and notifies the payer once the call is done
+func (s *Service) execute(ctx context.Context, t *Transaction, call func(ctx context.Context) error) error {
+	s.mu.RLock()
+	timeout, ok := s.timeouts[t.paymentMethod]
+	s.mu.RUnlock()
+
+	senderBefore, recipientBefore := t.sender.balance, t.recipient.balance
+
+	callCtx, sequence, err := s.journalBegin(ctx, t)
+
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		var cancel context.CancelFunc
+		callCtx, cancel = context.WithTimeout(callCtx, timeout)
+		defer cancel()
+	}
+
+	err = call(callCtx)
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = ErrPaymentTimeout
+	}
+
+	if err == nil {
+		t.closedAt = s.now()
+	}
+
+	s.save(t)
+	s.journalEnd(sequence, err)
+
+	if errors.Is(err, ErrConfirmationRequired) || errors.Is(err, ErrAwaitingChain) || errors.Is(err, ErrAwaitingGateway) || errors.Is(err, ErrAwaitingHandler) {
+		return err
+	}
+
+	if err != nil {
+		s.releasePromoCode(t)
+		s.publish(Event{kind: TRANSACTION_FAILED, transaction: t, detail: err.Error()})
+		s.notify(ctx, PAYMENT_FAILED, t, localizeError(err, t.preferredLocale()))
+		return err
+	}
+
+	s.afterPayment(ctx, t, senderBefore, recipientBefore)
+
+	return nil
+}
+
+// Runs everything that follows a successful payment
+func (s *Service) afterPayment(ctx context.Context, t *Transaction, senderBefore uint32, recipientBefore uint32) {
+	s.mu.RLock()
+	rollup, rewards, tax := s.rollup, s.rewards, s.tax
+	s.mu.RUnlock()
+
+	if rollup != nil {
+		rollup.add(t)
+	}
+
+	if rewards != nil {
+		s.postReward(ctx, rewards, t)
+	}
+
+	if tax != nil {
+		s.withholdTax(ctx, tax, t)
+	}
+
+	s.checkBalanceAlerts(t.sender, senderBefore)
+	s.checkBalanceAlerts(t.recipient, recipientBefore)
+	s.checkBudget(t)
+	s.checkSLA(t)
+	s.reportThreshold(t)
+	s.postToLedger(t)
+	s.notify(ctx, PAYMENT_SUCCEEDED, t, "")
+}
+
+// Abandons an open transaction and lets subscribers know about it
+func (s *Service) Cancel(role Role, t *Transaction, reason string) error {
+	if err := authorize(role, CANCEL); err != nil {
+		return err
+	}
+
+	return s.cancel(context.Background(), t, reason)
+}
+
+// Cancels a transaction under the locks of its accounts, which a payment of it holds while it runs
+func (s *Service) cancel(ctx context.Context, t *Transaction, reason string) error {
+	_, release, err := s.lockAccounts(ctx, t.sender, t.recipient)
+
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
+	s.bindStates(t)
+
+	// The handler may have approved the payment, only its answer ends it
+	if t.state == AWAITING_HANDLER {
+		return newError(INVALID_STATE, "Transaction is waiting for its handler to decide")
+	}
+
+	if err := t.Cancel(reason); err != nil {
+		return err
+	}
+
+	s.releasePromoCode(t)
+	s.save(t)
+
+	s.publish(Event{kind: TRANSACTION_CANCELLED, transaction: t, detail: s.Redact(PII_NOTE, reason)})
+
+	return nil
+}
+
+// Returns the id of the next transaction created by the service
+func (s *Service) newTransactionID() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastTransactionID++
+
+	return s.lastTransactionID
+}
+
+// Expires a transaction that was never paid and lets the payer know
+func (s *Service) Expire(ctx context.Context, role Role, t *Transaction) error {
+	if err := authorize(role, CANCEL); err != nil {
+		return err
+	}
+
+	// A payment of the transaction holds the locks of its accounts while it runs
+	ctx, release, err := s.lockAccounts(ctx, t.sender, t.recipient)
+
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
+	s.bindStates(t)
+
+	if err := t.transition(EXPIRED); err != nil {
+		return err
+	}
+
+	s.releasePromoCode(t)
+	s.save(t)
+	s.notify(ctx, TRANSACTION_EXPIRED, t, "")
+
+	return nil
+}
+
+// Stores the current state of a transaction
+// Failures are logged, balances were already changed by then
+func (s *Service) save(t *Transaction) {
+	if err := s.repository.saveTransaction(t); err != nil {
+		log.Println(err)
+	}
+}
+
+// Sends a notification to the payer of a transaction, as their preferences allow
+// Delivery failures are logged, they never undo the operation that caused them
+func (s *Service) notify(ctx context.Context, kind NotificationKind, t *Transaction, detail string) {
+	n, err := renderNotification(kind, t, detail)
+
+	if err == nil {
+		err = s.deliver(ctx, n)
+	}
+
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Moves funds between two accounts as a fee-free debit transaction of its own
+// Used for postings the service makes itself, which skip the checks applied to submitted payments but not the balance caps
+// Both accounts are locked for the posting, or must already be locked by the operation in ctx
+func (s *Service) postTransfer(ctx context.Context, from *Account, to *Account, amount uint32, metadata map[string]string) (*Transaction, error) {
+	ctx, release, err := s.lockAccounts(ctx, from, to)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer release()
+
+	if err := s.checkBalanceCap(ctx, to, amount); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	balances := s.balances
+	s.mu.RUnlock()
+
+	t := &Transaction{
+		id:                 s.newTransactionID(),
+		tenant:             from.tenant,
+		amount:             amount,
+		sender:             from,
+		recipient:          to,
+		state:              OPEN,
+		paymentMethod:      DEBIT,
+		transactionHandler: &DebitTransactionHandler{balances: balances},
+		metadata:           metadata,
+		createdAt:          s.now(),
+	}
+
+	journalCtx, sequence, err := s.journalBegin(ctx, t)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.makePayment(journalCtx); err != nil {
+		s.journalEnd(sequence, err)
+		return nil, err
+	}
+
+	t.closedAt = s.now()
+	s.save(t)
+	s.journalEnd(sequence, nil)
+	s.postToLedger(t)
+
+	return t, nil
+}
+
+// Sends an event to the configured publisher
+func (s *Service) publish(e Event) {
+	s.mu.RLock()
+	events := s.events
+	s.mu.RUnlock()
+
+	e.at = s.now()
+	events.publish(e)
+}
+
+// Confirms a payment that is waiting for the payer's second factor
+func (s *Service) Confirm(ctx context.Context, role Role, t *Transaction, code string) error {
+	if err := authorize(role, PAY); err != nil {
+		return err
+	}
+
+	// Confirming pays the transaction, so it goes through the checks paying it would
+	if err := s.checkFrozen(t); err != nil {
+		return err
+	}
+
+	ctx, release, err := s.lockAccounts(ctx, s.paymentAccounts(t)...)
+
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
+	if err := s.checkBalanceCap(ctx, t.recipient, t.amount); err != nil {
+		return err
+	}
+
+	if err := s.checkAccountRate(t); err != nil {
+		return err
+	}
+
+	return s.execute(ctx, t, func(ctx context.Context) error {
+		return t.confirmPayment(ctx, code)
+	})
+}
+
+// Returns the balance of an account, as the balance provider sees it
+func (s *Service) Balance(ctx context.Context, role Role, a *Account) (uint32, error) {
+	if err := authorize(role, READ); err != nil {
+		return 0, err
+	}
+
+	s.mu.RLock()
+	balances := s.balances
+	s.mu.RUnlock()
+
+	return balancesOrLocal(balances).balance(ctx, a)
+}
+
+// Changes which payments require a second confirmation
+// A nil policy turns confirmations off
+func (s *Service) SetConfirmationPolicy(role Role, policy *ConfirmationPolicy) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.confirmation = policy
+
+	return nil
+}
+
+// Changes where events are delivered
+func (s *Service) SetEventPublisher(role Role, events EventPublisher) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.events = events
+
+	return nil
+}
+
+// Changes how end users are notified about their payments
+func (s *Service) SetNotifier(role Role, notifier Notifier) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.notifier = notifier
+
+	return nil
+}
+
+// Changes how likely double submissions are detected
+// A nil detector turns detection off
+func (s *Service) SetDuplicateDetector(role Role, detector *DuplicateDetector) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.duplicates = detector
+
+	return nil
+}
+
+// Requires every submitted transaction to be signed with the secret
+// A nil secret turns signature checks off
+func (s *Service) SetSigningSecret(role Role, secret []byte) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.signingSecret = secret
+
+	return nil
+}
+
+// Pays an open transaction on behalf of a machine integration
+// Every attempt is recorded in the audit trail with the key that made it
+func (s *Service) PayWithAPIKey(ctx context.Context, secret string, t *Transaction) error {
+	key, err := s.apiKeys.authenticate(secret)
+
+	if err != nil {
+		return err
+	}
+
+	return s.payWithKey(ctx, key, t)
+}
+
+// Pays a transaction with an authenticated API key and audits the attempt
+func (s *Service) payWithKey(ctx context.Context, key *APIKey, t *Transaction) error {
+	var err error
+
+	if !key.allows(PAY) || t.tenant != key.tenant {
+		err = ErrForbidden
+	} else {
+		t.initiatedBy = key.id
+		err = s.pay(ctx, t)
+	}
+
+	s.mu.Lock()
+	s.auditTrail = append(s.auditTrail, AuditRecord{
+		keyID:         key.id,
+		transactionID: t.id,
+		operation:     PAY,
+		err:           err,
+		at:            s.now(),
+	})
+	s.mu.Unlock()
+
+	return err
+}
+
+// Returns every operation performed with an API key, and every freeze and unfreeze
+func (s *Service) AuditTrail(role Role) ([]AuditRecord, error) {
+	if err := authorize(role, READ); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]AuditRecord(nil), s.auditTrail...), nil
+}
+
+// Issues a key for a machine integration of a tenant, limited to scopes and a request rate
+// Returns the key id and its secret
+func (s *Service) IssueAPIKey(role Role, tenant TenantID, scopes []Operation, perSecond float64, burst int) (string, string, error) {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return "", "", err
+	}
+
+	return s.apiKeys.issue(tenant, scopes, perSecond, burst)
+}
+
+// Replaces the secret of an API key
+func (s *Service) RotateAPIKey(role Role, id string) (string, error) {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return "", err
+	}
+
+	return s.apiKeys.rotate(id)
+}
+
+// Permanently disables an API key
+func (s *Service) RevokeAPIKey(role Role, id string) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	return s.apiKeys.revoke(id)
+}
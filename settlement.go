@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Models what a merchant received and gave back with one payment method over a period
+type SettlementLine struct {
+	method PaymentMethod
+	// Paid to the merchant by its customers
+	gross uint64
+	// Taken out of the receipts, such as tax withheld
+	fees        uint64
+	refunds     uint64
+	chargebacks uint64
+	// What is left to pay out, negative when more went back than came in
+	net int64
+}
+
+// Sends part or all of a closed payment back to the payer at the recipient's request
+func (s *Service) Refund(ctx context.Context, role Role, t *Transaction, amount uint32) (*Transaction, error) {
+	if err := authorize(role, PAY); err != nil {
+		return nil, err
+	}
+
+	return s.reverse(ctx, t, amount, "refund_of")
+}
+
+// Takes part or all of a closed payment back from the recipient after the payer disputed it
+func (s *Service) Chargeback(ctx context.Context, role Role, t *Transaction, amount uint32) (*Transaction, error) {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return nil, err
+	}
+
+	return s.reverse(ctx, t, amount, "chargeback_of")
+}
+
+// Posts amount from the recipient of a closed payment back to its sender, tagged with key
+func (s *Service) reverse(ctx context.Context, t *Transaction, amount uint32, key string) (*Transaction, error) {
+	if amount == 0 {
+		return nil, newError(INVALID_AMOUNT, "Reversals need an amount")
+	}
+
+	// The payment's accounts are locked first, so its state can't change while it's reversed
+	ctx, release, err := s.lockAccounts(ctx, t.sender, t.recipient)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer release()
+
+	s.mu.Lock()
+	if t.state != CLOSED {
+		s.mu.Unlock()
+		return nil, newError(INVALID_STATE, "Only closed transactions can be reversed")
+	}
+	if t.reversed+amount > t.amount {
+		s.mu.Unlock()
+		return nil, newError(INVALID_AMOUNT, "Amount is more than what is left of the transaction")
+	}
+	t.reversed += amount
+	s.mu.Unlock()
+
+	metadata := map[string]string{key: strconv.FormatUint(uint64(t.id), 10)}
+	reversal, err := s.postTransfer(ctx, t.recipient, t.sender, amount, metadata)
+
+	if err != nil {
+		s.mu.Lock()
+		t.reversed -= amount
+		s.mu.Unlock()
+		return nil, err
+	}
+
+	return reversal, nil
+}
+
+// Sums what a merchant received, had deducted and gave back between from and to, one line per payment method
+// Deductions and reversals are counted under the method of the payment they came from
+func (s *Service) SettlementReport(role Role, merchant *Account, from time.Time, to time.Time) ([]SettlementLine, error) {
+	if err := authorize(role, READ); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	house := s.feeAccounts[merchant.tenant]
+	s.mu.RUnlock()
+
+	transactions, err := s.closedBetween(merchant.tenant, from, to)
+
+	if err != nil {
+		return nil, err
+	}
+
+	byMethod := map[PaymentMethod]*SettlementLine{}
+	line := func(method PaymentMethod) *SettlementLine {
+		l, ok := byMethod[method]
+		if !ok {
+			l = &SettlementLine{method: method}
+			byMethod[method] = l
+		}
+		return l
+	}
+
+	for _, t := range transactions {
+		if t.sender == merchant {
+			for _, key := range []string{"tax_withheld_from", "refund_of", "chargeback_of"} {
+				id, ok := t.metadata[key]
+				if !ok {
+					continue
+				}
+
+				method, err := s.originalMethod(merchant.tenant, id)
+				if err != nil {
+					return nil, err
+				}
+
+				l := line(method)
+				switch key {
+				case "tax_withheld_from":
+					l.fees += uint64(t.amount)
+				case "refund_of":
+					l.refunds += uint64(t.amount)
+				case "chargeback_of":
+					l.chargebacks += uint64(t.amount)
+				}
+			}
+			continue
+		}
+
+		_, refund := t.metadata["refund_of"]
+		_, chargeback := t.metadata["chargeback_of"]
+
+		// Loans, rewards and other postings from the house aren't sales, neither is money given back to the merchant
+		if t.recipient == merchant && t.sender != house && !refund && !chargeback {
+			line(t.paymentMethod).gross += uint64(t.amount)
+		}
+	}
+
+	lines := make([]SettlementLine, 0, len(byMethod))
+
+	for _, l := range byMethod {
+		l.net = int64(l.gross) - int64(l.fees+l.refunds+l.chargebacks)
+		lines = append(lines, *l)
+	}
+
+	sort.Slice(lines, func(i, j int) bool {
+		return lines[i].method < lines[j].method
+	})
+
+	return lines, nil
+}
+
+// Returns the payment method of the transaction a posting refers to by id
+func (s *Service) originalMethod(tenant TenantID, id string) (PaymentMethod, error) {
+	n, err := strconv.ParseUint(id, 10, 32)
+
+	if err != nil {
+		return "", err
+	}
+
+	t, err := s.repository.findTransaction(tenant, uint32(n))
+
+	if err != nil {
+		return "", err
+	}
+
+	return t.paymentMethod, nil
+}
+
+// Writes a settlement report as CSV, one payment method per row
+func exportSettlementReport(w io.Writer, lines []SettlementLine) error {
+	out := csv.NewWriter(w)
+
+	if err := out.Write([]string{"method", "gross", "fees", "refunds", "chargebacks", "net"}); err != nil {
+		return err
+	}
+
+	for _, l := range lines {
+		row := []string{
+			string(l.method),
+			strconv.FormatUint(l.gross, 10),
+			strconv.FormatUint(l.fees, 10),
+			strconv.FormatUint(l.refunds, 10),
+			strconv.FormatUint(l.chargebacks, 10),
+			strconv.FormatInt(l.net, 10),
+		}
+
+		if err := out.Write(row); err != nil {
+			return err
+		}
+	}
+
+	out.Flush()
+
+	return out.Error()
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Returned when a transaction's signature doesn't match its payload
+var ErrInvalidSignature = newError(INVALID_SIGNATURE, "Invalid transaction signature")
+
+// Returned when a signed transaction is submitted after its signature expired
+var ErrSignatureExpired = newError(INVALID_SIGNATURE, "Transaction signature expired")
+
+// Returned when the nonce of a signature was already used by another transaction
+var ErrSignatureReplayed = newError(INVALID_SIGNATURE, "Transaction signature was already used")
+
+// Request header the API reads signatures from, as nonce=<nonce>,expires=<unix seconds>,v1=<hex HMAC>
+const signatureHeader = "Dip-Signature"
+
+// Builds the bytes that get signed for a transaction
+// Fields are always written in the same order so both sides compute the same payload
+// Every field that changes what money moves is signed, with a nonce and an expiry so a signature can't be replayed
+// The id is left out, the service hands it out when the transaction is paid, after the client signed it
+func canonicalPayload(t *Transaction) []byte {
+	fields := []string{
+		"tenant=" + url.QueryEscape(string(t.tenant)),
+		"sender=" + strconv.FormatUint(uint64(t.sender.id), 10),
+		"recipient=" + strconv.FormatUint(uint64(t.recipient.id), 10),
+		"amount=" + strconv.FormatUint(uint64(t.amount), 10),
+		"method=" + url.QueryEscape(string(t.paymentMethod)),
+		"card=" + url.QueryEscape(t.cardToken),
+		"memo=" + url.QueryEscape(t.memo),
+		"reference=" + url.QueryEscape(t.reference),
+		"category=" + url.QueryEscape(string(t.category)),
+		"promo=" + url.QueryEscape(t.promoCode),
+	}
+
+	keys := make([]string, 0, len(t.metadata))
+
+	for k := range t.metadata {
+		keys = append(keys, k)
+	}
+
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		fields = append(fields, "metadata."+url.QueryEscape(k)+"="+url.QueryEscape(t.metadata[k]))
+	}
+
+	fields = append(fields,
+		"nonce="+url.QueryEscape(t.nonce),
+		"expires="+strconv.FormatInt(t.signatureExpiresAt.Unix(), 10),
+	)
+
+	return []byte(strings.Join(fields, "&"))
+}
+
+// Computes the hex encoded HMAC-SHA256 of a transaction
+func signTransaction(secret []byte, t *Transaction) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(canonicalPayload(t))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Checks the signature carried by a transaction
+// Returns ErrInvalidSignature if it wasn't produced with the secret, and ErrSignatureExpired once it's too late to use
+func verifyTransactionSignature(secret []byte, t *Transaction, now time.Time) error {
+	if t.nonce == "" || t.signatureExpiresAt.IsZero() {
+		return ErrInvalidSignature
+	}
+
+	expected := signTransaction(secret, t)
+
+	if !hmac.Equal([]byte(expected), []byte(t.signature)) {
+		return ErrInvalidSignature
+	}
+
+	if now.After(t.signatureExpiresAt) {
+		return ErrSignatureExpired
+	}
+
+	return nil
+}
+
+// Signs an outbound webhook payload, returning the signature header in the format submissions are signed with
+// The HMAC covers the nonce and the expiry along with the body, so the receiver can tell a replayed or altered delivery
+func signWebhookPayload(secret []byte, payload []byte, nonce string, expires time.Time) string {
+	unix := strconv.FormatInt(expires.Unix(), 10)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("nonce=" + url.QueryEscape(nonce) + "&expires=" + unix + "&"))
+	mac.Write(payload)
+
+	return "nonce=" + nonce + ",expires=" + unix + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Checks the signature header of a webhook delivery, the way its receiver would
+func verifyWebhookSignature(secret []byte, header string, payload []byte, now time.Time) error {
+	signature, nonce, expires, err := parseSignatureHeader(header)
+
+	if err != nil {
+		return err
+	}
+
+	_, expected, _ := strings.Cut(signWebhookPayload(secret, payload, nonce, expires), ",v1=")
+
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return ErrInvalidSignature
+	}
+
+	if now.After(expires) {
+		return ErrSignatureExpired
+	}
+
+	return nil
+}
+
+// Reads a signature header into the signature, nonce and expiry a transaction is built with
+func parseSignatureHeader(header string) (string, string, time.Time, error) {
+	var signature, nonce string
+	var expires time.Time
+
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+
+		switch key {
+		case "nonce":
+			nonce = value
+		case "expires":
+			unix, err := strconv.ParseInt(value, 10, 64)
+
+			if err != nil {
+				return "", "", time.Time{}, ErrInvalidSignature
+			}
+
+			expires = time.Unix(unix, 0)
+		case "v1":
+			signature = value
+		}
+	}
+
+	if signature == "" || nonce == "" || expires.IsZero() {
+		return "", "", time.Time{}, ErrInvalidSignature
+	}
+
+	return signature, nonce, expires, nil
+}
+
+// Remembers the nonces of signed transactions until their signatures expire, so each is used once
+type SignatureNonces struct {
+	mu sync.Mutex
+	// Transaction that used each nonce of a tenant, and when its signature expires
+	used map[tenantKey]usedNonce
+}
+
+// Transaction a nonce was used by
+type usedNonce struct {
+	transaction *Transaction
+	expiresAt   time.Time
+}
+
+// Creates an empty nonce registry
+func NewSignatureNonces() *SignatureNonces {
+	return &SignatureNonces{used: map[tenantKey]usedNonce{}}
+}
+
+// Claims the nonce of a signed transaction, failing with ErrSignatureReplayed when another transaction used it
+// The same transaction can claim it again, e.g. when it's paid once its approvals are in
+func (n *SignatureNonces) claim(t *Transaction, now time.Time) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for key, used := range n.used {
+		if now.After(used.expiresAt) {
+			delete(n.used, key)
+		}
+	}
+
+	key := tenantKey{t.tenant, t.nonce}
+
+	if used, ok := n.used[key]; ok && used.transaction != t {
+		return ErrSignatureReplayed
+	}
+
+	n.used[key] = usedNonce{transaction: t, expiresAt: t.signatureExpiresAt}
+
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+// Latency of the transactions of one payment method closed over a period
+type LatencyLine struct {
+	method PaymentMethod
+	count  int
+	p50    time.Duration
+	p90    time.Duration
+	p99    time.Duration
+	max    time.Duration
+	// Transactions that took longer than the method's target
+	breaches int
+}
+
+// Returns how long a transaction took from creation to closure, false when it isn't closed or its creation is unknown
+func (t *Transaction) elapsed() (time.Duration, bool) {
+	if t.state != CLOSED || t.createdAt.IsZero() || t.closedAt.IsZero() {
+		return 0, false
+	}
+
+	return t.closedAt.Sub(t.createdAt), true
+}
+
+// Publishes an event when a transaction took longer to close than its method's target
+func (s *Service) checkSLA(t *Transaction) {
+	s.mu.RLock()
+	target, ok := s.slaTargets[t.paymentMethod]
+	s.mu.RUnlock()
+
+	elapsed, closed := t.elapsed()
+
+	// Transactions flagged while open already had their breach published
+	if !ok || !closed || elapsed <= target || t.slaFlagged {
+		return
+	}
+
+	s.publish(Event{
+		kind:        SLA_BREACHED,
+		transaction: t,
+		detail:      fmt.Sprintf("took %s, target is %s", elapsed, target),
+	})
+}
+
+// Publishes an event for each transaction still waiting past its method's target, once per transaction
+// Breaches are otherwise only seen when a transaction closes, which one stuck open never does
+func (s *Service) FlagOverdueTransactions(role Role) error {
+	if err := authorize(role, READ); err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	targets := make(map[PaymentMethod]time.Duration, len(s.slaTargets))
+	for method, target := range s.slaTargets {
+		targets[method] = target
+	}
+	now := s.now()
+	s.mu.RUnlock()
+
+	tenants, err := s.repository.tenants()
+
+	if err != nil {
+		return err
+	}
+
+	for _, tenant := range tenants {
+		transactions, err := s.repository.listTransactions(tenant)
+
+		if err != nil {
+			return err
+		}
+
+		for _, t := range transactions {
+			target, ok := targets[t.paymentMethod]
+
+			if !ok || (!t.unpaid() && t.state != AWAITING_GATEWAY && t.state != AWAITING_HANDLER) || t.createdAt.IsZero() {
+				continue
+			}
+
+			waited := now.Sub(t.createdAt)
+
+			if waited <= target {
+				continue
+			}
+
+			s.mu.Lock()
+			flagged := t.slaFlagged
+			t.slaFlagged = true
+			s.mu.Unlock()
+
+			if flagged {
+				continue
+			}
+
+			s.save(t)
+			s.publish(Event{
+				kind:        SLA_BREACHED,
+				transaction: t,
+				detail:      fmt.Sprintf("open for %s, target is %s", waited, target),
+			})
+		}
+	}
+
+	return nil
+}
+
+// Flags overdue transactions every tick until ctx is done
+func (s *Service) ScheduleSLASweep(ctx context.Context, role Role, tick time.Duration) error {
+	if err := authorize(role, READ); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.FlagOverdueTransactions(role); err != nil {
+					log.Println(err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Returns the value below which the given share of sorted durations fall, by nearest rank
+func percentile(sorted []time.Duration, share float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := int(math.Ceil(share * float64(len(sorted))))
+
+	return sorted[max(rank, 1)-1]
+}
+
+// Reports the creation to closure latency of the transactions closed between from and to, one line per payment method
+func (s *Service) LatencyReport(role Role, tenant TenantID, from time.Time, to time.Time) ([]LatencyLine, error) {
+	if err := authorize(role, READ); err != nil {
+		return nil, err
+	}
+
+	transactions, err := s.closedBetween(tenant, from, to)
+
+	if err != nil {
+		return nil, err
+	}
+
+	byMethod := map[PaymentMethod][]time.Duration{}
+
+	for _, t := range transactions {
+		if elapsed, ok := t.elapsed(); ok {
+			byMethod[t.paymentMethod] = append(byMethod[t.paymentMethod], elapsed)
+		}
+	}
+
+	s.mu.RLock()
+	targets := make(map[PaymentMethod]time.Duration, len(s.slaTargets))
+	for method, target := range s.slaTargets {
+		targets[method] = target
+	}
+	s.mu.RUnlock()
+
+	lines := make([]LatencyLine, 0, len(byMethod))
+
+	for method, durations := range byMethod {
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+
+		line := LatencyLine{
+			method: method,
+			count:  len(durations),
+			p50:    percentile(durations, 0.50),
+			p90:    percentile(durations, 0.90),
+			p99:    percentile(durations, 0.99),
+			max:    durations[len(durations)-1],
+		}
+
+		if target, ok := targets[method]; ok {
+			for _, d := range durations {
+				if d > target {
+					line.breaches++
+				}
+			}
+		}
+
+		lines = append(lines, line)
+	}
+
+	sort.Slice(lines, func(i, j int) bool {
+		return lines[i].method < lines[j].method
+	})
+
+	return lines, nil
+}
+
+// Sets how long transactions of a payment method should take from creation to closure
+// A zero target stops tracking the method
+func (s *Service) SetSLATarget(role Role, method PaymentMethod, target time.Duration) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if target == 0 {
+		delete(s.slaTargets, method)
+		return nil
+	}
+
+	s.slaTargets[method] = target
+
+	return nil
+}
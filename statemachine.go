@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// Returned when a transaction is asked to move to a state its current one doesn't lead to
+var ErrInvalidTransition = newError(INVALID_TRANSITION, "Transaction can't move to that state")
+
+// Called after a transaction moved from one state to another
+// Hooks run synchronously and can't undo the transition, so they should be quick
+type TransitionHook func(t *Transaction, from TransactionState, to TransactionState)
+
+// Models which states a transaction may move to from each state, and who is told when it does
+type StateMachine struct {
+	mu          sync.RWMutex
+	transitions map[TransactionState]map[TransactionState]bool
+	hooks       []TransitionHook
+}
+
+// Creates a machine with the transitions of the built-in states
+func NewStateMachine() *StateMachine {
+	sm := &StateMachine{transitions: map[TransactionState]map[TransactionState]bool{}}
+
+	for from, to := range map[TransactionState][]TransactionState{
+		OPEN:                 {PENDING_CONFIRMATION, PENDING_APPROVAL, AWAITING_CHAIN, AWAITING_GATEWAY, AWAITING_HANDLER, CLOSED, EXPIRED, CANCELLED},
+		PENDING_CONFIRMATION: {OPEN, EXPIRED, CANCELLED},
+		PENDING_APPROVAL:     {OPEN, EXPIRED, CANCELLED},
+		AWAITING_CHAIN:       {CLOSED, EXPIRED, CANCELLED},
+		AWAITING_GATEWAY:     {CLOSED, EXPIRED, CANCELLED},
+		// The handler may have approved, so only its answer ends the payment
+		AWAITING_HANDLER: {CLOSED, CANCELLED},
+	} {
+		for _, state := range to {
+			sm.allow(from, state)
+		}
+	}
+
+	return sm
+}
+
+// Used by transactions that were never prepared by a service
+var defaultStateMachine = NewStateMachine()
+
+// Lets transactions move from one state to another
+func (sm *StateMachine) allow(from TransactionState, to TransactionState) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if sm.transitions[from] == nil {
+		sm.transitions[from] = map[TransactionState]bool{}
+	}
+
+	sm.transitions[from][to] = true
+}
+
+// Returns ErrInvalidTransition unless a transaction in state from may move to state to
+// Staying in the same state is always allowed
+func (sm *StateMachine) check(from TransactionState, to TransactionState) error {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	if from != to && !sm.transitions[from][to] {
+		return ErrInvalidTransition
+	}
+
+	return nil
+}
+
+// Moves a transaction to a state and runs the hooks
+func (sm *StateMachine) move(t *Transaction, to TransactionState) error {
+	from := t.state
+
+	if err := sm.check(from, to); err != nil {
+		return err
+	}
+
+	t.state = to
+
+	if from == to {
+		return nil
+	}
+
+	sm.mu.RLock()
+	hooks := sm.hooks
+	sm.mu.RUnlock()
+
+	for _, hook := range hooks {
+		hook(t, from, to)
+	}
+
+	return nil
+}
+
+// Returns the machine that governs a transaction
+func (t *Transaction) machine() *StateMachine {
+	if t.states != nil {
+		return t.states
+	}
+
+	return defaultStateMachine
+}
+
+// Returns ErrInvalidTransition unless the transaction may move to state to
+func (t *Transaction) checkTransition(to TransactionState) error {
+	return t.machine().check(t.state, to)
+}
+
+// Moves the transaction to a state its machine allows
+func (t *Transaction) transition(to TransactionState) error {
+	return t.machine().move(t, to)
+}
+
+// Puts a transaction under the service's state machine, unless it already has one
+func (s *Service) bindStates(t *Transaction) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if t.states == nil {
+		t.states = s.states
+	}
+}
+
+// Lets transactions move from one state to another, e.g. into and out of a custom HELD state
+func (s *Service) AddTransition(role Role, from TransactionState, to TransactionState) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.states.allow(from, to)
+
+	return nil
+}
+
+// Calls hook after every transition of the transactions the service handles
+func (s *Service) OnTransition(role Role, hook TransitionHook) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.states.mu.Lock()
+	defer s.states.mu.Unlock()
+
+	s.states.hooks = append(s.states.hooks, hook)
+
+	return nil
+}
+
+// Moves a transaction to a state its machine allows and stores it
+// Transactions only close by being paid, and cancelling or expiring one goes through Cancel and Expire
+// The payment's accounts are locked while at it, so no payment of it is halfway through
+func (s *Service) Transition(ctx context.Context, role Role, t *Transaction, to TransactionState) error {
+	switch to {
+	case CLOSED:
+		return ErrInvalidTransition
+	case CANCELLED:
+		return s.Cancel(role, t, "")
+	case EXPIRED:
+		return s.Expire(ctx, role, t)
+	}
+
+	if err := authorize(role, PAY); err != nil {
+		return err
+	}
+
+	_, release, err := s.lockAccounts(ctx, s.paymentAccounts(t)...)
+
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
+	s.bindStates(t)
+
+	// The handler holds the payer's funds until it answers
+	if t.state == AWAITING_HANDLER {
+		return newError(INVALID_STATE, "Transaction is waiting for its handler to decide")
+	}
+
+	if err := t.transition(to); err != nil {
+		return err
+	}
+
+	s.save(t)
+
+	return nil
+}
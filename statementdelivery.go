@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// All of the formats monthly statements can be delivered in
+type StatementFormat string
+
+const (
+	STATEMENT_CSV StatementFormat = "csv"
+	STATEMENT_PDF StatementFormat = "pdf"
+)
+
+// One payment made or received by an account, as listed in its monthly statement
+type StatementEntry struct {
+	at            time.Time
+	transactionID uint32
+	// Nickname the account gave the counterparty, or its name
+	counterparty string
+	avatar       string
+	memo         string
+	// Positive for money received, negative for money sent
+	amount int64
+}
+
+// Models an account's payments over one calendar month, as delivered to its owner
+type MonthlyStatement struct {
+	account *Account
+	// First instant of the month, in UTC
+	period   time.Time
+	entries  []StatementEntry
+	received uint64
+	sent     uint64
+}
+
+// Returns the first instant of the month t is in, in UTC
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// Opts an account into monthly statements in a format, starting with the current month
+func (s *Service) SubscribeStatements(role Role, a *Account, format StatementFormat) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	if format != STATEMENT_CSV && format != STATEMENT_PDF {
+		return newError(INVALID_ARGUMENT, "Unknown statement format")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if a.statementFormat == "" {
+		s.statementsDue[a] = monthStart(s.now())
+	}
+
+	a.statementFormat = format
+
+	return nil
+}
+
+// Stops the monthly statements of an account
+func (s *Service) UnsubscribeStatements(role Role, a *Account) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a.statementFormat = ""
+	delete(s.statementsDue, a)
+
+	return nil
+}
+
+// Builds the statement of an account for the month starting at period
+func (s *Service) monthlyStatement(a *Account, period time.Time) (*MonthlyStatement, error) {
+	s.mu.RLock()
+	entries, err := s.accountEntries(a, period, period.AddDate(0, 1, 0))
+	s.mu.RUnlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	st := &MonthlyStatement{account: a, period: period, entries: entries}
+
+	for _, e := range entries {
+		if e.amount > 0 {
+			st.received += uint64(e.amount)
+		} else {
+			st.sent += uint64(-e.amount)
+		}
+	}
+
+	return st, nil
+}
+
+// Returns the payments an account made or received that closed in [from, to), oldest first
+// Callers hold the service lock, which guards the account's counterparty profiles
+func (s *Service) accountEntries(a *Account, from time.Time, to time.Time) ([]StatementEntry, error) {
+	transactions, err := query(s.transactions(a.tenant), closedIn(from, to))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []StatementEntry
+
+	for _, t := range transactions {
+		var counterparty *Account
+		amount := int64(t.amount)
+
+		switch a {
+		case t.recipient:
+			counterparty = t.sender
+		case t.sender:
+			counterparty = t.recipient
+			amount = -amount
+		default:
+			continue
+		}
+
+		entries = append(entries, StatementEntry{
+			at:            t.closedAt,
+			transactionID: t.id,
+			counterparty:  a.displayName(counterparty),
+			avatar:        a.counterparties[counterparty.id].avatar,
+			memo:          t.memo,
+			amount:        amount,
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].at.Before(entries[j].at)
+	})
+
+	return entries, nil
+}
+
+// Writes a monthly statement as CSV, one payment per row
+func exportMonthlyStatement(w io.Writer, st *MonthlyStatement) error {
+	out := csv.NewWriter(w)
+
+	if err := out.Write([]string{"date", "transaction", "counterparty", "memo", "amount"}); err != nil {
+		return err
+	}
+
+	for _, e := range st.entries {
+		row := []string{
+			e.at.UTC().Format(time.DateOnly),
+			strconv.FormatUint(uint64(e.transactionID), 10),
+			e.counterparty,
+			e.memo,
+			strconv.FormatInt(e.amount, 10),
+		}
+
+		if err := out.Write(row); err != nil {
+			return err
+		}
+	}
+
+	out.Flush()
+
+	return out.Error()
+}
+
+// Renders a monthly statement in a format, as a file to attach to a notification
+func (st *MonthlyStatement) attachment(format StatementFormat, style *DocumentStyle) (Attachment, error) {
+	name := "statement-" + st.period.Format("2006-01")
+
+	if format == STATEMENT_PDF {
+		data, err := st.pdf(style)
+
+		if err != nil {
+			return Attachment{}, err
+		}
+
+		return Attachment{name: name + ".pdf", contentType: "application/pdf", data: data}, nil
+	}
+
+	var buf bytes.Buffer
+
+	if err := exportMonthlyStatement(&buf, st); err != nil {
+		return Attachment{}, err
+	}
+
+	return Attachment{name: name + ".csv", contentType: "text/csv", data: buf.Bytes()}, nil
+}
+
+// Sends every subscribed account the statements of the months that ended since its last delivery
+// Accounts whose delivery fails are tried again on the next run, from the month that failed
+func (s *Service) SendStatements(ctx context.Context, role Role) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	now := s.now()
+	due := make(map[*Account]time.Time, len(s.statementsDue))
+	formats := make(map[*Account]StatementFormat, len(s.statementsDue))
+	for a, period := range s.statementsDue {
+		due[a] = period
+		formats[a] = a.statementFormat
+	}
+	s.mu.RUnlock()
+
+	for a, period := range due {
+		for !period.AddDate(0, 1, 0).After(now) {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			if err := s.sendStatement(ctx, a, period, formats[a]); err != nil {
+				log.Println(err)
+				break
+			}
+
+			period = period.AddDate(0, 1, 0)
+
+			s.mu.Lock()
+			if _, ok := s.statementsDue[a]; ok {
+				s.statementsDue[a] = period
+			}
+			s.mu.Unlock()
+		}
+	}
+
+	return nil
+}
+
+// Builds and sends an account's statement for one month
+func (s *Service) sendStatement(ctx context.Context, a *Account, period time.Time, format StatementFormat) error {
+	st, err := s.monthlyStatement(a, period)
+
+	if err != nil {
+		return err
+	}
+
+	attachment, err := st.attachment(format, s.documentStyle(a.tenant))
+
+	if err != nil {
+		return err
+	}
+
+	n, err := renderStatementNotification(st, attachment)
+
+	if err != nil {
+		return err
+	}
+
+	return s.deliver(ctx, n)
+}
+
+// Sends due statements every tick until ctx is done
+func (s *Service) ScheduleStatements(ctx context.Context, role Role, tick time.Duration) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.SendStatements(ctx, role); err != nil {
+					log.Println(err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Models the bill for an account's credit charges over one period
+type Statement struct {
+	account  *Account
+	closedAt time.Time
+	dueDate  time.Time
+	// What was billed, including interest charged after the due date
+	amount uint32
+	paid   uint32
+	// When interest was last charged on the statement
+	interestChargedAt time.Time
+}
+
+// Returns what is still owed on the statement
+func (st *Statement) outstanding() uint32 {
+	return st.amount - st.paid
+}
+
+// Bills an account's credit charges since its last statement, due after dueIn
+func (s *Service) CloseStatement(role Role, a *Account, dueIn time.Duration) (*Statement, error) {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	st := &Statement{
+		account:  a,
+		closedAt: now,
+		dueDate:  now.Add(dueIn),
+		amount:   a.unbilledCredit,
+	}
+
+	a.unbilledCredit = 0
+	s.statements[a] = append(s.statements[a], st)
+
+	return st, nil
+}
+
+// Pays part or all of a statement from the account balance back to the house
+// The payment is posted like any other transfer, so it goes through the balance provider and the ledger
+func (s *Service) PayStatement(ctx context.Context, role Role, st *Statement, amount uint32) error {
+	if err := authorize(role, PAY); err != nil {
+		return err
+	}
+
+	a := st.account
+
+	s.mu.RLock()
+	house, ok := s.feeAccounts[a.tenant]
+	s.mu.RUnlock()
+
+	if !ok {
+		return ErrNoFeeAccount
+	}
+
+	ctx, release, err := s.lockAccounts(ctx, a, house)
+
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
+	s.mu.Lock()
+	if amount > st.outstanding() {
+		s.mu.Unlock()
+		return newError(INVALID_AMOUNT, "Amount is more than what is owed on the statement")
+	}
+	st.paid += amount
+	s.mu.Unlock()
+
+	metadata := map[string]string{"statement_payment": st.closedAt.Format(time.RFC3339)}
+
+	if _, err := s.postTransfer(ctx, a, house, amount, metadata); err != nil {
+		s.mu.Lock()
+		st.paid -= amount
+		s.mu.Unlock()
+
+		if errors.Is(err, ErrInsufficientFunds) {
+			return newError(INSUFFICIENT_FUNDS, "Account doesn't have enough balance to pay the statement")
+		}
+
+		return err
+	}
+
+	a.creditUsed -= amount
+
+	return nil
+}
+
+// Charges interest on statements still unpaid after their due date
+// Interest is charged at most once per interval on each statement
+func (s *Service) ChargeLateInterest(role Role, basisPoints uint32, interval time.Duration) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+
+	for a, statements := range s.statements {
+		for _, st := range statements {
+			if st.outstanding() == 0 || !now.After(st.dueDate) {
+				continue
+			}
+
+			if !st.interestChargedAt.IsZero() && now.Sub(st.interestChargedAt) < interval {
+				continue
+			}
+
+			interest := s.rounding.share(st.outstanding(), basisPoints)
+			st.amount += interest
+			a.creditUsed += interest
+			st.interestChargedAt = now
+		}
+	}
+
+	return nil
+}
+
+// Returns every statement of an account, oldest first
+func (s *Service) Statements(role Role, a *Account) ([]*Statement, error) {
+	if err := authorize(role, READ); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]*Statement(nil), s.statements[a]...), nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Interface for storing one kind of entity by id
+type Store[T any, ID comparable] interface {
+	get(id ID) (T, error)
+	save(v T) error
+	list() ([]T, error)
+	delete(id ID) error
+}
+
+// Typed criterion an entity must meet to be returned by a query
+type Spec[T any] func(v T) bool
+
+// Returns the entities of a store that meet every spec
+func query[T any, ID comparable](st Store[T, ID], specs ...Spec[T]) ([]T, error) {
+	all, err := st.list()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var found []T
+
+	for _, v := range all {
+		if matchesAll(v, specs) {
+			found = append(found, v)
+		}
+	}
+
+	return found, nil
+}
+
+// Checks if an entity meets every spec
+func matchesAll[T any](v T, specs []Spec[T]) bool {
+	for _, spec := range specs {
+		if !spec(v) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Keeps entities in memory, keyed by the id the key function reads from them
+type MemoryStore[T any, ID comparable] struct {
+	mu    sync.RWMutex
+	key   func(v T) ID
+	items map[ID]T
+	// Ids in the order they were first saved, so listing is stable
+	order []ID
+}
+
+// Creates an empty in-memory store
+func NewMemoryStore[T any, ID comparable](key func(v T) ID) *MemoryStore[T, ID] {
+	return &MemoryStore[T, ID]{key: key, items: map[ID]T{}}
+}
+
+func (st *MemoryStore[T, ID]) get(id ID) (T, error) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	v, ok := st.items[id]
+
+	if !ok {
+		return v, ErrNotFound
+	}
+
+	return v, nil
+}
+
+func (st *MemoryStore[T, ID]) save(v T) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	id := st.key(v)
+
+	if _, ok := st.items[id]; !ok {
+		st.order = append(st.order, id)
+	}
+
+	st.items[id] = v
+
+	return nil
+}
+
+func (st *MemoryStore[T, ID]) list() ([]T, error) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	all := make([]T, 0, len(st.order))
+
+	for _, id := range st.order {
+		all = append(all, st.items[id])
+	}
+
+	return all, nil
+}
+
+func (st *MemoryStore[T, ID]) delete(id ID) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if _, ok := st.items[id]; !ok {
+		return ErrNotFound
+	}
+
+	delete(st.items, id)
+
+	st.order = slices.DeleteFunc(st.order, func(other ID) bool { return other == id })
+
+	return nil
+}
+
+// Exposes the accounts one tenant has in a repository as a store, so they're queried like any other entity
+// The repository keeps sharding, replicas and caches behind it
+type tenantAccounts struct {
+	repository Repository
+	tenant     TenantID
+}
+
+func (st tenantAccounts) get(id uint32) (*Account, error) {
+	return st.repository.findAccount(st.tenant, id)
+}
+
+func (st tenantAccounts) save(a *Account) error {
+	if a.tenant != st.tenant {
+		return ErrCrossTenant
+	}
+
+	return st.repository.saveAccount(a)
+}
+
+func (st tenantAccounts) list() ([]*Account, error) {
+	return st.repository.listAccounts(st.tenant)
+}
+
+func (st tenantAccounts) delete(id uint32) error {
+	return newError(INVALID_STATE, "Accounts can't be deleted")
+}
+
+// Exposes the transactions one tenant has in a repository as a store
+type tenantTransactions struct {
+	repository Repository
+	tenant     TenantID
+}
+
+func (st tenantTransactions) get(id uint32) (*Transaction, error) {
+	return st.repository.findTransaction(st.tenant, id)
+}
+
+func (st tenantTransactions) save(t *Transaction) error {
+	if t.tenant != st.tenant {
+		return ErrCrossTenant
+	}
+
+	return st.repository.saveTransaction(t)
+}
+
+func (st tenantTransactions) list() ([]*Transaction, error) {
+	return st.repository.listTransactions(st.tenant)
+}
+
+func (st tenantTransactions) delete(id uint32) error {
+	return st.repository.deleteTransaction(st.tenant, id)
+}
+
+// Returns the accounts of a tenant as a store
+func (s *Service) accounts(tenant TenantID) Store[*Account, uint32] {
+	return tenantAccounts{repository: s.repository, tenant: tenant}
+}
+
+// Returns the transactions of a tenant as a store
+func (s *Service) transactions(tenant TenantID) Store[*Transaction, uint32] {
+	return tenantTransactions{repository: s.repository, tenant: tenant}
+}
+
+// Matches transactions closed from from up to, not including, to
+func closedIn(from time.Time, to time.Time) Spec[*Transaction] {
+	return func(t *Transaction) bool {
+		return t.state == CLOSED && !t.closedAt.Before(from) && t.closedAt.Before(to)
+	}
+}
+
+// Matches closed transactions sent by an account
+func closedSentBy(a *Account) Spec[*Transaction] {
+	return func(t *Transaction) bool {
+		return t.state == CLOSED && t.sender.id == a.id
+	}
+}
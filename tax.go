@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Models the tax withheld on payments received by merchants
+type TaxPolicy struct {
+	mu sync.Mutex
+	// Account the withheld amounts are posted to
+	taxAccount *Account
+	// Share of each payment withheld, in hundredths of a percent
+	basisPoints  uint32
+	withholdings []Withholding
+}
+
+// Creates a policy that withholds a share of merchant receipts into taxAccount
+func NewTaxPolicy(taxAccount *Account, basisPoints uint32) *TaxPolicy {
+	return &TaxPolicy{taxAccount: taxAccount, basisPoints: basisPoints}
+}
+
+// Records an amount withheld from a payment
+type Withholding struct {
+	account       *Account
+	transactionID uint32
+	amount        uint32
+	at            time.Time
+}
+
+// One line of the year-end tax report
+type TaxReportLine struct {
+	account  *Account
+	withheld uint64
+}
+
+// Posts the tax owed on a merchant's receipt to the tax account
+// Failures are logged, the taxed payment already went through
+func (s *Service) withholdTax(ctx context.Context, p *TaxPolicy, t *Transaction) {
+	if !t.recipient.merchant || t.recipient == p.taxAccount || t.recipient.tenant != p.taxAccount.tenant {
+		return
+	}
+
+	amount := s.defaultRounding().share(t.amount, p.basisPoints)
+
+	if amount == 0 {
+		return
+	}
+
+	metadata := map[string]string{"tax_withheld_from": strconv.FormatUint(uint64(t.id), 10)}
+
+	if _, err := s.postTransfer(ctx, t.recipient, p.taxAccount, amount, metadata); err != nil {
+		log.Println(err)
+		return
+	}
+
+	p.mu.Lock()
+	p.withholdings = append(p.withholdings, Withholding{
+		account:       t.recipient,
+		transactionID: t.id,
+		amount:        amount,
+		at:            s.now(),
+	})
+	p.mu.Unlock()
+}
+
+// Sums the tax withheld from each account of a tenant during a year
+func (s *Service) TaxReport(role Role, tenant TenantID, year int) ([]TaxReportLine, error) {
+	if err := authorize(role, READ); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	p := s.tax
+	s.mu.RUnlock()
+
+	if p == nil {
+		return nil, nil
+	}
+
+	p.mu.Lock()
+	byAccount := map[*Account]uint64{}
+	for _, w := range p.withholdings {
+		if w.account.tenant == tenant && w.at.Year() == year {
+			byAccount[w.account] += uint64(w.amount)
+		}
+	}
+	p.mu.Unlock()
+
+	lines := make([]TaxReportLine, 0, len(byAccount))
+
+	for a, withheld := range byAccount {
+		lines = append(lines, TaxReportLine{account: a, withheld: withheld})
+	}
+
+	sort.Slice(lines, func(i, j int) bool {
+		return lines[i].account.id < lines[j].account.id
+	})
+
+	return lines, nil
+}
+
+// Writes a tax report as CSV, one account per row
+func exportTaxReport(w io.Writer, lines []TaxReportLine) error {
+	out := csv.NewWriter(w)
+
+	if err := out.Write([]string{"account_id", "account_name", "withheld"}); err != nil {
+		return err
+	}
+
+	for _, l := range lines {
+		row := []string{
+			strconv.FormatUint(uint64(l.account.id), 10),
+			l.account.name,
+			strconv.FormatUint(l.withheld, 10),
+		}
+
+		if err := out.Write(row); err != nil {
+			return err
+		}
+	}
+
+	out.Flush()
+
+	return out.Error()
+}
+
+// Changes how tax is withheld from merchants
+// A nil policy turns withholding off
+func (s *Service) SetTaxPolicy(role Role, p *TaxPolicy) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tax = p
+
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+// Returned when a transaction involves accounts of different tenants
+var ErrCrossTenant = newError(CROSS_TENANT, "Transactions can't cross tenants")
+
+// Registers an account with the service
+func (s *Service) AddAccount(role Role, a *Account) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	return s.accounts(a.tenant).save(a)
+}
+
+// Finds an account of a tenant
+func (s *Service) Account(role Role, tenant TenantID, id uint32) (*Account, error) {
+	if err := authorize(role, READ); err != nil {
+		return nil, err
+	}
+
+	return s.accounts(tenant).get(id)
+}
+
+// Returns every account of a tenant
+func (s *Service) Accounts(role Role, tenant TenantID) ([]*Account, error) {
+	if err := authorize(role, READ); err != nil {
+		return nil, err
+	}
+
+	return s.accounts(tenant).list()
+}
+
+// Searches the accounts of a tenant by name and tags, ordered by id
+func (s *Service) FindAccounts(role Role, tenant TenantID, q AccountQuery) ([]*Account, error) {
+	if err := authorize(role, READ); err != nil {
+		return nil, err
+	}
+
+	return s.repository.findAccounts(tenant, q)
+}
+
+// Finds a transaction of a tenant
+func (s *Service) Transaction(role Role, tenant TenantID, id uint32) (*Transaction, error) {
+	if err := authorize(role, READ); err != nil {
+		return nil, err
+	}
+
+	return s.transactions(tenant).get(id)
+}
+
+// Returns every transaction of a tenant
+func (s *Service) Transactions(role Role, tenant TenantID) ([]*Transaction, error) {
+	if err := authorize(role, READ); err != nil {
+		return nil, err
+	}
+
+	return s.transactions(tenant).list()
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"time"
+)
+
+// Returned when a handler takes longer than its payment method allows
+// Balances are left untouched, so the payment can be retried
+var ErrPaymentTimeout = newError(PAYMENT_TIMEOUT, "Payment timed out")
+
+// Limits how long handlers of a payment method may take
+// A zero duration removes the limit
+func (s *Service) SetPaymentTimeout(role Role, method PaymentMethod, timeout time.Duration) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if timeout == 0 {
+		delete(s.timeouts, method)
+		return nil
+	}
+
+	s.timeouts[method] = timeout
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/rand"
+	"io"
+	"sync"
+	"time"
+)
+
+// Interface for storing card data outside of transactions
+// Transactions only ever carry the opaque token returned by the vault
+type TokenVault interface {
+	// Stores a card number and returns a token that stands for it
+	tokenize(cardNumber string) (string, error)
+	// Returns the card number behind a token
+	// Returns an error if the token is unknown or expired
+	detokenize(token string) (string, error)
+	// Replaces a token by a new one, invalidating the old token
+	rotate(token string) (string, error)
+}
+
+// Card data kept by the in-memory vault
+type vaultedCard struct {
+	cardNumber string
+	expiresAt  time.Time
+}
+
+// Keeps tokens in memory, meant to be used in tests and demos
+type MemoryTokenVault struct {
+	mu  sync.Mutex
+	ttl time.Duration
+	now func() time.Time
+	// Source of tokens
+	random io.Reader
+	cards  map[string]vaultedCard
+}
+
+// Creates an in-memory vault whose tokens expire after ttl
+func NewMemoryTokenVault(ttl time.Duration) *MemoryTokenVault {
+	return &MemoryTokenVault{
+		ttl:    ttl,
+		now:    time.Now,
+		random: rand.Reader,
+		cards:  map[string]vaultedCard{},
+	}
+}
+
+func (v *MemoryTokenVault) tokenize(cardNumber string) (string, error) {
+	if cardNumber == "" {
+		return "", newError(INVALID_CARD_TOKEN, "Card number can't be empty")
+	}
+
+	token, err := newCardToken(v.random)
+
+	if err != nil {
+		return "", err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.cards[token] = vaultedCard{cardNumber: cardNumber, expiresAt: v.now().Add(v.ttl)}
+
+	return token, nil
+}
+
+func (v *MemoryTokenVault) detokenize(token string) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	card, err := v.lookup(token)
+
+	if err != nil {
+		return "", err
+	}
+
+	return card.cardNumber, nil
+}
+
+func (v *MemoryTokenVault) rotate(token string) (string, error) {
+	newToken, err := newCardToken(v.random)
+
+	if err != nil {
+		return "", err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	card, err := v.lookup(token)
+
+	if err != nil {
+		return "", err
+	}
+
+	delete(v.cards, token)
+	v.cards[newToken] = vaultedCard{cardNumber: card.cardNumber, expiresAt: v.now().Add(v.ttl)}
+
+	return newToken, nil
+}
+
+// Finds a card by its token, dropping it if it already expired
+// Must be called with the lock held
+func (v *MemoryTokenVault) lookup(token string) (vaultedCard, error) {
+	card, ok := v.cards[token]
+
+	if !ok {
+		return vaultedCard{}, newError(INVALID_CARD_TOKEN, "Unknown card token")
+	}
+
+	if !v.now().Before(card.expiresAt) {
+		delete(v.cards, token)
+		return vaultedCard{}, newError(INVALID_CARD_TOKEN, "Card token expired")
+	}
+
+	return card, nil
+}
+
+// Generates a token from random that carries no card data
+func newCardToken(random io.Reader) (string, error) {
+	id, err := randomHex(random, 16)
+
+	if err != nil {
+		return "", err
+	}
+
+	return "tok_" + id, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+)
+
+// Returns the top level account a wallet belongs to
+func (a *Account) root() *Account {
+	for a.parent != nil {
+		a = a.parent
+	}
+
+	return a
+}
+
+// Opens a wallet, e.g. a vacation fund, under an account
+func (s *Service) OpenWallet(role Role, parent *Account, id uint32, name string) (*Account, error) {
+	if err := authorize(role, PAY); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.repository.findAccount(parent.tenant, id); err == nil {
+		return nil, newError(ALREADY_EXISTS, "Account id is already taken")
+	}
+
+	wallet := &Account{id: id, tenant: parent.tenant, name: name, parent: parent}
+
+	if err := s.repository.saveAccount(wallet); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	parent.wallets = append(parent.wallets, wallet)
+	s.mu.Unlock()
+
+	return wallet, nil
+}
+
+// Moves funds instantly between wallets of the same account, free of fees
+func (s *Service) MoveBetweenWallets(ctx context.Context, role Role, from *Account, to *Account, amount uint32) (*Transaction, error) {
+	if err := authorize(role, PAY); err != nil {
+		return nil, err
+	}
+
+	if from.root() != to.root() {
+		return nil, newError(INVALID_ARGUMENT, "Wallets belong to different accounts")
+	}
+
+	if err := s.checkAccountsFrozen(from, to); err != nil {
+		return nil, err
+	}
+
+	return s.postTransfer(ctx, from, to, amount, map[string]string{"wallet_transfer": "true"})
+}
+
+// Returns the balance of an account plus the balances of every wallet under it, as the balance provider sees them
+func (s *Service) RollupBalance(ctx context.Context, role Role, a *Account) (uint64, error) {
+	if err := authorize(role, READ); err != nil {
+		return 0, err
+	}
+
+	s.mu.RLock()
+	balances := balancesOrLocal(s.balances)
+	accounts := walletTree(a)
+	s.mu.RUnlock()
+
+	var total uint64
+
+	for _, w := range accounts {
+		balance, err := balances.balance(ctx, w)
+
+		if err != nil {
+			return 0, err
+		}
+
+		total += uint64(balance)
+	}
+
+	return total, nil
+}
+
+// Returns an account and every wallet under it
+// Must be called with the lock held for reading
+func walletTree(a *Account) []*Account {
+	accounts := []*Account{a}
+
+	for _, w := range a.wallets {
+		accounts = append(accounts, walletTree(w)...)
+	}
+
+	return accounts
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Keeps the accounts and transactions read from a slower repository in memory
+// Writes go through to the repository before the cache, so it never serves records older than the ones written
+type CachedRepository struct {
+	next Repository
+
+	mu           sync.RWMutex
+	accounts     map[recordKey]*Account
+	transactions map[recordKey]*Transaction
+}
+
+// Creates an empty cache in front of a repository, Warmup fills it before traffic comes in
+func NewCachedRepository(next Repository) *CachedRepository {
+	return &CachedRepository{
+		next:         next,
+		accounts:     map[recordKey]*Account{},
+		transactions: map[recordKey]*Transaction{},
+	}
+}
+
+// Adds accounts and transactions to the cache
+func (r *CachedRepository) keep(accounts []*Account, transactions []*Transaction) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, a := range accounts {
+		r.accounts[recordKey{a.tenant, a.id}] = a
+	}
+
+	for _, t := range transactions {
+		r.transactions[recordKey{t.tenant, t.id}] = t
+	}
+}
+
+func (r *CachedRepository) saveAccount(a *Account) error {
+	if err := r.next.saveAccount(a); err != nil {
+		return err
+	}
+
+	r.keep([]*Account{a}, nil)
+
+	return nil
+}
+
+func (r *CachedRepository) saveAccounts(accounts []*Account) error {
+	if err := r.next.saveAccounts(accounts); err != nil {
+		return err
+	}
+
+	r.keep(accounts, nil)
+
+	return nil
+}
+
+func (r *CachedRepository) findAccount(tenant TenantID, id uint32) (*Account, error) {
+	r.mu.RLock()
+	a, ok := r.accounts[recordKey{tenant, id}]
+	r.mu.RUnlock()
+
+	if ok {
+		return a, nil
+	}
+
+	a, err := r.next.findAccount(tenant, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	r.keep([]*Account{a}, nil)
+
+	return a, nil
+}
+
+// Lists and searches always go to the repository, the cache can't tell if it holds every match
+func (r *CachedRepository) listAccounts(tenant TenantID) ([]*Account, error) {
+	return r.next.listAccounts(tenant)
+}
+
+func (r *CachedRepository) findAccounts(tenant TenantID, q AccountQuery) ([]*Account, error) {
+	return r.next.findAccounts(tenant, q)
+}
+
+func (r *CachedRepository) saveTransaction(t *Transaction) error {
+	if err := r.next.saveTransaction(t); err != nil {
+		return err
+	}
+
+	r.keep(nil, []*Transaction{t})
+
+	return nil
+}
+
+func (r *CachedRepository) findTransaction(tenant TenantID, id uint32) (*Transaction, error) {
+	r.mu.RLock()
+	t, ok := r.transactions[recordKey{tenant, id}]
+	r.mu.RUnlock()
+
+	if ok {
+		return t, nil
+	}
+
+	t, err := r.next.findTransaction(tenant, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	r.keep(nil, []*Transaction{t})
+
+	return t, nil
+}
+
+func (r *CachedRepository) listTransactions(tenant TenantID) ([]*Transaction, error) {
+	return r.next.listTransactions(tenant)
+}
+
+func (r *CachedRepository) deleteTransaction(tenant TenantID, id uint32) error {
+	if err := r.next.deleteTransaction(tenant, id); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	delete(r.transactions, recordKey{tenant, id})
+	r.mu.Unlock()
+
+	return nil
+}
+
+func (r *CachedRepository) tenants() ([]TenantID, error) {
+	return r.next.tenants()
+}
+
+// Models which records of a tenant are loaded before the service takes traffic
+type WarmupPlan struct {
+	tenant TenantID
+	// Accounts loaded whatever their activity, e.g. fee and settlement accounts
+	accounts []uint32
+	// Transactions created or closed this long before now are loaded with their accounts, zero loads none
+	recency time.Duration
+}
+
+// Models what a warmup loaded and how long it took
+type WarmupReport struct {
+	accounts     int
+	transactions int
+	took         time.Duration
+}
+
+// Loads the hot records of each plan into the cached repository and the balances of their accounts from the
+// balance provider, so the first payments after a deploy don't wait on cold storage
+// Must be called before the service takes traffic
+func (s *Service) Warmup(ctx context.Context, role Role, plans ...WarmupPlan) (WarmupReport, error) {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return WarmupReport{}, err
+	}
+
+	cache, ok := s.repository.(*CachedRepository)
+
+	if !ok {
+		return WarmupReport{}, newError(MISCONFIGURED, "Warmup needs a cached repository")
+	}
+
+	s.mu.RLock()
+	balances := s.balances
+	s.mu.RUnlock()
+
+	started := s.now()
+	var report WarmupReport
+
+	for _, plan := range plans {
+		seen := map[*Account]bool{}
+		var accounts []*Account
+		var transactions []*Transaction
+
+		hot := func(a *Account) {
+			if !seen[a] {
+				seen[a] = true
+				accounts = append(accounts, a)
+			}
+		}
+
+		for _, id := range plan.accounts {
+			a, err := cache.next.findAccount(plan.tenant, id)
+
+			if err != nil {
+				return report, err
+			}
+
+			hot(a)
+		}
+
+		if plan.recency > 0 {
+			all, err := cache.next.listTransactions(plan.tenant)
+
+			if err != nil {
+				return report, err
+			}
+
+			since := started.Add(-plan.recency)
+
+			for _, t := range all {
+				if t.createdAt.After(since) || t.closedAt.After(since) {
+					transactions = append(transactions, t)
+					hot(t.sender)
+					hot(t.recipient)
+				}
+			}
+		}
+
+		for _, a := range accounts {
+			if err := ctx.Err(); err != nil {
+				return report, err
+			}
+
+			if _, err := balancesOrLocal(balances).balance(ctx, a); err != nil {
+				return report, err
+			}
+		}
+
+		cache.keep(accounts, transactions)
+		report.accounts += len(accounts)
+		report.transactions += len(transactions)
+	}
+
+	report.took = s.now().Sub(started)
+
+	return report, nil
+}
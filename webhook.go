@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Returned while a gateway payment waits for the processor to settle the capture
+var ErrAwaitingGateway = newError(GATEWAY_SETTLEMENT_PENDING, "Transaction is waiting for the gateway")
+
+// Largest webhook body read
+const maxWebhookBody = 1 << 20
+
+// Models dependencies used to pay a transaction through a card gateway
+// The card token holds the processor's payment method, e.g. a Stripe pm_ id
+type GatewayTransactionHandler struct {
+	gateway Gateway
+}
+
+// Handles transactions paid through a card gateway
+// Authorizes and captures the payment, the recipient is credited once the gateway calls back that the capture settled
+func (th *GatewayTransactionHandler) pay(ctx context.Context, t *Transaction) error {
+	if t.sender.id == t.recipient.id {
+		return ErrSelfTransfer
+	}
+
+	if t.state == CLOSED {
+		return ErrTransactionClosed
+	}
+
+	if t.state == EXPIRED {
+		return ErrTransactionExpired
+	}
+
+	if t.state == CANCELLED {
+		return ErrTransactionCancelled
+	}
+
+	if t.state == AWAITING_GATEWAY {
+		return ErrAwaitingGateway
+	}
+
+	if err := t.checkTransition(AWAITING_GATEWAY); err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	payment, err := th.gateway.authorize(ctx, t, t.cardToken)
+
+	if err != nil {
+		return err
+	}
+
+	if payment.status == GATEWAY_AUTHORIZED {
+		payment, err = th.gateway.capture(ctx, payment.id)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if payment.status == GATEWAY_FAILED {
+		return newError(PAYMENT_REFUSED, "Payment was declined by the gateway")
+	}
+
+	t.gatewayPaymentID = payment.id
+
+	if err := t.transition(AWAITING_GATEWAY); err != nil {
+		return err
+	}
+
+	return ErrAwaitingGateway
+}
+
+// Makes the service pay a payment method through a card gateway
+func (s *Service) RegisterGateway(role Role, method PaymentMethod, gateway Gateway) error {
+	return s.RegisterHandler(role, method, func(deps HandlerDependencies) TransactionHandler {
+		return &GatewayTransactionHandler{gateway: gateway}
+	})
+}
+
+// Makes a hold what its tenant's customers are refunded at card gateways, until the gateway takes it
+func (s *Service) SetGatewayClearingAccount(role Role, a *Account) error {
+	if err := authorize(role, CONFIGURE); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.gatewayClearing[a.tenant] = a
+
+	return nil
+}
+
+// Receives a gateway's callbacks over HTTP and applies them to the transactions they are about
+// Deliveries are deduplicated by event id, so retries by the gateway are acknowledged without being applied twice
+type GatewayWebhook struct {
+	service *Service
+	gateway Gateway
+	// Request header carrying the signature, e.g. Stripe-Signature
+	signatureHeader string
+	mu              sync.Mutex
+	// When each delivery was applied, kept for retention
+	seen map[string]time.Time
+	// Deliveries being applied right now
+	applying  map[string]bool
+	retention time.Duration
+}
+
+// Creates an endpoint for the callbacks of gateway, signed in signatureHeader
+func NewGatewayWebhook(s *Service, gateway Gateway, signatureHeader string) *GatewayWebhook {
+	return &GatewayWebhook{
+		service:         s,
+		gateway:         gateway,
+		signatureHeader: signatureHeader,
+		seen:            map[string]time.Time{},
+		applying:        map[string]bool{},
+		retention:       72 * time.Hour,
+	}
+}
+
+// Answers 2xx once a delivery is applied or was already, 400 for bad signatures, and 409 or 5xx so the gateway retries
+func (h *GatewayWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	payload, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody))
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	event, err := h.gateway.reconcile(payload, r.Header.Get(h.signatureHeader))
+
+	switch {
+	case errors.Is(err, ErrInvalidSignature):
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	case errorCode(err) == INVALID_ARGUMENT:
+		// Events the service doesn't use are acknowledged, so the gateway stops sending them
+		w.WriteHeader(http.StatusOK)
+		return
+	case err != nil:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	applied, claimed := h.claim(event.id)
+
+	if applied {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Another retry of the delivery is being applied, the gateway tries again later
+	if !claimed {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	if err := h.service.applyGatewayEvent(r.Context(), event); err != nil {
+		log.Println(err)
+		h.unclaim(event.id)
+
+		if errors.Is(err, ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	h.remember(event.id)
+	w.WriteHeader(http.StatusOK)
+}
+
+// Claims a delivery for applying it, in one step so concurrent retries can't both apply it
+// Returns whether it was already applied, and whether the caller claimed it
+func (h *GatewayWebhook) claim(id string) (bool, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.seen[id]; ok {
+		return true, false
+	}
+
+	if h.applying[id] {
+		return false, false
+	}
+
+	h.applying[id] = true
+
+	return false, true
+}
+
+// Gives up the claim of a delivery that failed, so a retry can apply it
+func (h *GatewayWebhook) unclaim(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.applying, id)
+}
+
+// Records a claimed delivery as applied and forgets the ones past retention
+func (h *GatewayWebhook) remember(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.applying, id)
+
+	now := h.service.now()
+
+	for seen, at := range h.seen {
+		if now.Sub(at) > h.retention {
+			delete(h.seen, seen)
+		}
+	}
+
+	h.seen[id] = now
+}
+
+// Moves the transaction a gateway event is about according to the payment's new status
+// Events that don't change anything, e.g. a capture of a transaction already closed, are ignored
+// The accounts of the payment are locked first, so its state can't change between the checks and the postings
+func (s *Service) applyGatewayEvent(ctx context.Context, e GatewayEvent) error {
+	t, err := s.repository.findTransaction(e.tenant, e.transactionID)
+
+	if err != nil {
+		return err
+	}
+
+	if t.gatewayPaymentID != e.payment.id {
+		return newError(INVALID_ARGUMENT, "Gateway payment doesn't match the transaction")
+	}
+
+	s.mu.RLock()
+	balances, clearing := s.balances, s.gatewayClearing[t.tenant]
+	s.mu.RUnlock()
+
+	// Refunds are posted to the clearing account, which is locked with the payment's
+	ctx, release, err := s.lockAccounts(ctx, append(s.paymentAccounts(t), clearing)...)
+
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
+	switch {
+	case e.payment.status == GATEWAY_CAPTURED && t.state == AWAITING_GATEWAY:
+		return s.settleInbound(ctx, balances, t)
+	case e.payment.status == GATEWAY_FAILED && t.state == AWAITING_GATEWAY:
+		return s.cancel(ctx, t, "Declined by the gateway")
+	case e.payment.status == GATEWAY_REFUNDED && t.state == CLOSED && e.refunded > t.reversed:
+		return s.refundToGateway(ctx, clearing, t, min(e.refunded, t.amount)-t.reversed)
+	}
+
+	return nil
+}
+
+// Takes back from the recipient what the gateway refunded to the payer's card, posted as a transfer to the clearing account
+// The caller holds the locks of the payment and the clearing account
+func (s *Service) refundToGateway(ctx context.Context, clearing *Account, t *Transaction, amount uint32) error {
+	if clearing == nil {
+		return newError(MISCONFIGURED, "Gateway refunds require a clearing account")
+	}
+
+	metadata := map[string]string{
+		"refund_of":      strconv.FormatUint(uint64(t.id), 10),
+		"gateway_refund": t.gatewayPaymentID,
+	}
+
+	if _, err := s.postTransfer(ctx, t.recipient, clearing, amount, metadata); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	t.reversed += amount
+	s.mu.Unlock()
+
+	s.save(t)
+
+	return nil
+}
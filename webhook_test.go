@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Posts a sandbox gateway callback to the webhook and fails the test unless it's acknowledged
+func postGatewayEvent(t *testing.T, h *GatewayWebhook, body string) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/webhooks/gateway", strings.NewReader(body)))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("callback %s answered %d", body, w.Code)
+	}
+}
+
+func TestGatewayRefundKeepsTheLedgerBalanced(t *testing.T) {
+	s := NewSandboxService(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), 0)
+	payer := &Account{id: 1, name: "Payer"}
+	merchant := &Account{id: 2, name: "Merchant", balance: 5}
+	clearing := &Account{id: 3, name: "Gateway clearing"}
+
+	for _, a := range []*Account{payer, merchant, clearing} {
+		if err := s.AddAccount(ADMIN, a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.SetGatewayClearingAccount(ADMIN, clearing); err != nil {
+		t.Fatal(err)
+	}
+
+	payment, err := s.NewTransfer().From(payer).To(merchant).Amount(10).Via(SANDBOX_CARD).WithCard("pm_card").Build()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Pay(context.Background(), OPERATOR, payment); !errors.Is(err, ErrAwaitingGateway) {
+		t.Fatalf("paying returned %v", err)
+	}
+
+	webhook := NewGatewayWebhook(s, &SandboxGateway{}, "Sandbox-Signature")
+	event := `{"id":%q,"payment":%q,"status":%q,"transaction":%d,"refunded":%d}`
+
+	postGatewayEvent(t, webhook, fmt.Sprintf(event, "evt_1", payment.gatewayPaymentID, GATEWAY_CAPTURED, payment.id, 0))
+
+	// The first close only takes the snapshot the next one reconciles from
+	closeDay := func() *DayClose {
+		t.Helper()
+
+		if err := s.Advance(ADMIN, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+
+		dc, err := s.CloseDay(ADMIN, "", s.now())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return dc
+	}
+
+	closeDay()
+
+	if err := s.Advance(ADMIN, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	postGatewayEvent(t, webhook, fmt.Sprintf(event, "evt_2", payment.gatewayPaymentID, GATEWAY_REFUNDED, payment.id, 10))
+
+	if dc := closeDay(); !dc.balanced() {
+		t.Fatalf("close after the refund has breaks %+v, %d in debits and %d in credits", dc.breaks, dc.debits, dc.credits)
+	}
+
+	if merchant.balance != 5 || clearing.balance != 10 || payment.reversed != 10 {
+		t.Fatalf("merchant has %d, clearing %d and %d of the payment was reversed", merchant.balance, clearing.balance, payment.reversed)
+	}
+}
+
+func TestEventDeliveriesAreSigned(t *testing.T) {
+	secret := []byte("whsec")
+	received := make(chan error, 1)
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+
+		if err == nil {
+			err = verifyWebhookSignature(secret, r.Header.Get(signatureHeader), body, time.Now())
+		}
+
+		received <- err
+	}))
+
+	defer receiver.Close()
+
+	NewWebhookEventPublisher(receiver.URL, secret).publish(Event{kind: LEDGER_IMBALANCE, tenant: "acme", at: time.Now()})
+
+	if err := <-received; err != nil {
+		t.Fatalf("receiver refused the delivery: %v", err)
+	}
+
+	if err := verifyWebhookSignature(secret, signWebhookPayload(secret, []byte("{}"), "n", time.Now().Add(time.Minute)), []byte("{ }"), time.Now()); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("altered payload was checked as %v", err)
+	}
+}